@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"io/ioutil"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// adminToken is an admin API key given on the command line
+var adminToken string
+
+// tempFilePrefixes are the prefixes of the temp files and directories we create
+var tempFilePrefixes = []string{"web_", "image_", "explode_", "mailbox_", "pcap_", "eicar_", "bench_", "layer_", "admission_", "shadow_", "warm_"}
+
+// childProcess json object
+type childProcess struct {
+	PID     int    `json:"pid"`
+	Command string `json:"command"`
+	State   string `json:"state"`
+}
+
+// childProcesses lists the processes we spawned that are still around,
+// including zombies nobody waited for
+func childProcesses() []childProcess {
+	children := []childProcess{}
+	stats, _ := filepath.Glob("/proc/[0-9]*/stat")
+	for _, stat := range stats {
+		data, err := ioutil.ReadFile(stat)
+		if err != nil {
+			continue
+		}
+		// pid (comm) state ppid ...
+		s := string(data)
+		open, close := strings.IndexByte(s, '('), strings.LastIndexByte(s, ')')
+		if open < 0 || close < open {
+			continue
+		}
+		fields := strings.Fields(s[close+1:])
+		if len(fields) < 2 || fields[1] != strconv.Itoa(os.Getpid()) {
+			continue
+		}
+		pid, _ := strconv.Atoi(strings.TrimSpace(s[:open]))
+		children = append(children, childProcess{
+			PID:     pid,
+			Command: s[open+1 : close],
+			State:   fields[0],
+		})
+	}
+	return children
+}
+
+// openTempFiles lists the scan temp files that currently exist
+func openTempFiles() []string {
+	files := []string{}
+	for _, dir := range []string{os.TempDir(), "/malware"} {
+		for _, prefix := range tempFilePrefixes {
+			matches, _ := filepath.Glob(filepath.Join(dir, prefix+"*"))
+			files = append(files, matches...)
+		}
+	}
+	return files
+}
+
+func init() {
+	expvar.Publish("goroutines", expvar.Func(func() interface{} {
+		return runtime.NumGoroutine()
+	}))
+	expvar.Publish("temp_files", expvar.Func(func() interface{} {
+		return openTempFiles()
+	}))
+	expvar.Publish("children", expvar.Func(func() interface{} {
+		return childProcesses()
+	}))
+	expvar.Publish("scan_latency_ms", expvar.Func(func() interface{} {
+		return milliseconds(shedder.latency())
+	}))
+}
+
+// LicenseStatus json object
+type LicenseStatus struct {
+	Valid   bool   `json:"valid"`
+	Expires string `json:"expires,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+func licenseStatus(ctx context.Context) LicenseStatus {
+	expired, err := didLicenseExpire(ctx)
+	if err != nil {
+		return LicenseStatus{Error: errors.Wrap(err, "failed to check license").Error()}
+	}
+	status := LicenseStatus{Valid: !expired}
+	if license, err := runCtl(ctx, "license"); err == nil {
+		status.Expires = parseLicenseExpiry(license)
+	}
+	return status
+}
+
+// webLicense returns the license status, POST renews the license
+func webLicense(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Minute)
+	defer cancel()
+
+	if r.Method == http.MethodPost {
+		if err := updateLicense(ctx); err != nil {
+			http.Error(w, errors.Wrap(err, "failed to update license").Error(), http.StatusInternalServerError)
+			return
+		}
+		session.invalidate("license updated")
+	}
+	writeJSON(w, http.StatusOK, licenseStatus(ctx))
+}
+
+// webUpdate updates the virus definitions
+func webUpdate(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Minute)
+	defer cancel()
+
+	update, err := updateAV(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, update)
+}
+
+// reloadLock guards the settings /admin/reload replaces while scans use them:
+// the scan profiles, policies and suppressions, the family aliases and the
+// ATT&CK mapping
+var reloadLock sync.RWMutex
+
+// webReload returns a handler re-reading the API keys and whatever else reload
+// loads, the cached engine info is asked for again as well
+func webReload(reload func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := apiKeys.reload(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := tenants.reload(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := tickets.reload(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := signing.reload(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := reload(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		baseInfo.invalidate("configuration reloaded")
+		session.invalidate("configuration reloaded")
+		audit.record(auditConfig, requestKeyID(r), "", "", map[string]string{"reason": "reloaded"})
+		log.WithFields(log.Fields{
+			"plugin":   name,
+			"category": category,
+		}).Info("reloaded configuration")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// adminRoutes adds the administrative endpoints to router, they all require an admin API key
+func adminRoutes(router *mux.Router, reload func() error) {
+	router.Handle("/update", requireAdmin(http.HandlerFunc(webUpdate))).Methods("POST")
+	router.Handle("/license", requireAdmin(http.HandlerFunc(webLicense))).Methods("GET", "POST")
+	router.Handle("/admin/reload", requireAdmin(webReload(reload))).Methods("POST")
+	router.Handle("/admin/drain", requireAdmin(http.HandlerFunc(webDrain))).Methods("GET", "POST", "DELETE")
+	router.Handle("/stats", requireAdmin(http.HandlerFunc(webStats))).Methods("GET")
+	router.Handle("/outbox", requireAdmin(http.HandlerFunc(webOutbox))).Methods("GET")
+	router.Handle("/queue", requireAdmin(http.HandlerFunc(webQueue))).Methods("GET")
+	router.Handle("/queue", requireAdmin(http.HandlerFunc(webDrainQueue))).Methods("DELETE")
+	router.Handle("/queue/{jobID}", requireAdmin(http.HandlerFunc(webReprioritizeJob))).Methods("PATCH")
+	router.Handle("/queue/{jobID}", requireAdmin(http.HandlerFunc(webQueueCancelJob))).Methods("DELETE")
+	debugRoutes(router)
+}
+
+// debugRoutes adds the pprof and expvar endpoints to router
+func debugRoutes(router *mux.Router) {
+	debug := router.PathPrefix("/debug").Subrouter()
+	debug.Handle("/vars", requireAdmin(expvar.Handler()))
+	debug.Handle("/pprof/cmdline", requireAdmin(http.HandlerFunc(pprof.Cmdline)))
+	debug.Handle("/pprof/profile", requireAdmin(http.HandlerFunc(pprof.Profile)))
+	debug.Handle("/pprof/symbol", requireAdmin(http.HandlerFunc(pprof.Symbol)))
+	debug.Handle("/pprof/trace", requireAdmin(http.HandlerFunc(pprof.Trace)))
+	debug.PathPrefix("/pprof/").Handler(requireAdmin(http.HandlerFunc(pprof.Index)))
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// maxQueuedAdmissionScans is how many layers and payloads may wait for the engine
+	maxQueuedAdmissionScans = 1000
+	// maxAdmissionVerdicts is how many layer and payload verdicts are cached
+	maxAdmissionVerdicts = 10000
+	// admissionRetry is how long a failed layer or payload scan is remembered
+	admissionRetry = time.Minute
+)
+
+// AdmissionReview json object, a Kubernetes admission.k8s.io review
+type AdmissionReview struct {
+	APIVersion string             `json:"apiVersion"`
+	Kind       string             `json:"kind"`
+	Request    *AdmissionRequest  `json:"request,omitempty"`
+	Response   *AdmissionResponse `json:"response,omitempty"`
+}
+
+// AdmissionRequest json object
+type AdmissionRequest struct {
+	UID  string `json:"uid"`
+	Kind struct {
+		Group   string `json:"group"`
+		Version string `json:"version"`
+		Kind    string `json:"kind"`
+	} `json:"kind"`
+	Namespace string          `json:"namespace"`
+	Name      string          `json:"name"`
+	Operation string          `json:"operation"`
+	Object    json.RawMessage `json:"object"`
+}
+
+// AdmissionResponse json object
+type AdmissionResponse struct {
+	UID      string           `json:"uid"`
+	Allowed  bool             `json:"allowed"`
+	Status   *AdmissionStatus `json:"status,omitempty"`
+	Warnings []string         `json:"warnings,omitempty"`
+}
+
+// AdmissionStatus json object, the reason an object was denied
+type AdmissionStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type podContainer struct {
+	Image string `json:"image"`
+}
+
+// podSpec holds the images of a pod
+type podSpec struct {
+	Containers          []podContainer `json:"containers"`
+	InitContainers      []podContainer `json:"initContainers"`
+	EphemeralContainers []podContainer `json:"ephemeralContainers"`
+}
+
+func (p podSpec) images() []string {
+	var images []string
+	for _, containers := range [][]podContainer{p.Containers, p.InitContainers, p.EphemeralContainers} {
+		for _, container := range containers {
+			images = append(images, container.Image)
+		}
+	}
+	return images
+}
+
+// admissionObject is what is scanned of a reviewed object: the pod spec of
+// pods, workloads and cron jobs, or the payloads of config maps and secrets
+type admissionObject struct {
+	Spec struct {
+		podSpec
+		Template struct {
+			Spec podSpec `json:"spec"`
+		} `json:"template"`
+		JobTemplate struct {
+			Spec struct {
+				Template struct {
+					Spec podSpec `json:"spec"`
+				} `json:"template"`
+			} `json:"spec"`
+		} `json:"jobTemplate"`
+	} `json:"spec"`
+	Data       map[string]json.RawMessage `json:"data"`
+	BinaryData map[string][]byte          `json:"binaryData"`
+	StringData map[string]string          `json:"stringData"`
+}
+
+// admissionTarget is an image layer or payload of a reviewed object
+type admissionTarget struct {
+	key  string // layer digest or sha256 of the payload, verdicts are cached by it
+	what string
+	scan func() ResultsData
+}
+
+// admissionVerdict is a cached scan result, failed scans expire
+type admissionVerdict struct {
+	results ResultsData
+	expires time.Time
+}
+
+// admissionScanner scans what admission reviews reference one after another,
+// in the background so scans outliving a review are cached for its retry
+type admissionScanner struct {
+	sync.Mutex
+	registry    *registryClient
+	timeout     time.Duration // how long a review waits for its scans
+	failClosed  bool
+	scanTimeout int
+	verdicts    map[string]admissionVerdict
+	pending     map[string]chan struct{}
+	queue       chan admissionTask
+}
+
+type admissionTask struct {
+	target admissionTarget
+	done   chan struct{}
+}
+
+var admission = &admissionScanner{
+	registry:    newRegistryClient(5*time.Minute, "linux/amd64", 1<<30),
+	timeout:     25 * time.Second,
+	scanTimeout: 60,
+	verdicts:    make(map[string]admissionVerdict),
+	pending:     make(map[string]chan struct{}),
+	queue:       make(chan admissionTask, maxQueuedAdmissionScans),
+}
+
+// work scans the queued targets until the queue is closed
+func (a *admissionScanner) work() {
+	for task := range a.queue {
+		results := task.target.scan()
+		verdict := admissionVerdict{results: results}
+		if results.Status != statusClean && results.Status != statusInfected {
+			verdict.expires = time.Now().Add(admissionRetry)
+		}
+
+		a.Lock()
+		if len(a.verdicts) >= maxAdmissionVerdicts {
+			for key := range a.verdicts {
+				delete(a.verdicts, key)
+				break
+			}
+		}
+		a.verdicts[task.target.key] = verdict
+		delete(a.pending, task.target.key)
+		a.Unlock()
+		close(task.done)
+	}
+}
+
+// cached returns the verdict of target if there is a current one
+func (a *admissionScanner) cached(target admissionTarget) (ResultsData, bool) {
+	a.Lock()
+	defer a.Unlock()
+	verdict, ok := a.verdicts[target.key]
+	if !ok || (!verdict.expires.IsZero() && time.Now().After(verdict.expires)) {
+		return ResultsData{}, false
+	}
+	return verdict.results, true
+}
+
+// enqueue queues target unless it already is, the channel is closed once it was scanned
+func (a *admissionScanner) enqueue(target admissionTarget) (<-chan struct{}, error) {
+	a.Lock()
+	defer a.Unlock()
+	if done, ok := a.pending[target.key]; ok {
+		return done, nil
+	}
+	task := admissionTask{target: target, done: make(chan struct{})}
+	select {
+	case a.queue <- task:
+	default:
+		return nil, fmt.Errorf("too many queued scans")
+	}
+	a.pending[target.key] = task.done
+	return task.done, nil
+}
+
+// wait returns the verdict of target, scanning it first unless it is cached
+func (a *admissionScanner) wait(ctx context.Context, target admissionTarget) (ResultsData, error) {
+	if results, ok := a.cached(target); ok {
+		return results, nil
+	}
+	done, err := a.enqueue(target)
+	if err != nil {
+		return ResultsData{}, err
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ResultsData{}, fmt.Errorf("scan did not finish within %s", a.timeout)
+	}
+	if results, ok := a.cached(target); ok {
+		return results, nil
+	}
+	return ResultsData{}, fmt.Errorf("scan result was evicted")
+}
+
+// imageTargets returns the layers of an image
+func (a *admissionScanner) imageTargets(ref string) ([]admissionTarget, error) {
+	image, err := parseImageRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	layers, err := a.registry.layers(image)
+	if err != nil {
+		return nil, err
+	}
+	targets := make([]admissionTarget, len(layers))
+	for i, layer := range layers {
+		layer := layer
+		targets[i] = admissionTarget{
+			key:  layer.Digest,
+			what: fmt.Sprintf("image %s layer %s", ref, layer.Digest),
+			scan: func() ResultsData {
+				file, err := a.registry.downloadLayer(image, layer)
+				if err != nil {
+					return ResultsData{Status: statusError, Error: err.Error()}
+				}
+				defer os.Remove(file)
+				path = file
+				return AvScan(a.scanTimeout).Results
+			},
+		}
+	}
+	return targets, nil
+}
+
+// payloadTarget returns a config map or secret value to scan
+func (a *admissionScanner) payloadTarget(what string, data []byte) admissionTarget {
+	return admissionTarget{
+		key:  fmt.Sprintf("sha256:%x", sha256.Sum256(data)),
+		what: what,
+		scan: func() ResultsData {
+			results, err := scanBuffer(data, "admission_", a.scanTimeout)
+			if err != nil {
+				return ResultsData{Status: statusError, Error: err.Error()}
+			}
+			return results
+		},
+	}
+}
+
+// targets returns what to scan of the reviewed object, images that can not be
+// resolved are returned as problems
+func (a *admissionScanner) targets(req *AdmissionRequest) ([]admissionTarget, []string, error) {
+	var object admissionObject
+	if err := json.Unmarshal(req.Object, &object); err != nil {
+		return nil, nil, errors.Wrap(err, "failed to parse object")
+	}
+	reviewed := req.Kind.Kind + " " + req.Name
+	if len(req.Namespace) > 0 {
+		reviewed = req.Kind.Kind + " " + req.Namespace + "/" + req.Name
+	}
+
+	var targets []admissionTarget
+	var problems []string
+	switch req.Kind.Kind {
+	case "ConfigMap", "Secret":
+		payloads := make(map[string][]byte)
+		for key, value := range object.Data {
+			// config map data is text, secret data base64
+			var data []byte
+			var err error
+			if req.Kind.Kind == "Secret" {
+				err = json.Unmarshal(value, &data)
+			} else {
+				var text string
+				err = json.Unmarshal(value, &text)
+				data = []byte(text)
+			}
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "failed to parse data key %q", key)
+			}
+			payloads[key] = data
+		}
+		for key, data := range object.BinaryData {
+			payloads[key] = data
+		}
+		for key, text := range object.StringData {
+			payloads[key] = []byte(text)
+		}
+		keys := make([]string, 0, len(payloads))
+		for key := range payloads {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			targets = append(targets, a.payloadTarget(fmt.Sprintf("%s key %q", reviewed, key), payloads[key]))
+		}
+	default:
+		seen := make(map[string]bool)
+		spec := object.Spec
+		for _, pod := range []podSpec{spec.podSpec, spec.Template.Spec, spec.JobTemplate.Spec.Template.Spec} {
+			for _, ref := range pod.images() {
+				if len(ref) == 0 || seen[ref] {
+					continue
+				}
+				seen[ref] = true
+				layers, err := a.imageTargets(ref)
+				if err != nil {
+					problems = append(problems, fmt.Sprintf("could not scan image %s: %v", ref, err))
+					continue
+				}
+				targets = append(targets, layers...)
+			}
+		}
+	}
+	return targets, problems, nil
+}
+
+// review scans the object of an admission request, it is denied if anything
+// in it is infected and, with fail closed, if anything could not be scanned
+func (a *admissionScanner) review(req *AdmissionRequest) *AdmissionResponse {
+	response := &AdmissionResponse{UID: req.UID, Allowed: true}
+	if req.Operation == "DELETE" || len(req.Object) == 0 {
+		return response
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.timeout)
+	defer cancel()
+
+	targets, problems, err := a.targets(req)
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+	var detections []string
+	for _, target := range targets {
+		results, err := a.wait(ctx, target)
+		switch {
+		case err != nil:
+			problems = append(problems, fmt.Sprintf("could not scan %s: %v", target.what, err))
+		case results.Infected:
+			detections = append(detections, fmt.Sprintf("%s is infected with %s", target.what, results.Result))
+		case results.Status != statusClean:
+			problems = append(problems, fmt.Sprintf("could not scan %s: %s", target.what, results.Error))
+		}
+	}
+
+	switch {
+	case len(detections) > 0:
+		response.Allowed = false
+		response.Status = &AdmissionStatus{Code: http.StatusForbidden, Message: strings.Join(detections, "; ")}
+	case len(problems) > 0 && a.failClosed:
+		response.Allowed = false
+		response.Status = &AdmissionStatus{Code: http.StatusForbidden, Message: strings.Join(problems, "; ")}
+	case len(problems) > 0:
+		response.Warnings = problems
+	}
+	if !response.Allowed {
+		log.WithFields(log.Fields{
+			"plugin":    name,
+			"category":  category,
+			"kind":      req.Kind.Kind,
+			"namespace": req.Namespace,
+			"name":      req.Name,
+		}).Warn("denied admission: ", response.Status.Message)
+	}
+	return response
+}
+
+// webAdmission answers the AdmissionReview requests of a Kubernetes
+// ValidatingWebhookConfiguration
+func webAdmission(w http.ResponseWriter, r *http.Request) {
+	var review AdmissionReview
+	if err := json.NewDecoder(io.LimitReader(r.Body, 8<<20)).Decode(&review); err != nil {
+		http.Error(w, "invalid admission review: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if review.Request == nil {
+		http.Error(w, "admission review has no request", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, AdmissionReview{
+		APIVersion: review.APIVersion,
+		Kind:       "AdmissionReview",
+		Response:   admission.review(review.Request),
+	})
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// S3 object lock modes, see --sample-archive-lock
+const (
+	lockGovernance = "governance"
+	lockCompliance = "compliance"
+)
+
+// CustodyRecord json object, written next to every archived sample: which
+// sample was received from whom, when, and what the engine said about it
+type CustodyRecord struct {
+	SHA256      string     `json:"sha256"`
+	Size        int64      `json:"size"`
+	ReceivedAt  time.Time  `json:"received_at"`
+	ArchivedAt  time.Time  `json:"archived_at"`
+	RetainUntil time.Time  `json:"retain_until"`
+	Submitter   *Submitter `json:"submitter,omitempty"`
+	Infected    bool       `json:"infected"`
+	Status      string     `json:"status,omitempty"`
+	Result      string     `json:"result,omitempty"`
+	Engine      string     `json:"engine,omitempty"`
+	Database    string     `json:"database,omitempty"`
+	Container   string     `json:"container,omitempty"`
+	Member      string     `json:"member,omitempty"`
+	Sample      string     `json:"sample"`
+	VersionID   string     `json:"version_id,omitempty"`
+}
+
+// sampleArchive keeps retained samples where they can not be changed or
+// deleted, unlike the samples of the store the janitor prunes
+type sampleArchive interface {
+	// put writes a sample and its custody record
+	put(data []byte, record CustodyRecord) error
+	String() string
+}
+
+// archive is nil unless --sample-archive is set
+var archive sampleArchive
+
+// archiveSample writes an upload and its verdict to the archive, it is kept
+// for --retain-samples
+func archiveSample(u *uploadScan, results ResultsData) {
+	if archive == nil {
+		return
+	}
+	record := custodyRecord(u, u.sha, u.data, results)
+	if err := archive.put(u.data, record); err != nil {
+		log.WithFields(log.Fields{
+			"plugin":   name,
+			"category": category,
+			"archive":  archive.String(),
+		}).Error(errors.Wrapf(err, "failed to archive sample %s", u.sha))
+	}
+}
+
+// retainMembers keeps the infected archive members read with
+// --retain-infected-members like uploads, under their own sha256, in the
+// store and the archive
+func retainMembers(u *uploadScan, results *ResultsData) {
+	for i := range results.Members {
+		member := &results.Members[i]
+		if member.data == nil {
+			continue
+		}
+		data := member.data
+		member.data = nil
+		fields := log.Fields{
+			"plugin":   name,
+			"category": category,
+			"sha256":   u.sha,
+			"member":   member.Path,
+		}
+		if store != nil {
+			if err := store.saveSample(member.SHA256, data); err != nil {
+				log.WithFields(fields).Error(err)
+				continue
+			}
+		}
+		if archive != nil {
+			record := custodyRecord(u, member.SHA256, data, member.Results)
+			record.Container, record.Member = strings.ToLower(u.sha), member.Path
+			if err := archive.put(data, record); err != nil {
+				log.WithFields(fields).Error(errors.Wrapf(err, "failed to archive sample %s", member.SHA256))
+				continue
+			}
+		}
+		member.Retained = true
+		log.WithFields(fields).Debug("retained infected archive member ", member.SHA256)
+	}
+}
+
+// custodyRecord returns the record of archiving data with the sha256 sha,
+// received with u
+func custodyRecord(u *uploadScan, sha string, data []byte, results ResultsData) CustodyRecord {
+	record := CustodyRecord{
+		SHA256:     strings.ToLower(sha),
+		Size:       int64(len(data)),
+		ReceivedAt: u.received.UTC(),
+		ArchivedAt: time.Now().UTC(),
+		Submitter:  u.submitter,
+		Infected:   results.Infected,
+		Status:     results.Status,
+		Result:     results.Result,
+		Engine:     results.Engine,
+		Database:   results.Database,
+	}
+	record.RetainUntil = record.ArchivedAt.Add(sampleRetention)
+	return record
+}
+
+// openArchive returns the archive at location, an s3://bucket/prefix url or
+// a directory
+func openArchive(location, endpoint, lockMode string) (sampleArchive, error) {
+	switch lockMode {
+	case "", lockGovernance, lockCompliance:
+	default:
+		return nil, fmt.Errorf("invalid --sample-archive-lock %q (must be %s or %s)", lockMode, lockGovernance, lockCompliance)
+	}
+	if !strings.HasPrefix(location, "s3://") {
+		if len(lockMode) > 0 {
+			return nil, fmt.Errorf("--sample-archive-lock requires an s3:// archive")
+		}
+		dir := strings.TrimPrefix(location, "file://")
+		for _, sub := range []string{"samples", "records"} {
+			if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+				return nil, errors.Wrapf(err, "failed to create sample archive in %s", dir)
+			}
+		}
+		return &dirArchive{dir: dir}, nil
+	}
+
+	a, err := openBucket(location, endpoint)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid --sample-archive")
+	}
+	a.lockMode = strings.ToUpper(lockMode)
+	return a, nil
+}
+
+// openBucket returns a client of the S3 bucket at an s3://bucket/prefix
+// url, with the credentials of the environment
+func openBucket(location, endpoint string) (*s3Archive, error) {
+	u, err := url.Parse(location)
+	if err != nil || u.Scheme != "s3" || len(u.Host) == 0 {
+		return nil, fmt.Errorf("%q is not an s3://bucket/prefix url", location)
+	}
+	a := &s3Archive{
+		bucket:    u.Host,
+		prefix:    strings.Trim(u.Path, "/"),
+		region:    os.Getenv("AWS_REGION"),
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		token:     os.Getenv("AWS_SESSION_TOKEN"),
+		client:    &http.Client{Timeout: 5 * time.Minute},
+	}
+	if len(a.region) == 0 {
+		a.region = "us-east-1"
+	}
+	if a.endpoint = strings.TrimRight(endpoint, "/"); len(a.endpoint) == 0 {
+		a.endpoint = "https://s3." + a.region + ".amazonaws.com"
+	}
+	if len(a.accessKey) == 0 || len(a.secretKey) == 0 {
+		return nil, fmt.Errorf("s3://%s needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY", a.bucket)
+	}
+	if len(a.prefix) > 0 {
+		a.prefix += "/"
+	}
+	return a, nil
+}
+
+// dirArchive writes samples once as <dir>/samples/<sha256> and their
+// records as <dir>/records/<sha256>/<archive time>.json, read-only, e.g. to
+// a WORM mount
+type dirArchive struct {
+	dir string
+}
+
+func (a *dirArchive) String() string {
+	return a.dir
+}
+
+// writeOnce creates file with data, it is never replaced
+func writeOnce(file string, data []byte) error {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
+	if os.IsExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (a *dirArchive) put(data []byte, record CustodyRecord) error {
+	record.Sample = filepath.Join("samples", record.SHA256)
+	if err := writeOnce(filepath.Join(a.dir, record.Sample), data); err != nil {
+		return err
+	}
+	recordJSON, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(a.dir, "records", record.SHA256)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	return writeOnce(filepath.Join(dir, record.ArchivedAt.Format(storeTimeFormat)+".json"), recordJSON)
+}
+
+// s3Archive writes samples as <prefix>samples/<sha256> and their records
+// as <prefix>records/<sha256>/<archive time>.json to an S3 bucket, versioned
+// or with object lock, signing the requests with AWS signature version 4
+type s3Archive struct {
+	endpoint  string
+	bucket    string
+	prefix    string
+	region    string
+	accessKey string
+	secretKey string
+	token     string
+	lockMode  string
+	client    *http.Client
+}
+
+func (a *s3Archive) String() string {
+	return "s3://" + a.bucket + "/" + a.prefix
+}
+
+func (a *s3Archive) put(data []byte, record CustodyRecord) error {
+	record.Sample = a.prefix + "samples/" + record.SHA256
+	meta := map[string]string{
+		"x-amz-meta-sha256":   record.SHA256,
+		"x-amz-meta-infected": strconv.FormatBool(record.Infected),
+		"x-amz-meta-result":   url.QueryEscape(record.Result),
+	}
+	versionID, err := a.putObject(record.Sample, "application/octet-stream", data, record.RetainUntil, meta)
+	if err != nil {
+		return err
+	}
+	record.VersionID = versionID
+
+	recordJSON, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	key := a.prefix + "records/" + record.SHA256 + "/" + record.ArchivedAt.Format(storeTimeFormat) + ".json"
+	_, err = a.putObject(key, "application/json", recordJSON, record.RetainUntil, nil)
+	return err
+}
+
+// putObject uploads an object, locked until retainUntil with object lock,
+// and returns its version id if the bucket is versioned
+func (a *s3Archive) putObject(key, contentType string, data []byte, retainUntil time.Time, meta map[string]string) (string, error) {
+	req, err := http.NewRequest("PUT", a.endpoint+"/"+a.bucket+"/"+key, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	md5sum := md5.Sum(data)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(md5sum[:]))
+	for header, value := range meta {
+		req.Header.Set(header, value)
+	}
+	if len(a.lockMode) > 0 {
+		req.Header.Set("x-amz-object-lock-mode", a.lockMode)
+		req.Header.Set("x-amz-object-lock-retain-until-date", retainUntil.Format(time.RFC3339))
+	}
+	a.sign(req, data, time.Now().UTC())
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return "", fmt.Errorf("failed to put %s: %s %s", key, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp.Header.Get("x-amz-version-id"), nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// sign adds an AWS signature version 4 of every header of req
+func (a *s3Archive) sign(req *http.Request, payload []byte, now time.Time) {
+	payloadHash := sha256.Sum256(payload)
+	req.Header.Set("x-amz-content-sha256", hex.EncodeToString(payloadHash[:]))
+	req.Header.Set("x-amz-date", now.Format("20060102T150405Z"))
+	if len(a.token) > 0 {
+		req.Header.Set("x-amz-security-token", a.token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for header, values := range req.Header {
+		headers[strings.ToLower(header)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	var names []string
+	for header := range headers {
+		names = append(names, header)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, header := range names {
+		canonicalHeaders.WriteString(header + ":" + headers[header] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := now.Format("20060102") + "/" + a.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+a.secretKey), now.Format("20060102"))
+	for _, part := range []string{a.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", a.accessKey, scope, signedHeaders, signature))
+}
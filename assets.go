@@ -0,0 +1,38 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"net/http"
+)
+
+// assets are built into the binary so it runs without any files next to it
+//
+//go:embed assets
+var assets embed.FS
+
+// tpl is the markdown table template of the results
+var tpl = string(asset("drweb.md.tmpl"))
+
+// asset returns an embedded file
+func asset(file string) []byte {
+	data, err := assets.ReadFile("assets/" + file)
+	assert(err)
+	return data
+}
+
+// webOpenAPI serves the OpenAPI document of the web service
+func webOpenAPI(w http.ResponseWriter, r *http.Request) {
+	var doc map[string]interface{}
+	assert(json.Unmarshal(asset("openapi.json"), &doc))
+	if info, ok := doc["info"].(map[string]interface{}); ok && len(Version) > 0 {
+		info["version"] = Version
+	}
+	writeJSON(w, http.StatusOK, doc)
+}
+
+// webSchema serves the JSON schema of the scan results
+func webSchema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Write(asset("results.schema.json"))
+}
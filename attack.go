@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// attackMap maps detection name tokens and families to MITRE ATT&CK technique
+// IDs, it is nil unless a mapping file is configured
+var attackMap map[string][]string
+
+func loadAttackMap(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return errors.Wrap(err, "failed to read ATT&CK mapping file")
+	}
+
+	mapping := make(map[string][]string)
+	if err := json.Unmarshal(data, &mapping); err != nil {
+		return errors.Wrapf(err, "failed to parse ATT&CK mapping file %s", file)
+	}
+	reloadLock.Lock()
+	attackMap = mapping
+	reloadLock.Unlock()
+
+	return nil
+}
+
+// currentAttackMap returns the ATT&CK mapping, nil unless one is configured
+func currentAttackMap() map[string][]string {
+	reloadLock.RLock()
+	defer reloadLock.RUnlock()
+	return attackMap
+}
+
+// attackTechniques returns the sorted ATT&CK technique IDs mapped to a detection
+func attackTechniques(detection, family string) []string {
+	keys := detectionTokens(detection)
+	if len(family) > 0 {
+		keys = append(keys, family)
+	}
+
+	mapping := currentAttackMap()
+	seen := make(map[string]bool)
+	var techniques []string
+	for _, key := range keys {
+		for _, technique := range mapping[key] {
+			if !seen[technique] {
+				seen[technique] = true
+				techniques = append(techniques, technique)
+			}
+		}
+	}
+	sort.Strings(techniques)
+
+	return techniques
+}
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// audit events
+const (
+	auditSubmitted = "scan_submitted"
+	auditVerdict   = "verdict"
+	auditAdmin     = "admin_action"
+	auditConfig    = "config_changed"
+)
+
+// auditPriority is the syslog priority of audit entries: facility log audit
+// (13), severity informational (6)
+const auditPriority = 13*8 + 6
+
+// maxAuditQueue is how many entries may wait for the syslog collector
+const maxAuditQueue = 10000
+
+// AuditEntry json object, one line of the audit trail. Hash is the sha256
+// of the entry with an empty hash, which includes the hash of the entry
+// before it, so changing, removing or inserting an entry breaks the chain
+// from there on.
+type AuditEntry struct {
+	Seq     uint64            `json:"seq"`
+	Time    time.Time         `json:"time"`
+	Event   string            `json:"event"`
+	Actor   string            `json:"actor,omitempty"` // API key id, socket or cli
+	Tenant  string            `json:"tenant,omitempty"`
+	SHA256  string            `json:"sha256,omitempty"`
+	Details map[string]string `json:"details,omitempty"`
+	Prev    string            `json:"prev"`
+	Hash    string            `json:"hash"`
+}
+
+// sum returns the hash of the entry
+func (e AuditEntry) sum() string {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	assert(err)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// auditTrail appends hash chained entries to --audit-log and ships them to
+// --audit-syslog. The file is only ever appended to, a restart continues
+// its chain.
+type auditTrail struct {
+	sync.Mutex
+	file   *os.File
+	seq    uint64
+	last   string // hash of the last entry
+	syslog *auditSyslog
+}
+
+// audit is the audit trail, nil if neither --audit-log nor --audit-syslog is set
+var audit *auditTrail
+
+// openAuditTrail opens the audit trail, continuing the chain of file
+func openAuditTrail(file, syslogURL, syslogCA string) (*auditTrail, error) {
+	a := &auditTrail{}
+	if len(file) > 0 {
+		last, err := lastAuditEntry(file)
+		if err != nil {
+			return nil, err
+		}
+		if last != nil {
+			a.seq, a.last = last.Seq, last.Hash
+		}
+		if a.file, err = os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600); err != nil {
+			return nil, errors.Wrap(err, "failed to open --audit-log")
+		}
+	}
+	if len(syslogURL) > 0 {
+		var err error
+		if a.syslog, err = newAuditSyslog(syslogURL, syslogCA); err != nil {
+			return nil, err
+		}
+		go a.syslog.run()
+	}
+	return a, nil
+}
+
+// lastAuditEntry returns the last entry of an audit log, nil if it is empty
+// or does not exist yet. An entry that does not hash to its hash is an error,
+// a trail is not continued from a broken chain.
+func lastAuditEntry(file string) (*AuditEntry, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open --audit-log")
+	}
+	defer f.Close()
+
+	// entries are small, the last one is well within the tail of the file
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	offset := info.Size() - 1<<20
+	if offset < 0 {
+		offset = 0
+	}
+	tail, err := ioutil.ReadAll(io.NewSectionReader(f, offset, info.Size()-offset))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read --audit-log")
+	}
+	tail = bytes.TrimRight(tail, "\n")
+	if len(tail) == 0 {
+		return nil, nil
+	}
+	line := tail[bytes.LastIndexByte(tail, '\n')+1:]
+
+	var last AuditEntry
+	if err := json.Unmarshal(line, &last); err != nil {
+		return nil, errors.Wrapf(err, "%s ends in a broken entry, check it with audit verify", file)
+	}
+	if last.sum() != last.Hash {
+		return nil, fmt.Errorf("the last entry of %s does not match its hash, check it with audit verify", file)
+	}
+	return &last, nil
+}
+
+// record appends an entry to the trail. Failing to write it is logged, it
+// does not fail what is audited.
+func (a *auditTrail) record(event, actor, tenant, sha string, details map[string]string) {
+	if a == nil {
+		return
+	}
+	a.Lock()
+	defer a.Unlock()
+
+	a.seq++
+	entry := AuditEntry{
+		Seq:     a.seq,
+		Time:    time.Now().UTC(),
+		Event:   event,
+		Actor:   actor,
+		Tenant:  tenant,
+		SHA256:  sha,
+		Details: details,
+		Prev:    a.last,
+	}
+	entry.Hash = entry.sum()
+	a.last = entry.Hash
+	line, err := json.Marshal(entry)
+	assert(err)
+
+	if a.file != nil {
+		if _, err := a.file.Write(append(line, '\n')); err == nil {
+			err = a.file.Sync()
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"plugin":   name,
+				"category": category,
+				"seq":      entry.Seq,
+			}).Error(errors.Wrap(err, "failed to write audit entry"))
+		}
+	}
+	a.syslog.send(entry, line)
+}
+
+// submitted records the submission of an upload
+func (a *auditTrail) submitted(u *uploadScan, channel string) {
+	details := map[string]string{
+		"channel": channel,
+		"size":    strconv.Itoa(len(u.data)),
+		"ip":      u.submitter.IP,
+	}
+	if len(u.name) > 0 {
+		details["name"] = u.name
+	}
+	if len(u.options.Profile) > 0 {
+		details["profile"] = u.options.Profile
+	}
+	a.record(auditSubmitted, u.submitter.KeyID, u.submitter.Tenant, u.sha, details)
+}
+
+// verdict records the results of a scan
+func (a *auditTrail) verdict(sha string, submitter *Submitter, results ResultsData) {
+	details := map[string]string{
+		"infected": strconv.FormatBool(results.Infected),
+		"status":   results.Status,
+	}
+	for key, value := range map[string]string{"result": results.Result, "database": results.Database, "source": results.Source, "error": results.Error} {
+		if len(value) > 0 {
+			details[key] = value
+		}
+	}
+	if results.Suppressed {
+		details["suppressed"] = "true"
+	}
+	var actor, tenant string
+	if submitter != nil {
+		actor, tenant = submitter.KeyID, submitter.Tenant
+	}
+	a.record(auditVerdict, actor, tenant, sha, details)
+}
+
+// configured records the configuration a service started with: the names
+// of the flags that are set, their values may be secrets
+func (a *auditTrail) configured(c *cli.Context) {
+	var flags []string
+	for _, flag := range c.GlobalFlagNames() {
+		if c.GlobalIsSet(flag) {
+			flags = append(flags, "--"+flag)
+		}
+	}
+	for _, flag := range c.FlagNames() {
+		if c.IsSet(flag) {
+			flags = append(flags, "--"+flag)
+		}
+	}
+	a.record(auditConfig, "cli", "", "", map[string]string{
+		"reason":  "started",
+		"command": c.Command.Name,
+		"version": Version,
+		"flags":   strings.Join(flags, ","),
+	})
+}
+
+// statusResponseWriter remembers the status of a response
+type statusResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusResponseWriter) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusResponseWriter) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// auditRequest records an admin request and how it was answered, key is
+// empty if it was refused before an API key was found
+func (a *auditTrail) auditRequest(r *http.Request, key string, status int) {
+	a.record(auditAdmin, key, requestTenant(r), "", map[string]string{
+		"method": r.Method,
+		"path":   r.URL.Path,
+		"ip":     requestSubmitter(r).IP,
+		"status": strconv.Itoa(status),
+	})
+}
+
+// audited records the admin requests next serves
+func audited(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if audit == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rec := &statusResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		audit.auditRequest(r, requestKeyID(r), rec.status)
+	})
+}
+
+// flush waits up to timeout for the syslog collector to get the queued entries
+func (a *auditTrail) flush(timeout time.Duration) {
+	if a == nil || a.syslog == nil {
+		return
+	}
+	deadline := time.Now().Add(timeout)
+	for unsent := a.syslog.pending(); unsent > 0; unsent = a.syslog.pending() {
+		if time.Now().After(deadline) {
+			log.WithFields(log.Fields{
+				"plugin":   name,
+				"category": category,
+			}).Warnf("%d audit entries were not shipped to --audit-syslog", unsent)
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// auditSyslog ships audit entries as RFC 5424 messages to a syslog
+// collector, over TLS (RFC 5425), TCP (octet counting) or UDP. Entries are
+// sent in order and retried until the collector takes them.
+type auditSyslog struct {
+	network  string
+	addr     string
+	tls      *tls.Config
+	hostname string
+	queue    chan []byte
+
+	mu      sync.Mutex
+	unsent  int // queued or being sent
+	dropped int
+}
+
+// newAuditSyslog returns the shipper of --audit-syslog, tls://host:port,
+// tcp://host:port or udp://host:port. ca is a PEM file of the certificate
+// authorities the collector's certificate is checked against, the system
+// ones if empty.
+func newAuditSyslog(raw, ca string) (*auditSyslog, error) {
+	u, err := url.Parse(raw)
+	if err != nil || len(u.Host) == 0 {
+		return nil, fmt.Errorf("invalid --audit-syslog %q (must be tls://, tcp:// or udp://host:port)", raw)
+	}
+	s := &auditSyslog{addr: u.Host, queue: make(chan []byte, maxAuditQueue)}
+	port := "514"
+	switch u.Scheme {
+	case "tls":
+		s.network, port = "tcp", "6514"
+		s.tls = &tls.Config{ServerName: u.Hostname()}
+		if len(ca) > 0 {
+			pem, err := ioutil.ReadFile(ca)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to read --audit-syslog-ca")
+			}
+			s.tls.RootCAs = x509.NewCertPool()
+			if !s.tls.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in --audit-syslog-ca %s", ca)
+			}
+		}
+	case "tcp", "udp":
+		s.network = u.Scheme
+	default:
+		return nil, fmt.Errorf("invalid --audit-syslog %q (must be tls://, tcp:// or udp://host:port)", raw)
+	}
+	if len(u.Port()) == 0 {
+		s.addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	if s.hostname, err = os.Hostname(); err != nil || len(s.hostname) == 0 {
+		s.hostname = "-"
+	}
+	return s, nil
+}
+
+// send queues an entry, it is dropped (and counted) if the collector is so
+// far behind that the queue is full
+func (s *auditSyslog) send(entry AuditEntry, line []byte) {
+	if s == nil {
+		return
+	}
+	msg := fmt.Sprintf("<%d>1 %s %s %s %d %s - %s", auditPriority, entry.Time.Format("2006-01-02T15:04:05.000000Z07:00"), s.hostname, name, os.Getpid(), entry.Event, line)
+	if s.network != "udp" {
+		msg = strconv.Itoa(len(msg)) + " " + msg
+	}
+	s.mu.Lock()
+	s.unsent++
+	s.mu.Unlock()
+	select {
+	case s.queue <- []byte(msg):
+	default:
+		s.mu.Lock()
+		s.unsent--
+		s.dropped++
+		dropped := s.dropped
+		s.mu.Unlock()
+		log.WithFields(log.Fields{
+			"plugin":   name,
+			"category": category,
+			"seq":      entry.Seq,
+			"dropped":  dropped,
+		}).Error("audit syslog queue is full, dropped entry")
+	}
+}
+
+func (s *auditSyslog) pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.unsent
+}
+
+func (s *auditSyslog) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if s.tls != nil {
+		return tls.DialWithDialer(dialer, s.network, s.addr, s.tls)
+	}
+	return dialer.Dial(s.network, s.addr)
+}
+
+// run sends the queued entries, reconnecting with a backoff of up to a
+// minute while the collector can not be reached
+func (s *auditSyslog) run() {
+	var conn net.Conn
+	var w *bufio.Writer
+	for msg := range s.queue {
+		for backoff := time.Second; ; backoff *= 2 {
+			if conn == nil {
+				var err error
+				if conn, err = s.dial(); err != nil {
+					conn = nil
+					s.retry(err, &backoff)
+					continue
+				}
+				w = bufio.NewWriter(conn)
+			}
+			conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+			w.Write(msg)
+			if err := w.Flush(); err != nil {
+				conn.Close()
+				conn = nil
+				s.retry(err, &backoff)
+				continue
+			}
+			break
+		}
+		s.mu.Lock()
+		s.unsent--
+		s.mu.Unlock()
+	}
+}
+
+func (s *auditSyslog) retry(err error, backoff *time.Duration) {
+	if *backoff > time.Minute {
+		*backoff = time.Minute
+	}
+	log.WithFields(log.Fields{
+		"plugin":   name,
+		"category": category,
+	}).Warn(errors.Wrapf(err, "failed to ship audit entry to %s, retrying in %s", s.addr, *backoff))
+	time.Sleep(*backoff)
+}
+
+// AuditVerification json object, the outcome of audit verify
+type AuditVerification struct {
+	File     string `json:"file"`
+	Entries  int    `json:"entries"`
+	FirstSeq uint64 `json:"first_seq,omitempty"`
+	LastSeq  uint64 `json:"last_seq,omitempty"`
+	LastHash string `json:"last_hash,omitempty"`
+}
+
+// verifyAuditLog checks the chain of an audit log: every entry hashes to
+// its hash, names the hash of the entry before it and has the next sequence
+// number. The first entry must start the chain unless after is set, the
+// hash of the entry before it in an earlier, archived part of the log.
+func verifyAuditLog(file, after string) (AuditVerification, error) {
+	verification := AuditVerification{File: file}
+	f, err := os.Open(file)
+	if err != nil {
+		return verification, err
+	}
+	defer f.Close()
+
+	prev := after
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return verification, errors.Wrapf(err, "%s:%d: broken entry", file, line)
+		}
+		switch {
+		case entry.sum() != entry.Hash:
+			return verification, fmt.Errorf("%s:%d: entry %d does not match its hash, it was changed", file, line, entry.Seq)
+		case entry.Prev != prev:
+			return verification, fmt.Errorf("%s:%d: entry %d does not follow the entry before it, entries were removed or inserted", file, line, entry.Seq)
+		case verification.Entries > 0 && entry.Seq != verification.LastSeq+1:
+			return verification, fmt.Errorf("%s:%d: entry %d follows entry %d", file, line, entry.Seq, verification.LastSeq)
+		}
+		if verification.Entries == 0 {
+			verification.FirstSeq = entry.Seq
+		}
+		verification.Entries++
+		verification.LastSeq, verification.LastHash = entry.Seq, entry.Hash
+		prev = entry.Hash
+	}
+	if err := scanner.Err(); err != nil {
+		return verification, errors.Wrapf(err, "failed to read %s", file)
+	}
+	return verification, nil
+}
+
+// auditVerifyCommand checks the chain of an audit log and prints what it
+// checked as JSON
+func auditVerifyCommand(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("audit verify needs the audit log to check")
+	}
+	verification, err := verifyAuditLog(c.Args().First(), c.String("after"))
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(verification)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
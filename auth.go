@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// API key roles, admin keys may do everything scan keys may and scan keys
+// everything verdict keys may. Verdict keys only learn whether a sample is
+// infected, not what it was detected as or by which engine.
+const (
+	roleVerdict = "verdict"
+	roleScan    = "scan"
+	roleAdmin   = "admin"
+)
+
+// roleRanks orders the roles by what they may do
+var roleRanks = map[string]int{roleVerdict: 1, roleScan: 2, roleAdmin: 3}
+
+type contextKey string
+
+// API key context keys: the id and role of the key a request was made with
+const (
+	apiKeyIDContextKey   = contextKey("api-key-id")
+	apiKeyRoleContextKey = contextKey("api-key-role")
+)
+
+// apiKey is an entry of the API keys file, the key is stored either as is or
+// as the hex encoded sha256 of the key
+type apiKey struct {
+	ID        string `json:"id"`
+	Key       string `json:"key,omitempty"`
+	KeySHA256 string `json:"key_sha256,omitempty"`
+	Role      string `json:"role"`
+	Tenant    string `json:"tenant,omitempty"`
+
+	hash []byte
+}
+
+type keyring struct {
+	sync.RWMutex
+	file string
+	keys []apiKey
+}
+
+// apiKeys is empty unless an API keys file is configured
+var apiKeys = &keyring{}
+
+// load reads the API keys file, a JSON list of keys
+func (k *keyring) load(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return errors.Wrap(err, "failed to read API keys")
+	}
+	var keys []apiKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return errors.Wrapf(err, "failed to parse API keys file %s", file)
+	}
+
+	for i, key := range keys {
+		if len(key.ID) == 0 {
+			return fmt.Errorf("API key %d has no id", i)
+		}
+		if _, ok := roleRanks[key.Role]; !ok {
+			return fmt.Errorf("API key %s has invalid role %q (must be %s, %s or %s)", key.ID, key.Role, roleVerdict, roleScan, roleAdmin)
+		}
+		if len(key.Tenant) > 0 && !validTenantID(key.Tenant) {
+			return fmt.Errorf("API key %s has invalid tenant %q", key.ID, key.Tenant)
+		}
+		switch {
+		case len(key.KeySHA256) > 0:
+			if keys[i].hash, err = hex.DecodeString(key.KeySHA256); err != nil || len(keys[i].hash) != sha256.Size {
+				return fmt.Errorf("API key %s has an invalid key_sha256", key.ID)
+			}
+		case len(key.Key) > 0:
+			sum := sha256.Sum256([]byte(key.Key))
+			keys[i].hash = sum[:]
+			keys[i].Key = ""
+		default:
+			return fmt.Errorf("API key %s has neither key nor key_sha256", key.ID)
+		}
+	}
+
+	k.Lock()
+	defer k.Unlock()
+	k.file = file
+	k.keys = keys
+	return nil
+}
+
+// reload re-reads the API keys file, if there is one
+func (k *keyring) reload() error {
+	k.RLock()
+	file := k.file
+	k.RUnlock()
+	if len(file) == 0 {
+		return nil
+	}
+	return k.load(file)
+}
+
+// enabled reports whether the web API requires credentials
+func (k *keyring) enabled() bool {
+	k.RLock()
+	defer k.RUnlock()
+	return len(k.keys) > 0 || len(adminToken) > 0 || oidc != nil
+}
+
+// lookup returns the API key matching token, which may also be a JWT if OIDC
+// authentication is enabled
+func (k *keyring) lookup(token string) (apiKey, bool) {
+	if len(adminToken) > 0 && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1 {
+		return apiKey{ID: "admin-token", Role: roleAdmin}, true
+	}
+	if oidc != nil && strings.Count(token, ".") == 2 {
+		key, err := oidc.verify(token)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"plugin":   name,
+				"category": category,
+			}).Debug(errors.Wrap(err, "rejected JWT"))
+			return apiKey{}, false
+		}
+		return key, true
+	}
+
+	k.RLock()
+	defer k.RUnlock()
+	sum := sha256.Sum256([]byte(token))
+	for _, key := range k.keys {
+		if subtle.ConstantTimeCompare(sum[:], key.hash) == 1 {
+			return key, true
+		}
+	}
+	return apiKey{}, false
+}
+
+// requireRole only lets requests through that carry an API key with role or
+// a higher one. Scan endpoints stay open as long as no API keys are configured.
+func requireRole(role string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if role != roleAdmin && !apiKeys.enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		key, ok := apiKeys.lookup(token)
+		if len(token) == 0 || !ok {
+			if role == roleAdmin {
+				audit.auditRequest(r, "", http.StatusUnauthorized)
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="drweb"`)
+			http.Error(w, "valid API key required", http.StatusUnauthorized)
+			return
+		}
+		if roleRanks[key.Role] < roleRanks[role] {
+			if role == roleAdmin {
+				audit.auditRequest(r, key.ID, http.StatusForbidden)
+			}
+			http.Error(w, "API key is not allowed to do this", http.StatusForbidden)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), apiKeyIDContextKey, key.ID)
+		ctx = context.WithValue(ctx, apiKeyTenantContextKey, key.Tenant)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, apiKeyRoleContextKey, key.Role)))
+	})
+}
+
+// requestKeyID returns the id of the API key r was authenticated with
+func requestKeyID(r *http.Request) string {
+	id, _ := r.Context().Value(apiKeyIDContextKey).(string)
+	return id
+}
+
+// verdictOnly reports whether r was made with a verdict API key, whose
+// responses must not name detections or the engine
+func verdictOnly(r *http.Request) bool {
+	role, _ := r.Context().Value(apiKeyRoleContextKey).(string)
+	return role == roleVerdict
+}
+
+func requireAdmin(next http.Handler) http.Handler {
+	return requireRole(roleAdmin, audited(next))
+}
+
+func requireScan(next http.HandlerFunc) http.Handler {
+	return requireRole(roleScan, next)
+}
+
+func requireVerdict(next http.HandlerFunc) http.Handler {
+	return requireRole(roleVerdict, next)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// BaseInfo json object, the engine version and virus base info every result carries
+type BaseInfo struct {
+	Version     string     `json:"version"`
+	Engine      string     `json:"engine"`
+	Database    string     `json:"database"`
+	UpdatedAt   *time.Time `json:"updated_at,omitempty"`
+	DBTimestamp *time.Time `json:"db_timestamp,omitempty"`
+	CachedAt    time.Time  `json:"cached_at"`
+}
+
+// parseBaseInfo returns the core engine version and virus base records of
+// the output of drweb-ctl baseinfo
+func parseBaseInfo(baseinfo string) (string, string) {
+	var engine, database string
+	for _, line := range strings.Split(baseinfo, "\n") {
+		if strings.Contains(line, "Core engine:") {
+			engine = strings.TrimSpace(strings.TrimPrefix(line, "Core engine:"))
+		}
+		if strings.Contains(line, "Virus base records:") {
+			database = strings.TrimSpace(strings.TrimPrefix(line, "Virus base records:"))
+		}
+	}
+	return engine, database
+}
+
+// parseBaseInfoTimes returns the virus base timestamp and when the engine
+// last updated itself of the output of drweb-ctl baseinfo, nil if missing
+func parseBaseInfoTimes(baseinfo string) (*time.Time, *time.Time) {
+	var dbTimestamp, lastUpdate *time.Time
+	for _, line := range strings.Split(baseinfo, "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		t, ok := parseEngineTimestamp(parts[1])
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(parts[0]) {
+		case "Virus database timestamp", "Virus base timestamp":
+			dbTimestamp = &t
+		case "Last successful update":
+			lastUpdate = &t
+		}
+	}
+	return dbTimestamp, lastUpdate
+}
+
+// baseInfoCache keeps the engine version and virus base info, which only
+// change when the engine is updated, so scans do not ask the engine for them
+// every time. It is invalidated once an update completed, on SIGHUP and
+// after maxAge, as Dr.Web also updates its virus bases on its own.
+type baseInfoCache struct {
+	sync.Mutex
+	maxAge time.Duration // 0 keeps the info until it is invalidated
+	info   BaseInfo
+	cached bool
+}
+
+var baseInfo = &baseInfoCache{}
+
+// get returns the cached info, asking the engine for it if there is none.
+// Concurrent callers wait for the one asking the engine.
+func (b *baseInfoCache) get(ctx context.Context) (BaseInfo, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.cached && (b.maxAge == 0 || time.Since(b.info.CachedAt) < b.maxAge) {
+		return b.info, nil
+	}
+	if err := startConfigd(ctx); err != nil {
+		return BaseInfo{}, errors.Wrap(err, "failed to start drweb-configd")
+	}
+	version, err := runCtl(ctx, "--version")
+	if err != nil {
+		return BaseInfo{}, errors.Wrap(err, "failed to get engine version")
+	}
+	baseinfo, err := runCtl(ctx, "baseinfo")
+	if err != nil {
+		return BaseInfo{}, errors.Wrap(err, "failed to get virus base info")
+	}
+
+	info := BaseInfo{
+		Version:  strings.TrimSpace(strings.TrimPrefix(version, "drweb-ctl ")),
+		CachedAt: time.Now().UTC(),
+	}
+	info.Engine, info.Database = parseBaseInfo(baseinfo)
+	// Dr.Web also updates itself, so what it says wins over our UPDATED file
+	info.DBTimestamp, info.UpdatedAt = parseBaseInfoTimes(baseinfo)
+	if info.UpdatedAt == nil {
+		info.UpdatedAt = definitionsUpdated()
+	}
+	if len(info.Engine) == 0 {
+		info.Engine = info.Version
+	}
+	b.info, b.cached = info, true
+	return info, nil
+}
+
+// invalidate makes the next scan ask the engine again
+func (b *baseInfoCache) invalidate(reason string) {
+	b.Lock()
+	b.cached = false
+	b.Unlock()
+
+	log.WithFields(log.Fields{
+		"plugin":   name,
+		"category": category,
+	}).Debug("engine info cache invalidated: ", reason)
+}
+
+// invalidateOnHangup invalidates the cache and the engine session on every
+// SIGHUP, e.g. sent by whatever updated the virus bases behind our back
+func (b *baseInfoCache) invalidateOnHangup() {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			b.invalidate("SIGHUP")
+			session.invalidate("SIGHUP")
+		}
+	}()
+}
+
+// webBaseInfo returns the cached engine version and virus base info
+func webBaseInfo(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	info, err := baseInfo.get(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// eicarTestFile is the EICAR anti-virus test file, every engine detects it
+const eicarTestFile = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// EicarResult json object
+type EicarResult struct {
+	Detected  bool    `json:"detected"`
+	Result    string  `json:"result,omitempty"`
+	Engine    string  `json:"engine,omitempty"`
+	Database  string  `json:"database,omitempty"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// BenchResult json object
+type BenchResult struct {
+	Files          int     `json:"files"`
+	Size           int64   `json:"size"`
+	Errors         int     `json:"errors"`
+	Detections     int     `json:"detections"`
+	DurationMS     float64 `json:"duration_ms"`
+	FilesPerSecond float64 `json:"files_per_second"`
+	MBPerSecond    float64 `json:"mb_per_second"`
+	LatencyMS      struct {
+		Min float64 `json:"min"`
+		P50 float64 `json:"p50"`
+		P90 float64 `json:"p90"`
+		P99 float64 `json:"p99"`
+		Max float64 `json:"max"`
+	} `json:"latency_ms"`
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d/time.Microsecond) / 1000
+}
+
+// parseSize parses a byte count with an optional K, M or G suffix
+func parseSize(size string) (int64, error) {
+	number := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(size)), "B")
+	shift := uint(0)
+	switch {
+	case strings.HasSuffix(number, "K"):
+		shift = 10
+	case strings.HasSuffix(number, "M"):
+		shift = 20
+	case strings.HasSuffix(number, "G"):
+		shift = 30
+	}
+	if shift > 0 {
+		number = number[:len(number)-1]
+	}
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q (e.g. 512K or 1M)", size)
+	}
+	return n << shift, nil
+}
+
+// percentile returns the p-th percentile of sorted latencies
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(p/100*float64(len(sorted))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// eicar scans the EICAR test file to check the engine detects malware end to end
+func eicar(c *cli.Context) error {
+	started := time.Now()
+	results, err := scanBuffer([]byte(eicarTestFile), "eicar_", c.GlobalInt("timeout"))
+
+	result := EicarResult{
+		Detected:  err == nil && results.Infected,
+		Result:    results.Result,
+		Engine:    results.Engine,
+		Database:  results.Database,
+		LatencyMS: milliseconds(time.Since(started)),
+		Error:     results.Error,
+	}
+	if err != nil {
+		result.Error = err.Error()
+	} else if !result.Detected && len(result.Error) == 0 {
+		result.Error = "EICAR test file was not detected"
+	}
+
+	eicarJSON, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(eicarJSON))
+
+	if !result.Detected {
+		return cli.NewExitError("", 1)
+	}
+	return nil
+}
+
+// bench scans generated files one after another and reports throughput and
+// latency, the same seed always generates the same files
+func bench(c *cli.Context) error {
+	n := c.Int("n")
+	if n <= 0 {
+		return fmt.Errorf("--n must be positive")
+	}
+	size, err := parseSize(c.String("size"))
+	if err != nil {
+		return err
+	}
+
+	random := rand.New(rand.NewSource(c.Int64("seed")))
+	data := make([]byte, size)
+
+	var report BenchResult
+	report.Files = n
+	report.Size = size
+
+	latencies := make([]time.Duration, 0, n)
+	started := time.Now()
+	for i := 0; i < n; i++ {
+		random.Read(data)
+		scanStarted := time.Now()
+		results, err := scanBuffer(data, "bench_", c.GlobalInt("timeout"))
+		latencies = append(latencies, time.Since(scanStarted))
+		if err != nil || results.Status == statusError {
+			report.Errors++
+		}
+		if results.Infected {
+			report.Detections++
+		}
+	}
+	elapsed := time.Since(started)
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	report.DurationMS = milliseconds(elapsed)
+	report.FilesPerSecond = float64(n) / elapsed.Seconds()
+	report.MBPerSecond = float64(int64(n)*size) / (1 << 20) / elapsed.Seconds()
+	report.LatencyMS.Min = milliseconds(latencies[0])
+	report.LatencyMS.P50 = milliseconds(percentile(latencies, 50))
+	report.LatencyMS.P90 = milliseconds(percentile(latencies, 90))
+	report.LatencyMS.P99 = milliseconds(percentile(latencies, 99))
+	report.LatencyMS.Max = milliseconds(latencies[len(latencies)-1])
+
+	benchJSON, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(benchJSON))
+
+	if report.Errors > 0 {
+		return cli.NewExitError(fmt.Sprintf("%d of %d scans failed", report.Errors, n), 1)
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// sourceCloud marks results answered by the hash reputation service instead of the local engine
+const sourceCloud = "cloud"
+
+// confidenceRank orders detection confidences
+var confidenceRank = map[string]int{
+	confidenceLow:    1,
+	confidenceMedium: 2,
+	confidenceHigh:   3,
+}
+
+// CloudVerdict json object, the answer of the hash reputation service
+type CloudVerdict struct {
+	Verdict    string `json:"verdict"`
+	Name       string `json:"name"`
+	Confidence string `json:"confidence"`
+	Updated    string `json:"updated"`
+}
+
+// cloudReputation looks samples up by hash before they are scanned, only
+// confident detections are trusted, anything else is scanned locally
+type cloudReputation struct {
+	url           string
+	key           string
+	minConfidence string
+	client        *http.Client
+}
+
+// cloud is nil unless --cloud-url is set outside of privacy mode
+var cloud *cloudReputation
+
+func newCloudReputation(url, key, minConfidence string, timeout time.Duration) (*cloudReputation, error) {
+	if _, ok := confidenceRank[minConfidence]; !ok {
+		return nil, fmt.Errorf("invalid --cloud-confidence %q (must be one of %s, %s or %s)", minConfidence, confidenceLow, confidenceMedium, confidenceHigh)
+	}
+	return &cloudReputation{
+		url:           url,
+		key:           key,
+		minConfidence: minConfidence,
+		client:        &http.Client{Timeout: timeout},
+	}, nil
+}
+
+// lookupURL puts sha into the url, in place of {sha256} or appended to it
+func (c *cloudReputation) lookupURL(sha string) string {
+	if strings.Contains(c.url, "{sha256}") {
+		return strings.Replace(c.url, "{sha256}", sha, -1)
+	}
+	return strings.TrimRight(c.url, "/") + "/" + sha
+}
+
+// fetch asks the reputation service about sha, unknown samples return nil
+func (c *cloudReputation) fetch(ctx context.Context, sha string) (*CloudVerdict, error) {
+	req, err := http.NewRequest("GET", c.lookupURL(sha), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if len(c.key) > 0 {
+		req.Header.Set("Authorization", "Bearer "+c.key)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to look up hash reputation")
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("hash reputation lookup returned %s", resp.Status)
+	}
+
+	verdict := &CloudVerdict{}
+	if err := json.NewDecoder(resp.Body).Decode(verdict); err != nil {
+		return nil, errors.Wrap(err, "failed to parse hash reputation")
+	}
+	return verdict, nil
+}
+
+// lookup returns the results of a confident detection of sha, ok is false
+// when the sample has to be scanned locally. Failed lookups are only logged.
+func (c *cloudReputation) lookup(ctx context.Context, sha string) (ResultsData, bool) {
+	if c == nil || len(sha) == 0 {
+		return ResultsData{}, false
+	}
+
+	verdict, err := c.fetch(ctx, sha)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"plugin":   name,
+			"category": category,
+			"sha256":   sha,
+		}).Warn(errors.Wrap(err, "scanning locally"))
+		return ResultsData{}, false
+	}
+	if verdict == nil || verdict.Verdict != statusInfected || len(verdict.Name) == 0 ||
+		confidenceRank[verdict.Confidence] < confidenceRank[c.minConfidence] {
+		return ResultsData{}, false
+	}
+
+	results := ResultsData{
+		Infected:   true,
+		Status:     statusInfected,
+		Result:     verdict.Name,
+		Confidence: verdict.Confidence,
+		Source:     sourceCloud,
+	}
+	if updated, ok := parseTimestamp(verdict.Updated); ok {
+		results.UpdatedAt = &updated
+	}
+	if legacyUpdated || results.UpdatedAt == nil {
+		// keep what the service said if it is not a date we know
+		results.Updated = verdict.Updated
+	}
+	results.Heuristic, _ = classifyDetection(verdict.Name)
+	if families := currentFamilies(); families != nil {
+		results.Family = families.normalize(verdict.Name)
+	}
+	if currentAttackMap() != nil {
+		results.Attack = attackTechniques(verdict.Name, results.Family)
+	}
+
+	log.WithFields(log.Fields{
+		"plugin":   name,
+		"category": category,
+		"sha256":   sha,
+	}).Debug("hash reputation hit: ", verdict.Name)
+	return results, true
+}
+
+// scanOrLookup answers from the hash reputation service when it is confident
+// and scans the file at path with the local engine otherwise
+func scanOrLookup(ctx context.Context, sha string, timeout int, profile *ScanProfile) DrWEB {
+	if results, ok := cloud.lookup(ctx, sha); ok {
+		return DrWEB{Results: results}
+	}
+	return AvScanProfile(ctx, timeout, profile)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+// completionValues lists the values flags with a fixed set of values accept,
+// keyed by command ("" for global flags) and flag name
+var completionValues = map[string]map[string][]string{
+	"": {
+		"elasticsearch-dedup": {dedupOverwrite, dedupVersion, dedupSkip},
+		"log-level":           logLevels,
+		"log-format":          logFormats,
+	},
+	"mailbox": {
+		"action": mailboxActions,
+	},
+	"export": {
+		"format": {exportCSV, exportParquet},
+	},
+}
+
+// completionArgs lists the values the arguments of a command can take
+var completionArgs = map[string][]string{
+	"completion": {"bash", "zsh", "fish"},
+	"config":     {"show", "set"},
+}
+
+// completionFlag is a flag as seen by the shell
+type completionFlag struct {
+	long   []string
+	short  []string
+	usage  string
+	value  bool
+	values []string
+}
+
+func completionFlags(command string, flags []cli.Flag) []completionFlag {
+	var cflags []completionFlag
+	for _, flag := range flags {
+		cf := completionFlag{value: true}
+		switch f := flag.(type) {
+		case cli.BoolFlag:
+			cf.value, cf.usage = false, f.Usage
+		case cli.BoolTFlag:
+			cf.value, cf.usage = false, f.Usage
+		case cli.StringFlag:
+			cf.usage = f.Usage
+		case cli.StringSliceFlag:
+			cf.usage = f.Usage
+		case cli.IntFlag:
+			cf.usage = f.Usage
+		case cli.Int64Flag:
+			cf.usage = f.Usage
+		case cli.Float64Flag:
+			cf.usage = f.Usage
+		case cli.DurationFlag:
+			cf.usage = f.Usage
+		}
+		for _, n := range strings.Split(flag.GetName(), ",") {
+			n = strings.TrimSpace(n)
+			if len(n) == 1 {
+				cf.short = append(cf.short, n)
+			} else if len(n) > 1 {
+				cf.long = append(cf.long, n)
+			}
+		}
+		if len(cf.long) > 0 {
+			cf.values = completionValues[command][cf.long[0]]
+		}
+		cflags = append(cflags, cf)
+	}
+	return cflags
+}
+
+func (f completionFlag) options() []string {
+	var opts []string
+	for _, n := range f.long {
+		opts = append(opts, "--"+n)
+	}
+	for _, n := range f.short {
+		opts = append(opts, "-"+n)
+	}
+	return opts
+}
+
+func visibleCommands(app *cli.App) []cli.Command {
+	var commands []cli.Command
+	for _, command := range app.Commands {
+		if !command.Hidden {
+			commands = append(commands, command)
+		}
+	}
+	return commands
+}
+
+func bashCompletion(app *cli.App) string {
+	var names, flagCases, valueCases, argCases []string
+	addFlags := func(command string, flags []cli.Flag) {
+		var opts []string
+		for _, f := range completionFlags(command, flags) {
+			opts = append(opts, f.options()...)
+			if len(f.values) > 0 {
+				var patterns []string
+				for _, opt := range f.options() {
+					patterns = append(patterns, command+"/"+opt)
+				}
+				valueCases = append(valueCases, fmt.Sprintf("\t\t%s)\n\t\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n\t\t\treturn\n\t\t\t;;",
+					strings.Join(patterns, "|"), strings.Join(f.values, " ")))
+			}
+		}
+		flagCases = append(flagCases, fmt.Sprintf("\t\t%q)\n\t\t\topts=%q\n\t\t\t;;", command, strings.Join(opts, " ")))
+	}
+
+	addFlags("", app.Flags)
+	for _, command := range visibleCommands(app) {
+		names = append(names, command.Names()...)
+		addFlags(command.Name, command.Flags)
+		if args, ok := completionArgs[command.Name]; ok {
+			argCases = append(argCases, fmt.Sprintf("\t%s)\n\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n\t\treturn\n\t\t;;",
+				strings.Join(command.Names(), "|"), strings.Join(args, " ")))
+		}
+	}
+	sort.Strings(names)
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# bash completion for %s\n", app.Name)
+	fmt.Fprintf(&b, "_%s() {\n", app.Name)
+	fmt.Fprintf(&b, "\tlocal cur prev cmd opts word\n")
+	fmt.Fprintf(&b, "\tcur=\"${COMP_WORDS[COMP_CWORD]}\"\n")
+	fmt.Fprintf(&b, "\tprev=\"${COMP_WORDS[COMP_CWORD-1]}\"\n")
+	fmt.Fprintf(&b, "\tcmd=\"\"\n")
+	fmt.Fprintf(&b, "\tfor word in \"${COMP_WORDS[@]:1:COMP_CWORD-1}\"; do\n")
+	fmt.Fprintf(&b, "\t\tcase \"$word\" in\n\t\t%s)\n\t\t\tcmd=\"$word\"\n\t\t\tbreak\n\t\t\t;;\n\t\tesac\n", strings.Join(names, "|"))
+	fmt.Fprintf(&b, "\tdone\n\n")
+	fmt.Fprintf(&b, "\tcase \"$cmd/$prev\" in\n%s\n\tesac\n\n", strings.Join(valueCases, "\n"))
+	fmt.Fprintf(&b, "\tif [[ \"$cur\" == -* ]]; then\n")
+	fmt.Fprintf(&b, "\t\tcase \"$cmd\" in\n%s\n\t\tesac\n", strings.Join(flagCases, "\n"))
+	fmt.Fprintf(&b, "\t\tCOMPREPLY=($(compgen -W \"$opts\" -- \"$cur\"))\n\t\treturn\n\tfi\n\n")
+	fmt.Fprintf(&b, "\tcase \"$cmd\" in\n%s\n\tesac\n\n", strings.Join(argCases, "\n"))
+	fmt.Fprintf(&b, "\tif [[ -z \"$cmd\" ]]; then\n\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n\tfi\n", strings.Join(names, " "))
+	fmt.Fprintf(&b, "\tCOMPREPLY+=($(compgen -f -- \"$cur\"))\n")
+	fmt.Fprintf(&b, "}\n\n")
+	fmt.Fprintf(&b, "complete -o filenames -F _%s %s\n", app.Name, app.Name)
+
+	return b.String()
+}
+
+func zshCompletion(app *cli.App) string {
+	return fmt.Sprintf("# zsh completion for %s\nautoload -U +X bashcompinit && bashcompinit\n\n%s", app.Name, bashCompletion(app))
+}
+
+func fishQuote(s string) string {
+	return "'" + strings.Replace(strings.Replace(s, `\`, `\\`, -1), "'", `\'`, -1) + "'"
+}
+
+func fishCompletion(app *cli.App) string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# fish completion for %s\n", app.Name)
+
+	addFlags := func(condition, command string, flags []cli.Flag) {
+		for _, f := range completionFlags(command, flags) {
+			fmt.Fprintf(&b, "complete -c %s -n %s", app.Name, fishQuote(condition))
+			for _, n := range f.long {
+				fmt.Fprintf(&b, " -l %s", n)
+			}
+			for _, n := range f.short {
+				fmt.Fprintf(&b, " -s %s", n)
+			}
+			if len(f.values) > 0 {
+				fmt.Fprintf(&b, " -x -a %s", fishQuote(strings.Join(f.values, " ")))
+			} else if f.value {
+				fmt.Fprintf(&b, " -r")
+			}
+			fmt.Fprintf(&b, " -d %s\n", fishQuote(f.usage))
+		}
+	}
+
+	addFlags("__fish_use_subcommand", "", app.Flags)
+	for _, command := range visibleCommands(app) {
+		for _, n := range command.Names() {
+			fmt.Fprintf(&b, "complete -c %s -n '__fish_use_subcommand' -a %s -d %s\n", app.Name, n, fishQuote(command.Usage))
+		}
+		condition := "__fish_seen_subcommand_from " + strings.Join(command.Names(), " ")
+		addFlags(condition, command.Name, command.Flags)
+		if args, ok := completionArgs[command.Name]; ok {
+			fmt.Fprintf(&b, "complete -c %s -n %s -x -a %s\n", app.Name, fishQuote(condition), fishQuote(strings.Join(args, " ")))
+		}
+	}
+
+	return b.String()
+}
+
+func completion(c *cli.Context) error {
+	switch shell := c.Args().First(); shell {
+	case "bash":
+		fmt.Print(bashCompletion(c.App))
+	case "zsh":
+		fmt.Print(zshCompletion(c.App))
+	case "fish":
+		fmt.Print(fishCompletion(c.App))
+	default:
+		return fmt.Errorf("unsupported shell %q (must be one of bash, zsh or fish)", shell)
+	}
+	return nil
+}
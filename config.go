@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// engineOption is a Section.Parameter=Value engine setting applied with drweb-ctl cfset
+type engineOption struct {
+	key   string
+	value string
+}
+
+// engineOptions are applied the first time the engine is started
+var (
+	engineOptions     []engineOption
+	engineOptionsOnce sync.Once
+	engineOptionsErr  error
+)
+
+func parseEngineOptions(options []string) ([]engineOption, error) {
+	var parsed []engineOption
+	for _, option := range options {
+		parts := strings.SplitN(option, "=", 2)
+		key := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || !strings.Contains(key, ".") || strings.HasPrefix(key, ".") || strings.HasSuffix(key, ".") {
+			return nil, fmt.Errorf("invalid engine option %q (must be formatted as Section.Parameter=Value)", option)
+		}
+		parsed = append(parsed, engineOption{key: key, value: strings.TrimSpace(parts[1])})
+	}
+	return parsed, nil
+}
+
+// applyEngineOptions changes the engine configuration, drweb-configd must be running
+func applyEngineOptions(ctx context.Context, options []engineOption) error {
+	for _, option := range options {
+		if _, err := runCtl(ctx, "cfset", option.key, option.value); err != nil {
+			return errors.Wrapf(err, "failed to set engine option %s", option.key)
+		}
+	}
+	return nil
+}
+
+// parseCfshow turns the Section.Parameter = Value lines of drweb-ctl cfshow
+// into a map of sections, repeated parameters are joined with a comma
+func parseCfshow(output string) map[string]map[string]string {
+	config := make(map[string]map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		path := strings.SplitN(strings.TrimSpace(parts[0]), ".", 2)
+		if len(parts) != 2 || len(path) != 2 {
+			continue
+		}
+		section, parameter, value := path[0], path[1], strings.TrimSpace(parts[1])
+		if _, ok := config[section]; !ok {
+			config[section] = make(map[string]string)
+		}
+		if previous, ok := config[section][parameter]; ok {
+			value = previous + ", " + value
+		}
+		config[section][parameter] = value
+	}
+	return config
+}
+
+func engineConfig(ctx context.Context, section string) (map[string]map[string]string, error) {
+	if err := startConfigd(ctx); err != nil {
+		return nil, errors.Wrap(err, "failed to start drweb-configd")
+	}
+	args := []string{"cfshow"}
+	if len(section) > 0 {
+		args = append(args, section)
+	}
+	output, err := runCtl(ctx, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to show engine configuration")
+	}
+	return parseCfshow(output), nil
+}
+
+func showConfig(c *cli.Context) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.GlobalInt("timeout"))*time.Second)
+	defer cancel()
+
+	config, err := engineConfig(ctx, c.Args().First())
+	if err != nil {
+		return err
+	}
+	configJSON, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(configJSON))
+	return nil
+}
+
+func setConfig(c *cli.Context) error {
+	if !c.Args().Present() {
+		return fmt.Errorf("please supply the engine options to set (Section.Parameter=Value)")
+	}
+	options, err := parseEngineOptions(c.Args())
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.GlobalInt("timeout"))*time.Second)
+	defer cancel()
+
+	if err := startConfigd(ctx); err != nil {
+		return errors.Wrap(err, "failed to start drweb-configd")
+	}
+	return applyEngineOptions(ctx, options)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Registration json object, announces this instance to a Malice coordinator
+// on startup and with every heartbeat
+type Registration struct {
+	ID                string            `json:"id"`
+	Name              string            `json:"name"`
+	Category          string            `json:"category"`
+	Version           string            `json:"version"`
+	URL               string            `json:"url"`
+	Endpoints         map[string]string `json:"endpoints"`
+	Capabilities      []string          `json:"capabilities"`
+	Profiles          []string          `json:"profiles,omitempty"`
+	Engine            string            `json:"engine,omitempty"`
+	Database          string            `json:"database,omitempty"`
+	DBTimestamp       *time.Time        `json:"db_timestamp,omitempty"`
+	Role              string            `json:"role"`
+	Healthy           bool              `json:"healthy"`
+	Queued            int               `json:"queued"`
+	StartedAt         time.Time         `json:"started_at"`
+	HeartbeatInterval int               `json:"heartbeat_interval"` // seconds
+}
+
+// coordinatorClient registers this instance with a Malice coordinator and
+// keeps sending it heartbeats, so it can find the plugins of its scan fleet
+type coordinatorClient struct {
+	url          string
+	token        string
+	advertise    string
+	interval     time.Duration
+	capabilities []string
+	id           string
+	started      time.Time
+	client       *http.Client
+}
+
+// newCoordinatorClient returns a client for the coordinator at url, this
+// instance is announced as advertise, or as listening on addr of this host
+func newCoordinatorClient(url, token, advertise string, addr net.Addr, tls bool, interval time.Duration, capabilities []string) (*coordinatorClient, error) {
+	if !httpURL(url) {
+		return nil, fmt.Errorf("invalid --coordinator %q (must be an http(s) url)", url)
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("--heartbeat-interval must be positive")
+	}
+	hostname, _ := os.Hostname()
+	if len(advertise) == 0 {
+		scheme := "http"
+		if tls {
+			scheme = "https"
+		}
+		port := "3993"
+		if tcp, ok := addr.(*net.TCPAddr); ok {
+			port = strconv.Itoa(tcp.Port)
+		}
+		advertise = scheme + "://" + net.JoinHostPort(hostname, port)
+	}
+	if !httpURL(advertise) {
+		return nil, fmt.Errorf("invalid --advertise-url %q (must be an http(s) url)", advertise)
+	}
+	return &coordinatorClient{
+		url:          strings.TrimRight(url, "/"),
+		token:        token,
+		advertise:    strings.TrimRight(advertise, "/"),
+		interval:     interval,
+		capabilities: capabilities,
+		id:           fmt.Sprintf("%s-%s-%d", name, hostname, os.Getpid()),
+		started:      time.Now().UTC(),
+		client:       &http.Client{Timeout: interval},
+	}, nil
+}
+
+// registration describes this instance as it is now
+func (c *coordinatorClient) registration(ctx context.Context) Registration {
+	reg := Registration{
+		ID:       c.id,
+		Name:     name,
+		Category: category,
+		Version:  Version,
+		URL:      c.advertise,
+		Endpoints: map[string]string{
+			"scan":        c.advertise + "/scan",
+			"malice_scan": c.advertise + "/malice/scan",
+			"healthz":     c.advertise + "/healthz",
+			"openapi":     c.advertise + "/openapi.json",
+		},
+		Capabilities:      availableCapabilities(c.capabilities),
+		Profiles:          profileNames(),
+		Role:              pair.role(),
+		Healthy:           breaker.healthy() && engineState.available() && !drain.draining(),
+		Queued:            jobs.status("").Queued,
+		StartedAt:         c.started,
+		HeartbeatInterval: int(c.interval.Seconds()),
+	}
+	if store != nil {
+		reg.Endpoints["results"] = c.advertise + "/results"
+	}
+	if base, err := baseInfo.get(ctx); err == nil {
+		reg.Engine, reg.Database, reg.DBTimestamp = base.Engine, base.Database, base.DBTimestamp
+	}
+	return reg
+}
+
+// send POSTs the registration to path of the coordinator and returns its status code
+func (c *coordinatorClient) send(path string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.interval)
+	defer cancel()
+	body, err := json.Marshal(c.registration(ctx))
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest("POST", c.url+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(c.token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return resp.StatusCode, fmt.Errorf("%s %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return resp.StatusCode, nil
+}
+
+// run registers this instance and sends heartbeats every interval. It
+// registers again whenever the coordinator does not know it (anymore), e.g.
+// because it was not reachable at startup or restarted since.
+func (c *coordinatorClient) run() {
+	registered := false
+	for {
+		var status int
+		var err error
+		if registered {
+			status, err = c.send("/plugins/" + c.id + "/heartbeat")
+			if status == http.StatusNotFound {
+				registered = false
+			}
+		} else {
+			if status, err = c.send("/plugins"); err == nil {
+				registered = true
+				log.WithFields(log.Fields{
+					"plugin":      name,
+					"category":    category,
+					"coordinator": c.url,
+					"id":          c.id,
+					"url":         c.advertise,
+				}).Info("registered with the coordinator")
+			}
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"plugin":      name,
+				"category":    category,
+				"coordinator": c.url,
+			}).Warn(errors.Wrap(err, "coordinator heartbeat failed"))
+		}
+		time.Sleep(c.interval)
+	}
+}
+
+// webCapabilities lists what this instance can do for the coordinator
+func webCapabilities(explode, tls bool) []string {
+	capabilities := []string{"scan", "async", "malice-scan", "admission"}
+	if store != nil {
+		capabilities = append(capabilities, "results")
+	}
+	if explode {
+		capabilities = append(capabilities, "explode")
+	}
+	if signer != nil {
+		capabilities = append(capabilities, "signing")
+	}
+	if tls {
+		capabilities = append(capabilities, "tls")
+	}
+	return capabilities
+}
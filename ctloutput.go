@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// --engine-output formats
+const (
+	engineOutputText = "text"
+	engineOutputJSON = "json"
+)
+
+// engineLocale is the locale engine commands run in, so their output is in
+// English whatever the locale of the image is, empty keeps the environment
+var engineLocale = "C.UTF-8"
+
+// engineOutput is the format drweb-ctl scan reports verdicts in
+var engineOutput = engineOutputText
+
+// reportArgs returns the drweb-ctl scan options selecting the output format
+func reportArgs() []string {
+	if engineOutput == engineOutputJSON {
+		return []string{"--Report", "JSON"}
+	}
+	return nil
+}
+
+// jsonReport is a file in the JSON report of drweb-ctl scan --Report JSON
+type jsonReport struct {
+	Path    string `json:"path"`
+	Threats []struct {
+		Name string `json:"name"`
+		Type string `json:"type"`
+	} `json:"threats"`
+	Error   string `json:"error"`
+	Skipped string `json:"skipped"`
+}
+
+// parseJSONVerdict returns the scan status and result of the JSON report of
+// a single file, which names threats the same way in every locale
+func parseJSONVerdict(output string) (string, string) {
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		var report jsonReport
+		if err := json.Unmarshal([]byte(line), &report); err != nil {
+			return statusError, fmt.Sprintf("unrecognized engine output: %s", line)
+		}
+		switch {
+		case len(report.Threats) > 0:
+			return statusInfected, report.Threats[0].Name
+		case len(report.Error) > 0:
+			return statusError, report.Error
+		case len(report.Skipped) > 0:
+			return statusSkipped, report.Skipped
+		}
+		return statusClean, ""
+	}
+	return statusError, "empty engine output"
+}
+
+// localized reports whether a verdict was not printed in English, detection
+// names are always ASCII
+func localized(verdict string) bool {
+	for _, r := range verdict {
+		if r > unicode.MaxASCII {
+			return true
+		}
+	}
+	return false
+}
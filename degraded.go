@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// engine availabilities of /readyz
+const (
+	engineStarting    = "starting"
+	engineAvailable   = "available"
+	engineUnavailable = "unavailable"
+)
+
+// engineDependent are the capabilities a degraded instance does not have
+var engineDependent = map[string]bool{
+	"scan":        true,
+	"async":       true,
+	"malice-scan": true,
+	"admission":   true,
+	"explode":     true,
+	"update":      true,
+}
+
+// engineAvailability tracks whether the engine can scan at all. Without the
+// Dr.Web binaries or a license the web service runs degraded instead of
+// exiting: it keeps serving health, metrics and results, refuses scans with
+// the engine_unavailable status and checks again every interval.
+type engineAvailability struct {
+	sync.Mutex
+	state  string
+	reason string // why the engine is unavailable
+	since  time.Time
+}
+
+var engineState = &engineAvailability{state: engineStarting}
+
+// engineInstalled checks the engine binaries are where they are expected
+func engineInstalled() error {
+	binaries := []string{drwebCtl}
+	if ctlEngine {
+		binaries = append(binaries, drwebConfigd)
+	}
+	for _, binary := range binaries {
+		if _, err := os.Stat(binary); err != nil {
+			return errors.Wrap(err, "Dr.Web is not installed")
+		}
+	}
+	return nil
+}
+
+// set records the outcome of preparing the engine, nil if it worked
+func (e *engineAvailability) set(err error) {
+	e.Lock()
+	defer e.Unlock()
+
+	state, reason := engineAvailable, ""
+	if err != nil {
+		state, reason = engineUnavailable, err.Error()
+	}
+	if state == e.state && reason == e.reason {
+		return
+	}
+	e.state, e.reason, e.since = state, reason, time.Now().UTC()
+
+	entry := log.WithFields(log.Fields{
+		"plugin":   name,
+		"category": category,
+	})
+	if err != nil {
+		entry.Error(errors.Wrap(err, "scan engine is unavailable, running degraded"))
+	} else {
+		entry.Info("scan engine is available")
+	}
+}
+
+// unavailable returns why scans are refused, empty if they are not
+func (e *engineAvailability) unavailable() string {
+	e.Lock()
+	defer e.Unlock()
+	if e.state != engineUnavailable {
+		return ""
+	}
+	return e.reason
+}
+
+// available reports whether the engine was found to work, false while the first check runs
+func (e *engineAvailability) available() bool {
+	e.Lock()
+	defer e.Unlock()
+	return e.state == engineAvailable
+}
+
+// probe checks the engine is installed and can be prepared for a scan
+func (e *engineAvailability) probe(ctx context.Context) {
+	err := engineInstalled()
+	if err == nil {
+		err = session.prepare(ctx)
+	}
+	e.set(err)
+}
+
+// watch probes the engine right away and then every interval while it is unavailable
+func (e *engineAvailability) watch(interval time.Duration) {
+	go func() {
+		for {
+			if !e.available() {
+				ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+				e.probe(ctx)
+				cancel()
+			}
+			if interval <= 0 {
+				return
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// engineUnavailableResults are the results of a scan refused for reason
+func engineUnavailableResults(reason string) ResultsData {
+	return ResultsData{Status: statusEngineUnavailable, Error: reason}
+}
+
+// refuseUnavailable answers a scan with 503 and the engine_unavailable
+// status if the engine is unavailable
+func refuseUnavailable(w http.ResponseWriter) bool {
+	reason := engineState.unavailable()
+	if len(reason) == 0 {
+		return false
+	}
+	w.Header().Set("Retry-After", "60")
+	writeJSON(w, http.StatusServiceUnavailable, DrWEB{Results: engineUnavailableResults(reason)})
+	return true
+}
+
+// availableCapabilities leaves out the capabilities that need the engine while it is unavailable
+func availableCapabilities(capabilities []string) []string {
+	if engineState.available() {
+		return capabilities
+	}
+	var available []string
+	for _, capability := range capabilities {
+		if !engineDependent[capability] {
+			available = append(available, capability)
+		}
+	}
+	return available
+}
+
+// Readiness json object
+type Readiness struct {
+	Ready        bool            `json:"ready"`
+	Role         string          `json:"role"`
+	Engine       string          `json:"engine"`
+	Reason       string          `json:"reason,omitempty"`
+	Draining     bool            `json:"draining,omitempty"`
+	Since        *time.Time      `json:"since,omitempty"`
+	Capabilities map[string]bool `json:"capabilities"`
+}
+
+// webReady returns a handler reporting whether this instance takes scans
+// and what it can do, capabilities are those of a working engine
+func webReady(capabilities []string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		engineState.Lock()
+		readiness := Readiness{Role: pair.role(), Engine: engineState.state, Reason: engineState.reason}
+		if !engineState.since.IsZero() {
+			since := engineState.since
+			readiness.Since = &since
+		}
+		engineState.Unlock()
+
+		readiness.Capabilities = map[string]bool{"health": true, "metrics": true, "update": ctlEngine}
+		for _, capability := range capabilities {
+			readiness.Capabilities[capability] = true
+		}
+		if readiness.Engine != engineAvailable {
+			for capability := range readiness.Capabilities {
+				if engineDependent[capability] {
+					readiness.Capabilities[capability] = false
+				}
+			}
+		}
+		readiness.Draining = drain.draining()
+		readiness.Ready = readiness.Role == roleActive && readiness.Engine == engineAvailable && breaker.healthy() && !readiness.Draining
+
+		status := http.StatusOK
+		if !readiness.Ready {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, readiness)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// diffFields are the fields of results compared between two scans, the
+// rest (e.g. the submitter or markdown) differs from scan to scan anyway
+var diffFields = []string{
+	"infected", "status", "result", "heuristic", "confidence", "family", "attack",
+	"engine", "database", "db_timestamp", "error", "profile",
+}
+
+// verdict flips between two scans
+const (
+	flipDetected = "detected"
+	flipCleared  = "cleared"
+)
+
+// FieldChange json object, a field of the results that differs between two scans
+type FieldChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+}
+
+// ScanRef json object, identifies one of the scans of a diff
+type ScanRef struct {
+	ScannedAt *time.Time `json:"scanned_at,omitempty"`
+	Engine    string     `json:"engine,omitempty"`
+	Database  string     `json:"database,omitempty"`
+}
+
+// ResultDiff json object, what changed between two scans of a sample
+type ResultDiff struct {
+	SHA256  string        `json:"sha256,omitempty"`
+	From    ScanRef       `json:"from"`
+	To      ScanRef       `json:"to"`
+	Flip    string        `json:"flip,omitempty"`
+	Changes []FieldChange `json:"changes"`
+}
+
+// HistoryEntry json object, a stored scan of a sample and what changed
+// since the scan before it
+type HistoryEntry struct {
+	ScannedAt time.Time     `json:"scanned_at"`
+	Infected  bool          `json:"infected"`
+	Status    string        `json:"status,omitempty"`
+	Result    string        `json:"result"`
+	Engine    string        `json:"engine"`
+	Database  string        `json:"database"`
+	Flip      string        `json:"flip,omitempty"`
+	Changes   []FieldChange `json:"changes,omitempty"`
+}
+
+// SampleHistory json object, every stored scan of a sample, oldest first
+type SampleHistory struct {
+	SHA256        string         `json:"sha256"`
+	FirstSeen     time.Time      `json:"first_seen"`
+	FirstDetected *time.Time     `json:"first_detected,omitempty"`
+	DetectedBy    string         `json:"detected_by,omitempty"` // the database of the first detection
+	Scans         []HistoryEntry `json:"scans"`
+}
+
+func scanRef(stored StoredResult) ScanRef {
+	ref := ScanRef{Engine: stored.Results.Engine, Database: stored.Results.Database}
+	if !stored.ScannedAt.IsZero() {
+		scannedAt := stored.ScannedAt
+		ref.ScannedAt = &scannedAt
+	} else if stored.Results.ScannedAt != nil {
+		ref.ScannedAt = stored.Results.ScannedAt
+	}
+	return ref
+}
+
+// resultFields returns the results as a map of their json fields
+func resultFields(results ResultsData) map[string]interface{} {
+	fields := make(map[string]interface{})
+	data, err := json.Marshal(results)
+	if err == nil {
+		json.Unmarshal(data, &fields)
+	}
+	return fields
+}
+
+// diffResults compares the diffFields of two results
+func diffResults(from, to ResultsData) (string, []FieldChange) {
+	var flip string
+	switch {
+	case !from.Infected && to.Infected:
+		flip = flipDetected
+	case from.Infected && !to.Infected:
+		flip = flipCleared
+	}
+
+	fromFields, toFields := resultFields(from), resultFields(to)
+	changes := []FieldChange{}
+	for _, field := range diffFields {
+		if !reflect.DeepEqual(fromFields[field], toFields[field]) {
+			changes = append(changes, FieldChange{Field: field, From: fromFields[field], To: toFields[field]})
+		}
+	}
+	return flip, changes
+}
+
+func newResultDiff(sha string, from, to StoredResult) ResultDiff {
+	diff := ResultDiff{SHA256: sha, From: scanRef(from), To: scanRef(to)}
+	diff.Flip, diff.Changes = diffResults(from.Results, to.Results)
+	return diff
+}
+
+// sampleHistory sums up the stored results of a sample, only the scans that
+// changed something if changesOnly is set
+func sampleHistory(sha string, history []StoredResult, changesOnly bool) SampleHistory {
+	sample := SampleHistory{SHA256: sha, Scans: []HistoryEntry{}}
+	for i, stored := range history {
+		entry := HistoryEntry{
+			ScannedAt: stored.ScannedAt,
+			Infected:  stored.Results.Infected,
+			Status:    stored.Results.Status,
+			Result:    stored.Results.Result,
+			Engine:    stored.Results.Engine,
+			Database:  stored.Results.Database,
+		}
+		if i == 0 {
+			sample.FirstSeen = stored.ScannedAt
+		} else {
+			entry.Flip, entry.Changes = diffResults(history[i-1].Results, stored.Results)
+		}
+		if stored.Results.Infected && sample.FirstDetected == nil {
+			scannedAt := stored.ScannedAt
+			sample.FirstDetected = &scannedAt
+			sample.DetectedBy = stored.Results.Database
+		}
+		if changesOnly && i > 0 && len(entry.Changes) == 0 {
+			continue
+		}
+		sample.Scans = append(sample.Scans, entry)
+	}
+	return sample
+}
+
+// webResultHistory returns every stored scan of a sample and what changed
+// from one to the next, only the scans that changed something with ?changes=true
+func webResultHistory(w http.ResponseWriter, r *http.Request) {
+	if store == nil {
+		http.Error(w, "results store is not enabled (see --store)", http.StatusNotFound)
+		return
+	}
+
+	sha := mux.Vars(r)["sha256"]
+	if !validSHA256(sha) {
+		http.Error(w, "invalid sha256", http.StatusBadRequest)
+		return
+	}
+	changesOnly, _ := strconv.ParseBool(r.URL.Query().Get("changes"))
+
+	history, err := store.tenant(requestTenant(r)).history(sha)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(history) == 0 {
+		http.Error(w, "no results found for "+sha, http.StatusNotFound)
+		return
+	}
+	writeTaggedJSON(w, r, sampleHistory(sha, history, changesOnly))
+}
+
+// readResultFile reads the output of a scan or a stored result
+func readResultFile(file string) (StoredResult, error) {
+	var stored StoredResult
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return stored, err
+	}
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return stored, errors.Wrapf(err, "failed to parse results %s", file)
+	}
+	return stored, nil
+}
+
+// pickScan returns the first scan at or after the time value, or with until
+// the last scan up to it, of a history oldest first
+func pickScan(history []StoredResult, value string, until bool) (StoredResult, error) {
+	at, err := parseExportTime(value, until)
+	if err != nil {
+		return StoredResult{}, err
+	}
+	if until {
+		for i := len(history) - 1; i >= 0; i-- {
+			if !history[i].ScannedAt.After(at) {
+				return history[i], nil
+			}
+		}
+		return StoredResult{}, fmt.Errorf("no stored scan up to %s", value)
+	}
+	for _, stored := range history {
+		if !stored.ScannedAt.Before(at) {
+			return stored, nil
+		}
+	}
+	return StoredResult{}, fmt.Errorf("no stored scan at or after %s", value)
+}
+
+// diffCommand prints what changed between two scans of a sample: the oldest
+// and latest stored results of a sha256 (or the ones picked with --from and
+// --to), or two result files
+func diffCommand(c *cli.Context) error {
+	var from, to StoredResult
+	var sha string
+	switch c.NArg() {
+	case 1:
+		sha = c.Args().First()
+		if store == nil {
+			return fmt.Errorf("diff of a sha256 requires --store")
+		}
+		if !validSHA256(sha) {
+			return fmt.Errorf("invalid sha256 %q", sha)
+		}
+		history, err := store.history(sha)
+		if err != nil {
+			return errors.Wrap(err, "failed to read stored results")
+		}
+		if len(history) == 0 {
+			return fmt.Errorf("no results found for %s", sha)
+		}
+		if c.Bool("history") {
+			data, err := json.Marshal(sampleHistory(sha, history, c.Bool("changes")))
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(data))
+			return nil
+		}
+
+		from, to = history[0], history[len(history)-1]
+		if len(c.String("from")) > 0 {
+			if from, err = pickScan(history, c.String("from"), false); err != nil {
+				return err
+			}
+		}
+		if len(c.String("to")) > 0 {
+			if to, err = pickScan(history, c.String("to"), true); err != nil {
+				return err
+			}
+		}
+	case 2:
+		var err error
+		if from, err = readResultFile(c.Args().Get(0)); err != nil {
+			return err
+		}
+		if to, err = readResultFile(c.Args().Get(1)); err != nil {
+			return err
+		}
+		sha = from.SHA256
+	default:
+		return fmt.Errorf("diff needs a sha256 of the store or two result files")
+	}
+
+	data, err := json.Marshal(newResultDiff(sha, from, to))
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// exclusions decide which paths of a directory scan are skipped. Globs
+// without a slash match the name of a file or directory anywhere in the tree,
+// other globs the path relative to the scanned directory (or the absolute
+// path if they start with a slash), and "re:" patterns are regular
+// expressions matched against the relative path.
+type exclusions struct {
+	globs   []string
+	regexes []*regexp.Regexp
+	paths   []string // absolute paths excluded as they are, not patterns
+}
+
+func parseExclusions(patterns []string) (*exclusions, error) {
+	e := &exclusions{}
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		if len(pattern) == 0 {
+			continue
+		}
+		if strings.HasPrefix(pattern, "re:") {
+			re, err := regexp.Compile(strings.TrimPrefix(pattern, "re:"))
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid exclusion %q", pattern)
+			}
+			e.regexes = append(e.regexes, re)
+			continue
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, errors.Wrapf(err, "invalid exclusion %q", pattern)
+		}
+		e.globs = append(e.globs, pattern)
+	}
+	return e, nil
+}
+
+// readExclusions reads one pattern per line, blank lines and lines starting with # are ignored
+func readExclusions(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read exclusion file")
+	}
+	defer f.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) > 0 && !strings.HasPrefix(line, "#") {
+			patterns = append(patterns, line)
+		}
+	}
+	return patterns, scanner.Err()
+}
+
+// excluded reports whether the file at abs, rel inside the scanned directory, is excluded
+func (e *exclusions) excluded(abs, rel string) bool {
+	for _, excluded := range e.paths {
+		if abs == excluded {
+			return true
+		}
+	}
+	rel = filepath.ToSlash(rel)
+	for _, glob := range e.globs {
+		var target string
+		switch {
+		case strings.HasPrefix(glob, "/"):
+			target = abs
+		case strings.Contains(glob, "/"):
+			target = rel
+		default:
+			target = filepath.Base(abs)
+		}
+		if matched, _ := filepath.Match(glob, target); matched {
+			return true
+		}
+	}
+	for _, re := range e.regexes {
+		if re.MatchString(rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// reasons a file or directory of a directory scan has no result
+const (
+	reasonPermissionDenied = "permission_denied"
+	reasonPathTooLong      = "path_too_long"
+	reasonNotFound         = "not_found"
+	reasonUnreadable       = "unreadable"
+	reasonScanSkipped      = "scan_skipped"
+	reasonScanFailed       = "scan_failed"
+)
+
+// DirError json object, a file or directory without a result
+type DirError struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+	Error  string `json:"error"`
+}
+
+// describeError returns the reason and message of a failure to read a path
+func describeError(err error) (string, string) {
+	cause := err
+	switch e := err.(type) {
+	case *os.PathError:
+		cause = e.Err
+	case *os.SyscallError:
+		cause = e.Err
+	}
+	switch {
+	case os.IsPermission(err):
+		return reasonPermissionDenied, cause.Error()
+	case os.IsNotExist(err):
+		return reasonNotFound, cause.Error()
+	case cause == syscall.ENAMETOOLONG:
+		return reasonPathTooLong, cause.Error()
+	}
+	return reasonUnreadable, cause.Error()
+}
+
+type dirEntry struct {
+	Path    string      `json:"path"`
+	Size    int64       `json:"size"`
+	SHA256  string      `json:"sha256,omitempty"`
+	Results ResultsData `json:"drweb"`
+}
+
+// DirReport json object
+type DirReport struct {
+	Dir     string      `json:"dir"`
+	Host    *HostFacts  `json:"host,omitempty"`
+	Summary ScanSummary `json:"summary"`
+	Entries []dirEntry  `json:"entries"`
+	Errors  []DirError  `json:"errors"`
+}
+
+// add records the results of a scanned file, files the engine skipped or
+// failed to scan go to the errors
+func (r *DirReport) add(entry dirEntry, infectedOnly bool) {
+	r.Summary.add(entry.Results)
+	switch {
+	case entry.Results.Status == statusSkipped:
+		r.Errors = append(r.Errors, DirError{Path: entry.Path, Reason: reasonScanSkipped, Error: entry.Results.Result})
+	case len(entry.Results.Error) > 0:
+		r.Errors = append(r.Errors, DirError{Path: entry.Path, Reason: reasonScanFailed, Error: entry.Results.Error})
+	case !infectedOnly || entry.Results.Infected:
+		r.Entries = append(r.Entries, entry)
+	}
+}
+
+// fileID identifies a file across hard and symbolic links
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// dirScan walks a directory tree. Symbolic links are skipped unless
+// followSymlinks is set, in which case every directory is entered at most
+// once so link loops end. Devices, sockets and named pipes are never scanned
+// and with oneFilesystem neither is anything on another filesystem, e.g. a
+// /proc or network mount below the scanned directory.
+type dirScan struct {
+	root           string
+	exclude        *exclusions
+	followSymlinks bool
+	oneFilesystem  bool
+	infectedOnly   bool
+	timeout        int
+	plan           *DryRun
+
+	device  uint64
+	visited map[fileID]bool
+	report  *DirReport
+}
+
+func (d *dirScan) skip(rel, reason string) {
+	d.report.Summary.skip()
+	log.WithFields(log.Fields{
+		"plugin":   name,
+		"category": category,
+		"reason":   reason,
+	}).Debug("skipping: ", rel)
+}
+
+// failed records a file or directory that could not be read, the rest of the
+// scan goes on
+func (d *dirScan) failed(rel string, err error) {
+	reason, message := describeError(err)
+	d.report.Summary.unreadable()
+	d.report.Errors = append(d.report.Errors, DirError{Path: rel, Reason: reason, Error: message})
+	log.WithFields(log.Fields{
+		"plugin":   name,
+		"category": category,
+		"reason":   reason,
+	}).Debug("failed to read: ", rel)
+}
+
+// walk scans file, info must come from os.Lstat
+func (d *dirScan) walk(file string, info os.FileInfo) {
+	rel, _ := filepath.Rel(d.root, file)
+	if file != d.root && d.exclude.excluded(file, rel) {
+		d.report.Summary.exclude()
+		return
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		if !d.followSymlinks {
+			d.skip(rel, "symbolic link")
+			return
+		}
+		target, err := os.Stat(file)
+		if err != nil {
+			d.skip(rel, "broken symbolic link")
+			return
+		}
+		info = target
+	}
+
+	id, ok := statID(info)
+	if ok && d.oneFilesystem && id.dev != d.device {
+		d.skip(rel, "other filesystem")
+		return
+	}
+
+	switch {
+	case info.IsDir():
+		if ok {
+			if d.visited[id] {
+				d.skip(rel, "directory already scanned")
+				return
+			}
+			d.visited[id] = true
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			d.failed(rel, err)
+			return
+		}
+		// the names read before an error are still scanned
+		names, err := f.Readdirnames(-1)
+		f.Close()
+		if err != nil {
+			d.failed(rel, err)
+		}
+		sort.Strings(names)
+		for i, entry := range names {
+			if d.report.Summary.stop() {
+				// directories left out are listed, not what is inside them
+				for _, rest := range names[i:] {
+					restRel, _ := filepath.Rel(d.root, filepath.Join(file, rest))
+					d.report.Summary.leaveOut(restRel)
+				}
+				break
+			}
+			child := filepath.Join(file, entry)
+			childInfo, err := os.Lstat(child)
+			if err != nil {
+				childRel, _ := filepath.Rel(d.root, child)
+				d.failed(childRel, err)
+				continue
+			}
+			d.walk(child, childInfo)
+		}
+	case info.Mode().IsRegular():
+		if d.plan != nil {
+			d.plan.scan(file)
+			d.report.Summary.add(ResultsData{})
+			return
+		}
+
+		// files we can not read are not handed to the engine
+		sha, err := fileSHA256(file)
+		if err != nil {
+			d.failed(rel, err)
+			return
+		}
+
+		log.WithFields(log.Fields{
+			"plugin":   name,
+			"category": category,
+		}).Debug("scanning: ", rel)
+
+		path = file
+		results := AvScanContext(d.report.Summary.context(), d.timeout).Results
+		if results.Status == statusError && d.report.Summary.timedOut() {
+			// the scan was cancelled by --max-time
+			d.report.Summary.stop()
+			d.report.Summary.leaveOut(rel)
+			return
+		}
+		suppress(sha, file, nil, &results)
+		d.report.add(dirEntry{Path: rel, Size: info.Size(), SHA256: sha, Results: results}, d.infectedOnly)
+	default:
+		d.skip(rel, "special file")
+	}
+}
+
+// scan scans every regular file below the root that is not excluded, an
+// excluded directory is not descended into and counts as one exclusion
+func (d *dirScan) scan() error {
+	info, err := os.Stat(d.root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", d.root)
+	}
+	if id, ok := statID(info); ok {
+		d.device = id.dev
+	}
+	d.visited = make(map[fileID]bool)
+	d.walk(d.root, info)
+	return nil
+}
+
+func scanDirectory(c *cli.Context) error {
+
+	if !c.Args().Present() {
+		return fmt.Errorf("please supply a directory to scan with malice/%s", name)
+	}
+	dir, err := filepath.Abs(c.Args().First())
+	if err != nil {
+		return err
+	}
+
+	patterns := c.StringSlice("exclude")
+	if len(c.String("exclude-from")) > 0 {
+		more, err := readExclusions(c.String("exclude-from"))
+		if err != nil {
+			return err
+		}
+		patterns = append(patterns, more...)
+	}
+	exclude, err := parseExclusions(patterns)
+	if err != nil {
+		return err
+	}
+
+	failOn, err := parseFailOn(c.String("fail-on"))
+	if err != nil {
+		return err
+	}
+
+	report := DirReport{Dir: dir, Summary: newScanSummary(c.Int("max-findings"), c.Duration("max-time")), Entries: []dirEntry{}, Errors: []DirError{}}
+	if report.Host, err = hostFacts(c); err != nil {
+		return err
+	}
+	scan := dirScan{
+		root:           dir,
+		exclude:        exclude,
+		followSymlinks: c.Bool("follow-symlinks"),
+		oneFilesystem:  c.Bool("one-filesystem"),
+		infectedOnly:   c.Bool("infected-only"),
+		timeout:        c.GlobalInt("timeout"),
+		report:         &report,
+	}
+	if c.GlobalBool("dry-run") {
+		scan.plan = newDryRun(c)
+	}
+	if err := scan.scan(); err != nil {
+		return errors.Wrapf(err, "failed to scan directory %s", dir)
+	}
+	report.Summary.finish()
+
+	if scan.plan != nil {
+		scan.plan.Summary = &report.Summary
+		return scan.plan.print()
+	}
+
+	reportJSON, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(reportJSON))
+
+	return report.Summary.exitError(failOn)
+}
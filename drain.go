@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// drainingError is why scans are refused while draining
+const drainingError = "this instance is draining, send scans to another one"
+
+// drainPollInterval is how often POST /admin/drain?wait= checks whether the
+// scans in flight finished
+const drainPollInterval = 250 * time.Millisecond
+
+// drainer stops an instance taking scans so deployment tooling can roll it
+// without dropping scans mid-flight: once draining, new scans are refused
+// with 503, /readyz reports it is not ready and no queued jobs are claimed
+// from a job directory, while the scans in flight run to completion.
+type drainer struct {
+	sync.Mutex
+	since    *time.Time // nil unless draining
+	inFlight int        // scan requests being answered
+}
+
+var drain = &drainer{}
+
+// DrainStatus json object
+type DrainStatus struct {
+	Draining bool       `json:"draining"`
+	Drained  bool       `json:"drained"`
+	Since    *time.Time `json:"since,omitempty"`
+	InFlight int        `json:"in_flight"` // scan requests being answered
+	Jobs     int        `json:"jobs"`      // background scans queued or running here
+}
+
+// draining reports whether new scans are refused
+func (d *drainer) draining() bool {
+	d.Lock()
+	defer d.Unlock()
+	return d.since != nil
+}
+
+// start refuses new scans from now on, false if it already did
+func (d *drainer) start() bool {
+	d.Lock()
+	defer d.Unlock()
+	if d.since != nil {
+		return false
+	}
+	now := time.Now().UTC()
+	d.since = &now
+	return true
+}
+
+// stop takes scans again, false if it did already
+func (d *drainer) stop() bool {
+	d.Lock()
+	defer d.Unlock()
+	draining := d.since != nil
+	d.since = nil
+	return draining
+}
+
+// status reports whether the instance drained, the background scans it has
+// yet to finish are those queued in memory or claimed from the job directory
+func (d *drainer) status() DrainStatus {
+	d.Lock()
+	status := DrainStatus{Draining: d.since != nil, Since: d.since, InFlight: d.inFlight}
+	d.Unlock()
+
+	status.Jobs = jobs.unfinished()
+	status.Drained = status.Draining && status.InFlight == 0 && status.Jobs == 0
+	return status
+}
+
+// wait returns once the instance drained, or ctx is done
+func (d *drainer) wait(ctx context.Context) DrainStatus {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		status := d.status()
+		if status.Drained || !status.Draining {
+			return status
+		}
+		select {
+		case <-ctx.Done():
+			return status
+		case <-ticker.C:
+		}
+	}
+}
+
+// enter counts a scan request in flight, false if it is refused as the
+// instance is draining
+func (d *drainer) enter() bool {
+	d.Lock()
+	defer d.Unlock()
+	if d.since != nil {
+		return false
+	}
+	d.inFlight++
+	return true
+}
+
+// leave counts a scan request answered
+func (d *drainer) leave() {
+	d.Lock()
+	defer d.Unlock()
+	d.inFlight--
+}
+
+// drainable refuses scan requests while draining and counts the ones in
+// flight otherwise
+func drainable(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !drain.enter() {
+			w.Header().Set("Retry-After", "30")
+			http.Error(w, drainingError, http.StatusServiceUnavailable)
+			return
+		}
+		defer drain.leave()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// unfinished counts the background scans queued or running on this instance,
+// with a job directory those it claimed
+func (q *jobQueue) unfinished() int {
+	q.Lock()
+	defer q.Unlock()
+
+	count := 0
+	if len(q.dir) > 0 {
+		for _, job := range q.list() {
+			if job.Status == jobRunning && q.claimedBy(job.ID) == q.instance {
+				count++
+			}
+		}
+		return count
+	}
+	for _, job := range q.jobs {
+		if job.Status == jobQueued || job.Status == jobRunning {
+			count++
+		}
+	}
+	return count
+}
+
+// webDrain reports whether the instance drained, POST starts draining and
+// waits up to ?wait= for it, DELETE takes scans again
+func webDrain(w http.ResponseWriter, r *http.Request) {
+	fields := log.Fields{
+		"plugin":   name,
+		"category": category,
+	}
+	switch r.Method {
+	case http.MethodPost:
+		var wait time.Duration
+		if value := r.URL.Query().Get("wait"); len(value) > 0 {
+			var err error
+			if wait, err = time.ParseDuration(value); err != nil || wait < 0 {
+				http.Error(w, "invalid wait "+strconv.Quote(value)+", a duration like 60s expected", http.StatusBadRequest)
+				return
+			}
+		}
+		if drain.start() {
+			audit.record(auditConfig, requestKeyID(r), "", "", map[string]string{"reason": "draining"})
+			log.WithFields(fields).Info("draining, refusing new scans")
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), wait)
+		defer cancel()
+		status := drain.wait(ctx)
+		code := http.StatusOK
+		if !status.Drained {
+			code = http.StatusAccepted
+		}
+		writeJSON(w, code, status)
+	case http.MethodDelete:
+		if drain.stop() {
+			audit.record(auditConfig, requestKeyID(r), "", "", map[string]string{"reason": "drain cancelled"})
+			log.WithFields(fields).Info("taking scans again")
+		}
+		writeJSON(w, http.StatusOK, drain.status())
+	default:
+		writeJSON(w, http.StatusOK, drain.status())
+	}
+}
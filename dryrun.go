@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+// drwebKeyPath is where the engine looks for a license key file (Root.KeyPath)
+const drwebKeyPath = "/etc/opt/drweb.com/drweb32.key"
+
+// dryRunCommands are the commands that understand --dry-run, besides scanning a file
+var dryRunCommands = []string{"dir", "help", "h"}
+
+// PlanCheck json object
+type PlanCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// DryRun json object, the plan of a scan that was not run
+type DryRun struct {
+	Inputs   []string     `json:"inputs"`
+	Commands []string     `json:"commands"`
+	Actions  []string     `json:"actions"`
+	Checks   []PlanCheck  `json:"checks"`
+	Summary  *ScanSummary `json:"summary,omitempty"`
+}
+
+func newDryRun(c *cli.Context) *DryRun {
+	return &DryRun{
+		Inputs:   []string{},
+		Commands: []string{},
+		Actions:  plannedActions(c),
+		Checks:   plannedChecks(c),
+	}
+}
+
+// shellQuote quotes args so the command line can be pasted into a shell
+func shellQuote(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if len(arg) > 0 && strings.IndexFunc(arg, func(r rune) bool {
+			return !strings.ContainsRune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./=:@%+,", r)
+		}) < 0 {
+			quoted[i] = arg
+			continue
+		}
+		quoted[i] = "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
+
+// command adds a command line, condition says when it only runs sometimes
+func (p *DryRun) command(condition, command string, args ...string) {
+	line := shellQuote(append([]string{command}, args...))
+	if len(condition) > 0 {
+		line += "  # " + condition
+	}
+	p.Commands = append(p.Commands, line)
+}
+
+// scan adds the commands AvScan runs for file
+func (p *DryRun) scan(file string) {
+	p.Inputs = append(p.Inputs, file)
+	if !ctlEngine {
+		p.command("", drwebCtl, "/ar", "/ok", "/qu", file)
+		return
+	}
+	p.command("", drwebConfigd, "-d")
+	if len(p.Inputs) == 1 {
+		// --engine-option settings are applied once the daemon first started
+		for _, option := range engineOptions {
+			p.command("", drwebCtl, "cfset", option.key, option.value)
+		}
+	}
+	p.command("", drwebCtl, "license")
+	if len(LicenseKey) > 0 {
+		p.command("only if the license is missing or expired", drwebCtl, "license", "--GetRegistered", "REDACTED")
+	} else {
+		p.command("only if the license is missing or expired", drwebCtl, "license", "--GetDemo")
+	}
+	p.command("", drwebConfigd, "-d")
+	p.command("", drwebCtl, append(append(append([]string{"scan"}, defaultProfile.ctlArgs()...), reportArgs()...), file)...)
+	p.command("", drwebCtl, "baseinfo")
+}
+
+// ok reports whether all checks passed
+func (p *DryRun) ok() bool {
+	for _, check := range p.Checks {
+		if !check.OK {
+			return false
+		}
+	}
+	return true
+}
+
+// print writes the plan as JSON, failed checks exit with 1
+func (p *DryRun) print() error {
+	planJSON, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(planJSON))
+	if !p.ok() {
+		return cli.NewExitError("", 1)
+	}
+	return nil
+}
+
+// plannedActions describes what happens to the results besides printing them
+func plannedActions(c *cli.Context) []string {
+	actions := []string{}
+	if c.GlobalBool("privacy") {
+		actions = append(actions, "never look up sample hashes (privacy mode)")
+	} else if len(c.GlobalString("cloud-url")) > 0 {
+		actions = append(actions, fmt.Sprintf("look up sample hashes at %s, %s confidence detections skip the commands", c.GlobalString("cloud-url"), c.GlobalString("cloud-confidence")))
+	}
+	if c.GlobalBool("engine-seccomp") {
+		actions = append(actions, "make the syscalls the engine never needs fail in engine commands")
+	}
+	if c.GlobalBool("engine-landlock") {
+		action := "only let engine commands write below Dr.Web's own, the run and the temp directories"
+		if writable := c.GlobalStringSlice("engine-writable"); len(writable) > 0 {
+			action += " and " + strings.Join(writable, ", ")
+		}
+		actions = append(actions, action)
+	}
+	if peers != nil {
+		actions = append(actions, "also scan samples with the peers at "+strings.Join(peers.urls, ", "))
+	}
+	if intel != nil {
+		sources := append([]string{}, intel.urls...)
+		if len(intel.misp) > 0 {
+			sources = append(sources, "MISP at "+intel.misp)
+		}
+		actions = append(actions, "look detections up in "+strings.Join(sources, ", "))
+	}
+	if c.GlobalBool("family") {
+		if len(c.GlobalString("family-aliases")) > 0 {
+			actions = append(actions, "fetch family aliases from "+c.GlobalString("family-aliases"))
+		}
+		actions = append(actions, "normalize detection names into families")
+	}
+	if defaultProfile != nil {
+		actions = append(actions, "scan with profile "+defaultProfile.name)
+	}
+	if defaultProfile.explode(c.GlobalBool("explode")) {
+		actions = append(actions, fmt.Sprintf("unpack archives with %s (at most %d levels deep) and scan every member", c.GlobalString("extractor"), c.GlobalInt("max-depth")))
+	}
+	if len(scanPolicies) > 0 {
+		actions = append(actions, fmt.Sprintf("apply the first of the %d scan policies in %s matching the sniffed content type", len(scanPolicies), c.GlobalString("scan-policies")))
+	}
+	if len(suppressions) > 0 {
+		actions = append(actions, fmt.Sprintf("report detections matching one of the %d suppressions in %s as suppressed rather than infected", len(suppressions), c.GlobalString("suppressions")))
+	}
+	if store != nil {
+		actions = append(actions, "save results to the store in "+store.dir)
+	}
+	if len(c.GlobalString("elasticsearch")) > 0 {
+		actions = append(actions, fmt.Sprintf("index results into %s (%s)", c.GlobalString("elasticsearch"), c.GlobalString("elasticsearch-dedup")))
+	}
+	if signer != nil && len(signer.kid) > 0 {
+		actions = append(actions, "sign results with key "+signer.kid)
+	} else if signer != nil {
+		actions = append(actions, "sign results")
+	}
+	if c.GlobalBool("callback") {
+		action := "POST results to " + os.Getenv("MALICE_ENDPOINT")
+		if t := payloadTemplateFor(os.Getenv("MALICE_ENDPOINT")); t != nil {
+			action += " rendered with " + t.file
+		}
+		if callbackRecipient != nil {
+			action += " encrypted to --callback-recipient"
+		}
+		actions = append(actions, action)
+	}
+	return actions
+}
+
+// plannedChecks validates the configuration without starting the engine
+func plannedChecks(c *cli.Context) []PlanCheck {
+	var checks []PlanCheck
+	for _, binary := range []string{drwebConfigd, drwebCtl} {
+		if len(binary) == 0 {
+			continue
+		}
+		check := PlanCheck{Name: filepath.Base(binary), OK: true}
+		if info, err := os.Stat(binary); err != nil {
+			check.OK, check.Detail = false, err.Error()
+		} else if ctlEngine && info.Mode()&0111 == 0 {
+			check.OK, check.Detail = false, binary+" is not executable"
+		}
+		checks = append(checks, check)
+	}
+
+	license := PlanCheck{Name: "license", OK: true, Detail: "no license key, a demo license will be requested"}
+	if len(LicenseKey) > 0 {
+		license.Detail = "registered license key built in"
+	} else if _, err := os.Stat(drwebKeyPath); err == nil {
+		license.Detail = "license key file " + drwebKeyPath
+	}
+	checks = append(checks, license)
+
+	if es := c.GlobalString("elasticsearch"); len(es) > 0 {
+		check := PlanCheck{Name: "elasticsearch", OK: true}
+		if u, err := url.Parse(es); err != nil || len(u.Host) == 0 {
+			check.OK, check.Detail = false, "invalid url "+es
+		}
+		checks = append(checks, check)
+	}
+	if cu := c.GlobalString("cloud-url"); len(cu) > 0 && !c.GlobalBool("privacy") {
+		check := PlanCheck{Name: "cloud", OK: true}
+		if u, err := url.Parse(cu); err != nil || len(u.Host) == 0 {
+			check.OK, check.Detail = false, "invalid url "+cu
+		}
+		checks = append(checks, check)
+	}
+	if c.GlobalBool("callback") {
+		check := PlanCheck{Name: "callback", OK: true}
+		if len(os.Getenv("MALICE_ENDPOINT")) == 0 {
+			check.OK, check.Detail = false, "MALICE_ENDPOINT is not set"
+		}
+		checks = append(checks, check)
+	}
+	return checks
+}
+
+// dryRunScan plans scanning a single file
+func dryRunScan(c *cli.Context) error {
+	plan := newDryRun(c)
+	file, err := filepath.Abs(c.Args().First())
+	if err != nil {
+		return err
+	}
+	input := PlanCheck{Name: "input", OK: true}
+	info, err := os.Stat(file)
+	if err != nil {
+		input.OK, input.Detail = false, err.Error()
+	} else if !info.Mode().IsRegular() {
+		input.OK, input.Detail = false, file+" is not a regular file"
+	}
+	plan.Checks = append(plan.Checks, input)
+
+	plan.scan(file)
+	explode := defaultProfile.explode(c.GlobalBool("explode"))
+	if contentType, err := sniffFile(file); input.OK && err == nil {
+		if policy := matchScanPolicy(fileSample(file, contentType, info.Size())); policy != nil {
+			plan.Actions = append(plan.Actions, fmt.Sprintf("%s is %s, scan policy %s applies (%s)", file, contentType, policy.Name, policy.Action))
+			explode = explode || policy.Action == policyExplode
+		}
+	}
+	if explode && input.OK && len(archiveType(file)) > 0 {
+		plan.Actions = append(plan.Actions, file+" is an archive, its members are scanned the same way once unpacked")
+	}
+	return plan.print()
+}
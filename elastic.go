@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/fatih/structs"
+	"github.com/malice-plugins/pkgs/utils"
+	"github.com/olivere/elastic"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// what to do when a sample that already has drweb results is indexed again
+const (
+	dedupOverwrite = "overwrite"
+	dedupVersion   = "version"
+	dedupSkip      = "skip"
+)
+
+// maxIndexConflicts is how often we retry when another plugin updates the
+// same sample document between our read and write
+const maxIndexConflicts = 3
+
+func validDedupPolicy(policy string) error {
+	switch policy {
+	case dedupOverwrite, dedupVersion, dedupSkip:
+		return nil
+	}
+	return fmt.Errorf("invalid elasticsearch dedup policy %q (must be one of %s, %s or %s)",
+		policy, dedupOverwrite, dedupVersion, dedupSkip)
+}
+
+// elasticDatabase is the elasticsearch results are indexed in, whatever is
+// not set defaults to the MALICE_ELASTICSEARCH_* variables
+type elasticDatabase struct {
+	URL      string
+	Username string
+	Password string
+	Index    string
+	Type     string
+}
+
+// defaults fills in the index, type and url. Without a url the host and port
+// are used, elasticsearch:9200 when running in docker.
+func (db *elasticDatabase) defaults() {
+	if len(strings.TrimSpace(db.Index)) == 0 {
+		db.Index = utils.Getopt("MALICE_ELASTICSEARCH_INDEX", "malice")
+	}
+	if len(strings.TrimSpace(db.Type)) == 0 {
+		db.Type = utils.Getopt("MALICE_ELASTICSEARCH_TYPE", "samples")
+	}
+	if len(strings.TrimSpace(db.URL)) == 0 {
+		host := utils.Getopt("MALICE_ELASTICSEARCH_HOST", "localhost")
+		if _, ok := os.LookupEnv("MALICE_IN_DOCKER"); ok {
+			host = "elasticsearch"
+		}
+		db.URL = utils.Getopt("MALICE_ELASTICSEARCH_URL", host+":"+utils.Getopt("MALICE_ELASTICSEARCH_PORT", "9200"))
+	}
+}
+
+// open connects to the database and creates its index with the malice
+// mapping if it does not exist yet
+func (db *elasticDatabase) open() (*elastic.Client, error) {
+	db.defaults()
+
+	client, err := elastic.NewSimpleClient(
+		elastic.SetURL(db.URL),
+		elastic.SetBasicAuth(
+			utils.Getopts(db.Username, "MALICE_ELASTICSEARCH_USERNAME", ""),
+			utils.Getopts(db.Password, "MALICE_ELASTICSEARCH_PASSWORD", ""),
+		),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create elasticsearch simple client")
+	}
+
+	ctx := context.Background()
+	info, code, err := client.Ping(db.URL).Do(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to database: failed to ping elasticsearch")
+	}
+	log.WithFields(log.Fields{
+		"plugin":   name,
+		"category": category,
+		"code":     code,
+		"cluster":  info.ClusterName,
+		"version":  info.Version.Number,
+		"url":      db.URL,
+	}).Debug("elasticsearch connection successful")
+
+	exists, err := client.IndexExists(db.Index).Do(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to check if index exists")
+	}
+	if !exists {
+		created, err := client.CreateIndex(db.Index).BodyString(string(asset("elasticsearch.mapping.json"))).Do(ctx)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to create index: %s", db.Index)
+		}
+		if !created.Acknowledged {
+			log.WithFields(log.Fields{
+				"plugin":   name,
+				"category": category,
+			}).Error("index creation not acknowledged")
+		}
+	}
+
+	return client, nil
+}
+
+// elasticClient connects to the elasticsearch configured with --elasticsearch
+func elasticClient() (*elastic.Client, error) {
+	client, err := es.open()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to initalize elasticsearch")
+	}
+	return client, nil
+}
+
+// storeElasticsearch indexes results under the sample document id according
+// to the dedup policy. The document id is always set so repeated scans of the
+// same sample land on the same document instead of creating a new one each time.
+func storeElasticsearch(id string, results ResultsData, policy string) error {
+	if err := validDedupPolicy(policy); err != nil {
+		return err
+	}
+	client, err := elasticClient()
+	if err != nil {
+		return err
+	}
+
+	results.MarkDown = ""
+	data := structs.Map(results)
+	scanDate := time.Now().UTC()
+
+	for attempt := 1; ; attempt++ {
+		err = indexPluginResults(client, id, data, scanDate, policy)
+		if !elastic.IsConflict(err) || attempt == maxIndexConflicts {
+			break
+		}
+		log.WithFields(log.Fields{
+			"plugin":   name,
+			"category": category,
+			"id":       id,
+		}).Debug("sample was modified concurrently, retrying")
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to index sample with id: %s", id)
+	}
+
+	if policy == dedupVersion {
+		history := map[string]interface{}{
+			"scan_id":   id,
+			"scan_date": scanDate.Format(time.RFC3339Nano),
+			"database":  results.Database,
+			"plugins": map[string]interface{}{
+				category: map[string]interface{}{name: data},
+			},
+		}
+		historyID := fmt.Sprintf("%s_%s", id, scanDate.Format(storeTimeFormat))
+		_, err := client.Index().
+			Index(es.Index).
+			Type(es.Type).
+			Id(historyID).
+			OpType("create").
+			BodyJson(history).
+			Do(context.Background())
+		if err != nil {
+			return errors.Wrapf(err, "failed to index scan history with id: %s", historyID)
+		}
+	}
+
+	return nil
+}
+
+// indexPluginResults replaces the drweb results in the sample document while
+// keeping the results of all other plugins
+func indexPluginResults(client *elastic.Client, id string, data map[string]interface{}, scanDate time.Time, policy string) error {
+	getSample, err := client.Get().
+		Index(es.Index).
+		Type(es.Type).
+		Id(id).
+		Do(context.Background())
+	if err != nil && !elastic.IsNotFound(err) {
+		return err
+	}
+
+	doc := map[string]interface{}{}
+	index := client.Index().
+		Index(es.Index).
+		Type(es.Type).
+		Id(id).
+		Refresh("wait_for")
+
+	if getSample != nil && getSample.Found && getSample.Source != nil {
+		if err := json.Unmarshal(*getSample.Source, &doc); err != nil {
+			return errors.Wrap(err, "failed to parse sample document")
+		}
+		// only write if nobody else touched the document since we read it
+		if getSample.Version != nil {
+			index = index.Version(*getSample.Version)
+		}
+	} else {
+		index = index.OpType("create")
+	}
+
+	plugins, _ := doc["plugins"].(map[string]interface{})
+	if plugins == nil {
+		plugins = map[string]interface{}{}
+	}
+	av, _ := plugins[category].(map[string]interface{})
+	if av == nil {
+		av = map[string]interface{}{}
+	}
+
+	if _, exists := av[name]; exists && policy == dedupSkip {
+		log.WithFields(log.Fields{
+			"plugin":   name,
+			"category": category,
+			"id":       id,
+		}).Debug("sample already has results, skipping index")
+		return nil
+	}
+
+	av[name] = data
+	plugins[category] = av
+	doc["plugins"] = plugins
+	doc["scan_date"] = scanDate.Format(time.RFC3339Nano)
+
+	resp, err := index.BodyJson(doc).Do(context.Background())
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"id":      resp.Id,
+		"index":   resp.Index,
+		"type":    resp.Type,
+		"version": resp.Version,
+	}).Debug("indexed sample")
+
+	return nil
+}
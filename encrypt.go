@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// encryptionAlg names the only envelope format we produce: an ephemeral
+// X25519 key agreement with the recipient, HKDF-SHA256 and AES-256-GCM
+const encryptionAlg = "X25519-HKDF-SHA256-A256GCM"
+
+const encryptionInfo = "malice drweb result"
+
+// EncryptedResult json object
+type EncryptedResult struct {
+	Alg        string `json:"alg"`
+	EPK        []byte `json:"epk"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// callbackRecipient is nil unless callbacks are encrypted
+var callbackRecipient *ecdh.PublicKey
+
+// readKeyPEM returns the PEM block in value, which is either the PEM itself
+// (handy for environment variables) or the name of a file containing it
+func readKeyPEM(value string) (*pem.Block, error) {
+	data := []byte(value)
+	if !strings.HasPrefix(strings.TrimSpace(value), "-----BEGIN") {
+		var err error
+		if data, err = ioutil.ReadFile(value); err != nil {
+			return nil, err
+		}
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM encoded key found")
+	}
+	return block, nil
+}
+
+func loadRecipient(value string) error {
+	block, err := readKeyPEM(value)
+	if err != nil {
+		return errors.Wrap(err, "failed to read callback recipient key")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse callback recipient key")
+	}
+	public, ok := key.(*ecdh.PublicKey)
+	if !ok || public.Curve() != ecdh.X25519() {
+		return fmt.Errorf("callback recipient key is not an X25519 public key")
+	}
+
+	callbackRecipient = public
+	return nil
+}
+
+// hkdfSHA256 derives a length byte key as described in RFC 5869
+func hkdfSHA256(secret, salt, info []byte, length int) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+
+	var okm, block []byte
+	for i := byte(1); len(okm) < length; i++ {
+		expand := hmac.New(sha256.New, prk)
+		expand.Write(block)
+		expand.Write(info)
+		expand.Write([]byte{i})
+		block = expand.Sum(nil)
+		okm = append(okm, block...)
+	}
+	return okm[:length]
+}
+
+func envelopeCipher(shared, epk, recipient []byte) (cipher.AEAD, error) {
+	salt := append(append([]byte{}, epk...), recipient...)
+	block, err := aes.NewCipher(hkdfSHA256(shared, salt, []byte(encryptionInfo), 32))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptResult encrypts plaintext so only the holder of the recipient's private key can read it
+func encryptResult(plaintext []byte, recipient *ecdh.PublicKey) ([]byte, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	epk := ephemeral.PublicKey().Bytes()
+	aead, err := envelopeCipher(shared, epk, recipient.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(EncryptedResult{
+		Alg:        encryptionAlg,
+		EPK:        epk,
+		Nonce:      nonce,
+		Ciphertext: aead.Seal(nil, nonce, plaintext, nil),
+	})
+}
+
+func decryptResult(envelope []byte, key *ecdh.PrivateKey) ([]byte, error) {
+	var encrypted EncryptedResult
+	if err := json.Unmarshal(envelope, &encrypted); err != nil {
+		return nil, errors.Wrap(err, "failed to parse encrypted result")
+	}
+	if encrypted.Alg != encryptionAlg {
+		return nil, fmt.Errorf("unsupported encryption %q", encrypted.Alg)
+	}
+
+	epk, err := ecdh.X25519().NewPublicKey(encrypted.EPK)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid ephemeral key")
+	}
+	shared, err := key.ECDH(epk)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := envelopeCipher(shared, encrypted.EPK, key.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if len(encrypted.Nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("invalid nonce")
+	}
+
+	plaintext, err := aead.Open(nil, encrypted.Nonce, encrypted.Ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt result: wrong key or result was altered")
+	}
+	return plaintext, nil
+}
+
+func decrypt(c *cli.Context) error {
+	if len(c.String("key")) == 0 {
+		return fmt.Errorf("please supply the private key to decrypt with (--key)")
+	}
+	block, err := readKeyPEM(c.String("key"))
+	if err != nil {
+		return err
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse private key")
+	}
+	key, ok := parsed.(*ecdh.PrivateKey)
+	if !ok || key.Curve() != ecdh.X25519() {
+		return fmt.Errorf("key is not an X25519 private key")
+	}
+
+	var envelope []byte
+	if file := c.Args().First(); len(file) > 0 && file != "-" {
+		envelope, err = ioutil.ReadFile(file)
+	} else {
+		envelope, err = ioutil.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		return err
+	}
+
+	plaintext, err := decryptResult(envelope, key)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(plaintext))
+	return nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/parnurzeal/gorequest"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// engineDir is where the Dr.Web binaries are installed, see --engine-dir
+var engineDir = defaultEngineDir
+
+// the engine binaries in engineDir, drwebConfigd is empty if the engine has no daemon
+var drwebConfigd, drwebCtl = engineBinaries(defaultEngineDir)
+
+// setEngineDir points the engine binaries at another installation
+func setEngineDir(dir string) {
+	engineDir = dir
+	drwebConfigd, drwebCtl = engineBinaries(dir)
+}
+
+// engineFailureMessages are printed by drweb-ctl when it can not talk to the
+// scan engine, as opposed to the engine failing to scan a particular file
+var engineFailureMessages = []string{
+	"scanengine is not available",
+	"connection refused",
+	"broken pipe",
+	"socket",
+}
+
+// engineAlertURL receives a JSON event whenever the engine is restarted or the
+// circuit breaker changes state
+var engineAlertURL string
+
+// EngineEvent json object
+type EngineEvent struct {
+	Event    string    `json:"event"`
+	Time     time.Time `json:"time"`
+	Failures int       `json:"consecutive_failures"`
+	Restarts int       `json:"restarts"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// engineFailed reports whether a drweb-ctl error means the daemon or scan engine died
+func engineFailed(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err.Error() == "exit status 119" {
+		return true
+	}
+
+	// only look at what drweb-ctl says about itself, output names the scanned files
+	msg := strings.ToLower(err.Error())
+	switch exitErr := err.(type) {
+	case *exec.ExitError:
+		msg += strings.ToLower(string(exitErr.Stderr))
+	case *engineExitError:
+		msg += strings.ToLower(exitErr.stderr)
+	}
+	for _, failure := range engineFailureMessages {
+		if strings.Contains(msg, failure) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitScanArgs splits the arguments of drweb-ctl scan into its options,
+// each with its value, and the files to scan. The console scanner of Dr.Web
+// for Windows takes none of the options.
+func splitScanArgs(args []string) ([]string, []string) {
+	var options, files []string
+	for i := 0; i < len(args); i++ {
+		if strings.HasPrefix(args[i], "--") && i+1 < len(args) {
+			options = append(options, args[i], args[i+1])
+			i++
+			continue
+		}
+		files = append(files, args[i])
+	}
+	return options, files
+}
+
+// restartEngine stops drweb-configd, which takes the scan engine down with it,
+// and starts it again, in the engine helper if there is one
+func restartEngine(ctx context.Context) error {
+	breaker.restarted()
+	if helper != nil {
+		return helper.restart(ctx)
+	}
+	return restartConfigd(ctx)
+}
+
+// restartConfigd does the restart where the engine runs
+func restartConfigd(ctx context.Context) error {
+	for _, proc := range configdProcesses() {
+		terminate(proc)
+	}
+	for i := 0; i < 10 && len(configdProcesses()) > 0; i++ {
+		time.Sleep(time.Second)
+	}
+	for _, proc := range configdProcesses() {
+		proc.Kill()
+	}
+
+	if err := startConfigd(ctx); err != nil {
+		return errors.Wrap(err, "failed to start drweb-configd")
+	}
+	time.Sleep(1 * time.Second)
+
+	return nil
+}
+
+// circuitBreaker stops accepting scans after threshold consecutive engine
+// failures and lets a single trial scan through every cooldown
+type circuitBreaker struct {
+	sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	restarts  int
+	openedAt  time.Time
+}
+
+var breaker = &circuitBreaker{
+	threshold: 5,
+	cooldown:  time.Minute,
+}
+
+func (b *circuitBreaker) open() bool {
+	return b.threshold > 0 && b.failures >= b.threshold
+}
+
+// healthy reports whether the breaker is closed
+func (b *circuitBreaker) healthy() bool {
+	b.Lock()
+	defer b.Unlock()
+
+	return !b.open()
+}
+
+// allow reports whether a scan may be attempted and otherwise how long to wait
+func (b *circuitBreaker) allow() (bool, time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+
+	if !b.open() {
+		return true, 0
+	}
+	if wait := b.cooldown - time.Since(b.openedAt); wait > 0 {
+		return false, wait
+	}
+	// half-open: block everybody else until the trial scan is done
+	b.openedAt = time.Now()
+	return true, 0
+}
+
+func (b *circuitBreaker) success() {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.open() {
+		b.alert("breaker_closed", nil)
+	}
+	b.failures = 0
+}
+
+func (b *circuitBreaker) failure(err error) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.failures++
+	if b.open() {
+		b.openedAt = time.Now()
+	}
+	if b.threshold > 0 && b.failures == b.threshold {
+		b.alert("breaker_open", err)
+	}
+}
+
+func (b *circuitBreaker) restarted() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.restarts++
+	b.alert("engine_restart", nil)
+}
+
+// alert logs the event and posts it to the alert hook, b must be locked
+func (b *circuitBreaker) alert(event string, err error) {
+	e := EngineEvent{
+		Event:    event,
+		Time:     time.Now().UTC(),
+		Failures: b.failures,
+		Restarts: b.restarts,
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	log.WithFields(log.Fields{
+		"plugin":   name,
+		"category": category,
+		"failures": e.Failures,
+		"restarts": e.Restarts,
+	}).Warn("scan engine ", strings.Replace(event, "_", " ", -1))
+
+	if len(engineAlertURL) == 0 {
+		return
+	}
+	eventJSON, jerr := json.Marshal(e)
+	assert(jerr)
+	go gorequest.New().
+		Timeout(10 * time.Second).
+		Post(engineAlertURL).
+		Send(string(eventJSON)).
+		End(func(resp gorequest.Response, body string, errs []error) {
+			if len(errs) > 0 {
+				log.WithFields(log.Fields{
+					"plugin":   name,
+					"category": category,
+				}).Error(errors.Wrap(errs[0], "failed to post engine alert"))
+			}
+		})
+}
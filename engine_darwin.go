@@ -0,0 +1,4 @@
+package main
+
+// defaultEngineDir is where Dr.Web for macOS installs drweb-configd and drweb-ctl
+const defaultEngineDir = "/Library/Application Support/DrWeb/bin"
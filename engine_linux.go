@@ -0,0 +1,32 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// defaultEngineDir is where Dr.Web for Linux installs drweb-configd and drweb-ctl
+const defaultEngineDir = "/opt/drweb.com/bin"
+
+// configdProcesses returns the running drweb-configd processes
+func configdProcesses() []*os.Process {
+	var procs []*os.Process
+	comms, _ := filepath.Glob("/proc/[0-9]*/comm")
+	for _, comm := range comms {
+		data, err := ioutil.ReadFile(comm)
+		if err != nil || strings.TrimSpace(string(data)) != filepath.Base(drwebConfigd) {
+			continue
+		}
+		pid, err := strconv.Atoi(filepath.Base(filepath.Dir(comm)))
+		if err != nil {
+			continue
+		}
+		if proc, err := os.FindProcess(pid); err == nil {
+			procs = append(procs, proc)
+		}
+	}
+	return procs
+}
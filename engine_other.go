@@ -0,0 +1,8 @@
+//go:build !linux && !darwin && !windows
+// +build !linux,!darwin,!windows
+
+package main
+
+// defaultEngineDir is where Dr.Web for Linux installs drweb-configd and
+// drweb-ctl, other Unix systems run it the same way
+const defaultEngineDir = "/opt/drweb.com/bin"
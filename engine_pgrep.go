@@ -0,0 +1,29 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// configdProcesses returns the running drweb-configd processes, there is no
+// /proc outside Linux so they are looked up with pgrep
+func configdProcesses() []*os.Process {
+	var procs []*os.Process
+	out, _ := exec.Command("pgrep", "-x", filepath.Base(drwebConfigd)).Output()
+	for _, line := range strings.Fields(string(out)) {
+		pid, err := strconv.Atoi(line)
+		if err != nil {
+			continue
+		}
+		if proc, err := os.FindProcess(pid); err == nil {
+			procs = append(procs, proc)
+		}
+	}
+	return procs
+}
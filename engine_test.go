@@ -0,0 +1,26 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestSplitScanArgs splits the drweb-ctl scan arguments of a profile, the
+// console scanner of Dr.Web for Windows only gets the files
+func TestSplitScanArgs(t *testing.T) {
+	defer func(output string) { engineOutput = output }(engineOutput)
+	engineOutput = engineOutputJSON
+
+	heuristic, level := false, 3
+	profile := &ScanProfile{Heuristic: &heuristic, ArchiveMaxLevel: &level}
+	file := `C:\Users\Public\malice\scan_123`
+	args := append(append(profile.ctlArgs(), reportArgs()...), file)
+
+	options, files := splitScanArgs(args)
+	if want := []string{"--HeuristicAnalysis", "Off", "--ArchiveMaxLevel", "3", "--Report", "JSON"}; !reflect.DeepEqual(options, want) {
+		t.Errorf("got options %q, want %q", options, want)
+	}
+	if want := []string{file}; !reflect.DeepEqual(files, want) {
+		t.Errorf("got files %q, want %q", files, want)
+	}
+}
@@ -0,0 +1,139 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// ctlEngine is set where the engine runs as the drweb-configd daemon driven
+// with drweb-ctl, which also manages the license, updates and settings
+const ctlEngine = true
+
+// startCommand starts the engine commands, the engine helper restricts them further
+var startCommand = (*exec.Cmd).Start
+
+func engineBinaries(dir string) (string, string) {
+	return filepath.Join(dir, "drweb-configd"), filepath.Join(dir, "drweb-ctl")
+}
+
+// closeInheritedOnce marks the descriptors we inherited close-on-exec
+var closeInheritedOnce sync.Once
+
+// closeInheritedFds makes sure engine commands do not inherit descriptors we
+// were started with, e.g. systemd sockets, ours are opened close-on-exec
+func closeInheritedFds() {
+	dir, err := os.Open("/dev/fd")
+	if err != nil {
+		return
+	}
+	names, _ := dir.Readdirnames(-1)
+	self := int(dir.Fd())
+	for _, name := range names {
+		if fd, err := strconv.Atoi(name); err == nil && fd > 2 && fd != self {
+			syscall.CloseOnExec(fd)
+		}
+	}
+	dir.Close()
+}
+
+// runGroup runs a command in its own process group, which is killed as a
+// whole once ctx is done so no engine helpers are left behind, within the
+// resource limits of ctx
+func runGroup(ctx context.Context, command string, args ...string) (string, error) {
+	closeInheritedOnce.Do(closeInheritedFds)
+	dir, err := engineDirectory()
+	if err != nil {
+		return "", err
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(command, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.Env = engineEnv()
+	cmd.Dir = dir
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	confined, err := confine(cmd, engineLimits(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer confined.release()
+	if err := startCommand(cmd); err != nil {
+		return "", err
+	}
+	if err := confined.started(cmd.Process.Pid); err != nil {
+		killGroup(cmd.Process.Pid)
+		cmd.Wait()
+		return "", err
+	}
+
+	defer watchdog.track(ctx, cmd.Process.Pid, command, args)()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			killGroup(cmd.Process.Pid)
+		case <-done:
+		}
+	}()
+
+	err = cmd.Wait()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		exitErr.Stderr = stderr.Bytes()
+	}
+	return stdout.String(), confined.exceeded(err)
+}
+
+// killGroup kills the process group of the command with pid
+func killGroup(pid int) {
+	syscall.Kill(-pid, syscall.SIGKILL)
+}
+
+// newGroup makes the command start a process group of its own for killGroup
+func newGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func runCtl(ctx context.Context, args ...string) (string, error) {
+	if helper != nil {
+		return helper.ctl(ctx, args...)
+	}
+	return runGroup(ctx, drwebCtl, args...)
+}
+
+// startConfigd starts the drweb-configd daemon, which drweb-ctl talks to, and
+// applies the --engine-option settings the first time
+func startConfigd(ctx context.Context) error {
+	if helper != nil {
+		return helper.configd(ctx)
+	}
+	_, err := runGroup(ctx, drwebConfigd, "-d")
+	if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+		return errors.Wrap(err, strings.TrimSpace(string(exitErr.Stderr)))
+	}
+	if err != nil {
+		return err
+	}
+	engineOptionsOnce.Do(func() {
+		engineOptionsErr = applyEngineOptions(ctx, engineOptions)
+	})
+	return engineOptionsErr
+}
+
+// terminate asks a process to shut down
+func terminate(proc *os.Process) {
+	proc.Signal(syscall.SIGTERM)
+}
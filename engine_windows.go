@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Dr.Web for Windows has no drweb-configd and drweb-ctl: its service keeps
+// the license, updates and settings itself and files are scanned with the
+// console scanner. runCtl translates the drweb-ctl commands a scan needs.
+const ctlEngine = false
+
+// defaultEngineDir is where Dr.Web for Windows installs the console scanner
+const defaultEngineDir = `C:\Program Files\DrWeb`
+
+func engineBinaries(dir string) (string, string) {
+	return "", filepath.Join(dir, "dwscancl.exe")
+}
+
+// runGroup runs a command, its whole process tree is killed once ctx is done
+func runGroup(ctx context.Context, command string, args ...string) (string, error) {
+	dir, err := engineDirectory()
+	if err != nil {
+		return "", err
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(command, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.Env = engineEnv()
+	cmd.Dir = dir
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+
+	defer watchdog.track(ctx, cmd.Process.Pid, command, args)()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			killGroup(cmd.Process.Pid)
+		case <-done:
+		}
+	}()
+
+	err = cmd.Wait()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		exitErr.Stderr = stderr.Bytes()
+	}
+	return stdout.String(), err
+}
+
+// killGroup kills the process tree of the command with pid
+func killGroup(pid int) {
+	exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(pid)).Run()
+}
+
+// newGroup does nothing, killGroup kills the process tree of any command
+func newGroup(cmd *exec.Cmd) {}
+
+// runCtl runs the console scanner for drweb-ctl scan, its report lines have
+// the same "<path> - <verdict>" format. The engine and base versions are not
+// reported by the console scanner, other commands are not supported.
+func runCtl(ctx context.Context, args ...string) (string, error) {
+	if len(args) == 0 {
+		return "", fmt.Errorf("no drweb-ctl command")
+	}
+	switch args[0] {
+	case "scan":
+		// profiles and --engine-output json are refused before they get here
+		options, files := splitScanArgs(args[1:])
+		if len(options) > 0 {
+			log.WithFields(log.Fields{
+				"plugin":   name,
+				"category": category,
+			}).Warn("ignoring drweb-ctl scan options Dr.Web for Windows does not support: ", strings.Join(options, " "))
+		}
+		out, err := runGroup(ctx, drwebCtl, append([]string{"/ar", "/ok", "/qu"}, files...)...)
+		// the exit code tells what was found, the report says it too
+		if _, ok := err.(*exec.ExitError); ok && ctx.Err() == nil && scanReported(out, files) {
+			err = nil
+		}
+		return out, err
+	case "baseinfo", "--version":
+		return "", nil
+	}
+	return "", fmt.Errorf("drweb-ctl %s is not supported by Dr.Web for Windows", args[0])
+}
+
+// scanReported reports whether the console scanner output has a verdict for every file
+func scanReported(out string, files []string) bool {
+	for _, file := range files {
+		if !strings.Contains(out, file+" - ") {
+			return false
+		}
+	}
+	return len(files) > 0
+}
+
+// startConfigd only checks --engine-option is not used, the Dr.Web for
+// Windows service is always running
+func startConfigd(ctx context.Context) error {
+	if len(engineOptions) > 0 {
+		return fmt.Errorf("--engine-option is not supported by Dr.Web for Windows, change its settings in the Dr.Web console")
+	}
+	return nil
+}
+
+// configdProcesses returns nothing, there is no daemon to restart
+func configdProcesses() []*os.Process {
+	return nil
+}
+
+func terminate(proc *os.Process) {
+	proc.Kill()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// engineWorkDir is the working directory of engine commands, empty for a
+// private directory in the temp dir
+var engineWorkDir string
+
+var (
+	workDirOnce sync.Once
+	workDir     string
+	workDirErr  error
+)
+
+// engineEnv returns the environment of engine commands: ours without the
+// plugin settings and anything that looks like a credential, so a
+// compromised engine cannot read them, in engineLocale if there is one
+func engineEnv() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		switch key := strings.SplitN(kv, "=", 2)[0]; {
+		case strings.HasPrefix(strings.ToUpper(key), "MALICE_"), secretRe.MatchString(key):
+			continue
+		case len(engineLocale) == 0:
+		case key == "LANG", key == "LANGUAGE", key == "LC_ALL", key == "LC_MESSAGES":
+			// LANGUAGE would win over LC_ALL for gettext messages
+			continue
+		}
+		env = append(env, kv)
+	}
+	if len(engineLocale) == 0 {
+		return env
+	}
+	return append(env, "LANG="+engineLocale, "LC_ALL="+engineLocale)
+}
+
+// engineDirectory returns the working directory of engine commands, creating
+// the private one the first time
+func engineDirectory() (string, error) {
+	workDirOnce.Do(func() {
+		workDir, workDirErr = privateEngineDir(engineWorkDir)
+	})
+	return workDir, workDirErr
+}
+
+// privateEngineDir makes sure dir, or the default one, is a directory only
+// we can get into
+func privateEngineDir(dir string) (string, error) {
+	if len(dir) == 0 {
+		dir = filepath.Join(os.TempDir(), defaultEngineWorkDir())
+	}
+	if err := os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+		return "", errors.Wrap(err, "failed to create engine working directory")
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create engine working directory")
+	}
+	if !info.IsDir() || !privateDir(info) {
+		return "", fmt.Errorf("engine working directory %s is not a directory private to us", dir)
+	}
+	return dir, nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// export formats
+const (
+	exportCSV     = "csv"
+	exportParquet = "parquet"
+)
+
+// column kinds
+const (
+	columnString = iota
+	columnBool
+	columnTime
+)
+
+// exportColumn is a column of an export, its value is a string, bool or time.Time
+type exportColumn struct {
+	name  string
+	kind  int
+	value func(StoredResult) interface{}
+}
+
+// exportColumns is the export schema. Columns are only ever appended so
+// pipelines reading exports by position keep working; lists are joined with ';'.
+var exportColumns = []exportColumn{
+	{"sha256", columnString, func(r StoredResult) interface{} { return r.SHA256 }},
+	{"scanned_at", columnTime, func(r StoredResult) interface{} { return r.ScannedAt }},
+	{"infected", columnBool, func(r StoredResult) interface{} { return r.Results.Infected }},
+	{"status", columnString, func(r StoredResult) interface{} { return r.Results.Status }},
+	{"result", columnString, func(r StoredResult) interface{} { return r.Results.Result }},
+	{"heuristic", columnBool, func(r StoredResult) interface{} { return r.Results.Heuristic }},
+	{"confidence", columnString, func(r StoredResult) interface{} { return r.Results.Confidence }},
+	{"family", columnString, func(r StoredResult) interface{} { return r.Results.Family }},
+	{"attack", columnString, func(r StoredResult) interface{} { return strings.Join(r.Results.Attack, ";") }},
+	{"tags", columnString, func(r StoredResult) interface{} { return strings.Join(r.Results.Tags, ";") }},
+	{"engine", columnString, func(r StoredResult) interface{} { return r.Results.Engine }},
+	{"database", columnString, func(r StoredResult) interface{} { return r.Results.Database }},
+	{"updated", columnString, func(r StoredResult) interface{} { return updatedString(r.Results) }},
+	{"source", columnString, func(r StoredResult) interface{} { return r.Results.Source }},
+	{"error", columnString, func(r StoredResult) interface{} { return r.Results.Error }},
+}
+
+// parseExportTime parses a --since or --until date or RFC3339 time, a date
+// given as --until includes the whole day
+func parseExportTime(value string, until bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return t, fmt.Errorf("invalid time %q (must be a date like 2019-01-21 or RFC3339)", value)
+	}
+	if until {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+func writeCSV(w io.Writer, results []StoredResult) error {
+	out := csv.NewWriter(w)
+	header := make([]string, len(exportColumns))
+	for i, column := range exportColumns {
+		header[i] = column.name
+	}
+	out.Write(header)
+
+	row := make([]string, len(exportColumns))
+	for _, result := range results {
+		for i, column := range exportColumns {
+			switch value := column.value(result).(type) {
+			case bool:
+				row[i] = strconv.FormatBool(value)
+			case time.Time:
+				row[i] = value.UTC().Format(time.RFC3339Nano)
+			default:
+				row[i] = value.(string)
+			}
+		}
+		out.Write(row)
+	}
+	out.Flush()
+	return out.Error()
+}
+
+func writeExportParquet(w io.Writer, results []StoredResult) error {
+	columns := make([]*parquetColumn, len(exportColumns))
+	for i, column := range exportColumns {
+		switch column.kind {
+		case columnBool:
+			columns[i] = &parquetColumn{name: column.name, typ: parquetBoolean, convertedType: -1}
+		case columnTime:
+			columns[i] = &parquetColumn{name: column.name, typ: parquetInt64, convertedType: parquetTimestampMillis}
+		default:
+			columns[i] = &parquetColumn{name: column.name, typ: parquetByteArray, convertedType: parquetUTF8}
+		}
+	}
+	for _, result := range results {
+		for i, column := range exportColumns {
+			switch value := column.value(result).(type) {
+			case bool:
+				columns[i].addBool(value)
+			case time.Time:
+				columns[i].addInt64(value.UnixNano() / int64(time.Millisecond))
+			default:
+				columns[i].addString(value.(string))
+			}
+		}
+	}
+	return writeParquet(w, columns, len(results), "drweb "+Version)
+}
+
+func exportCommand(c *cli.Context) error {
+	if store == nil {
+		return fmt.Errorf("export requires --store")
+	}
+	format := strings.ToLower(c.String("format"))
+	if format != exportCSV && format != exportParquet {
+		return fmt.Errorf("invalid export format %q (must be %s or %s)", format, exportCSV, exportParquet)
+	}
+
+	var since, until time.Time
+	var err error
+	if len(c.String("since")) > 0 {
+		if since, err = parseExportTime(c.String("since"), false); err != nil {
+			return err
+		}
+	}
+	if len(c.String("until")) > 0 {
+		if until, err = parseExportTime(c.String("until"), true); err != nil {
+			return err
+		}
+	}
+
+	results, err := store.query(func(stored StoredResult) bool {
+		return !stored.ScannedAt.Before(since) && (until.IsZero() || stored.ScannedAt.Before(until))
+	}, 0)
+	if err != nil {
+		return errors.Wrap(err, "failed to read stored results")
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].ScannedAt.Before(results[j].ScannedAt)
+	})
+
+	write := writeCSV
+	if format == exportParquet {
+		write = writeExportParquet
+	}
+
+	output := c.String("output")
+	if len(output) == 0 || output == "-" {
+		return write(os.Stdout, results)
+	}
+	f, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to create export")
+	}
+	err = write(f, results)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(output)
+		return errors.Wrap(err, "failed to write export")
+	}
+	return nil
+}
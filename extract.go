@@ -0,0 +1,622 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultExtractor is used to unpack 7z and rar archives. Malware archives are
+// commonly protected with the password "infected".
+const defaultExtractor = "7z x -y -bd -pinfected -o{dir} {file}"
+
+// retainInfectedMembers keeps the infected members of unpacked archives as
+// retained samples of their own
+var retainInfectedMembers bool
+
+// ArchiveMember json object
+type ArchiveMember struct {
+	Path     string      `json:"path" structs:"path"`
+	Depth    int         `json:"depth" structs:"depth"`
+	Size     int64       `json:"size" structs:"size"`
+	SHA256   string      `json:"sha256,omitempty" structs:"sha256,omitempty"`
+	MD5      string      `json:"md5,omitempty" structs:"md5,omitempty"`
+	SHA1     string      `json:"sha1,omitempty" structs:"sha1,omitempty"`
+	Retained bool        `json:"retained,omitempty" structs:"retained,omitempty"`
+	Results  ResultsData `json:"drweb" structs:"drweb"`
+
+	// data is the content of an infected member to retain
+	data []byte
+}
+
+// extractLimits guard the extraction stage against hostile archives, MaxTotal
+// is the budget of all the members unpacked from an archive and those nested in it
+type extractLimits struct {
+	MaxDepth int
+	MaxSize  int64
+	MaxRatio float64
+	MaxTotal int64
+}
+
+// extractedEntry is a member written to disk by one of the unpackers, status
+// is set if the member was refused
+type extractedEntry struct {
+	name   string
+	path   string
+	size   int64
+	status string
+	reason string
+}
+
+type extractor struct {
+	limits  extractLimits
+	command string
+	timeout int
+	profile *ScanProfile
+	workDir string
+	members []ArchiveMember
+
+	// extracted is the number of bytes unpacked so far, out of MaxTotal
+	extracted int64
+}
+
+// archiveType sniffs the container format of file
+func archiveType(file string) string {
+	f, err := os.Open(file)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	header := make([]byte, 512)
+	n, _ := io.ReadFull(f, header)
+	header = header[:n]
+
+	switch {
+	case bytes.HasPrefix(header, []byte("PK\x03\x04")), bytes.HasPrefix(header, []byte("PK\x05\x06")):
+		return "zip"
+	case bytes.HasPrefix(header, []byte{0x1f, 0x8b}):
+		return "gzip"
+	case bytes.HasPrefix(header, []byte("BZh")):
+		return "bzip2"
+	case bytes.HasPrefix(header, []byte{0x37, 0x7a, 0xbc, 0xaf, 0x27, 0x1c}):
+		return "7z"
+	case bytes.HasPrefix(header, []byte("Rar!\x1a\x07")):
+		return "rar"
+	case len(header) >= 262 && bytes.Equal(header[257:262], []byte("ustar")):
+		return "tar"
+	}
+
+	return ""
+}
+
+// explodeAndScan recursively unpacks archive and scans every member
+func explodeAndScan(archive string, limits extractLimits, command string, timeout int, profile *ScanProfile) ([]ArchiveMember, error) {
+	workDir, err := ioutil.TempDir("", "explode_")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(workDir)
+
+	e := &extractor{
+		limits:  limits,
+		command: command,
+		timeout: timeout,
+		profile: profile,
+		workDir: workDir,
+	}
+	if err := e.explode(archive, filepath.Base(archive), 0); err != nil {
+		return e.members, err
+	}
+
+	return e.members, nil
+}
+
+// addMembers folds the results of the unpacked members into those of the archive
+func (r *ResultsData) addMembers() {
+	for _, member := range r.Members {
+		if member.Results.Infected && !r.Infected {
+			r.Infected = true
+			r.Status = statusInfected
+			r.Result = member.Results.Result
+		}
+		// an unscannable member means the archive is not known to be clean
+		if r.Status == statusClean && member.Results.Status != statusClean {
+			r.Status = member.Results.Status
+		}
+	}
+}
+
+func (e *extractor) explode(file, logical string, depth int) error {
+	dir, err := ioutil.TempDir(e.workDir, "")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	var entries []extractedEntry
+	switch kind := archiveType(file); kind {
+	case "zip":
+		entries, err = e.unzip(file, dir)
+	case "tar":
+		entries, err = e.untar(file, dir)
+	case "gzip", "bzip2":
+		entries, err = e.decompress(kind, file, logical, dir)
+	case "7z", "rar":
+		entries, err = e.external(file, dir)
+	default:
+		return nil
+	}
+	if err != nil {
+		e.members = append(e.members, ArchiveMember{
+			Path:  logical,
+			Depth: depth,
+			Results: ResultsData{
+				Status: statusError,
+				Error:  errors.Wrap(err, "failed to extract archive").Error(),
+			},
+		})
+		return nil
+	}
+
+	for _, entry := range entries {
+		member := ArchiveMember{
+			Path:  logical + "/" + entry.name,
+			Depth: depth + 1,
+			Size:  entry.size,
+		}
+
+		if len(entry.status) > 0 {
+			member.Results.Status = entry.status
+			member.Results.Error = entry.reason
+			e.members = append(e.members, member)
+			continue
+		}
+
+		tooDeep := false
+		if len(archiveType(entry.path)) > 0 {
+			if depth+1 < e.limits.MaxDepth {
+				if err := e.explode(entry.path, member.Path, depth+1); err != nil {
+					return err
+				}
+				continue
+			}
+			log.WithFields(log.Fields{
+				"plugin":   name,
+				"category": category,
+				"member":   member.Path,
+			}).Debug("maximum archive depth exceeded, scanning nested archive as is")
+			tooDeep = true
+		}
+
+		member.SHA256, _ = fileSHA256(entry.path)
+		member.Results = avScanFile(context.Background(), entry.path, e.timeout, e.profile).Results
+		if tooDeep && member.Results.Status == statusClean {
+			member.Results.Status = statusArchiveTooDeep
+		}
+		if retainInfectedMembers && member.Results.Infected {
+			e.keep(&member, entry.path)
+		}
+		e.members = append(e.members, member)
+	}
+
+	return nil
+}
+
+// keep reads an infected member to retain once the archive is scanned, the
+// extracted files are gone by then
+func (e *extractor) keep(member *ArchiveMember, file string) {
+	data, err := ioutil.ReadFile(file)
+	if err == nil {
+		member.MD5, member.SHA1, err = fileHashes(file)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"plugin":   name,
+			"category": category,
+			"member":   member.Path,
+		}).Error(errors.Wrap(err, "failed to keep infected archive member"))
+		return
+	}
+	member.data = data
+}
+
+// copyMember writes at most the configured size limits of r to the entry and
+// sets its status if the member was refused
+func (e *extractor) copyMember(entry *extractedEntry, r io.Reader, compressed int64) (int64, error) {
+	limit, status, reason := e.memberLimit(compressed)
+
+	f, err := os.Create(entry.path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	n, err := io.CopyN(f, r, limit+1)
+	if n > limit {
+		n = limit + 1
+	}
+	e.extracted += n
+	if err != nil && err != io.EOF {
+		return n, err
+	}
+	if n > limit {
+		entry.status, entry.reason = status, reason
+	}
+
+	return n, nil
+}
+
+// memberLimit returns the number of bytes the next member may unpack to and
+// the status of the member if it unpacks to more
+func (e *extractor) memberLimit(compressed int64) (int64, string, string) {
+	limit, status, reason := e.limits.MaxSize, statusFileTooLarge, ""
+	if e.limits.MaxRatio > 0 && compressed > 0 {
+		if ratioLimit := int64(float64(compressed) * e.limits.MaxRatio); ratioLimit < limit {
+			limit, status = ratioLimit, statusDecompressionBomb
+		}
+	}
+	if e.limits.MaxTotal > 0 {
+		remaining := e.limits.MaxTotal - e.extracted
+		if remaining < 0 {
+			remaining = 0
+		}
+		if remaining < limit {
+			limit, status, reason = remaining, statusDecompressionBomb, "archive exceeds the total size limit"
+		}
+	}
+	return limit, status, reason
+}
+
+func (e *extractor) unzip(file, dir string) ([]extractedEntry, error) {
+	reader, err := zip.OpenReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	var entries []extractedEntry
+	for i, f := range reader.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		entry := extractedEntry{
+			name: f.Name,
+			path: filepath.Join(dir, fmt.Sprintf("%d", i)),
+			size: int64(f.UncompressedSize64),
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			entry.status, entry.reason = statusError, err.Error()
+			entries = append(entries, entry)
+			continue
+		}
+		_, err = e.copyMember(&entry, rc, int64(f.CompressedSize64))
+		rc.Close()
+		if err != nil {
+			entry.status, entry.reason = statusError, err.Error()
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+func (e *extractor) untar(file, dir string) ([]extractedEntry, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []extractedEntry
+	tr := tar.NewReader(f)
+	for i := 0; ; i++ {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return entries, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		entry := extractedEntry{
+			name: header.Name,
+			path: filepath.Join(dir, fmt.Sprintf("%d", i)),
+			size: header.Size,
+		}
+		if _, err = e.copyMember(&entry, tr, 0); err != nil {
+			return entries, err
+		}
+		entries = append(entries, entry)
+	}
+}
+
+func (e *extractor) decompress(kind, file, logical, dir string) ([]extractedEntry, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var r io.Reader
+	entryName := strings.TrimSuffix(filepath.Base(logical), filepath.Ext(logical))
+	switch kind {
+	case "gzip":
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		if len(gz.Name) > 0 {
+			entryName = gz.Name
+		}
+		r = gz
+	case "bzip2":
+		r = bzip2.NewReader(f)
+	}
+
+	entry := extractedEntry{
+		name: entryName,
+		path: filepath.Join(dir, "0"),
+	}
+	entry.size, err = e.copyMember(&entry, r, info.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	return []extractedEntry{entry}, nil
+}
+
+// sevenZipCommands are the 7-Zip binaries, extractors that can list an archive
+// and stream its members one by one
+var sevenZipCommands = map[string]bool{"7z": true, "7za": true, "7zr": true, "7zz": true}
+
+// extractorPollInterval is how often the members written by an extractor
+// other than 7-Zip are checked against the limits
+const extractorPollInterval = 100 * time.Millisecond
+
+// external unpacks formats we do not support natively with the configured
+// extractor command. 7-Zip streams every member through the limits, members it
+// lists as too large are not unpacked at all. Other extractors unpack the
+// whole archive and are stopped once what they wrote exceeds the limits.
+func (e *extractor) external(file, dir string) ([]extractedEntry, error) {
+	fields := strings.Fields(e.command)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("no extractor configured")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(e.timeout)*time.Second)
+	defer cancel()
+
+	if sevenZipCommands[strings.TrimSuffix(filepath.Base(fields[0]), ".exe")] {
+		return e.sevenZip(ctx, fields, file, dir)
+	}
+
+	args := make([]string, len(fields))
+	for i, field := range fields {
+		field = strings.Replace(field, "{dir}", dir, -1)
+		args[i] = strings.Replace(field, "{file}", file, -1)
+	}
+
+	var out bytes.Buffer
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout, cmd.Stderr = &out, &out
+	newGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	ticker := time.NewTicker(extractorPollInterval)
+	defer ticker.Stop()
+	var err error
+	for running := true; running; {
+		select {
+		case err = <-done:
+			running = false
+		case <-ctx.Done():
+			killGroup(cmd.Process.Pid)
+			err = <-done
+			running = false
+		case <-ticker.C:
+			if e.exceeded(dir) {
+				// what was written so far is refused below
+				killGroup(cmd.Process.Pid)
+				<-done
+				running = false
+			}
+		}
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: %s", args[0], strings.TrimSpace(out.String()))
+	}
+
+	var entries []extractedEntry
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		entry := extractedEntry{name: rel, path: p, size: info.Size()}
+		if limit, status, reason := e.memberLimit(0); info.Size() > limit {
+			entry.status, entry.reason = status, reason
+		}
+		e.extracted += info.Size()
+		entries = append(entries, entry)
+		return nil
+	})
+
+	return entries, err
+}
+
+// exceeded reports whether the members written to dir exceed the limits
+func (e *extractor) exceeded(dir string) bool {
+	var total int64
+	tooLarge := false
+	filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			total += info.Size()
+			tooLarge = tooLarge || info.Size() > e.limits.MaxSize
+		}
+		return nil
+	})
+	return tooLarge || (e.limits.MaxTotal > 0 && e.extracted+total > e.limits.MaxTotal)
+}
+
+// sevenZipMember is a member of an archive as 7-Zip lists it
+type sevenZipMember struct {
+	path   string
+	size   int64
+	packed int64
+}
+
+// sevenZip unpacks the members 7-Zip lists one by one, streamed through the
+// limits. Only the password options of the extractor command are passed on.
+func (e *extractor) sevenZip(ctx context.Context, fields []string, file, dir string) ([]extractedEntry, error) {
+	var options []string
+	for _, field := range fields[1:] {
+		if strings.HasPrefix(field, "-p") {
+			options = append(options, field)
+		}
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, fields[0], append(append([]string{"l", "-slt"}, options...), "--", file)...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: %s", fields[0], strings.TrimSpace(stderr.String()))
+	}
+
+	var entries []extractedEntry
+	for i, member := range parseSevenZipListing(out) {
+		entry := extractedEntry{
+			name: member.path,
+			path: filepath.Join(dir, fmt.Sprintf("%d", i)),
+			size: member.size,
+		}
+		if limit, status, reason := e.memberLimit(member.packed); member.size > limit {
+			entry.status, entry.reason = status, reason
+		} else if err := e.streamMember(ctx, fields[0], options, file, &entry, member.packed); err != nil {
+			entry.status, entry.reason = statusError, err.Error()
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// streamMember streams a member through the limits, 7-Zip is stopped as
+// soon as the member exceeds them whatever size it was listed with
+func (e *extractor) streamMember(ctx context.Context, command string, options []string, file string, entry *extractedEntry, packed int64) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, command, append(append([]string{"e", "-so", "-spd"}, options...), "--", file, entry.name)...)
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	n, err := e.copyMember(entry, stdout, packed)
+	if err != nil || len(entry.status) > 0 {
+		cancel()
+		cmd.Wait()
+		return err
+	}
+	if err := cmd.Wait(); err != nil {
+		return errors.Wrapf(err, "%s: %s", command, strings.TrimSpace(stderr.String()))
+	}
+	entry.size = n
+	return nil
+}
+
+// parseSevenZipListing returns the files of a 7z l -slt listing
+func parseSevenZipListing(listing []byte) []sevenZipMember {
+	var members []sevenZipMember
+	var member sevenZipMember
+	inMembers, isDir := false, false
+	flush := func() {
+		if len(member.path) > 0 && !isDir {
+			members = append(members, member)
+		}
+		member, isDir = sevenZipMember{}, false
+	}
+
+	for _, line := range strings.Split(string(listing), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if !inMembers {
+			inMembers = line == "----------"
+			continue
+		}
+		if len(line) == 0 {
+			flush()
+			continue
+		}
+		parts := strings.SplitN(line, " = ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch parts[0] {
+		case "Path":
+			member.path = parts[1]
+		case "Size":
+			member.size, _ = strconv.ParseInt(parts[1], 10, 64)
+		case "Packed Size":
+			member.packed, _ = strconv.ParseInt(parts[1], 10, 64)
+		case "Folder":
+			isDir = isDir || parts[1] == "+"
+		case "Attributes":
+			isDir = isDir || strings.HasPrefix(parts[1], "D")
+		}
+	}
+	flush()
+
+	return members
+}
+
+func fileSHA256(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
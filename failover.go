@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// instance roles
+const (
+	roleActive  = "active"
+	roleStandby = "standby"
+)
+
+// standbyPair makes this instance the standby of an active one: it does not
+// accept scans or run queued jobs until the active instance's /healthz failed
+// threshold times in a row, then it takes over for good
+type standbyPair struct {
+	sync.Mutex
+	active    string
+	interval  time.Duration
+	threshold int
+
+	standby  bool
+	failures int
+	promoted chan struct{} // closed when a standby takes over
+}
+
+// pair is active from the start without --standby-of
+var pair = &standbyPair{}
+
+// role returns whether this instance is active or standby
+func (p *standbyPair) role() string {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.standby {
+		return roleStandby
+	}
+	return roleActive
+}
+
+// wait blocks until this instance is active
+func (p *standbyPair) wait() {
+	p.Lock()
+	promoted := p.promoted
+	p.Unlock()
+	if promoted != nil {
+		<-promoted
+	}
+}
+
+// watch makes this instance the standby of the active instance at url
+func (p *standbyPair) watch(url string, interval time.Duration, threshold int) {
+	p.Lock()
+	p.active = strings.TrimRight(url, "/")
+	p.interval = interval
+	p.threshold = threshold
+	p.standby = true
+	p.promoted = make(chan struct{})
+	p.Unlock()
+
+	go func() {
+		client := &http.Client{Timeout: interval}
+		for range time.Tick(interval) {
+			healthy := false
+			if resp, err := client.Get(p.active + "/healthz"); err == nil {
+				healthy = resp.StatusCode == http.StatusOK
+				resp.Body.Close()
+			}
+			if p.observe(healthy) {
+				return
+			}
+		}
+	}()
+}
+
+// observe counts a health check of the active instance and reports whether this instance took over
+func (p *standbyPair) observe(healthy bool) bool {
+	p.Lock()
+	defer p.Unlock()
+
+	if healthy {
+		p.failures = 0
+		return false
+	}
+	p.failures++
+	if p.failures < p.threshold {
+		return false
+	}
+
+	log.WithFields(log.Fields{
+		"plugin":   name,
+		"category": category,
+		"active":   p.active,
+		"failures": p.failures,
+	}).Warn("active instance is not healthy, taking over")
+	if len(jobs.dir) > 0 {
+		jobs.requeueOrphans()
+	}
+	p.standby = false
+	close(p.promoted)
+	return true
+}
+
+// Health json object
+type Health struct {
+	Healthy bool   `json:"healthy"`
+	Role    string `json:"role"`
+	Engine  bool   `json:"engine"`
+}
+
+// webHealth reports whether this instance accepts scans, cheap enough to be
+// polled by load balancers and the standby instance
+func webHealth(w http.ResponseWriter, r *http.Request) {
+	health := Health{Role: pair.role(), Engine: breaker.healthy() && len(engineState.unavailable()) == 0}
+	health.Healthy = health.Role == roleActive && health.Engine
+
+	status := http.StatusOK
+	if !health.Healthy {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, health)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultAliases is the built-in family alias table. Generic tokens describe
+// behaviour or platform rather than a family and are dropped, aliases map
+// vendor specific names onto the canonical family name used across Malice AV plugins.
+const defaultAliases = `{
+  "generic": [
+    "adware", "android", "backdoor", "bat", "behaves", "click", "clicker",
+    "downloader", "dph", "dropper", "dos", "elf", "encoder", "exploit",
+    "file", "generic", "heur", "hllw", "hllp", "hlld", "hosts", "html",
+    "inject", "java", "linux", "macos", "malware", "modification", "multidrop",
+    "origin", "packed", "probably", "program", "pws", "ransom", "riskware",
+    "script", "siggen", "spy", "starter", "stealer", "suspicious", "tool",
+    "trojan", "unwanted", "virus", "win32", "win64", "worm"
+  ],
+  "aliases": {
+    "autoruner": "autorun",
+    "bitcoinminer": "coinminer",
+    "btcmine": "coinminer",
+    "cryptolocker": "cryptolocker",
+    "emotet": "emotet",
+    "gandcrab": "gandcrab",
+    "kovter": "kovter",
+    "lockbit": "lockbit",
+    "mirai": "mirai",
+    "tdss": "tdss",
+    "tdl": "tdss",
+    "trickbot": "trickbot",
+    "wannacry": "wannacry",
+    "wannacryptor": "wannacry",
+    "zbot": "zeus",
+    "zeus": "zeus"
+  }
+}`
+
+var familyTokenRe = regexp.MustCompile(`[^a-z0-9]+`)
+
+// familyTable normalizes detection names into family names
+type familyTable struct {
+	Generic []string          `json:"generic"`
+	Aliases map[string]string `json:"aliases"`
+	generic map[string]bool
+}
+
+// families is nil unless family normalization is enabled
+var families *familyTable
+
+func loadFamilyTable(url string) (*familyTable, error) {
+	table := &familyTable{}
+	if err := json.Unmarshal([]byte(defaultAliases), table); err != nil {
+		return nil, errors.Wrap(err, "failed to parse built-in alias table")
+	}
+
+	var err error
+	if len(url) > 0 {
+		var update *familyTable
+		if update, err = fetchFamilyTable(url); err == nil {
+			table.Generic = append(table.Generic, update.Generic...)
+			for alias, family := range update.Aliases {
+				table.Aliases[alias] = family
+			}
+		}
+	}
+
+	table.generic = make(map[string]bool)
+	for _, token := range table.Generic {
+		table.generic[token] = true
+	}
+
+	return table, err
+}
+
+func fetchFamilyTable(url string) (*familyTable, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to download alias table from %s", url)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download alias table from %s: %s", url, resp.Status)
+	}
+
+	table := &familyTable{}
+	if err := json.NewDecoder(resp.Body).Decode(table); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse alias table from %s", url)
+	}
+	return table, nil
+}
+
+// normalize returns the family of a Dr.Web detection name, i.e.
+// "BackDoor.Tdss.565" becomes "tdss" and "Trojan.Zbot.1234.origin" becomes "zeus"
+func (t *familyTable) normalize(detection string) string {
+	lower := strings.ToLower(detection)
+	if strings.HasPrefix(lower, "eicar") {
+		return "eicar"
+	}
+
+	for _, token := range detectionTokens(detection) {
+		if len(token) < 4 || t.generic[token] {
+			continue
+		}
+		if family, ok := t.Aliases[token]; ok {
+			return family
+		}
+		return token
+	}
+
+	return ""
+}
+
+// detectionTokens splits a detection name into lower case tokens
+func detectionTokens(detection string) []string {
+	var tokens []string
+	for _, token := range familyTokenRe.Split(strings.ToLower(detection), -1) {
+		// Dr.Web appends generation numbers to names (e.g. DownLoader28)
+		token = strings.TrimRight(token, "0123456789")
+		if len(token) > 0 {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+// currentFamilies returns the family table, nil unless family normalization
+// is enabled
+func currentFamilies() *familyTable {
+	reloadLock.RLock()
+	defer reloadLock.RUnlock()
+	return families
+}
+
+func initFamilies(url string) {
+	table, err := loadFamilyTable(url)
+	if err != nil && table != nil {
+		log.WithFields(log.Fields{
+			"plugin":   name,
+			"category": category,
+		}).Warn(errors.Wrap(err, "using built-in alias table"))
+	} else if err != nil {
+		assert(err)
+	}
+	reloadLock.Lock()
+	families = table
+	reloadLock.Unlock()
+}
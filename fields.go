@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// selectableFields are the fields ?fields= and --fields select: those of the
+// results in the JSON schema and the sha256 of the sample
+var selectableFields = schemaResultFields()
+
+// outputFields are the --fields the command line prints, all if empty
+var outputFields []string
+
+// verdictFields are all a verdict API key can select
+var verdictFields = map[string]bool{"sha256": true, "infected": true, "status": true}
+
+func schemaResultFields() map[string]bool {
+	var schema struct {
+		Definitions struct {
+			Results struct {
+				Properties map[string]json.RawMessage `json:"properties"`
+			} `json:"results"`
+		} `json:"definitions"`
+	}
+	assert(json.Unmarshal(asset("results.schema.json"), &schema))
+
+	fields := map[string]bool{"sha256": true}
+	for field := range schema.Definitions.Results.Properties {
+		fields[field] = true
+	}
+	return fields
+}
+
+// parseFields parses comma separated field selections, nil if there are
+// none. Fields not in the results schema are an error, so a typo does not
+// quietly select nothing.
+func parseFields(values ...string) ([]string, error) {
+	var fields []string
+	seen := make(map[string]bool)
+	for _, value := range values {
+		for _, field := range strings.Split(value, ",") {
+			field = strings.TrimSpace(field)
+			if len(field) == 0 || seen[field] {
+				continue
+			}
+			if !selectableFields[field] {
+				return nil, fmt.Errorf("unknown field %q (see /schema/results.json)", field)
+			}
+			seen[field] = true
+			fields = append(fields, field)
+		}
+	}
+	return fields, nil
+}
+
+// selectFields returns the selected fields of results, a ResultsData or a
+// Verdict, as one flat object with the sha256 of the sample. Fields the
+// results leave out, like an empty family, are left out as well.
+func selectFields(sha string, results interface{}, fields []string) map[string]json.RawMessage {
+	data, err := json.Marshal(results)
+	assert(err)
+	var all map[string]json.RawMessage
+	assert(json.Unmarshal(data, &all))
+	all["sha256"], _ = json.Marshal(sha)
+
+	selected := make(map[string]json.RawMessage, len(fields))
+	for _, field := range fields {
+		if value, ok := all[field]; ok {
+			selected[field] = value
+		}
+	}
+	return selected
+}
+
+// requestFields returns the ?fields= (or form field) of a request, answering
+// 400 for unknown fields and 403 if a verdict API key selects more than the verdict
+func requestFields(w http.ResponseWriter, r *http.Request) ([]string, bool) {
+	fields, err := parseFields(requestValues(r, "fields")...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	if verdictOnly(r) {
+		for _, field := range fields {
+			if !verdictFields[field] {
+				http.Error(w, "API key is only allowed the sha256, infected and status fields", http.StatusForbidden)
+				return nil, false
+			}
+		}
+	}
+	return fields, true
+}
+
+// requestSelection returns the selected fields of results as the request's
+// API key may see them
+func requestSelection(r *http.Request, sha string, results ResultsData, fields []string) map[string]json.RawMessage {
+	if verdictOnly(r) {
+		return selectFields(sha, newVerdict(sha, results), fields)
+	}
+	return selectFields(sha, results, fields)
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// dispositions of the files of an upload batch
+const (
+	dispositionApproved    = "approved"
+	dispositionQuarantined = "quarantined"
+	dispositionHeld        = "held"
+)
+
+// Disposition json object, what became of a file of a batch
+type Disposition struct {
+	Path        string       `json:"path"`
+	Size        int64        `json:"size"`
+	SHA256      string       `json:"sha256,omitempty"`
+	Disposition string       `json:"disposition"`
+	Location    string       `json:"location,omitempty"`
+	Detections  []string     `json:"detections,omitempty"`
+	Error       string       `json:"error,omitempty"` // why it was held
+	Results     *ResultsData `json:"drweb,omitempty"`
+}
+
+// DispositionManifest json object, the dispositions of the files of a batch
+type DispositionManifest struct {
+	Batch       string        `json:"batch"`
+	Incoming    string        `json:"incoming"`
+	StartedAt   time.Time     `json:"started_at"`
+	FinishedAt  time.Time     `json:"finished_at"`
+	Approved    int           `json:"approved"`
+	Quarantined int           `json:"quarantined"`
+	Held        int           `json:"held"`
+	Files       []Disposition `json:"files"`
+}
+
+// dispositionTarget is where the files of a disposition go, a directory or
+// an S3 bucket
+type dispositionTarget interface {
+	String() string
+	// move moves file to key, it appears there complete or not at all
+	move(file, key string) (string, error)
+	// write writes data to key
+	write(key string, data []byte) (string, error)
+}
+
+// openDispositionTarget returns the target at location, an
+// s3://bucket/prefix url or a directory, which is created if needed
+func openDispositionTarget(location, endpoint string, private bool) (dispositionTarget, error) {
+	if strings.HasPrefix(location, "s3://") {
+		bucket, err := openBucket(location, endpoint)
+		if err != nil {
+			return nil, err
+		}
+		return &bucketTarget{bucket: bucket}, nil
+	}
+	dir, err := filepath.Abs(strings.TrimPrefix(location, "file://"))
+	if err != nil {
+		return nil, err
+	}
+	t := &dirTarget{dir: dir, private: private}
+	if err := os.MkdirAll(dir, t.dirMode()); err != nil {
+		return nil, errors.Wrapf(err, "failed to create %s", dir)
+	}
+	return t, nil
+}
+
+// dirTarget moves files below a directory. The files of a private one,
+// e.g. a quarantine, are only readable by us.
+type dirTarget struct {
+	dir     string
+	private bool
+}
+
+func (t *dirTarget) String() string {
+	return t.dir
+}
+
+func (t *dirTarget) dirMode() os.FileMode {
+	if t.private {
+		return 0700
+	}
+	return 0755
+}
+
+func (t *dirTarget) path(key string) (string, error) {
+	target := filepath.Join(t.dir, filepath.FromSlash(key))
+	return target, os.MkdirAll(filepath.Dir(target), t.dirMode())
+}
+
+func (t *dirTarget) move(file, key string) (string, error) {
+	target, err := t.path(key)
+	if err != nil {
+		return "", err
+	}
+	if err := os.Rename(file, target); err != nil {
+		// the target may be on another filesystem
+		if err := moveFile(file, target); err != nil {
+			return "", err
+		}
+	}
+	if t.private {
+		return target, os.Chmod(target, 0600)
+	}
+	return target, nil
+}
+
+func (t *dirTarget) write(key string, data []byte) (string, error) {
+	target, err := t.path(key)
+	if err != nil {
+		return "", err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(target), "."+filepath.Base(target)+"-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	if !t.private {
+		os.Chmod(f.Name(), 0644)
+	}
+	return target, os.Rename(f.Name(), target)
+}
+
+// bucketTarget uploads files below the prefix of an S3 bucket and removes
+// them once the upload succeeded
+type bucketTarget struct {
+	bucket *s3Archive
+}
+
+func (t *bucketTarget) String() string {
+	return t.bucket.String()
+}
+
+// objectKey escapes the segments of key, uploads keep their path
+func (t *bucketTarget) objectKey(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return t.bucket.prefix + strings.Join(segments, "/")
+}
+
+func (t *bucketTarget) move(file, key string) (string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	if _, err := t.bucket.putObject(t.objectKey(key), "application/octet-stream", data, time.Time{}, nil); err != nil {
+		return "", err
+	}
+	return "s3://" + t.bucket.bucket + "/" + t.bucket.prefix + key, os.Remove(file)
+}
+
+func (t *bucketTarget) write(key string, data []byte) (string, error) {
+	if _, err := t.bucket.putObject(t.objectKey(key), "application/json", data, time.Time{}, nil); err != nil {
+		return "", err
+	}
+	return "s3://" + t.bucket.bucket + "/" + t.bucket.prefix + key, nil
+}
+
+// heldFile is a file that could not be scanned, tried again once retryAt
+// passed or it changed
+type heldFile struct {
+	stamp   fileStamp
+	retryAt time.Time
+}
+
+// uploadGate passes the files uploaded to an incoming directory on: clean
+// ones to the approved target and infected ones to quarantine, and emits a
+// manifest of the dispositions of every batch. Files that could not be
+// scanned are held in the incoming directory, nothing gets approved without
+// a clean verdict.
+type uploadGate struct {
+	incoming   string
+	approved   dispositionTarget
+	quarantine dispositionTarget
+	manifests  dispositionTarget // nil prints them
+	exclude    *exclusions
+	timeout    int
+	retryHeld  time.Duration
+
+	pending map[string]fileStamp // changed files, passed on once they settled
+	held    map[string]heldFile
+}
+
+// settled returns the files of the incoming directory that stayed the same
+// for a whole poll interval, so uploads still being written are left alone
+func (g *uploadGate) settled() map[string]fileStamp {
+	files := treeFiles(g.incoming, g.exclude)
+	ready := make(map[string]fileStamp)
+	for rel, stamp := range files {
+		if held, ok := g.held[rel]; ok && held.stamp == stamp && time.Now().Before(held.retryAt) {
+			continue
+		}
+		if g.pending[rel] != stamp {
+			g.pending[rel] = stamp
+			continue
+		}
+		ready[rel] = stamp
+	}
+	for rel := range g.pending {
+		if _, ok := files[rel]; !ok {
+			delete(g.pending, rel)
+		}
+	}
+	for rel := range g.held {
+		if _, ok := files[rel]; !ok {
+			delete(g.held, rel)
+		}
+	}
+	return ready
+}
+
+// batch disposes of files and emits their manifest
+func (g *uploadGate) batch(files map[string]fileStamp) (DispositionManifest, error) {
+	started := time.Now().UTC()
+	manifest := DispositionManifest{
+		Batch:     started.Format(storeTimeFormat),
+		Incoming:  g.incoming,
+		StartedAt: started,
+		Files:     []Disposition{},
+	}
+	rels := make([]string, 0, len(files))
+	for rel := range files {
+		rels = append(rels, rel)
+	}
+	sort.Strings(rels)
+
+	for _, rel := range rels {
+		disposition := g.dispose(rel, files[rel])
+		switch disposition.Disposition {
+		case dispositionApproved:
+			manifest.Approved++
+		case dispositionQuarantined:
+			manifest.Quarantined++
+		default:
+			manifest.Held++
+			g.held[rel] = heldFile{stamp: files[rel], retryAt: time.Now().Add(g.retryHeld)}
+		}
+		delete(g.pending, rel)
+		manifest.Files = append(manifest.Files, disposition)
+	}
+	manifest.FinishedAt = time.Now().UTC()
+
+	log.WithFields(log.Fields{
+		"plugin":      name,
+		"category":    category,
+		"batch":       manifest.Batch,
+		"approved":    manifest.Approved,
+		"quarantined": manifest.Quarantined,
+		"held":        manifest.Held,
+	}).Info("batch of ", len(manifest.Files), " files disposed of")
+	return manifest, g.emit(manifest)
+}
+
+// dispose scans a file of the incoming directory and moves it on according
+// to its verdict
+func (g *uploadGate) dispose(rel string, stamp fileStamp) Disposition {
+	file := filepath.Join(g.incoming, rel)
+	disposition := Disposition{Path: filepath.ToSlash(rel), Size: stamp.size, Disposition: dispositionHeld}
+	held := func(err error) Disposition {
+		disposition.Error = err.Error()
+		log.WithFields(log.Fields{
+			"plugin":   name,
+			"category": category,
+			"path":     disposition.Path,
+		}).Warn(errors.Wrap(err, "file held"))
+		return disposition
+	}
+
+	sha, err := fileSHA256(file)
+	if err != nil {
+		return held(err)
+	}
+	disposition.SHA256 = sha
+	results := avScanFile(context.Background(), file, g.timeout, currentDefaultProfile()).Results
+	suppress(sha, "", &Submitter{KeyID: "gate"}, &results)
+	audit.verdict(sha, &Submitter{KeyID: "gate"}, results)
+	disposition.Results = &results
+
+	// the verdict is only good for the file as it was scanned
+	if info, err := os.Stat(file); err != nil || (fileStamp{size: info.Size(), modTime: info.ModTime()}) != stamp {
+		return held(fmt.Errorf("file changed while it was scanned"))
+	}
+
+	switch {
+	case results.Infected:
+		disposition.Detections = detections(results)
+		record := QuarantineRecord{Path: disposition.Path, SHA256: sha, QuarantinedAt: time.Now().UTC(), Results: results}
+		location, err := quarantineFile(g.quarantine, file, record)
+		if err != nil {
+			return held(err)
+		}
+		disposition.Disposition, disposition.Location = dispositionQuarantined, location
+		log.WithFields(log.Fields{
+			"plugin":     name,
+			"category":   category,
+			"path":       disposition.Path,
+			"sha256":     sha,
+			"detections": strings.Join(disposition.Detections, ", "),
+		}).Warn("infected upload quarantined")
+	case len(results.Error) > 0:
+		return held(errors.New(results.Error))
+	case results.Status == statusSkipped:
+		return held(fmt.Errorf("not scanned: %s", results.Result))
+	default:
+		location, err := g.approved.move(file, disposition.Path)
+		if err != nil {
+			return held(errors.Wrap(err, "failed to move file to the approved files"))
+		}
+		disposition.Disposition, disposition.Location = dispositionApproved, location
+	}
+	return disposition
+}
+
+// emit writes the manifest of a batch as <batch>.json to the manifests
+// target, or prints it
+func (g *uploadGate) emit(manifest DispositionManifest) error {
+	if g.manifests == nil {
+		manifestJSON, err := json.Marshal(manifest)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(manifestJSON))
+		return nil
+	}
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if _, err := g.manifests.write(manifest.Batch+".json", manifestJSON); err != nil {
+		return errors.Wrapf(err, "failed to write manifest of batch %s", manifest.Batch)
+	}
+	return nil
+}
+
+// run passes on the uploads that settled every poll interval, as a batch.
+// Nothing is passed on while the engine is unavailable.
+func (g *uploadGate) run(poll time.Duration) {
+	for {
+		time.Sleep(poll)
+		files := g.settled()
+		if len(files) == 0 {
+			continue
+		}
+		if reason := engineState.unavailable(); len(reason) > 0 {
+			log.WithFields(log.Fields{
+				"plugin":   name,
+				"category": category,
+			}).Warn("holding ", len(files), " uploads, the scan engine is unavailable: ", reason)
+			continue
+		}
+		if _, err := g.batch(files); err != nil {
+			log.WithFields(log.Fields{
+				"plugin":   name,
+				"category": category,
+			}).Error(err)
+		}
+	}
+}
+
+func gate(c *cli.Context) error {
+
+	if len(c.String("incoming")) == 0 {
+		return fmt.Errorf("please supply the directory uploads arrive in with --incoming")
+	}
+	incoming, err := filepath.Abs(c.String("incoming"))
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(incoming); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", incoming)
+	}
+	if len(c.String("approved")) == 0 {
+		return fmt.Errorf("please supply where clean files go with --approved, a directory or s3://bucket/prefix")
+	}
+	if len(c.String("quarantine")) == 0 {
+		return fmt.Errorf("please supply where infected files go with --quarantine, a directory or s3://bucket/prefix")
+	}
+	if c.Duration("poll") <= 0 && !c.Bool("once") {
+		return fmt.Errorf("--poll must be positive")
+	}
+
+	exclude, err := parseExclusions(c.StringSlice("exclude"))
+	if err != nil {
+		return err
+	}
+	g := &uploadGate{
+		incoming:  incoming,
+		exclude:   exclude,
+		timeout:   c.GlobalInt("timeout"),
+		retryHeld: c.Duration("retry-held"),
+		pending:   make(map[string]fileStamp),
+		held:      make(map[string]heldFile),
+	}
+	endpoint := c.String("s3-endpoint")
+	if g.approved, err = openDispositionTarget(c.String("approved"), endpoint, false); err != nil {
+		return errors.Wrap(err, "invalid --approved")
+	}
+	if g.quarantine, err = openDispositionTarget(c.String("quarantine"), endpoint, true); err != nil {
+		return errors.Wrap(err, "invalid --quarantine")
+	}
+	if len(c.String("manifests")) > 0 {
+		if g.manifests, err = openDispositionTarget(c.String("manifests"), endpoint, false); err != nil {
+			return errors.Wrap(err, "invalid --manifests")
+		}
+	}
+	// targets inside the incoming directory are never passed on themselves
+	for _, target := range []dispositionTarget{g.approved, g.quarantine, g.manifests} {
+		if dir, ok := target.(*dirTarget); ok {
+			exclude.paths = append(exclude.paths, dir.dir)
+		}
+	}
+
+	if c.Bool("once") {
+		manifest, err := g.batch(treeFiles(incoming, exclude))
+		if err != nil {
+			return err
+		}
+		if manifest.Held > 0 {
+			return cli.NewExitError(fmt.Sprintf("%d files could not be scanned and were held in %s", manifest.Held, incoming), 1)
+		}
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"plugin":     name,
+		"category":   category,
+		"approved":   g.approved.String(),
+		"quarantine": g.quarantine.String(),
+	}).Info("passing on uploads to ", incoming)
+	g.run(c.Duration("poll"))
+	return nil
+}
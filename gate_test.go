@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// fakeCtl is a drweb-ctl that detects EICAR in the file it scans
+const fakeCtl = `#!/bin/sh
+case "$1" in
+license) echo "License number 1 expires 2099";;
+scan) for f; do last="$f"; done
+  grep -q EICAR "$last" && echo "$last - infected with EICAR Test File (NOT a Virus!)" || echo "$last - Ok";;
+esac
+`
+
+// fakeEngine installs a fake engine in a temporary directory
+func fakeEngine(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake engine is a shell script")
+	}
+	dir, err := ioutil.TempDir("", "drweb-engine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := engineDir
+	setEngineDir(dir)
+	t.Cleanup(func() {
+		setEngineDir(previous)
+		os.RemoveAll(dir)
+	})
+	for file, script := range map[string]string{drwebCtl: fakeCtl, drwebConfigd: "#!/bin/sh\nexit 0\n"} {
+		if err := ioutil.WriteFile(file, []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestGateSuppressionPath uploads an infected file under the name of a path
+// suppression, the uploader picked it so it must still be quarantined
+func TestGateSuppressionPath(t *testing.T) {
+	fakeEngine(t)
+
+	reloadLock.Lock()
+	suppressions = []Suppression{{
+		Name:          "build-agent",
+		Detection:     "EICAR*",
+		Path:          "build-agent",
+		Expires:       time.Now().Add(time.Hour),
+		Justification: "test",
+	}}
+	reloadLock.Unlock()
+	defer func() {
+		reloadLock.Lock()
+		suppressions = nil
+		reloadLock.Unlock()
+	}()
+
+	root, err := ioutil.TempDir("", "drweb-gate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	g := &uploadGate{incoming: filepath.Join(root, "incoming"), timeout: 10}
+	for _, dir := range []string{"incoming", "approved", "quarantine"} {
+		if err := os.Mkdir(filepath.Join(root, dir), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if g.approved, err = openDispositionTarget(filepath.Join(root, "approved"), "", false); err != nil {
+		t.Fatal(err)
+	}
+	if g.quarantine, err = openDispositionTarget(filepath.Join(root, "quarantine"), "", true); err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(g.incoming, "build-agent")
+	if err := ioutil.WriteFile(file, []byte("EICAR"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	disposition := g.dispose("build-agent", fileStamp{size: info.Size(), modTime: info.ModTime()})
+	if disposition.Disposition != dispositionQuarantined || disposition.Results == nil || disposition.Results.Suppressed {
+		t.Errorf("got %s (%s), want the upload quarantined", disposition.Disposition, disposition.Error)
+	}
+}
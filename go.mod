@@ -1,7 +1,6 @@
 module github.com/malice-plugins/drweb
 
 require (
-	github.com/Sirupsen/logrus v1.3.0
 	github.com/fatih/structs v1.1.0
 	github.com/gorilla/context v1.1.1
 	github.com/gorilla/mux v1.6.2
@@ -12,11 +11,10 @@ require (
 	github.com/olivere/elastic v6.2.15+incompatible
 	github.com/parnurzeal/gorequest v0.2.15
 	github.com/pkg/errors v0.8.1
+	github.com/sirupsen/logrus v1.3.0
 	github.com/urfave/cli v1.20.0
 	golang.org/x/crypto v0.0.0-20190103213133-ff983b9c42bc
 	golang.org/x/net v0.0.0-20190107155100-1a61f4433d85
 	golang.org/x/sys v0.0.0-20190107070147-cb59ee366067
 	golang.org/x/text v0.3.0
 )
-
-replace github.com/Sirupsen/logrus => github.com/sirupsen/logrus v1.3.0
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// HealthStatus json object
+type HealthStatus struct {
+	Healthy  bool   `json:"healthy"`
+	Engine   bool   `json:"engine"`
+	License  bool   `json:"license"`
+	Database string `json:"database,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// checkHealth verifies the engine answers control queries, has a valid license
+// and a loaded virus base
+func checkHealth(ctx context.Context) HealthStatus {
+	var health HealthStatus
+
+	expired, err := didLicenseExpire(ctx)
+	if err != nil {
+		health.Error = errors.Wrap(err, "failed to check license").Error()
+		return health
+	}
+	health.License = !expired
+
+	if err := startConfigd(ctx); err != nil {
+		health.Error = errors.Wrap(err, "failed to start drweb-configd").Error()
+		return health
+	}
+
+	baseinfo, err := runCtl(ctx, "baseinfo")
+	if err != nil {
+		health.Error = errors.Wrap(err, "engine did not respond").Error()
+		return health
+	}
+	health.Engine = true
+
+	_, health.Database = parseBaseInfo(baseinfo)
+
+	switch {
+	case !health.License:
+		health.Error = "license is missing or expired"
+	case ctlEngine && (len(health.Database) == 0 || health.Database == "0"):
+		health.Error = "virus base is not loaded"
+	default:
+		health.Healthy = true
+	}
+
+	return health
+}
+
+func healthcheck(c *cli.Context) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.Int("timeout"))*time.Second)
+	defer cancel()
+
+	health := checkHealth(ctx)
+	if ctx.Err() == context.DeadlineExceeded {
+		health.Healthy = false
+		health.Error = "healthcheck timed out"
+	}
+
+	healthJSON, err := json.Marshal(health)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(healthJSON))
+
+	if !health.Healthy {
+		return cli.NewExitError("", 1)
+	}
+	return nil
+}
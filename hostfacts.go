@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// osqueryInventory is what is asked of osquery about the host
+const osqueryInventory = `SELECT s.hostname, s.uuid, s.hardware_serial, o.name AS os_name, o.version AS os_version, i.uuid AS host_identifier
+FROM system_info s, os_version o, osquery_info i`
+
+// HostFacts json object, the host a tree was scanned on, so detections can
+// be attributed to an asset of the inventory
+type HostFacts struct {
+	Hostname       string                 `json:"hostname"`
+	OS             string                 `json:"os"`
+	OSVersion      string                 `json:"os_version,omitempty"`
+	Arch           string                 `json:"arch"`
+	UUID           string                 `json:"uuid,omitempty"`
+	HardwareSerial string                 `json:"hardware_serial,omitempty"`
+	OsqueryID      string                 `json:"osquery_host_identifier,omitempty"`
+	Facts          map[string]interface{} `json:"facts,omitempty"`
+}
+
+// readFactsFile reads a JSON object of facts, e.g. the agent ids of the host
+func readFactsFile(file string) (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read host facts")
+	}
+	var facts map[string]interface{}
+	if err := json.Unmarshal(data, &facts); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse host facts file %s, a JSON object expected", file)
+	}
+	return facts, nil
+}
+
+// queryOsquery asks the osqueryd listening on socket about the host, with
+// osqueryi --connect
+func queryOsquery(ctx context.Context, socket string) (map[string]string, error) {
+	out, err := exec.CommandContext(ctx, "osqueryi", "--json", "--connect", socket, osqueryInventory).Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+			err = fmt.Errorf("%s", strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, errors.Wrap(err, "failed to query osquery")
+	}
+	var rows []map[string]string
+	if err := json.Unmarshal(out, &rows); err != nil {
+		return nil, errors.Wrap(err, "failed to parse osquery output")
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("osquery returned nothing about the host")
+	}
+	return rows[0], nil
+}
+
+// hostFacts collects the facts of the host from the --host-facts file and
+// the --osquery-socket of a command, nil if neither is set
+func hostFacts(c *cli.Context) (*HostFacts, error) {
+	file, socket := c.String("host-facts"), c.String("osquery-socket")
+	if len(file) == 0 && len(socket) == 0 {
+		return nil, nil
+	}
+
+	host := &HostFacts{OS: runtime.GOOS, Arch: runtime.GOARCH}
+	host.Hostname, _ = os.Hostname()
+	if len(socket) > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		row, err := queryOsquery(ctx, socket)
+		if err != nil {
+			return nil, err
+		}
+		if len(row["hostname"]) > 0 {
+			host.Hostname = row["hostname"]
+		}
+		if len(row["os_name"]) > 0 {
+			host.OS = row["os_name"]
+		}
+		host.OSVersion, host.UUID, host.HardwareSerial, host.OsqueryID = row["os_version"], row["uuid"], row["hardware_serial"], row["host_identifier"]
+	}
+	if len(file) > 0 {
+		facts, err := readFactsFile(file)
+		if err != nil {
+			return nil, err
+		}
+		host.Facts = facts
+	}
+	return host, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// idempotencyHeader lets clients safely retry scan submissions
+const idempotencyHeader = "Idempotency-Key"
+
+// idempotencyEntry is the response to the first request made with a key,
+// done is closed once the response is available
+type idempotencyEntry struct {
+	key     string
+	sha     string
+	created time.Time
+	done    chan struct{}
+	status  int
+	header  http.Header
+	body    []byte
+}
+
+type idempotencyCache struct {
+	sync.Mutex
+	window  time.Duration
+	entries map[string]*idempotencyEntry
+}
+
+var idempotency = &idempotencyCache{
+	window:  time.Hour,
+	entries: make(map[string]*idempotencyEntry),
+}
+
+// begin returns the entry for key and whether the caller is the first request
+// with that key (and therefore has to call finish)
+func (c *idempotencyCache) begin(key, sha string) (*idempotencyEntry, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	for k, entry := range c.entries {
+		if now.Sub(entry.created) > c.window {
+			select {
+			case <-entry.done:
+				delete(c.entries, k)
+			default:
+				// still in flight
+			}
+		}
+	}
+
+	if entry, exists := c.entries[key]; exists {
+		return entry, false
+	}
+
+	entry := &idempotencyEntry{key: key, sha: sha, created: now, done: make(chan struct{})}
+	c.entries[key] = entry
+	return entry, true
+}
+
+// finish records the response to the first request with a key. Only
+// successful responses are kept, after a failure the key can be retried with
+// a new request; the requests already waiting get the failure.
+func (c *idempotencyCache) finish(entry *idempotencyEntry, rec *recordingResponseWriter) {
+	entry.status = rec.status
+	entry.header = rec.header
+	entry.body = rec.body.Bytes()
+	close(entry.done)
+
+	if entry.status < 200 || entry.status >= 300 {
+		c.Lock()
+		if c.entries[entry.key] == entry {
+			delete(c.entries, entry.key)
+		}
+		c.Unlock()
+	}
+}
+
+// replay writes the original response of a repeated request
+func (entry *idempotencyEntry) replay(w http.ResponseWriter, sha string) {
+	if entry.sha != sha {
+		http.Error(w, idempotencyHeader+" was already used for a different file", http.StatusUnprocessableEntity)
+		return
+	}
+	<-entry.done
+
+	for key, values := range entry.header {
+		w.Header()[key] = values
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(entry.status)
+	w.Write(entry.body)
+}
+
+// recordingResponseWriter keeps a copy of the response so it can be replayed
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (rec *recordingResponseWriter) WriteHeader(status int) {
+	rec.status = status
+	rec.header = rec.Header().Clone()
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *recordingResponseWriter) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+type imageEntry struct {
+	Path    string      `json:"path,omitempty"`
+	Offset  int64       `json:"offset"`
+	Length  int64       `json:"length"`
+	Results ResultsData `json:"drweb"`
+}
+
+// ImageReport json object
+type ImageReport struct {
+	Image    string       `json:"image"`
+	Size     int64        `json:"size"`
+	Mode     string       `json:"mode"`
+	Scanned  int          `json:"scanned"`
+	Infected int          `json:"infected"`
+	Errors   int          `json:"errors"`
+	Summary  ScanSummary  `json:"summary"`
+	Entries  []imageEntry `json:"entries"`
+}
+
+func (r *ImageReport) add(entry imageEntry, infectedOnly bool) {
+	r.Summary.add(entry.Results)
+	r.Scanned++
+	switch {
+	case entry.Results.Infected:
+		r.Infected++
+	case len(entry.Results.Error) > 0:
+		r.Errors++
+	case infectedOnly:
+		return
+	}
+	r.Entries = append(r.Entries, entry)
+}
+
+// scanImageChunks splits the image into overlapping chunks and scans each of
+// them separately so a single slow region can not time out the whole image
+func scanImageChunks(image string, chunkSize, overlap int64, timeout int, infectedOnly bool, report *ImageReport) error {
+	f, err := os.Open(image)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for offset := int64(0); offset < report.Size; offset += chunkSize - overlap {
+		if report.Summary.stop() {
+			report.Summary.leaveOut(fmt.Sprintf("bytes %d-%d", offset, report.Size-1))
+			break
+		}
+		length := chunkSize
+		if offset+length > report.Size {
+			length = report.Size - offset
+		}
+
+		tmpfile, err := ioutil.TempFile("", "image_")
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tmpfile, io.NewSectionReader(f, offset, length))
+		tmpfile.Close()
+		if err != nil {
+			os.Remove(tmpfile.Name())
+			return errors.Wrapf(err, "failed to read chunk at offset %d", offset)
+		}
+
+		log.WithFields(log.Fields{
+			"plugin":   name,
+			"category": category,
+			"offset":   offset,
+			"length":   length,
+		}).Debug("scanning image chunk")
+
+		path = tmpfile.Name()
+		results := AvScanContext(report.Summary.context(), timeout).Results
+		os.Remove(tmpfile.Name())
+		if results.Status == statusError && report.Summary.timedOut() {
+			// the scan was cancelled by --max-time
+			report.Summary.stop()
+			report.Summary.leaveOut(fmt.Sprintf("bytes %d-%d", offset, report.Size-1))
+			break
+		}
+
+		report.add(imageEntry{Offset: offset, Length: length, Results: results}, infectedOnly)
+
+		if offset+length >= report.Size {
+			break
+		}
+	}
+
+	return nil
+}
+
+// scanImageMount loop mounts the image read-only and scans every regular file in it
+func scanImageMount(image string, offset int64, timeout int, infectedOnly bool, report *ImageReport) error {
+	mountPoint, err := ioutil.TempDir("", "image_")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(mountPoint)
+
+	options := fmt.Sprintf("ro,loop,noexec,nodev,nosuid,offset=%d", offset)
+	out, err := exec.Command("mount", "-o", options, image, mountPoint).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "failed to mount %s: %s", image, out)
+	}
+	defer func() {
+		if out, err := exec.Command("umount", mountPoint).CombinedOutput(); err != nil {
+			log.WithFields(log.Fields{
+				"plugin":   name,
+				"category": category,
+			}).Error(errors.Wrapf(err, "failed to unmount %s: %s", mountPoint, out))
+		}
+	}()
+
+	return filepath.Walk(mountPoint, func(file string, info os.FileInfo, err error) error {
+		rel, _ := filepath.Rel(mountPoint, file)
+		if err != nil {
+			report.add(imageEntry{Path: rel, Results: ResultsData{Error: err.Error()}}, infectedOnly)
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if report.Summary.stop() {
+			// go on listing what is left out
+			report.Summary.leaveOut(rel)
+			return nil
+		}
+
+		log.WithFields(log.Fields{
+			"plugin":   name,
+			"category": category,
+		}).Debug("scanning image entry: ", rel)
+
+		path = file
+		results := AvScanContext(report.Summary.context(), timeout).Results
+		if results.Status == statusError && report.Summary.timedOut() {
+			// the scan was cancelled by --max-time
+			report.Summary.stop()
+			report.Summary.leaveOut(rel)
+			return nil
+		}
+		report.add(imageEntry{Path: rel, Length: info.Size(), Results: results}, infectedOnly)
+
+		return nil
+	})
+}
+
+func scanImage(c *cli.Context) error {
+
+	if !c.Args().Present() {
+		return fmt.Errorf("please supply an image to scan with malice/%s", name)
+	}
+	image := c.Args().First()
+
+	info, err := os.Stat(image)
+	if err != nil {
+		return err
+	}
+
+	failOn, err := parseFailOn(c.String("fail-on"))
+	if err != nil {
+		return err
+	}
+
+	report := ImageReport{
+		Image:   image,
+		Size:    info.Size(),
+		Mode:    "chunk",
+		Summary: newScanSummary(c.Int("max-findings"), c.Duration("max-time")),
+		Entries: []imageEntry{},
+	}
+
+	if c.Bool("mount") {
+		report.Mode = "mount"
+		err = scanImageMount(image, c.Int64("offset"), c.GlobalInt("timeout"), c.Bool("infected-only"), &report)
+	} else {
+		chunkSize := c.Int64("chunk-size") << 20
+		overlap := c.Int64("overlap") << 20
+		if chunkSize <= 0 || overlap < 0 || overlap >= chunkSize {
+			return fmt.Errorf("--overlap must be smaller than --chunk-size")
+		}
+		err = scanImageChunks(image, chunkSize, overlap, c.GlobalInt("timeout"), c.Bool("infected-only"), &report)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to scan image %s", image)
+	}
+	report.Summary.finish()
+
+	reportJSON, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(reportJSON))
+
+	return report.Summary.exitError(failOn)
+}
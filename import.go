@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// import formats, besides csv
+const (
+	importJSON = "json"
+)
+
+// ImportReport json object, what an import loaded into the store
+type ImportReport struct {
+	Files    int `json:"files"`
+	Imported int `json:"imported"`
+	Existing int `json:"existing"` // already stored, e.g. by an earlier import
+	Skipped  int `json:"skipped"`  // unreadable, or without a sha256 or scan time
+}
+
+// resultImporter loads result exports into a store
+type resultImporter struct {
+	store     *resultStore
+	scannedAt time.Time // of records without a scan time, skipped if zero
+	report    ImportReport
+}
+
+// upgradeResults brings results of earlier versions up to the current
+// shape: a status, updated_at instead of the yyyymmdd updated field and the
+// confidence, family and ATT&CK techniques of detections
+func upgradeResults(results *ResultsData) {
+	if len(results.Status) == 0 {
+		switch {
+		case len(results.Error) > 0:
+			results.Status = statusError
+		case results.Infected:
+			results.Status = statusInfected
+		default:
+			results.Status = statusClean
+		}
+	}
+	if results.UpdatedAt == nil && len(results.Updated) > 0 {
+		if updated, ok := parseTimestamp(results.Updated); ok {
+			results.UpdatedAt = &updated
+		}
+	}
+	if !legacyUpdated && results.UpdatedAt != nil {
+		results.Updated = ""
+	}
+	if results.Infected && len(results.Result) > 0 {
+		if len(results.Confidence) == 0 {
+			results.Heuristic, results.Confidence = classifyDetection(results.Result)
+		}
+		if families := currentFamilies(); families != nil && len(results.Family) == 0 {
+			results.Family = families.normalize(results.Result)
+		}
+		if currentAttackMap() != nil && len(results.Attack) == 0 {
+			results.Attack = attackTechniques(results.Result, results.Family)
+		}
+	}
+}
+
+// parseLegacyResult parses a JSON record of an export: a stored result, the
+// output of a scan ({"id": ..., "drweb": {...}}) or the flat results of old
+// versions with the sha256 next to them
+func parseLegacyResult(data []byte) (StoredResult, error) {
+	var stored StoredResult
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return stored, err
+	}
+	text := func(field string) string {
+		var value string
+		json.Unmarshal(fields[field], &value)
+		return value
+	}
+
+	stored.SHA256 = text("sha256")
+	if id := text("id"); len(stored.SHA256) == 0 && validSHA256(id) {
+		stored.SHA256 = id
+	}
+	scannedAt := text("scanned_at")
+	if len(scannedAt) == 0 {
+		scannedAt = text("scan_date")
+	}
+
+	results, ok := fields["drweb"]
+	if !ok {
+		for _, field := range []string{"sha256", "id", "scanned_at", "scan_date"} {
+			delete(fields, field)
+		}
+		results, _ = json.Marshal(fields)
+	}
+	if err := json.Unmarshal(results, &stored.Results); err != nil {
+		return stored, err
+	}
+
+	if t, ok := parseTimestamp(scannedAt); ok {
+		stored.ScannedAt = t
+	} else if stored.Results.ScannedAt != nil {
+		stored.ScannedAt = *stored.Results.ScannedAt
+	}
+	return stored, nil
+}
+
+// splitList splits a ';' separated column of a CSV export
+func splitList(value string) []string {
+	if len(value) == 0 {
+		return nil
+	}
+	return strings.Split(value, ";")
+}
+
+// readCSV reads a CSV export, by the names of its columns so exports of
+// versions with fewer columns can be read as well
+func (i *resultImporter) readCSV(file string, r io.Reader) error {
+	in := csv.NewReader(r)
+	in.FieldsPerRecord = -1
+	header, err := in.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %s", file)
+	}
+	columns := make(map[string]int)
+	for n, column := range header {
+		columns[strings.TrimSpace(column)] = n
+	}
+	if _, ok := columns["sha256"]; !ok {
+		return fmt.Errorf("%s is not a result export (no sha256 column)", file)
+	}
+
+	for line := 2; ; line++ {
+		row, err := in.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			i.skip(file, line, err)
+			continue
+		}
+		column := func(key string) string {
+			if n, ok := columns[key]; ok && n < len(row) {
+				return row[n]
+			}
+			return ""
+		}
+		flag := func(key string) bool {
+			b, _ := strconv.ParseBool(column(key))
+			return b
+		}
+
+		stored := StoredResult{
+			SHA256: column("sha256"),
+			Results: ResultsData{
+				Infected:   flag("infected"),
+				Status:     column("status"),
+				Result:     column("result"),
+				Heuristic:  flag("heuristic"),
+				Confidence: column("confidence"),
+				Family:     column("family"),
+				Attack:     splitList(column("attack")),
+				Tags:       splitList(column("tags")),
+				Engine:     column("engine"),
+				Database:   column("database"),
+				Updated:    column("updated"),
+				Source:     column("source"),
+				Error:      column("error"),
+			},
+		}
+		stored.ScannedAt, _ = parseTimestamp(column("scanned_at"))
+		i.add(file, line, stored)
+	}
+}
+
+// readJSON reads a JSON export: an array of records, or one record after
+// the other as in JSON lines
+func (i *resultImporter) readJSON(file string, r io.Reader) error {
+	reader := bufio.NewReader(r)
+	first, err := firstByte(reader)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %s", file)
+	}
+
+	var records []json.RawMessage
+	decoder := json.NewDecoder(reader)
+	if first == '[' {
+		if err := decoder.Decode(&records); err != nil {
+			return errors.Wrapf(err, "failed to parse %s", file)
+		}
+	} else {
+		for {
+			var record json.RawMessage
+			if err := decoder.Decode(&record); err == io.EOF {
+				break
+			} else if err != nil {
+				// the rest of the file can not be told apart anymore
+				i.skip(file, len(records)+1, err)
+				break
+			}
+			records = append(records, record)
+		}
+	}
+
+	for n, record := range records {
+		stored, err := parseLegacyResult(record)
+		if err != nil {
+			i.skip(file, n+1, err)
+			continue
+		}
+		i.add(file, n+1, stored)
+	}
+	return nil
+}
+
+// firstByte returns the first byte of r that is not white space, without consuming it
+func firstByte(r *bufio.Reader) (byte, error) {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if strings.IndexByte(" \t\r\n", b) < 0 {
+			return b, r.UnreadByte()
+		}
+	}
+}
+
+// add stores a record, record is its line of a CSV export or its number in
+// a JSON export
+func (i *resultImporter) add(file string, record int, stored StoredResult) {
+	if !validSHA256(stored.SHA256) {
+		i.skip(file, record, fmt.Errorf("invalid sha256 %q", stored.SHA256))
+		return
+	}
+	if stored.ScannedAt.IsZero() {
+		if i.scannedAt.IsZero() {
+			i.skip(file, record, fmt.Errorf("no scan time (see --scanned-at)"))
+			return
+		}
+		stored.ScannedAt = i.scannedAt
+	}
+	upgradeResults(&stored.Results)
+
+	imported, err := i.store.restore(stored)
+	if err != nil {
+		i.skip(file, record, err)
+		return
+	}
+	if !imported {
+		i.report.Existing++
+		return
+	}
+	i.report.Imported++
+	store.countScan(stored.Results, 0)
+	if i.store != store {
+		i.store.countScan(stored.Results, 0)
+	}
+}
+
+func (i *resultImporter) skip(file string, record int, err error) {
+	i.report.Skipped++
+	log.WithFields(log.Fields{
+		"plugin":   name,
+		"category": category,
+		"file":     file,
+		"record":   record,
+	}).Warn(errors.Wrap(err, "skipped result"))
+}
+
+// importFile imports a JSON or CSV export, format is guessed from the
+// extension if it is empty
+func (i *resultImporter) importFile(file, format string) error {
+	if len(format) == 0 {
+		format = importJSON
+		if strings.EqualFold(filepath.Ext(file), ".csv") {
+			format = exportCSV
+		}
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	i.report.Files++
+	if format == exportCSV {
+		return i.readCSV(file, f)
+	}
+	return i.readJSON(file, f)
+}
+
+// importFiles returns the exports to import, the .json, .jsonl, .ndjson and
+// .csv files of directories
+func importFiles(args []string) ([]string, error) {
+	var files []string
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, arg)
+			continue
+		}
+		err = filepath.Walk(arg, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			switch strings.ToLower(filepath.Ext(file)) {
+			case ".json", ".jsonl", ".ndjson", ".csv":
+				if !info.IsDir() {
+					files = append(files, file)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// importCommand loads result exports of earlier versions into the store,
+// importing the same export again only adds what is not stored yet
+func importCommand(c *cli.Context) error {
+	if store == nil {
+		return fmt.Errorf("import requires --store")
+	}
+	if !c.Args().Present() {
+		return fmt.Errorf("import needs the files or directories to import")
+	}
+	format := strings.ToLower(c.String("format"))
+	if len(format) > 0 && format != importJSON && format != exportCSV {
+		return fmt.Errorf("invalid import format %q (must be %s or %s)", format, importJSON, exportCSV)
+	}
+	tenant := c.String("tenant")
+	if len(tenant) > 0 && !validTenantID(tenant) {
+		return fmt.Errorf("invalid tenant %q", tenant)
+	}
+
+	importer := &resultImporter{store: store.tenant(tenant)}
+	if len(c.String("scanned-at")) > 0 {
+		var err error
+		if importer.scannedAt, err = parseExportTime(c.String("scanned-at"), false); err != nil {
+			return err
+		}
+	}
+
+	files, err := importFiles(c.Args())
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := importer.importFile(file, format); err != nil {
+			return err
+		}
+	}
+
+	data, err := json.Marshal(importer.report)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
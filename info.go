@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var licenseExpiryRe = regexp.MustCompile(`expires\s+(?:on\s+)?([^(,]+)`)
+
+// Info json object
+type Info struct {
+	Plugin          string `json:"plugin"`
+	Version         string `json:"version"`
+	BuildTime       string `json:"build_time"`
+	GoVersion       string `json:"go_version"`
+	Engine          string `json:"engine,omitempty"`
+	Database        string `json:"database,omitempty"`
+	DatabaseUpdated string `json:"database_updated,omitempty"`
+	LicenseExpires  string `json:"license_expires,omitempty"`
+	Error           string `json:"error,omitempty"`
+}
+
+// parseLicenseExpiry returns when the license in the output of drweb-ctl license expires
+func parseLicenseExpiry(license string) string {
+	if m := licenseExpiryRe.FindStringSubmatch(license); m != nil {
+		return strings.TrimRight(strings.TrimSpace(m[1]), ".")
+	}
+	return ""
+}
+
+// getInfo collects the plugin, engine, virus base and license versions
+func getInfo(ctx context.Context) Info {
+	info := Info{
+		Plugin:    name,
+		Version:   Version,
+		BuildTime: BuildTime,
+		GoVersion: runtime.Version(),
+	}
+
+	base, err := baseInfo.get(ctx)
+	if err != nil {
+		info.DatabaseUpdated = formatTimestamp(definitionsUpdated())
+		info.Error = err.Error()
+		return info
+	}
+	info.Engine, info.Database, info.DatabaseUpdated = base.Engine, base.Database, formatTimestamp(base.UpdatedAt)
+
+	if !ctlEngine {
+		return info
+	}
+	license, err := runCtl(ctx, "license")
+	if err != nil {
+		info.Error = errors.Wrap(err, "failed to get license info").Error()
+		return info
+	}
+	info.LicenseExpires = parseLicenseExpiry(license)
+
+	return info
+}
+
+func printInfo(c *cli.Context) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.GlobalInt("timeout"))*time.Second)
+	defer cancel()
+
+	infoJSON, err := json.Marshal(getInfo(ctx))
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(infoJSON))
+
+	return nil
+}
+
+// webVersion returns the plugin, engine and virus base versions
+func webVersion(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	writeJSON(w, http.StatusOK, getInfo(ctx))
+}
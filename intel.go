@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// IntelReference json object, threat intel matching a detected sample
+type IntelReference struct {
+	Source string   `json:"source" structs:"source"`
+	Title  string   `json:"title,omitempty" structs:"title,omitempty"`
+	URL    string   `json:"url,omitempty" structs:"url,omitempty"`
+	Tags   []string `json:"tags,omitempty" structs:"tags,omitempty"`
+}
+
+// intelSources are the threat intel services detections are looked up in
+type intelSources struct {
+	urls    []string
+	misp    string
+	mispKey string
+	client  *http.Client
+}
+
+// intel is nil unless --intel-url or --misp-url is set
+var intel *intelSources
+
+func newIntelSources(urls []string, misp, mispKey string, timeout time.Duration) *intelSources {
+	return &intelSources{
+		urls:    urls,
+		misp:    strings.TrimRight(misp, "/"),
+		mispKey: mispKey,
+		client:  &http.Client{Timeout: timeout},
+	}
+}
+
+// intelURL fills the {sha256}, {result} and {family} placeholders of a url
+func intelURL(template, sha string, results ResultsData) string {
+	return strings.NewReplacer(
+		"{sha256}", sha,
+		"{result}", url.QueryEscape(results.Result),
+		"{family}", url.QueryEscape(results.Family),
+	).Replace(template)
+}
+
+// do sends req and decodes a JSON response into v, not found leaves v alone
+func (s *intelSources) do(req *http.Request, v interface{}) error {
+	req.Header.Set("Accept", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil
+	default:
+		return fmt.Errorf("intel lookup returned %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return errors.Wrap(err, "failed to parse intel response")
+	}
+	return nil
+}
+
+// lookupREST queries a threat intel platform answering {"references": [...]}
+func (s *intelSources) lookupREST(ctx context.Context, template, sha string, results ResultsData) ([]IntelReference, error) {
+	lookup := intelURL(template, sha, results)
+	req, err := http.NewRequest("GET", lookup, nil)
+	if err != nil {
+		return nil, err
+	}
+	var response struct {
+		References []IntelReference `json:"references"`
+	}
+	if err := s.do(req.WithContext(ctx), &response); err != nil {
+		return nil, err
+	}
+
+	source := lookup
+	if u, err := url.Parse(lookup); err == nil {
+		source = u.Host
+	}
+	for i := range response.References {
+		if len(response.References[i].Source) == 0 {
+			response.References[i].Source = source
+		}
+	}
+	return response.References, nil
+}
+
+// lookupMISP searches MISP attributes for the hash, every event it is in is a reference
+func (s *intelSources) lookupMISP(ctx context.Context, sha string) ([]IntelReference, error) {
+	query, err := json.Marshal(map[string]interface{}{
+		"returnFormat":     "json",
+		"value":            sha,
+		"includeEventTags": true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", s.misp+"/attributes/restSearch", bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", s.mispKey)
+
+	var response struct {
+		Response struct {
+			Attribute []struct {
+				EventID string `json:"event_id"`
+				Event   struct {
+					Info string `json:"info"`
+				} `json:"Event"`
+				Tag []struct {
+					Name string `json:"name"`
+				} `json:"Tag"`
+			} `json:"Attribute"`
+		} `json:"response"`
+	}
+	if err := s.do(req.WithContext(ctx), &response); err != nil {
+		return nil, err
+	}
+
+	var references []IntelReference
+	seen := make(map[string]bool)
+	for _, attribute := range response.Response.Attribute {
+		if seen[attribute.EventID] {
+			continue
+		}
+		seen[attribute.EventID] = true
+		reference := IntelReference{
+			Source: "misp",
+			Title:  attribute.Event.Info,
+			URL:    s.misp + "/events/view/" + attribute.EventID,
+		}
+		for _, tag := range attribute.Tag {
+			reference.Tags = append(reference.Tags, tag.Name)
+		}
+		references = append(references, reference)
+	}
+	return references, nil
+}
+
+// enrich attaches the intel matching a detected sample to its results, all
+// sources are queried at once and failed lookups are only logged
+func (s *intelSources) enrich(ctx context.Context, sha string, results *ResultsData) {
+	if s == nil || !results.Infected {
+		return
+	}
+
+	var lookups []func() ([]IntelReference, error)
+	for _, template := range s.urls {
+		template := template
+		lookups = append(lookups, func() ([]IntelReference, error) {
+			return s.lookupREST(ctx, template, sha, *results)
+		})
+	}
+	if len(s.misp) > 0 {
+		lookups = append(lookups, func() ([]IntelReference, error) {
+			return s.lookupMISP(ctx, sha)
+		})
+	}
+
+	found := make([][]IntelReference, len(lookups))
+	var wg sync.WaitGroup
+	for i, lookup := range lookups {
+		wg.Add(1)
+		go func(i int, lookup func() ([]IntelReference, error)) {
+			defer wg.Done()
+			references, err := lookup()
+			if err != nil {
+				log.WithFields(log.Fields{
+					"plugin":   name,
+					"category": category,
+					"sha256":   sha,
+				}).Warn(errors.Wrap(err, "failed to look up threat intel"))
+			}
+			found[i] = references
+		}(i, lookup)
+	}
+	wg.Wait()
+
+	for _, references := range found {
+		results.Intel = append(results.Intel, references...)
+	}
+}
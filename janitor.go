@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// sampleRetention is how long web uploads are kept in the store, samples are
+// not kept if it is zero
+var sampleRetention time.Duration
+
+// janitor removes scan temp files left behind by crashed scans and retained
+// samples past their retention period
+type janitor struct {
+	tempMaxAge time.Duration
+	retention  time.Duration
+}
+
+// start sweeps once right away, to clean up after a previous crash, and then every interval
+func (j *janitor) start(interval time.Duration) {
+	j.sweep()
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(interval) {
+			j.sweep()
+		}
+	}()
+}
+
+func (j *janitor) sweep() {
+	now := time.Now()
+
+	removed := 0
+	for _, file := range openTempFiles() {
+		info, err := os.Lstat(file)
+		if err != nil || now.Sub(info.ModTime()) < j.tempMaxAge {
+			continue
+		}
+		if info.IsDir() {
+			// never descend into an image that is still mounted
+			if isMountPoint(file, info) {
+				continue
+			}
+			err = os.RemoveAll(file)
+		} else {
+			err = os.Remove(file)
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"plugin":   name,
+				"category": category,
+			}).Error(err)
+			continue
+		}
+		removed++
+	}
+
+	pruned := 0
+	if store != nil && j.retention > 0 {
+		var err error
+		if pruned, err = store.pruneSamples(now.Add(-j.retention)); err != nil {
+			log.WithFields(log.Fields{
+				"plugin":   name,
+				"category": category,
+			}).Error(err)
+		}
+	}
+
+	if removed > 0 || pruned > 0 {
+		log.WithFields(log.Fields{
+			"plugin":     name,
+			"category":   category,
+			"temp_files": removed,
+			"samples":    pruned,
+		}).Info("janitor cleaned up")
+	}
+}
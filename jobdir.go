@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// jobPollInterval is how often a shared job directory is checked for new
+// jobs and running jobs for cancellation by another instance
+const jobPollInterval = time.Second
+
+// storedJob is a job in a shared job directory, its sample is kept next to it
+type storedJob struct {
+	ScanJob
+	Owner     string      `json:"owner"`
+	Name      string      `json:"name,omitempty"`
+	Submitter *Submitter  `json:"submitter,omitempty"`
+	Received  time.Time   `json:"received"`
+	Options   ScanOptions `json:"options"`
+}
+
+func (q *jobQueue) jobFile(id, ext string) string {
+	return filepath.Join(q.dir, id+ext)
+}
+
+// load reads a job from the job directory
+func (q *jobQueue) load(id string) (*storedJob, error) {
+	data, err := ioutil.ReadFile(q.jobFile(id, ".json"))
+	if err != nil {
+		return nil, err
+	}
+	job := &storedJob{}
+	if err := json.Unmarshal(data, job); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse scan job %s", id)
+	}
+	return job, nil
+}
+
+// save atomically replaces a job in the job directory
+func (q *jobQueue) save(job *storedJob) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	tmp := q.jobFile(job.ID, ".json.tmp")
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.jobFile(job.ID, ".json"))
+}
+
+// remove deletes a job, its sample and claim
+func (q *jobQueue) remove(id string) {
+	for _, ext := range []string{".json", ".sample", ".claim"} {
+		os.Remove(q.jobFile(id, ext))
+	}
+}
+
+// list returns the jobs in the job directory, oldest first
+func (q *jobQueue) list() []*storedJob {
+	files, _ := filepath.Glob(filepath.Join(q.dir, "*.json"))
+	var stored []*storedJob
+	for _, file := range files {
+		if job, err := q.load(strings.TrimSuffix(filepath.Base(file), ".json")); err == nil {
+			stored = append(stored, job)
+		}
+	}
+	sort.Slice(stored, func(i, j int) bool {
+		return stored[i].SubmittedAt.Before(stored[j].SubmittedAt)
+	})
+	return stored
+}
+
+// claim makes this instance the only one to run a job
+func (q *jobQueue) claim(id string) bool {
+	f, err := os.OpenFile(q.jobFile(id, ".claim"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	fmt.Fprintln(f, q.instance)
+	return true
+}
+
+// claimedBy returns the instance that claimed a job
+func (q *jobQueue) claimedBy(id string) string {
+	data, _ := ioutil.ReadFile(q.jobFile(id, ".claim"))
+	return strings.TrimSpace(string(data))
+}
+
+func (q *jobQueue) submitDir(upload *uploadScan, owner string) (ScanJob, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	now := time.Now()
+	queued := 0
+	for _, job := range q.list() {
+		switch {
+		case job.FinishedAt != nil && now.Sub(*job.FinishedAt) > q.retention:
+			q.remove(job.ID)
+		case job.Status == jobQueued:
+			queued++
+		}
+	}
+	if queued >= maxQueuedJobs {
+		return ScanJob{}, fmt.Errorf("too many queued scans")
+	}
+
+	// the instance that runs the job may have another --profile
+	options := upload.options
+	if len(options.Profile) == 0 {
+		options.Profile = upload.profile.profileName()
+	}
+	job := &storedJob{
+		ScanJob: ScanJob{
+			ID:          newJobID(),
+			Status:      jobQueued,
+			SHA256:      upload.sha,
+			Size:        len(upload.data),
+			Priority:    jobPriority(upload.options.Priority),
+			SubmittedAt: now.UTC(),
+		},
+		Owner:     owner,
+		Name:      upload.name,
+		Submitter: upload.submitter,
+		Received:  upload.received,
+		Options:   options,
+	}
+	if err := ioutil.WriteFile(q.jobFile(job.ID, ".sample"), upload.data, 0600); err != nil {
+		return ScanJob{}, errors.Wrap(err, "failed to queue scan")
+	}
+	if err := q.save(job); err != nil {
+		os.Remove(q.jobFile(job.ID, ".sample"))
+		return ScanJob{}, errors.Wrap(err, "failed to queue scan")
+	}
+	return job.ScanJob, nil
+}
+
+func (q *jobQueue) getDir(id, owner string) (ScanJob, bool) {
+	job, err := q.load(id)
+	if err != nil || job.Owner != owner {
+		return ScanJob{}, false
+	}
+	return job.ScanJob, true
+}
+
+// tenant returns the tenant that submitted a job
+func (job *storedJob) tenant() string {
+	if job.Submitter == nil {
+		return ""
+	}
+	return job.Submitter.Tenant
+}
+
+// cancelDir marks a job cancelled, the instance running it notices within jobPollInterval
+func (q *jobQueue) cancelDir(id string, match func(owner, tenant string) bool) (ScanJob, bool, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	job, err := q.load(id)
+	if err != nil || !match(job.Owner, job.tenant()) {
+		return ScanJob{}, false, nil
+	}
+	switch job.Status {
+	case jobQueued, jobRunning:
+		finished := time.Now().UTC()
+		job.Status = jobCancelled
+		job.FinishedAt = &finished
+		if err := q.save(job); err != nil {
+			return job.ScanJob, true, err
+		}
+		if job.StartedAt == nil {
+			os.Remove(q.jobFile(id, ".sample"))
+		}
+		return job.ScanJob, true, nil
+	}
+	return job.ScanJob, true, fmt.Errorf("scan job is already %s", job.Status)
+}
+
+// nextDir claims the queued job with the highest priority, the oldest of them
+func (q *jobQueue) nextDir() *storedJob {
+	q.Lock()
+	defer q.Unlock()
+
+	stored := q.list()
+	sort.SliceStable(stored, func(i, j int) bool {
+		return priorityRank(stored[i].Priority) < priorityRank(stored[j].Priority)
+	})
+	for _, job := range stored {
+		if job.Status != jobQueued || !q.claim(job.ID) {
+			continue
+		}
+		// it may have been cancelled between listing and claiming
+		if current, err := q.load(job.ID); err != nil || current.Status != jobQueued {
+			continue
+		}
+		started := time.Now().UTC()
+		job.Status = jobRunning
+		job.StartedAt = &started
+		if err := q.save(job); err != nil {
+			log.WithFields(log.Fields{
+				"plugin":   name,
+				"category": category,
+				"job":      job.ID,
+			}).Error(err)
+			continue
+		}
+		return job
+	}
+	return nil
+}
+
+// workDir runs the jobs in the job directory, as long as this instance is active
+func (q *jobQueue) workDir() {
+	for {
+		pair.wait()
+		// a draining instance leaves the queued jobs to the others
+		var job *storedJob
+		if !drain.draining() {
+			job = q.nextDir()
+		}
+		if job == nil {
+			time.Sleep(jobPollInterval)
+			continue
+		}
+		q.run(job)
+	}
+}
+
+// run scans a claimed job and saves its results, unless it was cancelled meanwhile
+func (q *jobQueue) run(job *storedJob) {
+	data, err := ioutil.ReadFile(q.jobFile(job.ID, ".sample"))
+	if err != nil {
+		err = errors.Wrap(err, "failed to read sample")
+	}
+	// the profile may have been removed since the job was queued
+	var upload *uploadScan
+	if err == nil {
+		options := job.Options
+		options.Priority = job.Priority
+		upload, err = newUploadScan(data, job.Name, job.Submitter, job.Received, options)
+	}
+
+	var drweb DrWEB
+	if err == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			ticker := time.NewTicker(jobPollInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					if current, err := q.load(job.ID); err == nil && current.Status == jobCancelled {
+						cancel()
+						return
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+		drweb, err = upload.scan(ctx)
+		close(done)
+		cancel()
+	}
+	job.Options.Callback.deliver(job.SHA256, drweb, err)
+
+	q.Lock()
+	defer q.Unlock()
+
+	os.Remove(q.jobFile(job.ID, ".sample"))
+	current, lerr := q.load(job.ID)
+	if lerr != nil || current.Status == jobCancelled {
+		return
+	}
+	finished := time.Now().UTC()
+	current.Status = jobDone
+	current.FinishedAt = &finished
+	if err != nil {
+		current.Error = err.Error()
+	} else {
+		current.Result = &drweb
+	}
+	if err := q.save(current); err != nil {
+		log.WithFields(log.Fields{
+			"plugin":   name,
+			"category": category,
+			"job":      job.ID,
+		}).Error(err)
+	}
+}
+
+// requeueOrphans puts the jobs another instance was running back in the
+// queue, called when taking over from an active instance that stopped
+// responding and will not finish them
+func (q *jobQueue) requeueOrphans() {
+	q.Lock()
+	defer q.Unlock()
+
+	for _, job := range q.list() {
+		if job.Status != jobRunning || q.claimedBy(job.ID) == q.instance {
+			continue
+		}
+		job.Status = jobQueued
+		job.StartedAt = nil
+		if err := q.save(job); err != nil {
+			log.WithFields(log.Fields{
+				"plugin":   name,
+				"category": category,
+				"job":      job.ID,
+			}).Error(err)
+			continue
+		}
+		os.Remove(q.jobFile(job.ID, ".claim"))
+		log.WithFields(log.Fields{
+			"plugin":   name,
+			"category": category,
+			"job":      job.ID,
+		}).Info("requeued scan job of the previous active instance")
+	}
+}
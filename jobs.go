@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxQueuedJobs is how many async scans may wait for the engine
+const maxQueuedJobs = 100
+
+// job statuses
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobDone      = "done"
+	jobCancelled = "cancelled"
+)
+
+// uploadScan is a sample submitted to the web service
+type uploadScan struct {
+	sha       string
+	name      string // file name of the upload, empty if unknown
+	data      []byte
+	submitter *Submitter
+	received  time.Time
+	options   ScanOptions
+	profile   *ScanProfile // the options resolve to
+}
+
+// newUploadScan returns the scan of a sample with options, which fails if
+// they name an unknown profile
+func newUploadScan(data []byte, name string, submitter *Submitter, received time.Time, options ScanOptions) (*uploadScan, error) {
+	profile, err := options.scanProfile()
+	if err != nil {
+		return nil, err
+	}
+	return &uploadScan{
+		sha:       fmt.Sprintf("%x", sha256.Sum256(data)),
+		name:      name,
+		data:      data,
+		submitter: submitter,
+		received:  received,
+		options:   options,
+		profile:   profile,
+	}, nil
+}
+
+// scanLocally writes the upload to a temp file and scans it with the engine,
+// archives are unpacked and their members scanned as well if explode is set.
+// Scans of a single file count towards the latencies by size and type.
+func (u *uploadScan) scanLocally(ctx context.Context, explode bool, contentType string) (DrWEB, error) {
+	return pool.scan(ctx, func() (DrWEB, error) {
+		started := time.Now()
+		drweb, err := scanReader(ctx, bytes.NewReader(u.data), withProfile(u.profile), withExplode(explode), withLimits(u.options.limits()))
+		if err == nil && !explode {
+			latencies.record(u.profile, int64(len(u.data)), contentType, drweb.Results, time.Since(started))
+		}
+		return drweb, err
+	})
+}
+
+// scan scans the upload, unless the hash reputation service is confident
+// about it or a scan policy skips it, and stores, counts and signs the results
+func (u *uploadScan) scan(ctx context.Context) (DrWEB, error) {
+	sample := uploadSample(u.data, u.name, u.submitter)
+	contentType := sample.contentType
+	policy := matchScanPolicy(sample)
+
+	var drweb DrWEB
+	var err error
+	if policy.keepsFromEngine() {
+		drweb.Results = policy.skipped(contentType)
+	} else {
+		explode := u.profile.explode(defaultExplode) || policy != nil && policy.Action == policyExplode
+		fanOut := peers.scan(ctx, u.sha, u.data)
+		// members are only scanned locally, so archives to explode are never looked up
+		var known bool
+		if !explode {
+			drweb.Results, known = cloud.lookup(ctx, u.sha)
+		}
+		if !known {
+			if drweb, err = u.scanLocally(ctx, explode, contentType); err != nil {
+				metrics.scan(u.submitter, u.profile.profileName(), ResultsData{Status: statusError}, time.Since(u.received))
+				audit.verdict(u.sha, u.submitter, ResultsData{Status: statusError, Error: err.Error()})
+				return drweb, err
+			}
+			shadow.mirror(u.sha, u.data, drweb.Results)
+		}
+		// the name of an upload is the client's, suppressions only match its hash
+		suppress(u.sha, "", u.submitter, &drweb.Results)
+		drweb.Results.Peers = fanOut.results(drweb.Results)
+		intel.enrich(ctx, u.sha, &drweb.Results)
+	}
+	drweb.Results.Metadata = u.options.Metadata
+	drweb.Results.Tags = u.options.Tags
+	drweb.Results.Submitter = u.submitter
+	if policy != nil {
+		if policy.Action == policyFlag {
+			policy.flag(&drweb.Results)
+		}
+		drweb.Results.PolicyApplied = policy.applied(contentType)
+	}
+	stats.record(u.submitter.source(), drweb.Results.Infected, time.Since(u.received))
+	audit.verdict(u.sha, u.submitter, drweb.Results)
+	tickets.open(u.sha, u.submitter, drweb.Results)
+	metrics.scan(u.submitter, u.profile.profileName(), drweb.Results, time.Since(u.received))
+
+	store.countScan(drweb.Results, int64(len(u.data)))
+	if sampleRetention > 0 {
+		retainMembers(u, &drweb.Results)
+	}
+
+	if store != nil {
+		tenantStore := store.tenant(u.submitter.Tenant)
+		if tenantStore != store {
+			tenantStore.countScan(drweb.Results, int64(len(u.data)))
+		}
+		if _, err := tenantStore.save(u.sha, drweb.Results); err != nil {
+			log.WithFields(log.Fields{
+				"plugin":   name,
+				"category": category,
+			}).Error(err)
+		}
+		if sampleRetention > 0 {
+			if err := store.saveSample(u.sha, u.data); err != nil {
+				log.WithFields(log.Fields{
+					"plugin":   name,
+					"category": category,
+				}).Error(err)
+			}
+		}
+	}
+	archiveSample(u, drweb.Results)
+
+	if signer != nil {
+		if drweb.Signature, err = signer.sign(drweb); err != nil {
+			return drweb, errors.Wrap(err, "failed to sign results")
+		}
+	}
+
+	return drweb, nil
+}
+
+// asyncField returns the async form field, or the Prefer header if there is
+// no such field, and whether the client sent either
+func asyncField(r *http.Request) (bool, bool) {
+	if r.MultipartForm != nil && len(r.MultipartForm.Value["async"]) > 0 {
+		async, _ := strconv.ParseBool(r.MultipartForm.Value["async"][0])
+		return async, true
+	}
+	async := strings.Contains(strings.ToLower(r.Header.Get("Prefer")), "respond-async")
+	return async, async
+}
+
+// scanAsync reports whether an upload of size bytes is scanned in the
+// background: if the client asked for it, or if it is larger than
+// largeSampleSize unless the client asked for a synchronous scan with async=false
+func scanAsync(r *http.Request, size int) bool {
+	async, explicit := asyncField(r)
+	if explicit {
+		return async
+	}
+	return largeSampleSize > 0 && int64(size) > largeSampleSize
+}
+
+// ScanJob json object
+type ScanJob struct {
+	ID          string     `json:"id"`
+	Status      string     `json:"status"`
+	SHA256      string     `json:"sha256"`
+	Size        int        `json:"size,omitempty"`
+	Priority    string     `json:"priority,omitempty"`
+	SubmittedAt time.Time  `json:"submitted_at"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+	Result      *DrWEB     `json:"result,omitempty"`
+	Error       string     `json:"error,omitempty"`
+
+	owner  string
+	tenant string
+	upload *uploadScan
+	cancel context.CancelFunc
+}
+
+// jobQueue runs async scans one after another, the highest priority first.
+// With a job directory the jobs are kept on disk instead, where instances
+// sharing it pick them up.
+type jobQueue struct {
+	sync.Mutex
+	retention time.Duration
+	dir       string
+	instance  string
+	jobs      map[string]*ScanJob
+	pending   []*ScanJob    // queued jobs, in the order they were submitted
+	ready     chan struct{} // wakes up work when a job is queued
+}
+
+var jobs = &jobQueue{
+	retention: time.Hour,
+	jobs:      make(map[string]*ScanJob),
+	ready:     make(chan struct{}, 1),
+}
+
+func newJobID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		assert(err)
+	}
+	return hex.EncodeToString(id)
+}
+
+// submit queues upload, owner is the API key that may see and cancel the job
+func (q *jobQueue) submit(upload *uploadScan, owner string) (ScanJob, error) {
+	if len(q.dir) > 0 {
+		return q.submitDir(upload, owner)
+	}
+
+	q.Lock()
+	defer q.Unlock()
+
+	now := time.Now()
+	for id, job := range q.jobs {
+		if job.FinishedAt != nil && now.Sub(*job.FinishedAt) > q.retention {
+			delete(q.jobs, id)
+		}
+	}
+
+	if len(q.pending) >= maxQueuedJobs {
+		return ScanJob{}, fmt.Errorf("too many queued scans")
+	}
+	job := &ScanJob{
+		ID:          newJobID(),
+		Status:      jobQueued,
+		SHA256:      upload.sha,
+		Size:        len(upload.data),
+		Priority:    jobPriority(upload.options.Priority),
+		SubmittedAt: now.UTC(),
+		owner:       owner,
+		upload:      upload,
+	}
+	if upload.submitter != nil {
+		job.tenant = upload.submitter.Tenant
+	}
+	q.pending = append(q.pending, job)
+	q.jobs[job.ID] = job
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return *job, nil
+}
+
+// next takes the queued job with the highest priority, the oldest of them,
+// off the queue
+func (q *jobQueue) next() *ScanJob {
+	q.Lock()
+	defer q.Unlock()
+
+	if len(q.pending) == 0 {
+		return nil
+	}
+	first := 0
+	for i, job := range q.pending {
+		if priorityRank(job.Priority) < priorityRank(q.pending[first].Priority) {
+			first = i
+		}
+	}
+	job := q.pending[first]
+	q.pending = append(q.pending[:first], q.pending[first+1:]...)
+	return job
+}
+
+// unqueue removes a job that will not run from the queue
+func (q *jobQueue) unqueue(job *ScanJob) {
+	for i, pending := range q.pending {
+		if pending == job {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// work runs the queued jobs
+func (q *jobQueue) work() {
+	if len(q.dir) > 0 {
+		q.workDir()
+		return
+	}
+	for {
+		job := q.next()
+		if job == nil {
+			<-q.ready
+			continue
+		}
+		q.Lock()
+		if job.Status == jobCancelled {
+			q.Unlock()
+			continue
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		started := time.Now().UTC()
+		job.Status = jobRunning
+		job.StartedAt = &started
+		job.cancel = cancel
+		upload := job.upload
+		q.Unlock()
+
+		drweb, err := upload.scan(ctx)
+		cancel()
+		upload.options.Callback.deliver(upload.sha, drweb, err)
+
+		q.Lock()
+		finished := time.Now().UTC()
+		job.upload = nil
+		job.cancel = nil
+		if job.Status != jobCancelled {
+			job.Status = jobDone
+			job.FinishedAt = &finished
+			if err != nil {
+				job.Error = err.Error()
+			} else {
+				job.Result = &drweb
+			}
+		}
+		q.Unlock()
+	}
+}
+
+// get returns a copy of the job with id if owner may see it
+func (q *jobQueue) get(id, owner string) (ScanJob, bool) {
+	if len(q.dir) > 0 {
+		return q.getDir(id, owner)
+	}
+
+	q.Lock()
+	defer q.Unlock()
+
+	job, ok := q.jobs[id]
+	if !ok || job.owner != owner {
+		return ScanJob{}, false
+	}
+	return *job, true
+}
+
+// cancel stops a queued or running job, finished jobs can not be cancelled
+func (q *jobQueue) cancel(id, owner string) (ScanJob, bool, error) {
+	return q.cancelWhere(id, func(jobOwner, tenant string) bool {
+		return jobOwner == owner
+	})
+}
+
+// cancelWhere cancels the job with id if match accepts its owner and tenant
+func (q *jobQueue) cancelWhere(id string, match func(owner, tenant string) bool) (ScanJob, bool, error) {
+	if len(q.dir) > 0 {
+		return q.cancelDir(id, match)
+	}
+
+	q.Lock()
+	defer q.Unlock()
+
+	job, ok := q.jobs[id]
+	if !ok || !match(job.owner, job.tenant) {
+		return ScanJob{}, false, nil
+	}
+	switch job.Status {
+	case jobQueued, jobRunning:
+		if job.cancel != nil {
+			job.cancel()
+		}
+		q.unqueue(job)
+		finished := time.Now().UTC()
+		job.Status = jobCancelled
+		job.FinishedAt = &finished
+		job.upload = nil
+		return *job, true, nil
+	}
+	return *job, true, fmt.Errorf("scan job is already %s", job.Status)
+}
+
+// webJob returns the status and, once done, the results of an async scan
+func webJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := jobs.get(mux.Vars(r)["jobID"], requestKeyID(r))
+	if !ok {
+		http.Error(w, "scan job not found", http.StatusNotFound)
+		return
+	}
+	if verdictOnly(r) {
+		writeTaggedJSON(w, r, verdictOfJob(job))
+		return
+	}
+	writeTaggedJSON(w, r, job)
+}
+
+// webCancelJob cancels an async scan, killing drweb-ctl if it is already running
+func webCancelJob(w http.ResponseWriter, r *http.Request) {
+	job, ok, err := jobs.cancel(mux.Vars(r)["jobID"], requestKeyID(r))
+	if !ok {
+		http.Error(w, "scan job not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	log.WithFields(log.Fields{
+		"plugin":   name,
+		"category": category,
+		"job":      job.ID,
+	}).Info("scan job cancelled")
+	if verdictOnly(r) {
+		writeJSON(w, http.StatusOK, verdictOfJob(job))
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
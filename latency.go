@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxLatencySamples is how many latencies are kept per size bucket, file
+// type and profile
+const maxLatencySamples = 1000
+
+// minAdviceScans is how many scans of a profile it takes to suggest a timeout
+const minAdviceScans = 50
+
+// timeoutHeadroom is how many times the p99 a suggested timeout allows
+const timeoutHeadroom = 3
+
+// minSuggestedTimeout is the shortest timeout suggested, in seconds
+const minSuggestedTimeout = 10
+
+// defaultProfileName names the scans without a profile in the timeout suggestions
+const defaultProfileName = "default"
+
+// sizeBuckets are the sample sizes latencies are broken down by, by upper bound
+var sizeBuckets = []struct {
+	name string
+	max  int64
+}{
+	{"0-64K", 64 << 10},
+	{"64K-1M", 1 << 20},
+	{"1M-10M", 10 << 20},
+	{"10M-100M", 100 << 20},
+	{"100M+", math.MaxInt64},
+}
+
+func sizeBucket(size int64) string {
+	for _, bucket := range sizeBuckets {
+		if size < bucket.max {
+			return bucket.name
+		}
+	}
+	return sizeBuckets[len(sizeBuckets)-1].name
+}
+
+// LatencyBreakdown json object, of the latest scans of a size bucket, file
+// type or profile
+type LatencyBreakdown struct {
+	Scans     int            `json:"scans"`
+	TimedOut  int            `json:"timed_out"`
+	LatencyMS LatencySummary `json:"latency_ms"`
+}
+
+// TimeoutSuggestion json object, the timeout a profile's latencies call for
+type TimeoutSuggestion struct {
+	Timeout   int     `json:"timeout"`
+	Scans     int     `json:"scans"`
+	TimedOut  int     `json:"timed_out"`
+	P99MS     float64 `json:"p99_ms"`
+	Suggested int     `json:"suggested_timeout,omitempty"`
+	Advice    string  `json:"advice"`
+}
+
+// LatencyStats json object
+type LatencyStats struct {
+	BySize   map[string]LatencyBreakdown  `json:"by_size"`
+	ByType   map[string]LatencyBreakdown  `json:"by_type"`
+	Timeouts map[string]TimeoutSuggestion `json:"timeouts"`
+}
+
+// latencySamples are the latest latencies of scans that have something in common
+type latencySamples struct {
+	scans    []time.Duration
+	timedOut []bool
+	timeout  int // of the latest scan, in seconds
+}
+
+func (s *latencySamples) add(latency time.Duration, timedOut bool, timeout int) {
+	s.scans = append(s.scans, latency)
+	s.timedOut = append(s.timedOut, timedOut)
+	if len(s.scans) > maxLatencySamples {
+		s.scans, s.timedOut = s.scans[1:], s.timedOut[1:]
+	}
+	s.timeout = timeout
+}
+
+func (s *latencySamples) breakdown() LatencyBreakdown {
+	b := LatencyBreakdown{Scans: len(s.scans), LatencyMS: summarizeLatencies(s.scans)}
+	for _, timedOut := range s.timedOut {
+		if timedOut {
+			b.TimedOut++
+		}
+	}
+	return b
+}
+
+// suggest returns the timeout the latest scans call for: a few times their
+// p99, or twice the timeout if more than 1% of them ran into it, since the
+// p99 then only says the timeout is too short
+func (s *latencySamples) suggest() TimeoutSuggestion {
+	b := s.breakdown()
+	suggestion := TimeoutSuggestion{Timeout: s.timeout, Scans: b.Scans, TimedOut: b.TimedOut, P99MS: b.LatencyMS.P99}
+	switch {
+	case b.Scans < minAdviceScans:
+		suggestion.Advice = fmt.Sprintf("not enough scans yet, %d are needed", minAdviceScans)
+		return suggestion
+	case b.TimedOut*100 > b.Scans:
+		suggestion.Suggested = 2 * s.timeout
+		suggestion.Advice = fmt.Sprintf("%.1f%% of scans timed out, raise the timeout", float64(b.TimedOut)*100/float64(b.Scans))
+		return suggestion
+	}
+
+	seconds := int(math.Ceil(b.LatencyMS.P99 * timeoutHeadroom / 1000))
+	// round up to 5 seconds, so the suggestion does not change with every scan
+	seconds = (seconds + 4) / 5 * 5
+	if seconds < minSuggestedTimeout {
+		seconds = minSuggestedTimeout
+	}
+	suggestion.Suggested = seconds
+	switch {
+	case seconds > s.timeout:
+		suggestion.Advice = "the p99 is close to the timeout, raise it"
+	case seconds*2 <= s.timeout:
+		suggestion.Advice = "the timeout is far above the p99, lower it to give up on stuck scans sooner"
+	default:
+		suggestion.Advice = "keep the timeout"
+	}
+	return suggestion
+}
+
+// changes reports whether the suggestion is to change the timeout
+func (t TimeoutSuggestion) changes() bool {
+	return t.Suggested > t.Timeout || t.Suggested > 0 && t.Suggested*2 <= t.Timeout
+}
+
+// scanLatencies breaks the latencies of engine scans down by sample size,
+// file type and profile
+type scanLatencies struct {
+	sync.Mutex
+	bySize    map[string]*latencySamples
+	byType    map[string]*latencySamples
+	byProfile map[string]*latencySamples
+}
+
+var latencies = &scanLatencies{
+	bySize:    make(map[string]*latencySamples),
+	byType:    make(map[string]*latencySamples),
+	byProfile: make(map[string]*latencySamples),
+}
+
+// record adds the latency of a scan of a sample of size bytes. A failed
+// scan that took its whole timeout counts as timed out.
+func (l *scanLatencies) record(profile *ScanProfile, size int64, contentType string, results ResultsData, latency time.Duration) {
+	timeout := profile.timeout(defaultTimeout)
+	timedOut := len(results.Error) > 0 && latency >= time.Duration(timeout)*time.Second
+	profileName := profile.profileName()
+	if len(profileName) == 0 {
+		profileName = defaultProfileName
+	}
+	if len(contentType) == 0 {
+		contentType = "application/octet-stream"
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	for _, key := range []struct {
+		samples map[string]*latencySamples
+		name    string
+	}{{l.bySize, sizeBucket(size)}, {l.byType, contentType}, {l.byProfile, profileName}} {
+		samples, ok := key.samples[key.name]
+		if !ok {
+			samples = &latencySamples{}
+			key.samples[key.name] = samples
+		}
+		samples.add(latency, timedOut, timeout)
+	}
+}
+
+func (l *scanLatencies) snapshot() LatencyStats {
+	l.Lock()
+	defer l.Unlock()
+	stats := LatencyStats{
+		BySize:   make(map[string]LatencyBreakdown),
+		ByType:   make(map[string]LatencyBreakdown),
+		Timeouts: make(map[string]TimeoutSuggestion),
+	}
+	for bucket, samples := range l.bySize {
+		stats.BySize[bucket] = samples.breakdown()
+	}
+	for contentType, samples := range l.byType {
+		stats.ByType[contentType] = samples.breakdown()
+	}
+	for profile, samples := range l.byProfile {
+		stats.Timeouts[profile] = samples.suggest()
+	}
+	return stats
+}
+
+// advise logs the profiles whose timeout should change every interval
+func (l *scanLatencies) advise(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		timeouts := l.snapshot().Timeouts
+		profiles := make([]string, 0, len(timeouts))
+		for profile := range timeouts {
+			profiles = append(profiles, profile)
+		}
+		sort.Strings(profiles)
+		for _, profile := range profiles {
+			suggestion := timeouts[profile]
+			if !suggestion.changes() {
+				continue
+			}
+			log.WithFields(log.Fields{
+				"plugin":            name,
+				"category":          category,
+				"profile":           profile,
+				"timeout":           suggestion.Timeout,
+				"suggested_timeout": suggestion.Suggested,
+				"p99_ms":            suggestion.P99MS,
+				"scans":             suggestion.Scans,
+				"timed_out":         suggestion.TimedOut,
+			}).Warn("timeout advice: ", suggestion.Advice)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// engineLimitsContextKey holds the resource limits of the engine commands run with a context
+const engineLimitsContextKey = contextKey("engine-limits")
+
+// ResourceLimits confine the engine command of a scan, so a pathological
+// sample can not starve the scans running next to it. CPU and memory are
+// limited with rlimits, or a cgroup per command with --engine-cgroup, which
+// the CPU share, IO weight and process limits require.
+type ResourceLimits struct {
+	CPUPercent   int `json:"cpu_percent,omitempty"`   // of one core, cgroup only
+	CPUSeconds   int `json:"cpu_seconds,omitempty"`   // of CPU time
+	MemoryMB     int `json:"memory_mb,omitempty"`     // memory, address space with rlimits
+	IOWeight     int `json:"io_weight,omitempty"`     // 1 to 10000, 100 is the default, cgroup only
+	MaxProcesses int `json:"max_processes,omitempty"` // cgroup only
+}
+
+// validate checks the limits make sense
+func (l *ResourceLimits) validate() error {
+	switch {
+	case l.CPUPercent < 0, l.CPUSeconds < 0, l.MemoryMB < 0, l.MaxProcesses < 0:
+		return fmt.Errorf("limits must not be negative")
+	case l.IOWeight != 0 && (l.IOWeight < 1 || l.IOWeight > 10000):
+		return fmt.Errorf("io_weight must be between 1 and 10000")
+	}
+	return nil
+}
+
+// cgroupOnly reports whether the limits need a cgroup
+func (l *ResourceLimits) cgroupOnly() bool {
+	return l.CPUPercent > 0 || l.IOWeight > 0 || l.MaxProcesses > 0
+}
+
+// withEngineLimits has the engine commands run with ctx confined to limits
+func withEngineLimits(ctx context.Context, limits *ResourceLimits) context.Context {
+	if limits == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, engineLimitsContextKey, limits)
+}
+
+// engineLimits returns the limits of the engine commands run with ctx, nil for none
+func engineLimits(ctx context.Context) *ResourceLimits {
+	limits, _ := ctx.Value(engineLimitsContextKey).(*ResourceLimits)
+	return limits
+}
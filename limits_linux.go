@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// cgroupRoot is where the cgroup v2 hierarchy is mounted
+const cgroupRoot = "/sys/fs/cgroup"
+
+// cgroupControllers are enabled for the cgroups of engine commands
+var cgroupControllers = []string{"cpu", "memory", "io", "pids"}
+
+// engineCgroup is the cgroup the cgroups of limited engine commands are
+// created in, empty to limit them with rlimits
+var engineCgroup string
+
+// engineCgroups numbers the cgroups of engine commands
+var engineCgroups int64
+
+// engineControllers are the controllers enabled in engineCgroup
+var engineControllers = map[string]bool{}
+
+// setEngineCgroup checks dir is a cgroup v2 delegated to us and enables the
+// controllers of the limits in it. Processes can only be in the leaves of a
+// cgroup v2 tree, so if we run in dir we move to a service cgroup below it.
+func setEngineCgroup(dir string) error {
+	if len(dir) == 0 {
+		return nil
+	}
+	available, err := ioutil.ReadFile(filepath.Join(dir, "cgroup.controllers"))
+	if err != nil {
+		return errors.Wrapf(err, "%s is not a cgroup v2 directory", dir)
+	}
+	if self, err := ownCgroup(); err == nil && filepath.Clean(self) == filepath.Clean(dir) {
+		service := filepath.Join(dir, "service")
+		if err := os.Mkdir(service, 0755); err != nil && !os.IsExist(err) {
+			return errors.Wrapf(err, "failed to create %s", service)
+		}
+		if err := ioutil.WriteFile(filepath.Join(service, "cgroup.procs"), []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+			return errors.Wrapf(err, "failed to move to %s", service)
+		}
+	}
+
+	var enable []string
+	for _, controller := range cgroupControllers {
+		if strings.Contains(" "+strings.TrimSpace(string(available))+" ", " "+controller+" ") {
+			enable = append(enable, "+"+controller)
+			engineControllers[controller] = true
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte(strings.Join(enable, " ")), 0644); err != nil {
+		return errors.Wrapf(err, "failed to enable the %s controllers in %s, is it delegated to us?", strings.Join(enable, " "), dir)
+	}
+	engineCgroup = dir
+	return nil
+}
+
+// ownCgroup returns the cgroup v2 directory we run in
+func ownCgroup() (string, error) {
+	f, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "0::") {
+			return filepath.Join(cgroupRoot, strings.TrimPrefix(scanner.Text(), "0::")), nil
+		}
+	}
+	return "", fmt.Errorf("not in a cgroup v2")
+}
+
+// confinement holds the limits of an engine command while it runs
+type confinement struct {
+	limits *ResourceLimits
+	cgroup string
+	fd     int
+}
+
+// confine prepares cmd to start in a cgroup of its own with the limits, or
+// to have them set as rlimits once it started
+func confine(cmd *exec.Cmd, limits *ResourceLimits) (*confinement, error) {
+	c := &confinement{limits: limits, fd: -1}
+	if limits == nil || len(engineCgroup) == 0 {
+		if limits != nil && limits.cgroupOnly() {
+			return nil, fmt.Errorf("cpu_percent, io_weight and max_processes limits require --engine-cgroup")
+		}
+		return c, nil
+	}
+
+	c.cgroup = filepath.Join(engineCgroup, fmt.Sprintf("scan-%d-%d", os.Getpid(), atomic.AddInt64(&engineCgroups, 1)))
+	if err := os.Mkdir(c.cgroup, 0755); err != nil {
+		return nil, errors.Wrap(err, "failed to create cgroup of engine command")
+	}
+	settings := map[string]string{}
+	if limits.CPUPercent > 0 {
+		settings["cpu.max"] = fmt.Sprintf("%d 100000", limits.CPUPercent*1000)
+	}
+	if limits.MemoryMB > 0 {
+		settings["memory.max"] = strconv.FormatInt(int64(limits.MemoryMB)<<20, 10)
+		settings["memory.swap.max"] = "0"
+	}
+	if limits.IOWeight > 0 {
+		settings["io.weight"] = "default " + strconv.Itoa(limits.IOWeight)
+	}
+	if limits.MaxProcesses > 0 {
+		settings["pids.max"] = strconv.Itoa(limits.MaxProcesses)
+	}
+	for file, value := range settings {
+		if controller := strings.SplitN(file, ".", 2)[0]; !engineControllers[controller] {
+			c.release()
+			return nil, fmt.Errorf("the %s controller is not available in %s", controller, engineCgroup)
+		}
+		err := ioutil.WriteFile(filepath.Join(c.cgroup, file), []byte(value), 0644)
+		if err != nil && !(file == "memory.swap.max" && os.IsNotExist(err)) {
+			c.release()
+			return nil, errors.Wrapf(err, "failed to set %s of engine command", file)
+		}
+	}
+	fd, err := syscall.Open(c.cgroup, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		c.release()
+		return nil, errors.Wrap(err, "failed to open cgroup of engine command")
+	}
+	c.fd = fd
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD, cmd.SysProcAttr.CgroupFD = true, fd
+	return c, nil
+}
+
+// started sets the rlimits of a command right after it started, before it
+// gets to scan anything: CPU time, which cgroups do not limit, and memory
+// without a cgroup
+func (c *confinement) started(pid int) error {
+	if c.limits == nil {
+		return nil
+	}
+	set := func(resource int, value, max uint64) error {
+		limit := syscall.Rlimit{Cur: value, Max: max}
+		if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid), uintptr(resource), uintptr(unsafe.Pointer(&limit)), 0, 0, 0); errno != 0 {
+			return errno
+		}
+		return nil
+	}
+	if c.limits.CPUSeconds > 0 {
+		// SIGXCPU at the soft limit tells why it was killed, SIGKILL does not
+		if err := set(syscall.RLIMIT_CPU, uint64(c.limits.CPUSeconds), uint64(c.limits.CPUSeconds)+1); err != nil {
+			return errors.Wrap(err, "failed to limit CPU time of engine command")
+		}
+	}
+	if c.limits.MemoryMB > 0 && len(c.cgroup) == 0 {
+		if err := set(syscall.RLIMIT_AS, uint64(c.limits.MemoryMB)<<20, uint64(c.limits.MemoryMB)<<20); err != nil {
+			return errors.Wrap(err, "failed to limit memory of engine command")
+		}
+	}
+	return nil
+}
+
+// exceeded explains why a confined command failed if it ran into a limit,
+// err otherwise
+func (c *confinement) exceeded(err error) error {
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || c.limits == nil {
+		return err
+	}
+	status, _ := exitErr.Sys().(syscall.WaitStatus)
+	switch {
+	case status.Signaled() && status.Signal() == syscall.SIGXCPU && c.limits.CPUSeconds > 0:
+		return errors.Wrapf(err, "exceeded the CPU time limit of %d seconds", c.limits.CPUSeconds)
+	case len(c.cgroup) > 0 && c.oomKilled():
+		return errors.Wrapf(err, "exceeded the memory limit of %d MB", c.limits.MemoryMB)
+	}
+	return err
+}
+
+func (c *confinement) oomKilled() bool {
+	return c.stat("memory.events", "oom_kill") > 0
+}
+
+// stat returns a key of a flat keyed cgroup file
+func (c *confinement) stat(file, key string) int64 {
+	data, err := ioutil.ReadFile(filepath.Join(c.cgroup, file))
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 && fields[0] == key {
+			value, _ := strconv.ParseInt(fields[1], 10, 64)
+			return value
+		}
+	}
+	return 0
+}
+
+// release removes the cgroup of a command once it exited
+func (c *confinement) release() {
+	if c.fd >= 0 {
+		syscall.Close(c.fd)
+	}
+	if len(c.cgroup) == 0 {
+		return
+	}
+	if err := os.Remove(c.cgroup); err != nil {
+		log.WithFields(log.Fields{
+			"plugin":   name,
+			"category": category,
+		}).Warn(errors.Wrap(err, "failed to remove cgroup of engine command"))
+	}
+}
@@ -0,0 +1,31 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// setEngineCgroup fails, cgroups are Linux only
+func setEngineCgroup(dir string) error {
+	if len(dir) > 0 {
+		return fmt.Errorf("--engine-cgroup requires Linux")
+	}
+	return nil
+}
+
+// confinement does nothing, resource limits are Linux only
+type confinement struct{}
+
+func confine(cmd *exec.Cmd, limits *ResourceLimits) (*confinement, error) {
+	if limits != nil {
+		return nil, fmt.Errorf("resource limits of engine commands require Linux")
+	}
+	return &confinement{}, nil
+}
+
+func (c *confinement) started(pid int) error    { return nil }
+func (c *confinement) exceeded(err error) error { return err }
+func (c *confinement) release()                 {}
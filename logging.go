@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// logLevels and logFormats are the accepted --log-level and --log-format values
+var (
+	logLevels  = []string{"trace", "debug", "info", "warn", "error", "fatal", "panic"}
+	logFormats = []string{"text", "json"}
+)
+
+// logRotateTimeFormat is appended to the names of rotated log files
+const logRotateTimeFormat = "20060102T150405.000"
+
+// rotatingFile is a log file that is rotated once it grows past maxSize bytes
+// or has been written to for longer than maxAge, keeping at most maxBackups
+// rotated files around
+type rotatingFile struct {
+	sync.Mutex
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	file    *os.File
+	size    int64
+	created time.Time
+}
+
+func openRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxAge:     maxAge,
+		maxBackups: maxBackups,
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open log file %s", r.path)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	r.file = f
+	r.size = info.Size()
+	r.created = time.Now()
+	if r.size > 0 {
+		// appending to an existing log, it is as old as its last write
+		r.created = info.ModTime()
+	}
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.size > 0 && ((r.maxSize > 0 && r.size+int64(len(p)) > r.maxSize) ||
+		(r.maxAge > 0 && time.Since(r.created) > r.maxAge)) {
+		if err := r.rotate(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate must be called with r locked
+func (r *rotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	rotated := r.path + "." + time.Now().UTC().Format(logRotateTimeFormat)
+	if err := os.Rename(r.path, rotated); err != nil {
+		return errors.Wrap(err, "failed to rotate log file")
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+
+	if r.maxBackups > 0 {
+		backups, _ := filepath.Glob(r.path + ".[0-9]*")
+		sort.Strings(backups)
+		for len(backups) > r.maxBackups {
+			os.Remove(backups[0])
+			backups = backups[1:]
+		}
+	}
+	return nil
+}
+
+// AddLogHook sends the plugin's log entries to hook as well, so programs
+// embedding the scanner can route them into their own logging. The hook is
+// fired for the entries --log-level lets through, in the levels it returns.
+func AddLogHook(hook log.Hook) {
+	log.AddHook(hook)
+}
+
+// configureLogging applies the global logging flags
+func configureLogging(c *cli.Context) error {
+	level, err := log.ParseLevel(c.GlobalString("log-level"))
+	if err != nil {
+		return err
+	}
+	// --verbose predates --log-level and still means debug
+	if c.GlobalBool("verbose") && level < log.DebugLevel {
+		level = log.DebugLevel
+	}
+	// programs running us with --json-only only want to hear about trouble
+	if c.GlobalBool("json-only") && !c.GlobalIsSet("log-level") && !c.GlobalBool("verbose") {
+		level = log.WarnLevel
+	}
+	log.SetLevel(level)
+
+	switch format := c.GlobalString("log-format"); format {
+	case "text":
+		log.SetFormatter(&log.TextFormatter{})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("invalid log format %q (must be one of text or json)", format)
+	}
+
+	if file := c.GlobalString("log-file"); len(file) > 0 {
+		out, err := openRotatingFile(file, c.GlobalInt64("log-max-size")<<20, c.GlobalDuration("log-max-age"), c.GlobalInt("log-max-backups"))
+		if err != nil {
+			return err
+		}
+		log.SetOutput(out)
+	}
+
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// recordingHook keeps the entries it was fired with
+type recordingHook struct {
+	entries []*log.Entry
+}
+
+func (h *recordingHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *recordingHook) Fire(entry *log.Entry) error {
+	h.entries = append(h.entries, entry)
+	return nil
+}
+
+// TestAddLogHook checks a hook sees the plugin's log entries with their
+// fields, and only those --log-level lets through
+func TestAddLogHook(t *testing.T) {
+	logger := log.StandardLogger()
+	defer logger.ReplaceHooks(logger.ReplaceHooks(make(log.LevelHooks)))
+	defer func(level log.Level) { log.SetLevel(level) }(log.GetLevel())
+	defer log.SetOutput(logger.Out)
+	defer func(loaded []Suppression) { suppressions = loaded }(suppressions)
+	log.SetOutput(ioutil.Discard)
+
+	file, err := ioutil.TempFile("", "suppressions_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`[{"name": "old", "detection": "EICAR*", "path": "*.com", "expires": "2018-09-09T00:00:00Z", "justification": "test"}]`)
+	file.Close()
+
+	hook := &recordingHook{}
+	AddLogHook(hook)
+
+	log.SetLevel(log.ErrorLevel)
+	if err := loadSuppressions(file.Name()); err != nil {
+		t.Fatal(err)
+	}
+	if len(hook.entries) != 0 {
+		t.Fatalf("got %d entries below the log level, want none", len(hook.entries))
+	}
+
+	log.SetLevel(log.InfoLevel)
+	if err := loadSuppressions(file.Name()); err != nil {
+		t.Fatal(err)
+	}
+	if len(hook.entries) != 1 {
+		t.Fatalf("got %d entries, want 1", len(hook.entries))
+	}
+	entry := hook.entries[0]
+	if entry.Level != log.WarnLevel || entry.Data["plugin"] != name || entry.Data["category"] != category {
+		t.Errorf("got %s entry %v, want a warning of plugin %s category %s", entry.Level, entry.Data, name, category)
+	}
+}
@@ -0,0 +1,532 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/malice-plugins/pkgs/utils"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+var (
+	imapLiteralRe = regexp.MustCompile(`\{(\d+)\}$`)
+	imapUIDRe     = regexp.MustCompile(`UID (\d+)`)
+)
+
+// imapClient is a minimal IMAP4rev1 client, just enough to sweep a mailbox
+type imapClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+	tag  int
+}
+
+// imapResponse is a single (possibly multi-line) server response
+type imapResponse struct {
+	line     string
+	literals [][]byte
+}
+
+type mailboxAttachment struct {
+	Filename string      `json:"filename"`
+	SHA256   string      `json:"sha256"`
+	Results  ResultsData `json:"drweb"`
+}
+
+// mailboxMessage is a message of the report, its status is error if it could
+// not be parsed or one of its attachments could not be scanned
+type mailboxMessage struct {
+	UID         string              `json:"uid"`
+	Subject     string              `json:"subject,omitempty"`
+	From        string              `json:"from,omitempty"`
+	Date        string              `json:"date,omitempty"`
+	Infected    bool                `json:"infected"`
+	Status      string              `json:"status"`
+	Error       string              `json:"error,omitempty"`
+	Action      string              `json:"action,omitempty"`
+	Attachments []mailboxAttachment `json:"attachments,omitempty"`
+}
+
+// MailboxReport json object
+type MailboxReport struct {
+	Server   string           `json:"server"`
+	Mailbox  string           `json:"mailbox"`
+	Since    string           `json:"since,omitempty"`
+	Scanned  int              `json:"scanned"`
+	Infected int              `json:"infected"`
+	Failed   int              `json:"failed"`
+	Messages []mailboxMessage `json:"messages"`
+}
+
+func dialIMAP(server string, useTLS, insecure bool) (*imapClient, error) {
+	var conn net.Conn
+	var err error
+
+	if useTLS {
+		host, _, _ := net.SplitHostPort(server)
+		conn, err = tls.Dial("tcp", server, &tls.Config{
+			ServerName:         host,
+			InsecureSkipVerify: insecure,
+		})
+	} else {
+		conn, err = net.Dial("tcp", server)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to connect to %s", server)
+	}
+
+	c := &imapClient{conn: conn, r: bufio.NewReader(conn)}
+
+	// consume server greeting
+	greeting, err := c.readResponse()
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "failed to read IMAP greeting")
+	}
+	if !strings.HasPrefix(greeting.line, "* OK") && !strings.HasPrefix(greeting.line, "* PREAUTH") {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected IMAP greeting: %s", greeting.line)
+	}
+
+	return c, nil
+}
+
+func (c *imapClient) readResponse() (imapResponse, error) {
+	var resp imapResponse
+
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return resp, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		resp.line += line
+
+		m := imapLiteralRe.FindStringSubmatch(line)
+		if m == nil {
+			return resp, nil
+		}
+		n, err := strconv.Atoi(m[1])
+		if err != nil {
+			return resp, err
+		}
+		literal := make([]byte, n)
+		if _, err := io.ReadFull(c.r, literal); err != nil {
+			return resp, err
+		}
+		resp.literals = append(resp.literals, literal)
+	}
+}
+
+// cmd sends a tagged command and returns the untagged responses
+func (c *imapClient) cmd(format string, args ...interface{}) ([]imapResponse, error) {
+	c.tag++
+	tag := fmt.Sprintf("A%04d", c.tag)
+
+	command := fmt.Sprintf(format, args...)
+	if _, err := fmt.Fprintf(c.conn, "%s %s\r\n", tag, command); err != nil {
+		return nil, err
+	}
+
+	var untagged []imapResponse
+	for {
+		resp, err := c.readResponse()
+		if err != nil {
+			return untagged, err
+		}
+		if strings.HasPrefix(resp.line, tag+" ") {
+			status := strings.TrimPrefix(resp.line, tag+" ")
+			if !strings.HasPrefix(status, "OK") {
+				return untagged, fmt.Errorf("IMAP command %q failed: %s", strings.Fields(command)[0], status)
+			}
+			return untagged, nil
+		}
+		untagged = append(untagged, resp)
+	}
+}
+
+func (c *imapClient) login(username, password string) error {
+	_, err := c.cmd("LOGIN %s %s", imapQuote(username), imapQuote(password))
+	return err
+}
+
+// capabilities returns the capabilities the server announces, e.g. UIDPLUS
+func (c *imapClient) capabilities() (map[string]bool, error) {
+	resps, err := c.cmd("CAPABILITY")
+	if err != nil {
+		return nil, err
+	}
+	capabilities := make(map[string]bool)
+	for _, resp := range resps {
+		if strings.HasPrefix(resp.line, "* CAPABILITY ") {
+			for _, capability := range strings.Fields(strings.TrimPrefix(resp.line, "* CAPABILITY ")) {
+				capabilities[strings.ToUpper(capability)] = true
+			}
+		}
+	}
+	return capabilities, nil
+}
+
+func (c *imapClient) selectMailbox(mailbox string) error {
+	_, err := c.cmd("SELECT %s", imapQuote(mailbox))
+	return err
+}
+
+// search returns the UIDs of all messages, optionally only those since date
+func (c *imapClient) search(since time.Time) ([]string, error) {
+	criteria := "ALL"
+	if !since.IsZero() {
+		criteria = "SINCE " + since.Format("02-Jan-2006")
+	}
+
+	resps, err := c.cmd("UID SEARCH %s", criteria)
+	if err != nil {
+		return nil, err
+	}
+
+	var uids []string
+	for _, resp := range resps {
+		if strings.HasPrefix(resp.line, "* SEARCH") {
+			uids = append(uids, strings.Fields(strings.TrimPrefix(resp.line, "* SEARCH"))...)
+		}
+	}
+	return uids, nil
+}
+
+// fetch returns the raw RFC822 message without setting the \Seen flag
+func (c *imapClient) fetch(uid string) ([]byte, error) {
+	resps, err := c.cmd("UID FETCH %s (BODY.PEEK[])", uid)
+	if err != nil {
+		return nil, err
+	}
+	for _, resp := range resps {
+		m := imapUIDRe.FindStringSubmatch(resp.line)
+		if m != nil && m[1] == uid && len(resp.literals) > 0 {
+			return resp.literals[0], nil
+		}
+	}
+	return nil, fmt.Errorf("message with UID %s not returned by server", uid)
+}
+
+func (c *imapClient) store(uid, flags string) error {
+	_, err := c.cmd("UID STORE %s +FLAGS.SILENT (%s)", uid, flags)
+	return err
+}
+
+func (c *imapClient) copy(uid, mailbox string) error {
+	_, err := c.cmd("UID COPY %s %s", uid, imapQuote(mailbox))
+	return err
+}
+
+func (c *imapClient) create(mailbox string) error {
+	_, err := c.cmd("CREATE %s", imapQuote(mailbox))
+	return err
+}
+
+// move moves a message to mailbox, the server needs MOVE
+func (c *imapClient) move(uid, mailbox string) error {
+	_, err := c.cmd("UID MOVE %s %s", uid, imapQuote(mailbox))
+	return err
+}
+
+// expunge removes the messages with uids for good. A plain EXPUNGE would also
+// remove every other message flagged \Deleted, by the user or other clients,
+// so only UID EXPUNGE of UIDPLUS servers is used.
+func (c *imapClient) expunge(uids []string) error {
+	_, err := c.cmd("UID EXPUNGE %s", strings.Join(uids, ","))
+	return err
+}
+
+func (c *imapClient) logout() {
+	c.cmd("LOGOUT")
+	c.conn.Close()
+}
+
+func imapQuote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	return `"` + s + `"`
+}
+
+// mailAttachment is a decoded attachment of a message
+type mailAttachment struct {
+	filename string
+	data     []byte
+}
+
+// parseMessage returns the message headers and all of its attachments
+func parseMessage(raw []byte) (mail.Header, []mailAttachment, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var attachments []mailAttachment
+	err = walkMIMEPart(textproto.MIMEHeader(msg.Header), msg.Body, &attachments)
+
+	return msg.Header, attachments, err
+}
+
+func walkMIMEPart(header textproto.MIMEHeader, body io.Reader, attachments *[]mailAttachment) error {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := walkMIMEPart(part.Header, part, attachments); err != nil {
+				return err
+			}
+		}
+	}
+
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+
+	if mediaType == "message/rfc822" {
+		msg, err := mail.ReadMessage(body)
+		if err != nil {
+			return err
+		}
+		return walkMIMEPart(textproto.MIMEHeader(msg.Header), msg.Body, attachments)
+	}
+
+	disposition, dparams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	filename := dparams["filename"]
+	if len(filename) == 0 {
+		filename = params["name"]
+	}
+	if len(filename) == 0 && disposition != "attachment" {
+		// inline message body
+		return nil
+	}
+	if len(filename) == 0 {
+		filename = fmt.Sprintf("attachment-%d", len(*attachments)+1)
+	}
+
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	*attachments = append(*attachments, mailAttachment{filename: filename, data: data})
+
+	return nil
+}
+
+// mailboxActions are what can be done with messages carrying infected attachments
+var mailboxActions = []string{"none", "flag", "move", "delete"}
+
+func sweepMailbox(c *cli.Context) error {
+
+	action := c.String("action")
+	if !utils.StringInSlice(action, mailboxActions) {
+		return fmt.Errorf("invalid action %q (must be one of none, flag, move or delete)", action)
+	}
+
+	var since time.Time
+	var err error
+	if len(c.String("since")) > 0 {
+		since, err = time.Parse("2006-01-02", c.String("since"))
+		if err != nil {
+			return errors.Wrap(err, "--since must be formatted as YYYY-MM-DD")
+		}
+	}
+
+	client, err := dialIMAP(c.String("server"), !c.Bool("no-tls"), c.Bool("insecure"))
+	if err != nil {
+		return err
+	}
+	defer client.logout()
+
+	if err = client.login(c.String("username"), c.String("password")); err != nil {
+		return err
+	}
+	capabilities, err := client.capabilities()
+	if err != nil {
+		return err
+	}
+	if action == "delete" && !capabilities["UIDPLUS"] {
+		return fmt.Errorf("--action delete needs an IMAP server with UIDPLUS, only UID EXPUNGE removes just the infected messages")
+	}
+	if action == "move" && !capabilities["MOVE"] && !capabilities["UIDPLUS"] {
+		log.WithFields(log.Fields{
+			"plugin":   name,
+			"category": category,
+		}).Warn("the IMAP server has neither MOVE nor UIDPLUS, infected messages are only copied to ", c.String("quarantine"))
+	}
+	if err = client.selectMailbox(c.String("mailbox")); err != nil {
+		return err
+	}
+	if action == "move" {
+		// the quarantine folder may already exist
+		if err = client.create(c.String("quarantine")); err != nil {
+			log.WithFields(log.Fields{
+				"plugin":   name,
+				"category": category,
+			}).Debug(err)
+		}
+	}
+
+	uids, err := client.search(since)
+	if err != nil {
+		return err
+	}
+
+	report := MailboxReport{
+		Server:   c.String("server"),
+		Mailbox:  c.String("mailbox"),
+		Since:    c.String("since"),
+		Messages: []mailboxMessage{},
+	}
+
+	// the messages we flagged \Deleted, only those are expunged
+	var deleted []string
+	for _, uid := range uids {
+		raw, err := client.fetch(uid)
+		if err != nil {
+			return err
+		}
+
+		header, attachments, err := parseMessage(raw)
+		if err != nil {
+			// a message we can not parse may well be crafted to hide its attachments
+			err = errors.Wrap(err, "failed to parse message")
+			log.WithFields(log.Fields{
+				"plugin":   name,
+				"category": category,
+				"uid":      uid,
+			}).Error(err)
+			report.Failed++
+			report.Messages = append(report.Messages, mailboxMessage{UID: uid, Status: statusError, Error: err.Error()})
+			continue
+		}
+		if len(attachments) == 0 {
+			continue
+		}
+
+		dec := new(mime.WordDecoder)
+		subject, err := dec.DecodeHeader(header.Get("Subject"))
+		if err != nil {
+			subject = header.Get("Subject")
+		}
+		msg := mailboxMessage{
+			UID:     uid,
+			Subject: subject,
+			From:    header.Get("From"),
+			Date:    header.Get("Date"),
+			Status:  statusClean,
+		}
+		var failed []string
+
+		for _, attachment := range attachments {
+			log.WithFields(log.Fields{
+				"plugin":   name,
+				"category": category,
+				"uid":      uid,
+			}).Debug("scanning attachment: ", attachment.filename)
+
+			results, err := scanBuffer(attachment.data, "mailbox_", c.GlobalInt("timeout"))
+			if err != nil {
+				return errors.Wrapf(err, "failed to scan attachment %s", attachment.filename)
+			}
+			msg.Attachments = append(msg.Attachments, mailboxAttachment{
+				Filename: attachment.filename,
+				SHA256:   fmt.Sprintf("%x", sha256.Sum256(attachment.data)),
+				Results:  results,
+			})
+			if results.Infected {
+				msg.Infected = true
+			} else if results.Status != statusClean {
+				failed = append(failed, fmt.Sprintf("%s: %s", attachment.filename, results.Status))
+			}
+		}
+		if len(failed) > 0 {
+			msg.Status, msg.Error = statusError, "attachments not scanned: "+strings.Join(failed, ", ")
+			report.Failed++
+		}
+		if msg.Infected {
+			msg.Status = statusInfected
+		}
+
+		if msg.Infected {
+			report.Infected++
+			switch action {
+			case "flag":
+				err = client.store(uid, `\Flagged`)
+			case "move":
+				switch {
+				case capabilities["MOVE"]:
+					err = client.move(uid, c.String("quarantine"))
+				case capabilities["UIDPLUS"]:
+					if err = client.copy(uid, c.String("quarantine")); err == nil {
+						err = client.store(uid, `\Deleted`)
+						deleted = append(deleted, uid)
+					}
+				default:
+					err = client.copy(uid, c.String("quarantine"))
+					msg.Action = "copy"
+				}
+			case "delete":
+				err = client.store(uid, `\Deleted`)
+				deleted = append(deleted, uid)
+			}
+			if err != nil {
+				return errors.Wrapf(err, "failed to %s message %s", action, uid)
+			}
+			if action != "none" && len(msg.Action) == 0 {
+				msg.Action = action
+			}
+		}
+
+		report.Scanned++
+		report.Messages = append(report.Messages, msg)
+	}
+
+	if len(deleted) > 0 {
+		if err = client.expunge(deleted); err != nil {
+			return err
+		}
+	}
+
+	reportJSON, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(reportJSON))
+
+	if report.Failed > 0 {
+		return cli.NewExitError(fmt.Sprintf("%d messages could not be parsed or scanned", report.Failed), exitIncomplete)
+	}
+	return nil
+}
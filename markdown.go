@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultTableColumns are the columns of the markdown table without --table-columns
+const defaultTableColumns = "infected,result,engine,updated"
+
+// markdownColumn is a column the markdown table can show
+type markdownColumn struct {
+	name  string
+	title string
+	value func(r markdownReport) string
+}
+
+// markdownColumns are the columns --table-columns picks from
+var markdownColumns = []markdownColumn{
+	{"infected", "Infected", func(r markdownReport) string { return fmt.Sprint(r.Results.Infected) }},
+	{"status", "Status", func(r markdownReport) string { return r.Results.Status }},
+	{"result", "Result", func(r markdownReport) string { return r.Results.Result }},
+	{"detections", "Detections", func(r markdownReport) string { return strings.Join(detections(r.Results), ", ") }},
+	{"family", "Family", func(r markdownReport) string { return r.Results.Family }},
+	{"engine", "Engine", func(r markdownReport) string { return r.Results.Engine }},
+	{"database", "Database", func(r markdownReport) string { return r.Results.Database }},
+	{"updated", "Updated", func(r markdownReport) string { return updatedString(r.Results) }},
+	{"sha256", "SHA256", func(r markdownReport) string { return r.sha256 }},
+	{"duration", "Duration", func(r markdownReport) string { return r.took.Round(time.Millisecond).String() }},
+	{"action", "Action", func(r markdownReport) string { return actionTaken(r.Results) }},
+	{"profile", "Profile", func(r markdownReport) string { return r.Results.Profile }},
+}
+
+// tableColumns are the columns the markdown table shows, in order
+var tableColumns, _ = parseTableColumns(defaultTableColumns)
+
+// parseTableColumns parses a comma separated list of column names
+func parseTableColumns(list string) ([]markdownColumn, error) {
+	var columns []markdownColumn
+	for _, item := range strings.Split(list, ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if len(item) == 0 {
+			continue
+		}
+		found := false
+		for _, column := range markdownColumns {
+			if column.name == item {
+				columns = append(columns, column)
+				found = true
+				break
+			}
+		}
+		if !found {
+			var names []string
+			for _, column := range markdownColumns {
+				names = append(names, column.name)
+			}
+			return nil, fmt.Errorf("invalid table column %q (must be one of %s)", item, strings.Join(names, ", "))
+		}
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("no table columns given")
+	}
+	return columns, nil
+}
+
+// markdownCell is a column of the results row of the markdown table
+type markdownCell struct {
+	Title string
+	Value string
+}
+
+// markdownReport is what the markdown template renders: the results, the
+// configured columns and the archive members that were not clean
+type markdownReport struct {
+	DrWEB
+	Columns []markdownCell
+	Members []ArchiveMember
+
+	sha256 string
+	took   time.Duration
+}
+
+// detections returns the distinct detections of the sample and its archive members
+func detections(results ResultsData) []string {
+	var found []string
+	add := func(r ResultsData) {
+		if !r.Infected {
+			return
+		}
+		for _, detection := range found {
+			if detection == r.Result {
+				return
+			}
+		}
+		found = append(found, r.Result)
+	}
+	add(results)
+	for _, member := range results.Members {
+		add(member.Results)
+	}
+	return found
+}
+
+// notClean returns the archive members that were infected or not scanned
+func notClean(members []ArchiveMember) []ArchiveMember {
+	var found []ArchiveMember
+	for _, member := range members {
+		if member.Results.Status != statusClean {
+			found = append(found, member)
+		}
+	}
+	return found
+}
+
+// actionTaken describes what was done with the sample besides scanning it
+func actionTaken(results ResultsData) string {
+	var actions []string
+	if policy := results.PolicyApplied; policy != nil {
+		switch policy.Action {
+		case policySkip:
+			actions = append(actions, "skipped by policy "+policy.Name)
+		case policyReject:
+			actions = append(actions, "rejected by policy "+policy.Name)
+		case policyFlag:
+			actions = append(actions, "flagged by policy "+policy.Name)
+		}
+	}
+	if results.Suppression != nil {
+		actions = append(actions, "suppressed by "+results.Suppression.Name)
+	}
+	if len(results.Members) > 0 {
+		actions = append(actions, fmt.Sprintf("unpacked %d members", len(results.Members)))
+	}
+	if profile, ok := currentScanProfiles()[results.Profile]; ok && profile.Cure != nil && *profile.Cure && results.Infected {
+		actions = append(actions, "cure requested")
+	}
+	if len(actions) == 0 {
+		return "none"
+	}
+	return strings.Join(actions, ", ")
+}
+
+// escapeCell keeps a value from breaking the table row
+func escapeCell(value string) string {
+	return strings.Replace(strings.Replace(value, "|", `\|`, -1), "\n", " ", -1)
+}
+
+// generateMarkDownTable renders the results with the --table-columns, sha is
+// the scanned sample and took how long scanning it took
+func generateMarkDownTable(a DrWEB, sha string, took time.Duration) string {
+	var tplOut bytes.Buffer
+
+	report := markdownReport{DrWEB: a, sha256: sha, took: took}
+	for _, column := range tableColumns {
+		report.Columns = append(report.Columns, markdownCell{Title: column.title, Value: escapeCell(column.value(report))})
+	}
+	for _, member := range notClean(a.Results.Members) {
+		member.Path = escapeCell(member.Path)
+		member.Results.Result = escapeCell(member.Results.Result)
+		member.Results.Error = escapeCell(member.Results.Error)
+		report.Members = append(report.Members, member)
+	}
+
+	t := template.Must(template.New("drweb").Parse(tpl))
+
+	err := t.Execute(&tplOut, report)
+	if err != nil {
+		log.Println("executing template:", err)
+	}
+
+	return tplOut.String()
+}
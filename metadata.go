@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/malice-plugins/pkgs/utils"
+)
+
+// metadataHeaderPrefix is the prefix of HTTP headers carrying scan metadata
+const metadataHeaderPrefix = "X-Malice-Meta-"
+
+// metadataFieldPrefix is the prefix of form fields carrying scan metadata
+const metadataFieldPrefix = "meta."
+
+// parseMetadata parses key=value pairs into a metadata map
+func parseMetadata(pairs []string) (map[string]string, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+
+	metadata := make(map[string]string)
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		key := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || len(key) == 0 {
+			return nil, fmt.Errorf("invalid metadata %q (must be formatted as key=value)", pair)
+		}
+		metadata[key] = parts[1]
+	}
+
+	return metadata, nil
+}
+
+// requestMetadata collects the scan metadata from X-Malice-Meta-* headers and
+// meta.* form fields of a parsed request, form fields take precedence
+func requestMetadata(r *http.Request) map[string]string {
+	metadata := make(map[string]string)
+
+	for header, values := range r.Header {
+		if strings.HasPrefix(header, metadataHeaderPrefix) && len(values) > 0 {
+			key := strings.ToLower(strings.TrimPrefix(header, metadataHeaderPrefix))
+			metadata[key] = values[0]
+		}
+	}
+	if r.MultipartForm != nil {
+		for field, values := range r.MultipartForm.Value {
+			if strings.HasPrefix(field, metadataFieldPrefix) && len(values) > 0 {
+				metadata[strings.TrimPrefix(field, metadataFieldPrefix)] = values[0]
+			}
+		}
+	}
+
+	if len(metadata) == 0 {
+		return nil
+	}
+	return metadata
+}
+
+// parseTags splits a comma separated list of tags
+func parseTags(list ...string) []string {
+	var tags []string
+	for _, item := range list {
+		for _, tag := range strings.Split(item, ",") {
+			if tag = strings.TrimSpace(tag); len(tag) > 0 && !utils.StringInSlice(tag, tags) {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // hashes used by the JWT algorithms
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// jwtLeeway is the clock skew tolerated when checking exp and nbf
+const jwtLeeway = time.Minute
+
+// jwksMinRefresh limits how often unknown key ids make us download the key set
+const jwksMinRefresh = time.Minute
+
+// oidcVerifier validates JWTs issued by an OpenID Connect provider
+type oidcVerifier struct {
+	issuer     string
+	audience   string
+	jwksURL    string
+	scanScope  string
+	adminScope string
+
+	sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+// oidc is nil unless JWT authentication is enabled
+var oidc *oidcVerifier
+
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// jwtClaims are the claims we check, aud and scp come as string or list
+type jwtClaims struct {
+	Issuer    string      `json:"iss"`
+	Subject   string      `json:"sub"`
+	ClientID  string      `json:"client_id"`
+	Audience  interface{} `json:"aud"`
+	Expires   float64     `json:"exp"`
+	NotBefore float64     `json:"nbf"`
+	Scope     string      `json:"scope"`
+	Scp       interface{} `json:"scp"`
+}
+
+func newOIDCVerifier(issuer, audience, jwksURL, scanScope, adminScope string) (*oidcVerifier, error) {
+	v := &oidcVerifier{
+		issuer:     strings.TrimSuffix(issuer, "/"),
+		audience:   audience,
+		jwksURL:    jwksURL,
+		scanScope:  scanScope,
+		adminScope: adminScope,
+	}
+	if len(v.jwksURL) == 0 {
+		var discovery struct {
+			Issuer  string `json:"issuer"`
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := getJSON(v.issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+			return nil, errors.Wrap(err, "failed to discover OpenID configuration")
+		}
+		if len(discovery.JWKSURI) == 0 {
+			return nil, fmt.Errorf("OpenID configuration of %s has no jwks_uri", issuer)
+		}
+		v.jwksURL = discovery.JWKSURI
+	}
+	if err := v.refresh(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func getJSON(url string, v interface{}) error {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// refresh downloads the key set, v must not be locked
+func (v *oidcVerifier) refresh() error {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := getJSON(v.jwksURL, &set); err != nil {
+		return errors.Wrap(err, "failed to download JWKS")
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		key, err := k.publicKey()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"plugin":   name,
+				"category": category,
+				"kid":      k.Kid,
+			}).Debug(errors.Wrap(err, "skipping JWK"))
+			continue
+		}
+		keys[k.Kid] = key
+	}
+
+	v.Lock()
+	defer v.Unlock()
+	v.keys = keys
+	v.fetched = time.Now()
+	return nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+// key returns the signing key with kid, downloading the key set again if the
+// provider rotated its keys
+func (v *oidcVerifier) key(kid string) (crypto.PublicKey, error) {
+	v.Lock()
+	key, ok := v.keys[kid]
+	stale := time.Since(v.fetched) > jwksMinRefresh
+	v.Unlock()
+	if ok {
+		return key, nil
+	}
+	if !stale {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	if err := v.refresh(); err != nil {
+		return nil, err
+	}
+
+	v.Lock()
+	defer v.Unlock()
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key id %q", kid)
+}
+
+func verifyJWTSignature(alg string, key crypto.PublicKey, signingInput, signature []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256", "PS256":
+		hash = crypto.SHA256
+	case "RS384", "ES384", "PS384":
+		hash = crypto.SHA384
+	case "RS512", "ES512", "PS512":
+		hash = crypto.SHA512
+	case "EdDSA":
+		if k, ok := key.(ed25519.PublicKey); ok && ed25519.Verify(k, signingInput, signature) {
+			return nil
+		}
+		return fmt.Errorf("invalid signature")
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write(signingInput)
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if strings.HasPrefix(alg, "RS") {
+			return rsa.VerifyPKCS1v15(k, hash, digest, signature)
+		}
+		if strings.HasPrefix(alg, "PS") {
+			return rsa.VerifyPSS(k, hash, digest, signature, nil)
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if strings.HasPrefix(alg, "ES") && len(signature) == 2*size {
+			r := new(big.Int).SetBytes(signature[:size])
+			s := new(big.Int).SetBytes(signature[size:])
+			if ecdsa.Verify(k, digest, r, s) {
+				return nil
+			}
+			return fmt.Errorf("invalid signature")
+		}
+	}
+	return fmt.Errorf("key does not match algorithm %q", alg)
+}
+
+func audienceContains(aud interface{}, audience string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == audience
+	case []interface{}:
+		for _, v := range a {
+			if s, ok := v.(string); ok && s == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c jwtClaims) scopes() []string {
+	scopes := strings.Fields(c.Scope)
+	switch scp := c.Scp.(type) {
+	case string:
+		scopes = append(scopes, strings.Fields(scp)...)
+	case []interface{}:
+		for _, v := range scp {
+			if s, ok := v.(string); ok {
+				scopes = append(scopes, s)
+			}
+		}
+	}
+	return scopes
+}
+
+// verify validates token and returns the API key it stands for
+func (v *oidcVerifier) verify(token string) (apiKey, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return apiKey{}, fmt.Errorf("malformed JWT")
+	}
+
+	var header jwtHeader
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(data, &header) != nil {
+		return apiKey{}, fmt.Errorf("malformed JWT header")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return apiKey{}, fmt.Errorf("malformed JWT signature")
+	}
+	key, err := v.key(header.Kid)
+	if err != nil {
+		return apiKey{}, err
+	}
+	if err := verifyJWTSignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return apiKey{}, err
+	}
+
+	var claims jwtClaims
+	data, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(data, &claims) != nil {
+		return apiKey{}, fmt.Errorf("malformed JWT claims")
+	}
+
+	now := time.Now()
+	switch {
+	case strings.TrimSuffix(claims.Issuer, "/") != v.issuer:
+		return apiKey{}, fmt.Errorf("JWT was issued by %q", claims.Issuer)
+	case len(v.audience) > 0 && !audienceContains(claims.Audience, v.audience):
+		return apiKey{}, fmt.Errorf("JWT is not meant for %q", v.audience)
+	case claims.Expires == 0 || now.Add(-jwtLeeway).After(time.Unix(int64(claims.Expires), 0)):
+		return apiKey{}, fmt.Errorf("JWT expired")
+	case claims.NotBefore != 0 && now.Add(jwtLeeway).Before(time.Unix(int64(claims.NotBefore), 0)):
+		return apiKey{}, fmt.Errorf("JWT is not valid yet")
+	}
+
+	id := claims.Subject
+	if len(claims.ClientID) > 0 {
+		id = claims.ClientID
+	}
+	authenticated := apiKey{ID: "jwt:" + id}
+	for _, scope := range claims.scopes() {
+		switch scope {
+		case v.adminScope:
+			authenticated.Role = roleAdmin
+		case v.scanScope:
+			if authenticated.Role != roleAdmin {
+				authenticated.Role = roleScan
+			}
+		}
+	}
+	if len(authenticated.Role) == 0 {
+		return apiKey{}, fmt.Errorf("JWT has neither the %s nor the %s scope", v.scanScope, v.adminScope)
+	}
+
+	return authenticated, nil
+}
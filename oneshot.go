@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// sessionFileName keeps the engine session of --no-daemon-teardown calls in
+// the engine working directory, which only we can get into
+const sessionFileName = "session.json"
+
+// savedSession json object, what a call left for the next one
+type savedSession struct {
+	ReadyAt  time.Time `json:"ready_at"`
+	BaseInfo *BaseInfo `json:"base_info,omitempty"`
+}
+
+// sessionFile returns where the engine session is kept between calls
+func sessionFile() (string, error) {
+	dir, err := engineDirectory()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, sessionFileName), nil
+}
+
+// resume trusts the license check, the daemon and the engine info an
+// earlier call left behind, if it was within the session ttl and
+// drweb-configd still runs, so a call only spawns drweb-ctl scan
+func (s *engineSession) resume() {
+	file, err := sessionFile()
+	if err != nil || s.ttl <= 0 {
+		return
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+	var saved savedSession
+	if err := json.Unmarshal(data, &saved); err != nil || time.Since(saved.ReadyAt) >= s.ttl {
+		return
+	}
+	if ctlEngine && len(configdProcesses()) == 0 {
+		return
+	}
+
+	s.Lock()
+	s.ready, s.readyAt = true, saved.ReadyAt
+	s.Unlock()
+	if saved.BaseInfo != nil {
+		baseInfo.Lock()
+		baseInfo.info, baseInfo.cached = *saved.BaseInfo, true
+		baseInfo.Unlock()
+	}
+}
+
+// save leaves the engine session for the next call, or removes the one of
+// an earlier call if the engine had to be prepared again and failed
+func (s *engineSession) save() {
+	file, err := sessionFile()
+	if err != nil {
+		return
+	}
+	s.Lock()
+	saved := savedSession{ReadyAt: s.readyAt}
+	ready := s.ready
+	s.Unlock()
+	if !ready {
+		os.Remove(file)
+		return
+	}
+
+	baseInfo.Lock()
+	if baseInfo.cached {
+		info := baseInfo.info
+		saved.BaseInfo = &info
+	}
+	baseInfo.Unlock()
+
+	data, err := json.Marshal(saved)
+	if err == nil {
+		err = writeFileAtomic(file, data)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"plugin":   name,
+			"category": category,
+		}).Warn(errors.Wrap(err, "failed to keep the engine session"))
+	}
+}
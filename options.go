@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/malice-plugins/pkgs/utils"
+	"github.com/urfave/cli"
+)
+
+// scan actions, what the engine does with an infected sample
+const (
+	actionReport = "report"
+	actionCure   = "cure"
+)
+
+// ScanOptions json object, how a sample is scanned and what happens with its
+// results. The command line, /scan, /malice/scan, the scan socket and queued
+// jobs all scan with one, so a setting added here works with all of them.
+type ScanOptions struct {
+	Profile  string            `json:"profile,omitempty"`
+	Timeout  int               `json:"timeout,omitempty"` // seconds
+	Action   string            `json:"action,omitempty"`
+	Explode  *bool             `json:"explode,omitempty"`
+	Limits   *ArchiveLimits    `json:"archive_limits,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Tags     []string          `json:"tags,omitempty"`
+	Priority string            `json:"priority,omitempty"`
+	Callback *MaliceCallback   `json:"callback,omitempty"`
+}
+
+// ArchiveLimits json object, limits of exploded archives that can only be
+// tighter than --max-depth, --max-member-size and --max-ratio
+type ArchiveLimits struct {
+	MaxDepth      int     `json:"max_depth,omitempty"`
+	MaxMemberSize int64   `json:"max_member_size,omitempty"` // MB
+	MaxRatio      float64 `json:"max_ratio,omitempty"`
+}
+
+// defaultTimeout, defaultExplode and defaultAction are --timeout, --explode
+// and --scan-action, what options scan with if neither they nor their profile
+// have a timeout, explode or cure setting
+var (
+	defaultTimeout = 120
+	defaultExplode bool
+	defaultAction  string
+)
+
+// normalize checks the options, their profile included, and lower cases
+// the priority
+func (o *ScanOptions) normalize() error {
+	if o.Timeout < 0 {
+		return fmt.Errorf("invalid timeout %d", o.Timeout)
+	}
+	switch o.Action {
+	case "":
+	case actionReport, actionCure:
+		if !ctlEngine {
+			return fmt.Errorf("action %s is not supported by Dr.Web for Windows", o.Action)
+		}
+	default:
+		return fmt.Errorf("invalid action %q (must be %s or %s)", o.Action, actionReport, actionCure)
+	}
+	if o.Limits != nil && (o.Limits.MaxDepth < 0 || o.Limits.MaxMemberSize < 0 || o.Limits.MaxRatio < 0) {
+		return fmt.Errorf("invalid archive limits (must not be negative)")
+	}
+	if o.Callback != nil && !httpURL(o.Callback.URL) {
+		return fmt.Errorf("invalid callback %q (must be an http(s) url)", o.Callback.URL)
+	}
+	var err error
+	if o.Priority, err = parsePriority(o.Priority); err != nil {
+		return err
+	}
+	_, err = o.scanProfile()
+	return err
+}
+
+// with returns the options with the settings of override over them
+func (o ScanOptions) with(override ScanOptions) ScanOptions {
+	if len(override.Profile) > 0 {
+		o.Profile = override.Profile
+	}
+	if override.Timeout > 0 {
+		o.Timeout = override.Timeout
+	}
+	if len(override.Action) > 0 {
+		o.Action = override.Action
+	}
+	if override.Explode != nil {
+		o.Explode = override.Explode
+	}
+	if override.Limits != nil {
+		o.Limits = override.Limits
+	}
+	if len(override.Metadata) > 0 {
+		metadata := make(map[string]string)
+		for _, set := range []map[string]string{o.Metadata, override.Metadata} {
+			for key, value := range set {
+				metadata[key] = value
+			}
+		}
+		o.Metadata = metadata
+	}
+	if len(override.Tags) > 0 {
+		o.Tags = override.Tags
+	}
+	if len(override.Priority) > 0 {
+		o.Priority = override.Priority
+	}
+	if override.Callback != nil {
+		o.Callback = override.Callback
+	}
+	return o
+}
+
+// scanProfile returns the profile to scan with, the named one or --profile,
+// with the timeout, action and explode settings of the options over its own
+func (o ScanOptions) scanProfile() (*ScanProfile, error) {
+	profile := currentDefaultProfile()
+	if len(o.Profile) > 0 {
+		var err error
+		if profile, err = lookupProfile(o.Profile); err != nil {
+			return nil, err
+		}
+	}
+
+	action := o.Action
+	if len(action) == 0 && (profile == nil || profile.Cure == nil) {
+		action = defaultAction
+	}
+	if o.Timeout == 0 && len(action) == 0 && o.Explode == nil {
+		return profile, nil
+	}
+
+	var derived ScanProfile
+	if profile != nil {
+		derived = *profile
+	}
+	if o.Timeout > 0 {
+		derived.Timeout = o.Timeout
+	}
+	if len(action) > 0 {
+		derived.Cure = boolSetting(action == actionCure)
+	}
+	if o.Explode != nil {
+		derived.Explode = o.Explode
+	}
+	return &derived, nil
+}
+
+// limits returns the limits of exploded archives
+func (o ScanOptions) limits() extractLimits {
+	limits := explodeLimits
+	if o.Limits == nil {
+		return limits
+	}
+	if o.Limits.MaxDepth > 0 && (limits.MaxDepth == 0 || o.Limits.MaxDepth < limits.MaxDepth) {
+		limits.MaxDepth = o.Limits.MaxDepth
+	}
+	if size := o.Limits.MaxMemberSize << 20; size > 0 && (limits.MaxSize == 0 || size < limits.MaxSize) {
+		limits.MaxSize = size
+	}
+	if o.Limits.MaxRatio > 0 && (limits.MaxRatio == 0 || o.Limits.MaxRatio < limits.MaxRatio) {
+		limits.MaxRatio = o.Limits.MaxRatio
+	}
+	return limits
+}
+
+// requestValues returns the form field key of an upload, or else the query parameter
+func requestValues(r *http.Request, key string) []string {
+	if r.MultipartForm != nil && len(r.MultipartForm.Value[key]) > 0 {
+		return r.MultipartForm.Value[key]
+	}
+	return r.URL.Query()[key]
+}
+
+func requestValue(r *http.Request, key string) string {
+	if values := requestValues(r, key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// requestScanOptions returns the options of a request: the form fields or
+// query parameters profile, timeout, action, explode, max_depth,
+// max_member_size, max_ratio, tags, priority, callback and scan_id, and the
+// metadata headers and fields
+func requestScanOptions(r *http.Request) (ScanOptions, error) {
+	options := ScanOptions{
+		Profile:  requestValue(r, "profile"),
+		Action:   requestValue(r, "action"),
+		Metadata: requestMetadata(r),
+		Tags:     parseTags(requestValues(r, "tags")...),
+		Priority: r.Header.Get(priorityHeader),
+	}
+	if priority := requestValue(r, "priority"); len(priority) > 0 {
+		options.Priority = priority
+	}
+	var err error
+	if value := requestValue(r, "timeout"); len(value) > 0 {
+		if options.Timeout, err = strconv.Atoi(value); err != nil {
+			return options, fmt.Errorf("invalid timeout %q", value)
+		}
+	}
+	if value := requestValue(r, "explode"); len(value) > 0 {
+		explode, err := strconv.ParseBool(value)
+		if err != nil {
+			return options, fmt.Errorf("invalid explode %q", value)
+		}
+		options.Explode = &explode
+	}
+
+	var limits ArchiveLimits
+	if value := requestValue(r, "max_depth"); len(value) > 0 {
+		if limits.MaxDepth, err = strconv.Atoi(value); err != nil {
+			return options, fmt.Errorf("invalid max_depth %q", value)
+		}
+	}
+	if value := requestValue(r, "max_member_size"); len(value) > 0 {
+		if limits.MaxMemberSize, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return options, fmt.Errorf("invalid max_member_size %q", value)
+		}
+	}
+	if value := requestValue(r, "max_ratio"); len(value) > 0 {
+		if limits.MaxRatio, err = strconv.ParseFloat(value, 64); err != nil {
+			return options, fmt.Errorf("invalid max_ratio %q", value)
+		}
+	}
+	if limits != (ArchiveLimits{}) {
+		options.Limits = &limits
+	}
+
+	if callback := requestValue(r, "callback"); len(callback) > 0 {
+		options.Callback = &MaliceCallback{ScanID: requestValue(r, "scan_id"), URL: callback, Tenant: requestTenant(r)}
+	}
+	return options, options.normalize()
+}
+
+// cliScanOptions returns the options of a scan on the command line, its
+// --callback goes to MALICE_ENDPOINT with the MALICE_SCANID (or sha256) of the sample
+func cliScanOptions(c *cli.Context, sha string) (ScanOptions, error) {
+	metadata, err := parseMetadata(c.StringSlice("meta"))
+	if err != nil {
+		return ScanOptions{}, err
+	}
+	options := ScanOptions{
+		Metadata: metadata,
+		Tags:     parseTags(c.String("tags")),
+	}
+	if c.Bool("callback") {
+		options.Callback = &MaliceCallback{ScanID: utils.Getopt("MALICE_SCANID", sha), URL: os.Getenv("MALICE_ENDPOINT")}
+	}
+	return options, nil
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// callback delivery states of the outbox
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+)
+
+// deliveryHeader carries the outbox id of a callback, it stays the same when
+// the callback is replayed so receivers can drop duplicates
+const deliveryHeader = "X-Malice-Delivery"
+
+// OutboxEntry json object, a callback the results of a scan were to be POSTed
+// to and how its delivery went
+type OutboxEntry struct {
+	ID          string          `json:"id"`
+	ScanID      string          `json:"scan_id"`
+	SHA256      string          `json:"sha256,omitempty"`
+	URL         string          `json:"url"`
+	Infected    bool            `json:"infected"`
+	Result      string          `json:"result,omitempty"`
+	Status      string          `json:"status"`
+	CreatedAt   time.Time       `json:"created_at"`
+	DeliveredAt *time.Time      `json:"delivered_at,omitempty"`
+	Attempts    []OutboxAttempt `json:"attempts"`
+}
+
+// OutboxAttempt json object, a POST of a callback
+type OutboxAttempt struct {
+	At         time.Time `json:"at"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Replay     bool      `json:"replay,omitempty"`
+}
+
+// callbackOutbox keeps every callback of the store as <dir>/outbox/<id>.json
+// next to the exact body that is POSTed, <id>.body
+type callbackOutbox struct {
+	dir string
+}
+
+// outboxLock serializes the updates of outbox entries within this process
+var outboxLock sync.Mutex
+
+// outbox returns the outbox of the store, nil without a store
+func (s *resultStore) outbox() *callbackOutbox {
+	if s == nil {
+		return nil
+	}
+	return &callbackOutbox{dir: filepath.Join(s.dir, "outbox")}
+}
+
+func (o *callbackOutbox) file(id, ext string) string {
+	return filepath.Join(o.dir, id+ext)
+}
+
+// add records a callback before it is POSTed the first time, nil without
+// an outbox
+func (o *callbackOutbox) add(url, scanID, sha string, drweb DrWEB, body []byte) (*OutboxEntry, error) {
+	if o == nil {
+		return nil, nil
+	}
+	entry := &OutboxEntry{
+		ID:        newJobID(),
+		ScanID:    scanID,
+		SHA256:    strings.ToLower(sha),
+		URL:       url,
+		Infected:  drweb.Results.Infected,
+		Result:    drweb.Results.Result,
+		Status:    deliveryPending,
+		CreatedAt: time.Now().UTC(),
+		Attempts:  []OutboxAttempt{},
+	}
+	if err := os.MkdirAll(o.dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "failed to create outbox")
+	}
+	if err := writeFileAtomic(o.file(entry.ID, ".body"), body); err != nil {
+		return nil, errors.Wrap(err, "failed to record callback")
+	}
+	return entry, errors.Wrap(o.save(entry), "failed to record callback")
+}
+
+func (o *callbackOutbox) save(entry *OutboxEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(o.file(entry.ID, ".json"), data)
+}
+
+// load reads an entry of the outbox
+func (o *callbackOutbox) load(id string) (*OutboxEntry, error) {
+	data, err := ioutil.ReadFile(o.file(id, ".json"))
+	if err != nil {
+		return nil, err
+	}
+	entry := &OutboxEntry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse outbox entry %s", id)
+	}
+	return entry, nil
+}
+
+// list returns the entries match accepts, oldest first
+func (o *callbackOutbox) list(match func(*OutboxEntry) bool) ([]*OutboxEntry, error) {
+	files, err := filepath.Glob(o.file("*", ".json"))
+	if err != nil {
+		return nil, err
+	}
+	entries := []*OutboxEntry{}
+	for _, file := range files {
+		entry, err := o.load(strings.TrimSuffix(filepath.Base(file), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		if match(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].CreatedAt.Before(entries[j].CreatedAt)
+	})
+	return entries, nil
+}
+
+// record adds the outcome of a POST of the callback to its entry
+func (o *callbackOutbox) record(entry *OutboxEntry, statusCode int, postErr error, replay bool) {
+	if o == nil || entry == nil {
+		return
+	}
+	outboxLock.Lock()
+	defer outboxLock.Unlock()
+
+	attempt := OutboxAttempt{At: time.Now().UTC(), StatusCode: statusCode, Replay: replay}
+	if postErr != nil {
+		attempt.Error = postErr.Error()
+	}
+	entry.Attempts = append(entry.Attempts, attempt)
+	switch {
+	case postErr == nil:
+		entry.Status = deliveryDelivered
+		entry.DeliveredAt = &attempt.At
+	case entry.Status != deliveryDelivered:
+		entry.Status = deliveryFailed
+	}
+	if err := o.save(entry); err != nil {
+		log.WithFields(log.Fields{
+			"plugin":   name,
+			"category": category,
+			"delivery": entry.ID,
+		}).Error(errors.Wrap(err, "failed to record callback delivery"))
+	}
+}
+
+// replay POSTs the recorded body of an entry again
+func (o *callbackOutbox) replay(entry *OutboxEntry) error {
+	body, err := ioutil.ReadFile(o.file(entry.ID, ".body"))
+	if err != nil {
+		return errors.Wrapf(err, "failed to read the body of outbox entry %s", entry.ID)
+	}
+	statusCode, err := postCallback(entry.URL, entry.ScanID, entry.ID, body)
+	o.record(entry, statusCode, err, true)
+	return err
+}
+
+// webOutbox lists the callbacks of the outbox, optionally filtered by
+// ?status= and ?scan_id=. Admin keys of a tenant only see their tenant's.
+func webOutbox(w http.ResponseWriter, r *http.Request) {
+	if store == nil {
+		http.Error(w, "results store is not enabled (see --store)", http.StatusNotFound)
+		return
+	}
+
+	limit := 100
+	if l := r.URL.Query().Get("limit"); len(l) > 0 {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+	status := r.URL.Query().Get("status")
+	scanID := r.URL.Query().Get("scan_id")
+
+	entries, err := store.tenant(requestTenant(r)).outbox().list(func(entry *OutboxEntry) bool {
+		return (len(status) == 0 || entry.Status == status) && (len(scanID) == 0 || entry.ScanID == scanID)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// the latest callbacks first
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].CreatedAt.After(entries[j].CreatedAt)
+	})
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// outboxes returns the outbox of the store and of each of its tenants
+func outboxes() ([]*callbackOutbox, error) {
+	if store == nil {
+		return nil, fmt.Errorf("the outbox requires --store")
+	}
+	tenants, err := store.tenants()
+	if err != nil {
+		return nil, err
+	}
+	all := []*callbackOutbox{store.outbox()}
+	for _, tenant := range tenants {
+		all = append(all, tenant.outbox())
+	}
+	return all, nil
+}
+
+// outboxListCommand prints the callbacks of the outbox as JSON lines
+func outboxListCommand(c *cli.Context) error {
+	all, err := outboxes()
+	if err != nil {
+		return err
+	}
+	for _, o := range all {
+		entries, err := o.list(func(entry *OutboxEntry) bool {
+			return len(c.String("status")) == 0 || entry.Status == c.String("status")
+		})
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			data, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(data))
+		}
+	}
+	return nil
+}
+
+// outboxReplayCommand POSTs the callbacks with the given ids again, or every
+// callback that was not delivered
+func outboxReplayCommand(c *cli.Context) error {
+	all, err := outboxes()
+	if err != nil {
+		return err
+	}
+	ids := make(map[string]bool)
+	for _, id := range c.Args() {
+		ids[id] = true
+	}
+
+	failed := 0
+	for _, o := range all {
+		entries, err := o.list(func(entry *OutboxEntry) bool {
+			if len(ids) > 0 {
+				return ids[entry.ID] && (entry.Status != deliveryDelivered || c.Bool("force"))
+			}
+			return entry.Status != deliveryDelivered
+		})
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			delete(ids, entry.ID)
+			err := o.replay(entry)
+			log.WithFields(log.Fields{
+				"plugin":   name,
+				"category": category,
+				"delivery": entry.ID,
+				"scan_id":  entry.ScanID,
+				"status":   entry.Status,
+			}).Info("replayed callback")
+			if err != nil {
+				failed++
+				log.WithFields(log.Fields{
+					"plugin":   name,
+					"category": category,
+					"delivery": entry.ID,
+				}).Error(err)
+			}
+		}
+	}
+	for id := range ids {
+		return fmt.Errorf("no undelivered callback %s in the outbox (use --force to replay delivered ones)", id)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d callbacks failed again", failed)
+	}
+	return nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// A minimal Parquet writer for exports: a single row group with one
+// uncompressed, PLAIN encoded data page per column and only required
+// columns, so no definition or repetition levels are written. The file
+// metadata is serialized with the Thrift compact protocol.
+
+const parquetMagic = "PAR1"
+
+// parquet physical types
+const (
+	parquetBoolean   = 0
+	parquetInt64     = 2
+	parquetByteArray = 6
+)
+
+// parquet converted types
+const (
+	parquetUTF8            = 0
+	parquetTimestampMillis = 9
+)
+
+// parquet encodings
+const (
+	parquetPlain = 0
+	parquetRLE   = 3
+)
+
+// thrift compact protocol types
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter serializes structs with the Thrift compact protocol
+type thriftWriter struct {
+	buf     bytes.Buffer
+	lastID  int16
+	parents []int16
+}
+
+func (t *thriftWriter) uvarint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	t.buf.Write(b[:binary.PutUvarint(b[:], v)])
+}
+
+func (t *thriftWriter) zigzag(v int64) {
+	t.uvarint(uint64((v << 1) ^ (v >> 63)))
+}
+
+func (t *thriftWriter) field(id int16, typ byte) {
+	if delta := id - t.lastID; delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		t.buf.WriteByte(typ)
+		t.zigzag(int64(id))
+	}
+	t.lastID = id
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.zigzag(int64(v))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.zigzag(v)
+}
+
+func (t *thriftWriter) str(s string) {
+	t.uvarint(uint64(len(s)))
+	t.buf.WriteString(s)
+}
+
+func (t *thriftWriter) stringField(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.str(s)
+}
+
+func (t *thriftWriter) list(id int16, elemType byte, size int) {
+	t.field(id, thriftList)
+	if size < 15 {
+		t.buf.WriteByte(byte(size)<<4 | elemType)
+		return
+	}
+	t.buf.WriteByte(0xf0 | elemType)
+	t.uvarint(uint64(size))
+}
+
+// begin starts a struct, a field of the current struct unless id is 0 (a
+// list element or the top level struct)
+func (t *thriftWriter) begin(id int16) {
+	if id > 0 {
+		t.field(id, thriftStruct)
+	}
+	t.parents = append(t.parents, t.lastID)
+	t.lastID = 0
+}
+
+func (t *thriftWriter) end() {
+	t.buf.WriteByte(0)
+	t.lastID = t.parents[len(t.parents)-1]
+	t.parents = t.parents[:len(t.parents)-1]
+}
+
+// parquetColumn is a required column and its PLAIN encoded values
+type parquetColumn struct {
+	name          string
+	typ           int32
+	convertedType int32 // -1 for none
+	values        bytes.Buffer
+	count         int
+	bits          byte // booleans are bit packed
+}
+
+func (c *parquetColumn) addString(s string) {
+	binary.Write(&c.values, binary.LittleEndian, uint32(len(s)))
+	c.values.WriteString(s)
+	c.count++
+}
+
+func (c *parquetColumn) addInt64(v int64) {
+	binary.Write(&c.values, binary.LittleEndian, v)
+	c.count++
+}
+
+func (c *parquetColumn) addBool(v bool) {
+	if v {
+		c.bits |= 1 << uint(c.count%8)
+	}
+	c.count++
+	if c.count%8 == 0 {
+		c.values.WriteByte(c.bits)
+		c.bits = 0
+	}
+}
+
+// data returns the encoded values, flushing a partial byte of booleans
+func (c *parquetColumn) data() []byte {
+	data := c.values.Bytes()
+	if c.typ == parquetBoolean && c.count%8 != 0 {
+		data = append(append([]byte{}, data...), c.bits)
+	}
+	return data
+}
+
+// countingWriter tracks the file offset of what is written
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
+
+// writeParquet writes the columns, which all hold rows values, as a Parquet file
+func writeParquet(w io.Writer, columns []*parquetColumn, rows int, createdBy string) error {
+	out := &countingWriter{w: w}
+	io.WriteString(out, parquetMagic)
+
+	type chunk struct {
+		offset int64
+		size   int64
+	}
+	var chunks []chunk
+	if rows > 0 {
+		for _, column := range columns {
+			data := column.data()
+			header := &thriftWriter{}
+			header.begin(0)
+			header.i32(1, 0) // DATA_PAGE
+			header.i32(2, int32(len(data)))
+			header.i32(3, int32(len(data)))
+			header.begin(5)
+			header.i32(1, int32(column.count))
+			header.i32(2, parquetPlain)
+			header.i32(3, parquetRLE)
+			header.i32(4, parquetRLE)
+			header.end()
+			header.end()
+
+			offset := out.n
+			out.Write(header.buf.Bytes())
+			out.Write(data)
+			chunks = append(chunks, chunk{offset: offset, size: out.n - offset})
+		}
+	}
+
+	meta := &thriftWriter{}
+	meta.begin(0)
+	meta.i32(1, 1)
+	meta.list(2, thriftStruct, len(columns)+1)
+	meta.begin(0)
+	meta.stringField(4, "schema")
+	meta.i32(5, int32(len(columns)))
+	meta.end()
+	for _, column := range columns {
+		meta.begin(0)
+		meta.i32(1, column.typ)
+		meta.i32(3, 0) // REQUIRED
+		meta.stringField(4, column.name)
+		if column.convertedType >= 0 {
+			meta.i32(6, column.convertedType)
+		}
+		meta.end()
+	}
+	meta.i64(3, int64(rows))
+	if len(chunks) == 0 {
+		meta.list(4, thriftStruct, 0)
+	} else {
+		meta.list(4, thriftStruct, 1)
+		var total int64
+		meta.begin(0)
+		meta.list(1, thriftStruct, len(columns))
+		for i, column := range columns {
+			total += chunks[i].size
+			meta.begin(0)
+			meta.i64(2, chunks[i].offset)
+			meta.begin(3)
+			meta.i32(1, column.typ)
+			meta.list(2, thriftI32, 1)
+			meta.zigzag(parquetPlain)
+			meta.list(3, thriftBinary, 1)
+			meta.str(column.name)
+			meta.i32(4, 0) // UNCOMPRESSED
+			meta.i64(5, int64(column.count))
+			meta.i64(6, chunks[i].size)
+			meta.i64(7, chunks[i].size)
+			meta.i64(9, chunks[i].offset)
+			meta.end()
+			meta.end()
+		}
+		meta.i64(2, total)
+		meta.i64(3, int64(rows))
+		meta.end()
+	}
+	meta.stringField(6, createdBy)
+	meta.end()
+
+	out.Write(meta.buf.Bytes())
+	binary.Write(out, binary.LittleEndian, uint32(meta.buf.Len()))
+	io.WriteString(out, parquetMagic)
+	return out.err
+}
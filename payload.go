@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// payloadTemplate renders the results POSTed to the callback urls starting
+// with prefix, for receivers expecting their own field names
+type payloadTemplate struct {
+	prefix string
+	file   string
+	tmpl   *template.Template
+}
+
+// payloadTemplates are sorted longest prefix first
+var payloadTemplates []payloadTemplate
+
+var payloadFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"join": func(items []interface{}, sep string) string {
+		texts := make([]string, len(items))
+		for i, item := range items {
+			texts[i] = fmt.Sprint(item)
+		}
+		return strings.Join(texts, sep)
+	},
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"now": func() string {
+		return time.Now().UTC().Format(time.RFC3339)
+	},
+}
+
+// loadPayloadTemplates parses --callback-template URL=FILE values
+func loadPayloadTemplates(specs []string) error {
+	var templates []payloadTemplate
+	for _, spec := range specs {
+		// urls may have a query, file names rarely have an equals sign
+		i := strings.LastIndex(spec, "=")
+		if i <= 0 || i == len(spec)-1 {
+			return fmt.Errorf("invalid callback template %q (must be formatted as URL=FILE)", spec)
+		}
+		prefix, file := spec[:i], spec[i+1:]
+		text, err := ioutil.ReadFile(file)
+		if err != nil {
+			return errors.Wrap(err, "failed to read callback template")
+		}
+		tmpl, err := template.New(file).Funcs(payloadFuncs).Parse(string(text))
+		if err != nil {
+			return errors.Wrap(err, "failed to parse callback template")
+		}
+		templates = append(templates, payloadTemplate{prefix: prefix, file: file, tmpl: tmpl})
+	}
+	sort.SliceStable(templates, func(i, j int) bool {
+		return len(templates[i].prefix) > len(templates[j].prefix)
+	})
+	payloadTemplates = templates
+	return nil
+}
+
+// payloadTemplateFor returns the template for url, nil if results are POSTed as they are
+func payloadTemplateFor(url string) *payloadTemplate {
+	for i := range payloadTemplates {
+		if strings.HasPrefix(url, payloadTemplates[i].prefix) {
+			return &payloadTemplates[i]
+		}
+	}
+	return nil
+}
+
+// callbackPayload returns what is POSTed to url: the results as JSON, or
+// rendered with the template of url. Templates see the results as they are
+// marshalled, e.g. {{.drweb.result}}, and the Malice scan id as {{.scan_id}}.
+func callbackPayload(url, scanID string, drweb DrWEB) ([]byte, error) {
+	body, err := json.Marshal(drweb)
+	if err != nil {
+		return nil, err
+	}
+	t := payloadTemplateFor(url)
+	if t == nil {
+		return body, nil
+	}
+
+	var data map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&data); err != nil {
+		return nil, err
+	}
+	data["scan_id"] = scanID
+
+	var payload bytes.Buffer
+	if err := t.tmpl.Execute(&payload, data); err != nil {
+		return nil, errors.Wrapf(err, "failed to render callback template %s", t.file)
+	}
+	return payload.Bytes(), nil
+}
@@ -0,0 +1,872 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// link-layer header types (http://www.tcpdump.org/linktypes.html)
+const (
+	linkTypeNull     = 0
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101
+	linkTypeLinuxSLL = 113
+	linkTypeIPv4     = 228
+	linkTypeIPv6     = 229
+)
+
+// pcapMaxRecord caps the packet records and pcapng blocks read from a
+// capture, their lengths come from the file and must not make us allocate more
+const pcapMaxRecord = 16 << 20
+
+var (
+	ftpPasvRe = regexp.MustCompile(`\((\d+),(\d+),(\d+),(\d+),(\d+),(\d+)\)`)
+	ftpEpsvRe = regexp.MustCompile(`\(\|\|\|(\d+)\|\)`)
+	ftpPortRe = regexp.MustCompile(`(\d+),(\d+),(\d+),(\d+),(\d+),(\d+)`)
+	ftpEprtRe = regexp.MustCompile(`\|[12]\|[^|]+\|(\d+)\|`)
+)
+
+// tcpSegment is a decoded TCP segment carrying payload
+type tcpSegment struct {
+	src     string
+	dst     string
+	seq     uint32
+	syn     bool
+	payload []byte
+}
+
+// tcpStream is one direction of a TCP connection
+type tcpStream struct {
+	src      string
+	dst      string
+	isn      uint32
+	syn      bool
+	segments []tcpSegment
+	data     []byte
+}
+
+type pcapObject struct {
+	Protocol    string      `json:"protocol"`
+	Source      string      `json:"src"`
+	Destination string      `json:"dst"`
+	Name        string      `json:"name,omitempty"`
+	Size        int         `json:"size"`
+	SHA256      string      `json:"sha256"`
+	Results     ResultsData `json:"drweb"`
+	data        []byte
+}
+
+// PcapReport json object
+type PcapReport struct {
+	File     string       `json:"file"`
+	Streams  int          `json:"streams"`
+	Scanned  int          `json:"scanned"`
+	Infected int          `json:"infected"`
+	Summary  ScanSummary  `json:"summary"`
+	Objects  []pcapObject `json:"objects"`
+}
+
+// readPackets calls fn for every packet in a pcap or pcapng capture
+func readPackets(r io.Reader, fn func(linkType uint32, data []byte)) error {
+	br := bufio.NewReader(r)
+
+	magic, err := br.Peek(4)
+	if err != nil {
+		return errors.Wrap(err, "failed to read capture file header")
+	}
+
+	switch {
+	case bytes.Equal(magic, []byte{0x0a, 0x0d, 0x0d, 0x0a}):
+		return readPcapNG(br, fn)
+	case bytes.Equal(magic, []byte{0xd4, 0xc3, 0xb2, 0xa1}), bytes.Equal(magic, []byte{0x4d, 0x3c, 0xb2, 0xa1}):
+		return readPcap(br, binary.LittleEndian, fn)
+	case bytes.Equal(magic, []byte{0xa1, 0xb2, 0xc3, 0xd4}), bytes.Equal(magic, []byte{0xa1, 0xb2, 0x3c, 0x4d}):
+		return readPcap(br, binary.BigEndian, fn)
+	}
+
+	return fmt.Errorf("unsupported capture file format (magic %x)", magic)
+}
+
+func readPcap(r io.Reader, order binary.ByteOrder, fn func(linkType uint32, data []byte)) error {
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return errors.Wrap(err, "failed to read pcap header")
+	}
+	linkType := order.Uint32(header[20:24])
+
+	record := make([]byte, 16)
+	for {
+		if _, err := io.ReadFull(r, record); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return errors.Wrap(err, "failed to read pcap record header")
+		}
+		length := order.Uint32(record[8:12])
+		if length > pcapMaxRecord {
+			return fmt.Errorf("pcap record of %d bytes is larger than %d", length, pcapMaxRecord)
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return errors.Wrap(err, "failed to read pcap record")
+		}
+		fn(linkType, data)
+	}
+}
+
+func readPcapNG(r io.Reader, fn func(linkType uint32, data []byte)) error {
+	var order binary.ByteOrder = binary.LittleEndian
+	var interfaces []uint32
+
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return errors.Wrap(err, "failed to read pcapng block header")
+		}
+
+		blockType := order.Uint32(header[0:4])
+		if blockType == 0x0a0d0d0a {
+			// section header block: byte-order magic follows the block length
+			bom := make([]byte, 4)
+			if _, err := io.ReadFull(r, bom); err != nil {
+				return errors.Wrap(err, "failed to read pcapng section header")
+			}
+			if bytes.Equal(bom, []byte{0x1a, 0x2b, 0x3c, 0x4d}) {
+				order = binary.BigEndian
+			} else {
+				order = binary.LittleEndian
+			}
+			interfaces = nil
+			length := order.Uint32(header[4:8])
+			if length < 12 {
+				return fmt.Errorf("invalid pcapng block length %d", length)
+			}
+			if _, err := io.CopyN(ioutil.Discard, r, int64(length)-12); err != nil {
+				return errors.Wrap(err, "failed to read pcapng section header")
+			}
+			continue
+		}
+
+		length := order.Uint32(header[4:8])
+		if length < 12 {
+			return fmt.Errorf("invalid pcapng block length %d", length)
+		}
+		if length > pcapMaxRecord {
+			return fmt.Errorf("pcapng block of %d bytes is larger than %d", length, pcapMaxRecord)
+		}
+		body := make([]byte, length-8)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return errors.Wrap(err, "failed to read pcapng block")
+		}
+		body = body[:len(body)-4]
+
+		switch blockType {
+		case 1: // interface description block
+			if len(body) >= 2 {
+				interfaces = append(interfaces, uint32(order.Uint16(body[0:2])))
+			}
+		case 3: // simple packet block
+			if len(body) >= 4 && len(interfaces) > 0 {
+				captured := order.Uint32(body[0:4])
+				if int(captured) > len(body)-4 {
+					captured = uint32(len(body) - 4)
+				}
+				fn(interfaces[0], body[4:4+captured])
+			}
+		case 6: // enhanced packet block
+			if len(body) >= 20 {
+				iface := order.Uint32(body[0:4])
+				captured := order.Uint32(body[12:16])
+				if int(iface) < len(interfaces) && int(captured) <= len(body)-20 {
+					fn(interfaces[iface], body[20:20+captured])
+				}
+			}
+		}
+	}
+}
+
+// decodeTCP strips the link and network layers and returns the TCP segment
+func decodeTCP(linkType uint32, data []byte) (tcpSegment, bool) {
+	var seg tcpSegment
+
+	switch linkType {
+	case linkTypeEthernet:
+		if len(data) < 14 {
+			return seg, false
+		}
+		etherType := binary.BigEndian.Uint16(data[12:14])
+		data = data[14:]
+		for etherType == 0x8100 || etherType == 0x88a8 {
+			if len(data) < 4 {
+				return seg, false
+			}
+			etherType = binary.BigEndian.Uint16(data[2:4])
+			data = data[4:]
+		}
+		if etherType != 0x0800 && etherType != 0x86dd {
+			return seg, false
+		}
+	case linkTypeLinuxSLL:
+		if len(data) < 16 {
+			return seg, false
+		}
+		data = data[16:]
+	case linkTypeNull:
+		if len(data) < 4 {
+			return seg, false
+		}
+		data = data[4:]
+	case linkTypeRaw, linkTypeIPv4, linkTypeIPv6, 12, 14: // DLT_RAW is 12 or 14 on some BSDs
+	default:
+		return seg, false
+	}
+
+	if len(data) < 1 {
+		return seg, false
+	}
+
+	var srcIP, dstIP net.IP
+	switch data[0] >> 4 {
+	case 4:
+		if len(data) < 20 || data[9] != 6 {
+			return seg, false
+		}
+		// skip fragments
+		if binary.BigEndian.Uint16(data[6:8])&0x3fff != 0 {
+			return seg, false
+		}
+		ihl := int(data[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(data[2:4]))
+		if ihl < 20 || total < ihl || total > len(data) {
+			return seg, false
+		}
+		srcIP, dstIP = net.IP(data[12:16]), net.IP(data[16:20])
+		data = data[ihl:total]
+	case 6:
+		if len(data) < 40 || data[6] != 6 {
+			return seg, false
+		}
+		total := 40 + int(binary.BigEndian.Uint16(data[4:6]))
+		if total > len(data) {
+			return seg, false
+		}
+		srcIP, dstIP = net.IP(data[8:24]), net.IP(data[24:40])
+		data = data[40:total]
+	default:
+		return seg, false
+	}
+
+	if len(data) < 20 {
+		return seg, false
+	}
+	offset := int(data[12]>>4) * 4
+	if offset < 20 || offset > len(data) {
+		return seg, false
+	}
+
+	seg.src = net.JoinHostPort(srcIP.String(), strconv.Itoa(int(binary.BigEndian.Uint16(data[0:2]))))
+	seg.dst = net.JoinHostPort(dstIP.String(), strconv.Itoa(int(binary.BigEndian.Uint16(data[2:4]))))
+	seg.seq = binary.BigEndian.Uint32(data[4:8])
+	seg.syn = data[13]&0x02 != 0
+	seg.payload = data[offset:]
+
+	return seg, true
+}
+
+// reassemble orders the stream's segments by sequence number and drops retransmissions
+func (s *tcpStream) reassemble() {
+	if len(s.segments) == 0 {
+		return
+	}
+
+	base := s.isn + 1
+	if !s.syn {
+		base = s.segments[0].seq
+		for _, seg := range s.segments {
+			if int32(seg.seq-base) < 0 {
+				base = seg.seq
+			}
+		}
+	}
+
+	sort.SliceStable(s.segments, func(i, j int) bool {
+		return s.segments[i].seq-base < s.segments[j].seq-base
+	})
+
+	var buf bytes.Buffer
+	for _, seg := range s.segments {
+		offset := int(seg.seq - base)
+		if offset+len(seg.payload) <= buf.Len() {
+			// retransmission
+			continue
+		}
+		if offset < buf.Len() {
+			seg.payload = seg.payload[buf.Len()-offset:]
+		}
+		buf.Write(seg.payload)
+	}
+
+	s.data = buf.Bytes()
+	s.segments = nil
+}
+
+func endpointPort(endpoint string) string {
+	_, port, _ := net.SplitHostPort(endpoint)
+	return port
+}
+
+func isHTTPRequest(data []byte) bool {
+	for _, method := range []string{"GET ", "POST ", "PUT ", "HEAD ", "PATCH ", "DELETE ", "OPTIONS "} {
+		if bytes.HasPrefix(data, []byte(method)) {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeContentEncoding(encoding string, body []byte) []byte {
+	var r io.ReadCloser
+	var err error
+
+	switch strings.ToLower(encoding) {
+	case "gzip", "x-gzip":
+		r, err = gzip.NewReader(bytes.NewReader(body))
+	case "deflate":
+		r = flate.NewReader(bytes.NewReader(body))
+	default:
+		return body
+	}
+	if err != nil {
+		return body
+	}
+	defer r.Close()
+
+	decoded, err := ioutil.ReadAll(r)
+	if err != nil && len(decoded) == 0 {
+		return body
+	}
+	return decoded
+}
+
+// extractHTTP returns the request and response bodies transferred over an HTTP connection
+func extractHTTP(client, server *tcpStream) []pcapObject {
+	var objects []pcapObject
+
+	reqs := bufio.NewReader(bytes.NewReader(client.data))
+	var resps *bufio.Reader
+	if server != nil {
+		resps = bufio.NewReader(bytes.NewReader(server.data))
+	}
+
+	for {
+		req, err := http.ReadRequest(reqs)
+		if err != nil {
+			break
+		}
+		uri := req.Host + req.URL.RequestURI()
+
+		body, _ := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if len(body) > 0 {
+			objects = append(objects, pcapObject{
+				Protocol:    "http",
+				Source:      client.src,
+				Destination: client.dst,
+				Name:        req.Method + " " + uri,
+				Size:        len(body),
+				data:        body,
+			})
+		}
+
+		if resps == nil {
+			continue
+		}
+		resp, err := http.ReadResponse(resps, req)
+		if err != nil {
+			resps = nil
+			continue
+		}
+		body, _ = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		body = decodeContentEncoding(resp.Header.Get("Content-Encoding"), body)
+		if len(body) > 0 {
+			objects = append(objects, pcapObject{
+				Protocol:    "http",
+				Source:      server.src,
+				Destination: server.dst,
+				Name:        uri,
+				Size:        len(body),
+				data:        body,
+			})
+		}
+	}
+
+	return objects
+}
+
+// extractFTP pairs the data connections announced on an FTP control
+// connection with the transfer commands that used them
+func extractFTP(client, server *tcpStream, streams map[string]*tcpStream) []pcapObject {
+	var objects []pcapObject
+	var transfers []string
+	var ports []string
+
+	for _, line := range strings.Split(string(client.data), "\n") {
+		line = strings.TrimSpace(line)
+		fields := strings.SplitN(line, " ", 2)
+		switch strings.ToUpper(fields[0]) {
+		case "RETR", "STOR", "STOU", "APPE", "LIST", "NLST", "MLSD":
+			transfers = append(transfers, line)
+		case "PORT":
+			if m := ftpPortRe.FindStringSubmatch(line); m != nil {
+				p1, _ := strconv.Atoi(m[5])
+				p2, _ := strconv.Atoi(m[6])
+				ports = append(ports, strconv.Itoa(p1*256+p2))
+			}
+		case "EPRT":
+			if m := ftpEprtRe.FindStringSubmatch(line); m != nil {
+				ports = append(ports, m[1])
+			}
+		}
+	}
+	if server != nil {
+		for _, line := range strings.Split(string(server.data), "\n") {
+			if strings.HasPrefix(line, "227") {
+				if m := ftpPasvRe.FindStringSubmatch(line); m != nil {
+					p1, _ := strconv.Atoi(m[5])
+					p2, _ := strconv.Atoi(m[6])
+					ports = append(ports, strconv.Itoa(p1*256+p2))
+				}
+			}
+			if strings.HasPrefix(line, "229") {
+				if m := ftpEpsvRe.FindStringSubmatch(line); m != nil {
+					ports = append(ports, m[1])
+				}
+			}
+		}
+	}
+
+	for i, transfer := range transfers {
+		if i >= len(ports) {
+			break
+		}
+		fields := strings.SplitN(transfer, " ", 2)
+		command := strings.ToUpper(fields[0])
+		if command == "LIST" || command == "NLST" || command == "MLSD" {
+			continue
+		}
+		filename := ""
+		if len(fields) > 1 {
+			filename = fields[1]
+		}
+		for _, s := range streams {
+			if len(s.data) == 0 {
+				continue
+			}
+			if endpointPort(s.src) != ports[i] && endpointPort(s.dst) != ports[i] {
+				continue
+			}
+			objects = append(objects, pcapObject{
+				Protocol:    "ftp",
+				Source:      s.src,
+				Destination: s.dst,
+				Name:        command + " " + filename,
+				Size:        len(s.data),
+				data:        s.data,
+			})
+		}
+	}
+
+	return objects
+}
+
+// SMB2 commands files are carved from
+const (
+	smb2Create = 0x05
+	smb2Read   = 0x08
+	smb2Write  = 0x09
+)
+
+// smb2HeaderSize is the size of an SMB2 message header
+const smb2HeaderSize = 64
+
+// smbMaxFileSize caps the files carved from SMB reads and writes, offsets in
+// a capture must not make us allocate more
+const smbMaxFileSize = 1 << 30
+
+// smbMaxHole caps the parts of a carved file that were never transferred, so
+// a single chunk at a large offset cannot make us allocate the whole file
+const smbMaxHole = 16 << 20
+
+// smb2Message is an SMB2 message of a session, body is the message without
+// its header, offsets in it are from the start of msg
+type smb2Message struct {
+	command   uint16
+	status    uint32
+	messageID uint64
+	msg       []byte
+	body      []byte
+}
+
+// smb2Messages splits a reassembled direct TCP or NetBIOS session stream into
+// its SMB2 messages, compounded ones included. Encrypted (SMB3 transform)
+// and SMB1 messages are skipped.
+func smb2Messages(data []byte) []smb2Message {
+	var messages []smb2Message
+	for len(data) >= 4 {
+		kind := data[0]
+		length := int(data[1])<<16 | int(data[2])<<8 | int(data[3])
+		if 4+length > len(data) {
+			break
+		}
+		packet := data[4 : 4+length]
+		data = data[4+length:]
+		// NetBIOS session requests and keep-alives on port 139 carry no SMB
+		if kind != 0 {
+			continue
+		}
+		for len(packet) >= smb2HeaderSize && bytes.HasPrefix(packet, []byte("\xfeSMB")) {
+			next := int(binary.LittleEndian.Uint32(packet[20:24]))
+			// a next command within the header or past the packet is a
+			// truncated or forged compound, the rest of it cannot be trusted
+			if next != 0 && (next < smb2HeaderSize || next > len(packet)) {
+				break
+			}
+			msg := packet
+			if next > 0 {
+				msg = packet[:next]
+			}
+			messages = append(messages, smb2Message{
+				command:   binary.LittleEndian.Uint16(packet[12:14]),
+				status:    binary.LittleEndian.Uint32(packet[8:12]),
+				messageID: binary.LittleEndian.Uint64(packet[24:32]),
+				msg:       msg,
+				body:      msg[smb2HeaderSize:],
+			})
+			if next == 0 {
+				break
+			}
+			packet = packet[next:]
+		}
+	}
+	return messages
+}
+
+// smbFile collects the chunks of a file read or written over SMB2
+type smbFile struct {
+	name   string
+	chunks map[uint64][]byte
+	size   uint64
+}
+
+func (f *smbFile) add(offset uint64, data []byte) {
+	end := offset + uint64(len(data))
+	if len(data) == 0 || end > smbMaxFileSize || end < offset {
+		return
+	}
+	if f.chunks == nil {
+		f.chunks = make(map[uint64][]byte)
+	}
+	f.chunks[offset] = data
+	if end > f.size {
+		f.size = end
+	}
+}
+
+// bytes assembles the chunks, parts that were never transferred are zeros.
+// It returns nil if more than smbMaxHole of the file was never transferred.
+func (f *smbFile) bytes() []byte {
+	var transferred uint64
+	for _, chunk := range f.chunks {
+		transferred += uint64(len(chunk))
+	}
+	if transferred < f.size && f.size-transferred > smbMaxHole {
+		return nil
+	}
+	data := make([]byte, f.size)
+	for offset, chunk := range f.chunks {
+		copy(data[offset:], chunk)
+	}
+	return data
+}
+
+// smbChunk returns the data of an SMB2 message at offset with length, nil if
+// it is not within the message
+func smbChunk(msg []byte, offset, length int) []byte {
+	if offset < smb2HeaderSize || length < 0 || offset+length > len(msg) {
+		return nil
+	}
+	return msg[offset : offset+length]
+}
+
+// extractSMB carves the files read and written over an SMB2 session: CREATE
+// names the file ids, READ responses carry what the client read and WRITE
+// requests what it wrote, each at its offset in the file
+func extractSMB(client, server *tcpStream) []pcapObject {
+	if server == nil {
+		return nil
+	}
+	type readRequest struct {
+		fileID string
+		offset uint64
+	}
+	creates := make(map[uint64]string)
+	reads := make(map[uint64]readRequest)
+	names := make(map[string]string)
+	var fileIDs []string
+	written := make(map[string]*smbFile)
+	read := make(map[string]*smbFile)
+
+	for _, m := range smb2Messages(client.data) {
+		switch {
+		case m.command == smb2Create && len(m.body) >= 56:
+			offset := int(binary.LittleEndian.Uint16(m.body[44:46]))
+			length := int(binary.LittleEndian.Uint16(m.body[46:48]))
+			creates[m.messageID] = decodeUTF16(smbChunk(m.msg, offset, length))
+		case m.command == smb2Read && len(m.body) >= 48:
+			reads[m.messageID] = readRequest{
+				fileID: string(m.body[16:32]),
+				offset: binary.LittleEndian.Uint64(m.body[8:16]),
+			}
+		case m.command == smb2Write && len(m.body) >= 48:
+			fileID := string(m.body[16:32])
+			offset := int(binary.LittleEndian.Uint16(m.body[2:4]))
+			length := int(binary.LittleEndian.Uint32(m.body[4:8]))
+			if written[fileID] == nil {
+				written[fileID] = &smbFile{}
+				fileIDs = append(fileIDs, fileID)
+			}
+			written[fileID].add(binary.LittleEndian.Uint64(m.body[8:16]), smbChunk(m.msg, offset, length))
+		}
+	}
+	for _, m := range smb2Messages(server.data) {
+		if m.status != 0 {
+			continue
+		}
+		switch {
+		case m.command == smb2Create && len(m.body) >= 80:
+			if name, ok := creates[m.messageID]; ok {
+				names[string(m.body[64:80])] = name
+			}
+		case m.command == smb2Read && len(m.body) >= 16:
+			request, ok := reads[m.messageID]
+			if !ok {
+				continue
+			}
+			offset := int(m.body[2])
+			length := int(binary.LittleEndian.Uint32(m.body[4:8]))
+			if read[request.fileID] == nil {
+				read[request.fileID] = &smbFile{}
+				if written[request.fileID] == nil {
+					fileIDs = append(fileIDs, request.fileID)
+				}
+			}
+			read[request.fileID].add(request.offset, smbChunk(m.msg, offset, length))
+		}
+	}
+
+	var objects []pcapObject
+	for _, fileID := range fileIDs {
+		for _, transfer := range []struct {
+			command  string
+			file     *smbFile
+			from, to *tcpStream
+		}{
+			{"READ", read[fileID], server, client},
+			{"WRITE", written[fileID], client, server},
+		} {
+			if transfer.file == nil || transfer.file.size == 0 {
+				continue
+			}
+			data := transfer.file.bytes()
+			if data == nil {
+				log.WithFields(log.Fields{
+					"plugin":   name,
+					"category": category,
+					"name":     names[fileID],
+					"size":     transfer.file.size,
+				}).Debug("skipping SMB file that was mostly never transferred")
+				continue
+			}
+			objects = append(objects, pcapObject{
+				Protocol:    "smb",
+				Source:      transfer.from.src,
+				Destination: transfer.to.src,
+				Name:        strings.TrimSpace(transfer.command + " " + names[fileID]),
+				Size:        len(data),
+				data:        data,
+			})
+		}
+	}
+	return objects
+}
+
+// decodeUTF16 decodes the little-endian UTF-16 names of SMB2
+func decodeUTF16(data []byte) string {
+	units := make([]uint16, len(data)/2)
+	for i := range units {
+		units[i] = binary.LittleEndian.Uint16(data[2*i:])
+	}
+	return string(utf16.Decode(units))
+}
+
+// extractObjects reassembles all TCP streams in a capture and returns the transferred files
+func extractObjects(capture string) ([]pcapObject, int, error) {
+	f, err := os.Open(capture)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	streams := make(map[string]*tcpStream)
+	err = readPackets(f, func(linkType uint32, data []byte) {
+		seg, ok := decodeTCP(linkType, data)
+		if !ok {
+			return
+		}
+		key := seg.src + "->" + seg.dst
+		s, exists := streams[key]
+		if !exists {
+			s = &tcpStream{src: seg.src, dst: seg.dst}
+			streams[key] = s
+		}
+		if seg.syn {
+			s.syn = true
+			s.isn = seg.seq
+		}
+		if len(seg.payload) > 0 {
+			s.segments = append(s.segments, seg)
+		}
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	keys := make([]string, 0, len(streams))
+	for key, s := range streams {
+		s.reassemble()
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var objects []pcapObject
+	for _, key := range keys {
+		s := streams[key]
+		server := streams[s.dst+"->"+s.src]
+		switch {
+		case isHTTPRequest(s.data):
+			objects = append(objects, extractHTTP(s, server)...)
+		case endpointPort(s.dst) == "21":
+			objects = append(objects, extractFTP(s, server, streams)...)
+		case endpointPort(s.dst) == "445" || endpointPort(s.dst) == "139":
+			objects = append(objects, extractSMB(s, server)...)
+		}
+	}
+
+	return objects, len(streams), nil
+}
+
+func scanPcap(c *cli.Context) error {
+
+	if !c.Args().Present() {
+		return fmt.Errorf("please supply a capture file to scan with malice/%s", name)
+	}
+	capture := c.Args().First()
+
+	failOn, err := parseFailOn(c.String("fail-on"))
+	if err != nil {
+		return err
+	}
+
+	objects, streams, err := extractObjects(capture)
+	if err != nil {
+		return errors.Wrapf(err, "failed to extract objects from %s", capture)
+	}
+
+	report := PcapReport{
+		File:    capture,
+		Streams: streams,
+		Summary: newScanSummary(c.Int("max-findings"), c.Duration("max-time")),
+		Objects: []pcapObject{},
+	}
+
+	for i, object := range objects {
+		if report.Summary.stop() {
+			for _, left := range objects[i:] {
+				report.Summary.leaveOut(left.Name)
+			}
+			break
+		}
+		if c.Int("max-size") > 0 && object.Size > c.Int("max-size")<<20 {
+			log.WithFields(log.Fields{
+				"plugin":   name,
+				"category": category,
+				"object":   object.Name,
+			}).Debug("skipping object larger than --max-size")
+			report.Summary.skip()
+			continue
+		}
+
+		log.WithFields(log.Fields{
+			"plugin":   name,
+			"category": category,
+			"src":      object.Source,
+			"dst":      object.Destination,
+		}).Debug("scanning object: ", object.Name)
+
+		object.SHA256 = fmt.Sprintf("%x", sha256.Sum256(object.data))
+		object.Results, err = scanBufferContext(report.Summary.context(), object.data, "pcap_", c.GlobalInt("timeout"))
+		if err != nil {
+			return errors.Wrapf(err, "failed to scan object %s", object.Name)
+		}
+		if object.Results.Status == statusError && report.Summary.timedOut() {
+			// the scan was cancelled by --max-time
+			report.Summary.stop()
+			for _, left := range objects[i:] {
+				report.Summary.leaveOut(left.Name)
+			}
+			break
+		}
+
+		report.Summary.add(object.Results)
+		report.Scanned++
+		if object.Results.Infected {
+			report.Infected++
+		} else if c.Bool("infected-only") {
+			continue
+		}
+		report.Objects = append(report.Objects, object)
+	}
+	report.Summary.finish()
+
+	reportJSON, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(reportJSON))
+
+	return report.Summary.exitError(failOn)
+}
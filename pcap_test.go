@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// smb2Header returns an SMB2 header for command with its next command offset
+func smb2Header(command uint16, next uint32) []byte {
+	header := make([]byte, smb2HeaderSize)
+	copy(header, "\xfeSMB")
+	binary.LittleEndian.PutUint16(header[4:6], smb2HeaderSize)
+	binary.LittleEndian.PutUint16(header[12:14], command)
+	binary.LittleEndian.PutUint32(header[20:24], next)
+	return header
+}
+
+// TestSMB2MessagesTruncatedCompound splits compounds whose next command
+// offsets point into the header or past the packet, it must not panic and
+// must stop at the first bad offset
+func TestSMB2MessagesTruncatedCompound(t *testing.T) {
+	tests := []struct {
+		name string
+		next uint32
+	}{
+		{"within header", 8},
+		{"header size minus one", smb2HeaderSize - 1},
+		{"past packet", 4096},
+	}
+	for _, test := range tests {
+		first := append(smb2Header(smb2Create, smb2HeaderSize+8), make([]byte, 8)...)
+		packet := append(first, smb2Header(smb2Read, test.next)...)
+		data := append([]byte{0, 0, 0, 0}, packet...)
+		binary.BigEndian.PutUint32(data[0:4], uint32(len(packet)))
+
+		messages := smb2Messages(data)
+		if len(messages) != 1 || messages[0].command != smb2Create {
+			t.Errorf("%s: got %d messages, want only the first", test.name, len(messages))
+		}
+	}
+}
+
+// TestSMBFileHole drops files that were mostly never transferred
+func TestSMBFileHole(t *testing.T) {
+	var f smbFile
+	f.add(smbMaxFileSize-4, []byte("tail"))
+	if data := f.bytes(); data != nil {
+		t.Errorf("got %d bytes for a file with a %d byte hole, want nil", len(data), f.size-4)
+	}
+
+	var g smbFile
+	g.add(4, []byte("data"))
+	if data := g.bytes(); string(data) != "\x00\x00\x00\x00data" {
+		t.Errorf("got %q, want the chunk after a zeroed hole", data)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// A minimal PDF writer for incident reports: text only, set in the standard
+// Helvetica fonts every viewer has, on A4 pages. Lines are wrapped by an
+// estimate of the average character width, which is good enough for the
+// short values of a report.
+
+// A4 in points, and the page margin
+const (
+	pdfWidth  = 595.0
+	pdfHeight = 842.0
+	pdfMargin = 50.0
+)
+
+// pdfLine is a line of text, gap is extra space above it
+type pdfLine struct {
+	text string
+	size float64
+	bold bool
+	gap  float64
+}
+
+type pdfDocument struct {
+	title string
+	lines []pdfLine
+}
+
+// add wraps text into lines of the given font size
+func (d *pdfDocument) add(text string, size float64, bold bool, gap float64) {
+	// Helvetica averages about half an em per character
+	width := int((pdfWidth - 2*pdfMargin) / (size * 0.5))
+	for _, line := range wrapText(text, width) {
+		d.lines = append(d.lines, pdfLine{text: line, size: size, bold: bold, gap: gap})
+		gap = 0
+	}
+}
+
+// wrapText breaks text into lines of at most width characters, at spaces
+// where possible
+func wrapText(text string, width int) []string {
+	var lines []string
+	for _, paragraph := range strings.Split(text, "\n") {
+		runes := []rune(paragraph)
+		for len(runes) > width {
+			cut := width
+			for i := width; i > width/2; i-- {
+				if runes[i] == ' ' {
+					cut = i
+					break
+				}
+			}
+			lines = append(lines, string(runes[:cut]))
+			runes = []rune(strings.TrimLeft(string(runes[cut:]), " "))
+		}
+		lines = append(lines, string(runes))
+	}
+	return lines
+}
+
+// pdfString escapes text as a PDF string literal. Latin-1 characters are
+// the same in WinAnsiEncoding, everything else is replaced.
+func pdfString(text string) string {
+	var b strings.Builder
+	b.WriteByte('(')
+	for _, r := range text {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r >= 0x20 && r < 0x7f:
+			b.WriteRune(r)
+		case r >= 0xa0 && r <= 0xff:
+			fmt.Fprintf(&b, "\\%03o", r)
+		default:
+			b.WriteByte('?')
+		}
+	}
+	b.WriteByte(')')
+	return b.String()
+}
+
+// pages lays the lines out and returns the content stream of every page
+func (d *pdfDocument) pages() []string {
+	var pages []string
+	var page bytes.Buffer
+	y := pdfHeight - pdfMargin
+	for _, line := range d.lines {
+		advance := line.gap + line.size*1.4
+		if y-advance < pdfMargin && page.Len() > 0 {
+			pages = append(pages, page.String())
+			page.Reset()
+			y = pdfHeight - pdfMargin
+		}
+		y -= advance
+		font := "F1"
+		if line.bold {
+			font = "F2"
+		}
+		fmt.Fprintf(&page, "BT /%s %.1f Tf %.1f %.1f Td %s Tj ET\n", font, line.size, pdfMargin, y, pdfString(line.text))
+	}
+	return append(pages, page.String())
+}
+
+// write writes the document, objects 1 to 5 are the catalog, the page tree,
+// the fonts and the document info, the pages and their contents follow
+func (d *pdfDocument) write(w io.Writer, created time.Time) error {
+	pages := d.pages()
+
+	var objects []string
+	var kids []string
+	for i := range pages {
+		kids = append(kids, fmt.Sprintf("%d 0 R", 6+2*i))
+	}
+	objects = append(objects,
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>",
+		fmt.Sprintf("<< /Title %s /Producer %s /CreationDate %s >>",
+			pdfString(d.title), pdfString("drweb "+Version), pdfString(created.UTC().Format("D:20060102150405Z"))),
+	)
+	for i, content := range pages {
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>", pdfWidth, pdfHeight, 7+2*i),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", len(content), content),
+		)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R /Info 5 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
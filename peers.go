@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// maxPeerResponseSize is the most of a peer response that is read
+const maxPeerResponseSize = 1 << 20
+
+// PeerVerdict json object, the verdict of a sibling Malice AV plugin
+type PeerVerdict struct {
+	URL      string `json:"url" structs:"url"`
+	Plugin   string `json:"plugin,omitempty" structs:"plugin,omitempty"`
+	Infected bool   `json:"infected" structs:"infected"`
+	Result   string `json:"result,omitempty" structs:"result,omitempty"`
+	Engine   string `json:"engine,omitempty" structs:"engine,omitempty"`
+	Updated  string `json:"updated,omitempty" structs:"updated,omitempty"`
+	Error    string `json:"error,omitempty" structs:"error,omitempty"`
+}
+
+// PeerResults json object, engines is the number of engines that returned a
+// verdict (this one included) and infected how many of them detected the sample
+type PeerResults struct {
+	Engines  int           `json:"engines" structs:"engines"`
+	Infected int           `json:"infected" structs:"infected"`
+	Verdicts []PeerVerdict `json:"verdicts" structs:"verdicts"`
+}
+
+// peerPlugins sends samples to the web services of sibling Malice AV plugins
+type peerPlugins struct {
+	urls   []string
+	token  string
+	client *http.Client
+}
+
+// peers is nil unless --peer is set
+var peers *peerPlugins
+
+func newPeerPlugins(urls []string, token string, timeout time.Duration) *peerPlugins {
+	p := &peerPlugins{token: token, client: &http.Client{Timeout: timeout}}
+	for _, url := range urls {
+		for _, url := range strings.Split(url, ",") {
+			if url = strings.TrimSpace(url); len(url) > 0 {
+				p.urls = append(p.urls, strings.TrimRight(url, "/"))
+			}
+		}
+	}
+	return p
+}
+
+// ask scans the sample with one peer
+func (p *peerPlugins) ask(ctx context.Context, url, sha string, data []byte) PeerVerdict {
+	verdict := PeerVerdict{URL: url}
+
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	part, err := form.CreateFormFile("malware", sha)
+	if err == nil {
+		_, err = part.Write(data)
+	}
+	if err == nil {
+		err = form.Close()
+	}
+	if err != nil {
+		verdict.Error = err.Error()
+		return verdict
+	}
+
+	req, err := http.NewRequest("POST", url+"/scan", body)
+	if err != nil {
+		verdict.Error = err.Error()
+		return verdict
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	if len(p.token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		verdict.Error = errors.Wrap(err, "failed to reach peer").Error()
+		return verdict
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxPeerResponseSize))
+	if err != nil {
+		verdict.Error = errors.Wrap(err, "failed to read peer response").Error()
+		return verdict
+	}
+	if resp.StatusCode != http.StatusOK {
+		verdict.Error = fmt.Sprintf("peer returned %s", resp.Status)
+		return verdict
+	}
+	if err := parsePeerResponse(respBody, &verdict); err != nil {
+		verdict.Error = err.Error()
+	}
+	return verdict
+}
+
+// parsePeerResponse reads the {"<plugin>": {"infected": ..., "result": ...}}
+// results every Malice AV plugin returns
+func parsePeerResponse(body []byte, verdict *PeerVerdict) error {
+	var response map[string]json.RawMessage
+	if err := json.Unmarshal(body, &response); err != nil {
+		return errors.Wrap(err, "failed to parse peer response")
+	}
+	for plugin, raw := range response {
+		var results struct {
+			Infected *bool  `json:"infected"`
+			Result   string `json:"result"`
+			Engine   string `json:"engine"`
+			Updated  string `json:"updated"`
+			Error    string `json:"error"`
+			// plugins reporting RFC3339 timestamps, like this one, may
+			// leave updated out
+			UpdatedAt string `json:"updated_at"`
+		}
+		if json.Unmarshal(raw, &results) != nil || results.Infected == nil {
+			continue
+		}
+		verdict.Plugin = plugin
+		verdict.Infected = *results.Infected
+		verdict.Result = results.Result
+		verdict.Engine = results.Engine
+		verdict.Updated = results.Updated
+		if len(verdict.Updated) == 0 {
+			verdict.Updated = results.UpdatedAt
+		}
+		verdict.Error = results.Error
+		return nil
+	}
+	return fmt.Errorf("peer response has no plugin results")
+}
+
+// peerScan is a sample being scanned by the peers
+type peerScan struct {
+	wg       sync.WaitGroup
+	verdicts []PeerVerdict
+}
+
+// scan sends the sample to every peer at once, in the background
+func (p *peerPlugins) scan(ctx context.Context, sha string, data []byte) *peerScan {
+	if p == nil || len(p.urls) == 0 {
+		return nil
+	}
+	s := &peerScan{verdicts: make([]PeerVerdict, len(p.urls))}
+	for i, url := range p.urls {
+		s.wg.Add(1)
+		go func(i int, url string) {
+			defer s.wg.Done()
+			s.verdicts[i] = p.ask(ctx, url, sha, data)
+		}(i, url)
+	}
+	return s
+}
+
+// results waits for the peers and tallies their verdicts with the local one
+func (s *peerScan) results(local ResultsData) *PeerResults {
+	if s == nil {
+		return nil
+	}
+	s.wg.Wait()
+
+	// skipped or failed local scans have no verdict either
+	own := PeerVerdict{Infected: local.Infected}
+	if local.Status != statusClean && local.Status != statusInfected {
+		own.Error = local.Status
+	}
+
+	results := &PeerResults{Verdicts: s.verdicts}
+	for _, verdict := range append([]PeerVerdict{own}, s.verdicts...) {
+		if len(verdict.Error) > 0 {
+			continue
+		}
+		results.Engines++
+		if verdict.Infected {
+			results.Infected++
+		}
+	}
+	return results
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	pathpkg "path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// scan policy actions
+const (
+	policySkip    = "skip"
+	policyExplode = "explode"
+	policyFlag    = "flag"
+	policyReject  = "reject"
+)
+
+// tar entry types scan policies can match on
+var tarEntryTypes = map[byte]string{
+	tar.TypeDir:     "dir",
+	tar.TypeSymlink: "symlink",
+	tar.TypeLink:    "hardlink",
+	tar.TypeChar:    "device",
+	tar.TypeBlock:   "device",
+	tar.TypeFifo:    "fifo",
+}
+
+// ScanPolicy is a rule of the policy file. Types are globs on the sniffed
+// content type, e.g. "text/*", extensions those of the file name, sources API
+// key ids, client IPs or CIDRs. The first rule matching a sample decides what
+// happens to it.
+type ScanPolicy struct {
+	Name       string   `json:"name"`
+	Types      []string `json:"types,omitempty"`
+	Extensions []string `json:"extensions,omitempty"`
+	MinSizeMB  int64    `json:"min_size_mb,omitempty"`
+	TarEntries []string `json:"tar_entries,omitempty"`
+	Sources    []string `json:"sources,omitempty"`
+	Action     string   `json:"action"`
+	Tag        string   `json:"tag,omitempty"`
+
+	nets []*net.IPNet
+}
+
+// policySample is what scan policies match a sample on
+type policySample struct {
+	contentType string
+	size        int64
+	name        string // file name, empty if unknown
+	submitter   *Submitter
+	open        func() (io.ReadCloser, error)
+
+	tarEntries map[string]bool
+}
+
+// uploadSample describes an upload for matching it against the scan policies
+func uploadSample(data []byte, name string, submitter *Submitter) *policySample {
+	return &policySample{
+		contentType: sniffContentType(data),
+		size:        int64(len(data)),
+		name:        name,
+		submitter:   submitter,
+		open: func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(data)), nil
+		},
+	}
+}
+
+// fileSample describes a file for matching it against the scan policies
+func fileSample(file, contentType string, size int64) *policySample {
+	return &policySample{
+		contentType: contentType,
+		size:        size,
+		name:        filepath.Base(file),
+		open: func() (io.ReadCloser, error) {
+			return os.Open(file)
+		},
+	}
+}
+
+// entries returns the types of the entries of a tar sample, read once
+func (s *policySample) entries() map[string]bool {
+	if s.tarEntries != nil {
+		return s.tarEntries
+	}
+	s.tarEntries = make(map[string]bool)
+	if s.contentType != "application/x-tar" || s.open == nil {
+		return s.tarEntries
+	}
+	r, err := s.open()
+	if err != nil {
+		return s.tarEntries
+	}
+	defer r.Close()
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			return s.tarEntries
+		}
+		if entryType, ok := tarEntryTypes[header.Typeflag]; ok {
+			s.tarEntries[entryType] = true
+		}
+	}
+}
+
+// PolicyRejection json object, the answer to an upload a reject policy refused
+type PolicyRejection struct {
+	Error         string         `json:"error"`
+	PolicyApplied *AppliedPolicy `json:"policy_applied"`
+}
+
+// AppliedPolicy json object, the policy rule a sample matched
+type AppliedPolicy struct {
+	Name        string `json:"name" structs:"name"`
+	Action      string `json:"action" structs:"action"`
+	ContentType string `json:"content_type" structs:"content_type"`
+}
+
+// scanPolicies are nil unless a policy file is configured
+var scanPolicies []ScanPolicy
+
+// explodeLimits and explodeCommand unpack the archives the explode policy
+// applies to, they are the --max-depth, --max-member-size, --max-ratio,
+// --max-total-size and --extractor settings
+var (
+	explodeLimits  extractLimits
+	explodeCommand = defaultExtractor
+)
+
+func loadScanPolicies(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return errors.Wrap(err, "failed to read scan policy file")
+	}
+
+	var policies []ScanPolicy
+	if err := json.Unmarshal(data, &policies); err != nil {
+		return errors.Wrapf(err, "failed to parse scan policy file %s", file)
+	}
+	for i := range policies {
+		policy := &policies[i]
+		if len(policy.Name) == 0 {
+			policy.Name = fmt.Sprintf("policy %d", i+1)
+		}
+		switch policy.Action {
+		case policySkip, policyExplode, policyFlag, policyReject:
+		default:
+			return fmt.Errorf("scan policy %s: invalid action %q (must be skip, explode, flag or reject)", policy.Name, policy.Action)
+		}
+		if len(policy.Types) == 0 && len(policy.Extensions) == 0 {
+			return fmt.Errorf("scan policy %s: no content types or extensions", policy.Name)
+		}
+		for _, entryType := range policy.TarEntries {
+			known := false
+			for _, t := range tarEntryTypes {
+				known = known || t == entryType
+			}
+			if !known {
+				return fmt.Errorf("scan policy %s: invalid tar entry type %q (must be dir, symlink, hardlink, device or fifo)", policy.Name, entryType)
+			}
+		}
+		for _, pattern := range policy.Types {
+			if _, err := pathpkg.Match(pattern, ""); err != nil {
+				return errors.Wrapf(err, "scan policy %s: invalid content type %q", policy.Name, pattern)
+			}
+		}
+		if policy.nets, err = parseSourceNets(policy.Sources); err != nil {
+			return errors.Wrapf(err, "scan policy %s: invalid source", policy.Name)
+		}
+	}
+	reloadLock.Lock()
+	scanPolicies = policies
+	reloadLock.Unlock()
+
+	return nil
+}
+
+// currentScanPolicies returns the scan policies, nil unless a policy file is
+// configured
+func currentScanPolicies() []ScanPolicy {
+	reloadLock.RLock()
+	defer reloadLock.RUnlock()
+	return scanPolicies
+}
+
+// sniffContentType returns the media type of a sample from its first bytes.
+// Executables and the archives the standard library does not know are
+// recognized by their magic numbers.
+func sniffContentType(header []byte) string {
+	switch {
+	case bytes.HasPrefix(header, []byte("MZ")):
+		return "application/x-dosexec"
+	case bytes.HasPrefix(header, []byte("\x7fELF")):
+		return "application/x-executable"
+	case bytes.HasPrefix(header, []byte{0xfe, 0xed, 0xfa, 0xce}), bytes.HasPrefix(header, []byte{0xfe, 0xed, 0xfa, 0xcf}),
+		bytes.HasPrefix(header, []byte{0xce, 0xfa, 0xed, 0xfe}), bytes.HasPrefix(header, []byte{0xcf, 0xfa, 0xed, 0xfe}):
+		return "application/x-mach-binary"
+	case bytes.HasPrefix(header, []byte{0x37, 0x7a, 0xbc, 0xaf, 0x27, 0x1c}):
+		return "application/x-7z-compressed"
+	case bytes.HasPrefix(header, []byte("BZh")):
+		return "application/x-bzip2"
+	case len(header) >= 262 && bytes.Equal(header[257:262], []byte("ustar")):
+		return "application/x-tar"
+	}
+
+	contentType := http.DetectContentType(header)
+	if i := strings.Index(contentType, ";"); i >= 0 {
+		contentType = contentType[:i]
+	}
+	return contentType
+}
+
+// sniffFile returns the media type of file
+func sniffFile(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	header := make([]byte, 512)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	return sniffContentType(header[:n]), nil
+}
+
+// matches reports whether the policy applies to a sample, its submitter is
+// nil for samples that were not uploaded
+func (p *ScanPolicy) matches(sample *policySample) bool {
+	if sample.size < p.MinSizeMB<<20 {
+		return false
+	}
+	typeMatches := len(p.Types) == 0
+	for _, pattern := range p.Types {
+		if matched, _ := pathpkg.Match(pattern, sample.contentType); matched {
+			typeMatches = true
+			break
+		}
+	}
+	if !typeMatches {
+		return false
+	}
+	extensionMatches := len(p.Extensions) == 0
+	ext := strings.ToLower(filepath.Ext(sample.name))
+	for _, extension := range p.Extensions {
+		extensionMatches = extensionMatches || len(ext) > 0 && ext == "."+strings.TrimPrefix(strings.ToLower(extension), ".")
+	}
+	if !extensionMatches {
+		return false
+	}
+	if len(p.TarEntries) > 0 {
+		entryMatches := false
+		for _, entryType := range p.TarEntries {
+			entryMatches = entryMatches || sample.entries()[entryType]
+		}
+		if !entryMatches {
+			return false
+		}
+	}
+	return len(p.Sources) == 0 || matchesSource(p.Sources, p.nets, sample.submitter)
+}
+
+// parseSourceNets returns the CIDRs among sources
+func parseSourceNets(sources []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, source := range sources {
+		if !strings.Contains(source, "/") {
+			continue
+		}
+		_, cidr, err := net.ParseCIDR(source)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, cidr)
+	}
+	return nets, nil
+}
+
+// matchesSource reports whether the API key id or IP of submitter is one of
+// sources, or the IP is in one of nets. Samples that were not uploaded have
+// no submitter and never match.
+func matchesSource(sources []string, nets []*net.IPNet, submitter *Submitter) bool {
+	if submitter == nil {
+		return false
+	}
+	ip := net.ParseIP(submitter.IP)
+	for _, source := range sources {
+		if source == submitter.KeyID || source == submitter.IP {
+			return true
+		}
+	}
+	for _, cidr := range nets {
+		if ip != nil && cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchScanPolicy returns the first policy applying to a sample, nil if none does
+func matchScanPolicy(sample *policySample) *ScanPolicy {
+	policies := currentScanPolicies()
+	for i := range policies {
+		if policies[i].matches(sample) {
+			return &policies[i]
+		}
+	}
+	return nil
+}
+
+// keepsFromEngine reports whether the policy keeps samples from the engine,
+// rejected uploads never get there and other rejected samples are skipped
+func (p *ScanPolicy) keepsFromEngine() bool {
+	return p != nil && (p.Action == policySkip || p.Action == policyReject)
+}
+
+// rejectUpload answers 422 with the rule if a reject policy applies to an
+// upload, before it is queued or scanned
+func rejectUpload(w http.ResponseWriter, sample *policySample) bool {
+	policy := matchScanPolicy(sample)
+	if policy == nil || policy.Action != policyReject {
+		return false
+	}
+	writeJSON(w, http.StatusUnprocessableEntity, PolicyRejection{
+		Error:         fmt.Sprintf("rejected by scan policy %s (%s)", policy.Name, sample.contentType),
+		PolicyApplied: policy.applied(sample.contentType),
+	})
+	return true
+}
+
+// applied returns what is reported as policy_applied
+func (p *ScanPolicy) applied(contentType string) *AppliedPolicy {
+	return &AppliedPolicy{Name: p.Name, Action: p.Action, ContentType: contentType}
+}
+
+// skipped returns the results of a sample the skip or reject policy kept
+// from the engine
+func (p *ScanPolicy) skipped(contentType string) ResultsData {
+	verb := "skipped"
+	if p.Action == policyReject {
+		verb = "rejected"
+	}
+	return ResultsData{
+		Status:        statusSkipped,
+		Result:        fmt.Sprintf("%s by scan policy %s (%s)", verb, p.Name, contentType),
+		PolicyApplied: p.applied(contentType),
+	}
+}
+
+// flag tags the results of a sample the flag policy applies to
+func (p *ScanPolicy) flag(results *ResultsData) {
+	tag := p.Tag
+	if len(tag) == 0 {
+		tag = "policy:" + p.Name
+	}
+	for _, existing := range results.Tags {
+		if existing == tag {
+			return
+		}
+	}
+	results.Tags = append(results.Tags, tag)
+}
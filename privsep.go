@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// engineSocketEnv tells the unprivileged web service where its engine helper listens
+const engineSocketEnv = "MALICE_ENGINE_SOCKET"
+
+// engine helper operations
+const (
+	helperCtl     = "ctl"
+	helperConfigd = "configd"
+	helperRestart = "restart"
+)
+
+// helperRequest is sent to the engine helper, one per connection
+type helperRequest struct {
+	Op     string          `json:"op"`
+	Args   []string        `json:"args,omitempty"`
+	Limits *ResourceLimits `json:"limits,omitempty"`
+}
+
+// helperResponse is the outcome of a helper request, exit is the exit code of
+// a drweb-ctl command that failed
+type helperResponse struct {
+	Stdout string `json:"stdout"`
+	Stderr string `json:"stderr,omitempty"`
+	Exit   int    `json:"exit,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// engineExitError is a drweb-ctl command run by the helper that exited non-zero
+type engineExitError struct {
+	code   int
+	stderr string
+}
+
+func (e *engineExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.code)
+}
+
+// engineHelper runs the engine commands of an unprivileged web service in
+// the privileged helper process
+type engineHelper struct {
+	socket string
+}
+
+// helper is nil unless the web service runs with --privsep-user
+var helper *engineHelper
+
+// call sends a request to the helper, closing the connection once ctx is
+// done makes the helper kill the command
+func (h *engineHelper) call(ctx context.Context, request helperRequest) (string, error) {
+	conn, err := net.DialTimeout("unix", h.socket, 10*time.Second)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to reach engine helper")
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	if err := json.NewEncoder(conn).Encode(request); err != nil {
+		return "", errors.Wrap(err, "failed to send engine helper request")
+	}
+	var response helperResponse
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", errors.Wrap(err, "failed to read engine helper response")
+	}
+	switch {
+	case len(response.Error) > 0:
+		return response.Stdout, errors.New(response.Error)
+	case response.Exit != 0:
+		return response.Stdout, &engineExitError{code: response.Exit, stderr: response.Stderr}
+	}
+	return response.Stdout, nil
+}
+
+func (h *engineHelper) ctl(ctx context.Context, args ...string) (string, error) {
+	return h.call(ctx, helperRequest{Op: helperCtl, Args: args, Limits: engineLimits(ctx)})
+}
+
+func (h *engineHelper) configd(ctx context.Context) error {
+	_, err := h.call(ctx, helperRequest{Op: helperConfigd})
+	return err
+}
+
+func (h *engineHelper) restart(ctx context.Context) error {
+	_, err := h.call(ctx, helperRequest{Op: helperRestart})
+	return err
+}
+
+// useEngineHelper sends engine commands to the helper if we were started by
+// the --privsep-user supervisor
+func useEngineHelper() {
+	if socket := os.Getenv(engineSocketEnv); len(socket) > 0 {
+		helper = &engineHelper{socket: socket}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os/exec"
+	"runtime"
+	"syscall"
+)
+
+const prCapbsetDrop = 24
+
+// engineCapabilities are the capabilities drweb-configd and drweb-ctl keep:
+// reading and owning the files it scans and quarantines, signalling its own
+// processes and switching to its unprivileged user
+var engineCapabilities = map[uintptr]bool{
+	0:  true, // CAP_CHOWN
+	1:  true, // CAP_DAC_OVERRIDE
+	2:  true, // CAP_DAC_READ_SEARCH
+	3:  true, // CAP_FOWNER
+	5:  true, // CAP_KILL
+	6:  true, // CAP_SETGID
+	7:  true, // CAP_SETUID
+	24: true, // CAP_SYS_RESOURCE
+}
+
+// dropCapabilities is set in the engine helper
+var dropCapabilities bool
+
+// restrictEngineCommands makes the engine helper start engine commands with
+// only engineCapabilities in their bounding set
+func restrictEngineCommands() error {
+	dropCapabilities = true
+	startCommand = startRestricted
+	return nil
+}
+
+// startRestricted starts cmd from a thread whose capability bounding set was
+// reduced and that was put in the engine sandbox. Both are per thread, so
+// the thread is locked and thrown away once the goroutine returns.
+func startRestricted(cmd *exec.Cmd) error {
+	errc := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		for capability := uintptr(0); dropCapabilities && capability < 64; capability++ {
+			if engineCapabilities[capability] {
+				continue
+			}
+			_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prCapbsetDrop, capability, 0)
+			if errno == syscall.EINVAL {
+				// past the last capability of this kernel
+				break
+			}
+			if errno != 0 {
+				errc <- errno
+				return
+			}
+		}
+		if sandbox != nil {
+			if err := sandbox.apply(); err != nil {
+				errc <- err
+				return
+			}
+		}
+		errc <- cmd.Start()
+	}()
+	return <-errc
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package main
+
+// restrictEngineCommands does nothing, only Linux has capabilities to drop
+func restrictEngineCommands() error {
+	return nil
+}
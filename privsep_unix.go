@@ -0,0 +1,312 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/malice-plugins/pkgs/utils"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// helperCommands are the drweb-ctl commands the engine helper runs
+var helperCommands = []string{"scan", "baseinfo", "license", "--version", "update", "cfset", "cfshow"}
+
+// helperScanOptions are the drweb-ctl scan options the helper passes on, each
+// takes a value: those of scan profiles and --engine-output
+var helperScanOptions = []string{
+	"--HeuristicAnalysis", "--Cure", "--ArchiveMaxLevel", "--PackerMaxLevel",
+	"--MailMaxLevel", "--ContainerMaxLevel", "--MaxCompressionRatio", "--Report",
+}
+
+// helperScanDirs are the directories the web service writes the files it scans to
+func helperScanDirs() []string {
+	return []string{"/malware", os.TempDir()}
+}
+
+// checkHelperArgs makes sure a compromised web service can only have the
+// helper run the commands it needs, and only scan its own temp files
+func checkHelperArgs(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("no drweb-ctl command")
+	}
+	allowed := false
+	for _, command := range helperCommands {
+		allowed = allowed || args[0] == command
+	}
+	if !allowed {
+		return fmt.Errorf("drweb-ctl %s is not allowed", args[0])
+	}
+	if args[0] != "scan" {
+		return nil
+	}
+	files := args[1:]
+	for len(files) > 1 && utils.StringInSlice(files[0], helperScanOptions) {
+		if strings.HasPrefix(files[1], "-") {
+			return fmt.Errorf("invalid value %s of %s", files[1], files[0])
+		}
+		files = files[2:]
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("nothing to scan")
+	}
+	for _, file := range files {
+		clean := filepath.Clean(file)
+		inside := false
+		for _, dir := range helperScanDirs() {
+			inside = inside || filepath.Dir(clean) == filepath.Clean(dir)
+		}
+		if !inside || strings.HasPrefix(file, "-") {
+			return fmt.Errorf("%s is not in a scan directory", file)
+		}
+		info, err := os.Lstat(clean)
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("%s is not a regular file", file)
+		}
+	}
+	return nil
+}
+
+// handleHelperRequest runs a request of the web service
+func handleHelperRequest(ctx context.Context, request helperRequest) helperResponse {
+	var response helperResponse
+	var err error
+	switch request.Op {
+	case helperConfigd:
+		err = startConfigd(ctx)
+	case helperRestart:
+		err = restartConfigd(ctx)
+	case helperCtl:
+		if err = checkHelperArgs(request.Args); err == nil {
+			response.Stdout, err = runGroup(withEngineLimits(ctx, request.Limits), drwebCtl, request.Args...)
+		}
+	default:
+		err = fmt.Errorf("unknown engine helper operation %q", request.Op)
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Exited() {
+			response.Exit = status.ExitStatus()
+			response.Stderr = string(exitErr.Stderr)
+			return response
+		}
+	}
+	if err != nil {
+		response.Error = err.Error()
+	}
+	return response
+}
+
+func serveHelperConn(conn net.Conn) {
+	defer conn.Close()
+
+	var request helperRequest
+	if err := json.NewDecoder(conn).Decode(&request); err != nil {
+		return
+	}
+	// the web service hangs up once it no longer wants the answer
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		cancel()
+	}()
+
+	log.WithFields(log.Fields{
+		"plugin":   name,
+		"category": category,
+		"op":       request.Op,
+		"args":     request.Args,
+	}).Debug("engine helper request")
+	json.NewEncoder(conn).Encode(handleHelperRequest(ctx, request))
+}
+
+// serveEngineHelper runs engine commands for the web service on socket,
+// which only group may connect to
+func serveEngineHelper(socket string, group int) error {
+	if err := restrictEngineCommands(); err != nil {
+		return errors.Wrap(err, "failed to restrict engine commands")
+	}
+	os.Remove(socket)
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return errors.Wrap(err, "failed to listen on engine helper socket")
+	}
+	defer listener.Close()
+	if err := os.Chown(socket, os.Geteuid(), group); err != nil {
+		return err
+	}
+	if err := os.Chmod(socket, 0660); err != nil {
+		return err
+	}
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return errors.Wrap(err, "engine helper stopped accepting requests")
+		}
+		go serveHelperConn(conn)
+	}
+}
+
+func engineHelperCommand(c *cli.Context) error {
+	if len(c.String("socket")) == 0 {
+		return fmt.Errorf("engine-helper requires --socket")
+	}
+	return serveEngineHelper(c.String("socket"), c.Int("group"))
+}
+
+// globalArgs returns the command line up to the command, so the engine
+// helper gets the same engine settings
+func globalArgs(command string) []string {
+	args := os.Args[1:]
+	for i, arg := range args {
+		if arg == command {
+			args = args[:i]
+			break
+		}
+	}
+	return append([]string{}, args...)
+}
+
+// superviseWeb runs the web service as username and the engine helper as
+// root, the helper is restarted should it die and stopped with the web service
+func superviseWeb(c *cli.Context, username string) error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("--privsep-user requires starting the web service as root")
+	}
+	account, err := user.Lookup(username)
+	if err != nil {
+		return errors.Wrap(err, "invalid --privsep-user")
+	}
+	uid, _ := strconv.Atoi(account.Uid)
+	gid, _ := strconv.Atoi(account.Gid)
+	credential := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	if groups, err := account.GroupIds(); err == nil {
+		for _, group := range groups {
+			if id, err := strconv.Atoi(group); err == nil {
+				credential.Groups = append(credential.Groups, uint32(id))
+			}
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "drweb-helper")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Chown(dir, 0, gid); err != nil {
+		return err
+	}
+	if err := os.Chmod(dir, 0750); err != nil {
+		return err
+	}
+	socket := filepath.Join(dir, "engine.sock")
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	helperArgs := append(globalArgs(c.Command.Name), "engine-helper", "--socket", socket, "--group", strconv.Itoa(gid))
+
+	var mu sync.Mutex
+	var helperCmd *exec.Cmd
+	stopping := false
+	go func() {
+		for {
+			cmd := exec.Command(executable, helperArgs...)
+			cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+			mu.Lock()
+			if stopping {
+				mu.Unlock()
+				return
+			}
+			err := cmd.Start()
+			helperCmd = cmd
+			mu.Unlock()
+			if err == nil {
+				err = cmd.Wait()
+			}
+			mu.Lock()
+			done := stopping
+			mu.Unlock()
+			if done {
+				return
+			}
+			log.WithFields(log.Fields{
+				"plugin":   name,
+				"category": category,
+			}).Error(errors.Wrap(err, "engine helper exited, restarting it"))
+			time.Sleep(time.Second)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(socket); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	web := exec.Command(executable, os.Args[1:]...)
+	web.Env = append(os.Environ(), engineSocketEnv+"="+socket)
+	web.Stdin, web.Stdout, web.Stderr = os.Stdin, os.Stdout, os.Stderr
+	web.SysProcAttr = &syscall.SysProcAttr{Credential: credential}
+	if err := web.Start(); err != nil {
+		return errors.Wrap(err, "failed to start unprivileged web service")
+	}
+	log.WithFields(log.Fields{
+		"plugin":   name,
+		"category": category,
+		"user":     username,
+		"pid":      web.Process.Pid,
+	}).Info("web service running unprivileged")
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		for sig := range signals {
+			web.Process.Signal(sig)
+		}
+	}()
+	err = web.Wait()
+
+	mu.Lock()
+	stopping = true
+	if helperCmd != nil && helperCmd.Process != nil {
+		helperCmd.Process.Signal(syscall.SIGTERM)
+	}
+	mu.Unlock()
+
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		status, ok := exitErr.Sys().(syscall.WaitStatus)
+		switch {
+		case ok && status.Signaled():
+			// stopped by the signal we passed on
+			return nil
+		case ok && status.Exited():
+			os.RemoveAll(dir)
+			os.Exit(status.ExitStatus())
+		}
+	}
+	return err
+}
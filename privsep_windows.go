@@ -0,0 +1,15 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/urfave/cli"
+)
+
+func engineHelperCommand(c *cli.Context) error {
+	return fmt.Errorf("engine-helper is not supported on Windows")
+}
+
+func superviseWeb(c *cli.Context, username string) error {
+	return fmt.Errorf("--privsep-user is not supported on Windows")
+}
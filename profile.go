@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// ScanProfile is a named set of scan settings, so clients pick one instead
+// of tweaking a dozen flags per call. Unset engine settings keep the engine
+// configuration, unset plugin settings the command line flags.
+type ScanProfile struct {
+	Heuristic           *bool `json:"heuristic,omitempty"`
+	Cure                *bool `json:"cure,omitempty"`
+	ArchiveMaxLevel     *int  `json:"archive_max_level,omitempty"`
+	PackerMaxLevel      *int  `json:"packer_max_level,omitempty"`
+	MailMaxLevel        *int  `json:"mail_max_level,omitempty"`
+	ContainerMaxLevel   *int  `json:"container_max_level,omitempty"`
+	MaxCompressionRatio *int  `json:"max_compression_ratio,omitempty"`
+	Explode             *bool `json:"explode,omitempty"`
+	Timeout             int   `json:"timeout,omitempty"`
+
+	Limits *ResourceLimits `json:"limits,omitempty"`
+
+	name string
+}
+
+func boolSetting(b bool) *bool { return &b }
+func intSetting(i int) *int    { return &i }
+
+// builtinProfiles can be overridden by --scan-profiles
+var builtinProfiles = map[string]ScanProfile{
+	"fast": {
+		Heuristic:         boolSetting(false),
+		ArchiveMaxLevel:   intSetting(0),
+		MailMaxLevel:      intSetting(0),
+		ContainerMaxLevel: intSetting(0),
+		Explode:           boolSetting(false),
+	},
+	"deep": {
+		Heuristic: boolSetting(true),
+		Cure:      boolSetting(true),
+		Explode:   boolSetting(true),
+	},
+}
+
+// scanProfiles are the built-in and configured profiles by name
+var scanProfiles = loadedProfiles(nil)
+
+// defaultProfile is the --profile every scan without one uses, nil for none
+var defaultProfile *ScanProfile
+
+func loadedProfiles(configured map[string]ScanProfile) map[string]*ScanProfile {
+	profiles := make(map[string]*ScanProfile)
+	for _, set := range []map[string]ScanProfile{builtinProfiles, configured} {
+		for name, profile := range set {
+			profile := profile
+			profile.name = name
+			profiles[name] = &profile
+		}
+	}
+	return profiles
+}
+
+// loadScanProfiles reads a JSON object of profiles by name, they are merged
+// over the built-in fast and deep profiles
+func loadScanProfiles(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return errors.Wrap(err, "failed to read scan profile file")
+	}
+
+	configured := make(map[string]ScanProfile)
+	if err := json.Unmarshal(data, &configured); err != nil {
+		return errors.Wrapf(err, "failed to parse scan profile file %s", file)
+	}
+	for name, profile := range configured {
+		if profile.Timeout < 0 {
+			return fmt.Errorf("scan profile %s: invalid timeout %d", name, profile.Timeout)
+		}
+		if profile.Limits != nil {
+			if err := profile.Limits.validate(); err != nil {
+				return errors.Wrapf(err, "scan profile %s", name)
+			}
+		}
+	}
+	profiles := loadedProfiles(configured)
+	reloadLock.Lock()
+	scanProfiles = profiles
+	reloadLock.Unlock()
+
+	return nil
+}
+
+// currentScanProfiles returns the profiles by name
+func currentScanProfiles() map[string]*ScanProfile {
+	reloadLock.RLock()
+	defer reloadLock.RUnlock()
+	return scanProfiles
+}
+
+// currentDefaultProfile returns the --profile, nil for none
+func currentDefaultProfile() *ScanProfile {
+	reloadLock.RLock()
+	defer reloadLock.RUnlock()
+	return defaultProfile
+}
+
+// setDefaultProfile replaces the --profile
+func setDefaultProfile(profile *ScanProfile) {
+	reloadLock.Lock()
+	defaultProfile = profile
+	reloadLock.Unlock()
+}
+
+// profileNames returns the names of the available profiles, sorted
+func profileNames() []string {
+	var names []string
+	for name := range currentScanProfiles() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lookupProfile returns the profile called name, nil for an empty name
+func lookupProfile(name string) (*ScanProfile, error) {
+	if len(name) == 0 {
+		return nil, nil
+	}
+	profile, ok := currentScanProfiles()[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown scan profile %q (available: %v)", name, profileNames())
+	}
+	if !ctlEngine && len(profile.ctlArgs()) > 0 {
+		return nil, fmt.Errorf("scan profile %s changes engine settings, which Dr.Web for Windows does not support", name)
+	}
+	if runtime.GOOS != "linux" && profile.Limits != nil {
+		return nil, fmt.Errorf("scan profile %s sets resource limits, which require Linux", name)
+	}
+	return profile, nil
+}
+
+// ctlArgs returns the drweb-ctl scan options of the profile
+func (p *ScanProfile) ctlArgs() []string {
+	if p == nil {
+		return nil
+	}
+	var args []string
+	onOff := func(option string, value *bool, on, off string) {
+		if value == nil {
+			return
+		}
+		if *value {
+			args = append(args, option, on)
+		} else {
+			args = append(args, option, off)
+		}
+	}
+	level := func(option string, value *int) {
+		if value != nil {
+			args = append(args, option, strconv.Itoa(*value))
+		}
+	}
+	onOff("--HeuristicAnalysis", p.Heuristic, "On", "Off")
+	onOff("--Cure", p.Cure, "Yes", "No")
+	level("--ArchiveMaxLevel", p.ArchiveMaxLevel)
+	level("--PackerMaxLevel", p.PackerMaxLevel)
+	level("--MailMaxLevel", p.MailMaxLevel)
+	level("--ContainerMaxLevel", p.ContainerMaxLevel)
+	level("--MaxCompressionRatio", p.MaxCompressionRatio)
+	return args
+}
+
+// explode reports whether archives are unpacked by the plugin, fallback is
+// the --explode setting
+func (p *ScanProfile) explode(fallback bool) bool {
+	if p == nil || p.Explode == nil {
+		return fallback
+	}
+	return *p.Explode
+}
+
+// timeout returns the scan timeout in seconds, fallback is the --timeout setting
+func (p *ScanProfile) timeout(fallback int) int {
+	if p == nil || p.Timeout == 0 {
+		return fallback
+	}
+	return p.Timeout
+}
+
+// limits returns the resource limits of the engine commands of a scan, nil for none
+func (p *ScanProfile) limits() *ResourceLimits {
+	if p == nil {
+		return nil
+	}
+	return p.Limits
+}
+
+// profileName returns what is reported as the profile of the results
+func (p *ScanProfile) profileName() string {
+	if p == nil {
+		return ""
+	}
+	return p.name
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/olivere/elastic"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// parseRetention parses a retention period, a duration or a number of days like 90d
+func parseRetention(value string) (time.Duration, error) {
+	var retention time.Duration
+	var err error
+	if days := strings.TrimSuffix(value, "d"); days != value {
+		var n int
+		n, err = strconv.Atoi(days)
+		retention = time.Duration(n) * 24 * time.Hour
+	} else {
+		retention, err = time.ParseDuration(value)
+	}
+	if err != nil || retention <= 0 {
+		return 0, fmt.Errorf("invalid retention period %q (e.g. 90d or 720h)", value)
+	}
+	return retention, nil
+}
+
+// ElasticPrune json object, updated is the number of sample documents the
+// drweb results were removed from and deleted the number of scan history
+// documents (--elasticsearch-dedup version) deleted
+type ElasticPrune struct {
+	Updated int64 `json:"updated"`
+	Deleted int64 `json:"deleted"`
+}
+
+// PruneReport json object
+type PruneReport struct {
+	Cutoff        time.Time     `json:"cutoff"`
+	Results       int           `json:"results"`
+	Samples       int           `json:"samples"`
+	Elasticsearch *ElasticPrune `json:"elasticsearch,omitempty"`
+}
+
+// pruneElasticsearch removes drweb results indexed before cutoff. Sample
+// documents are shared with the other plugins, so only the drweb results
+// are removed from them, scan history documents only hold drweb results.
+func pruneElasticsearch(cutoff time.Time) (ElasticPrune, error) {
+	var pruned ElasticPrune
+	client, err := elasticClient()
+	if err != nil {
+		return pruned, err
+	}
+
+	field := fmt.Sprintf("plugins.%s.%s", category, name)
+	before := elastic.NewRangeQuery("scan_date").Lt(cutoff.Format(time.RFC3339Nano))
+
+	updated, err := client.UpdateByQuery(es.Index).
+		Type(es.Type).
+		Query(elastic.NewBoolQuery().
+			Filter(before, elastic.NewExistsQuery(field)).
+			MustNot(elastic.NewExistsQuery("scan_id"))).
+		Script(elastic.NewScript("ctx._source.plugins[params.category].remove(params.name)").
+			Params(map[string]interface{}{"category": category, "name": name})).
+		ProceedOnVersionConflict().
+		Do(context.Background())
+	if err != nil {
+		return pruned, errors.Wrap(err, "failed to remove results from elasticsearch")
+	}
+	pruned.Updated = updated.Updated
+
+	deleted, err := client.DeleteByQuery(es.Index).
+		Type(es.Type).
+		Query(elastic.NewBoolQuery().
+			Filter(before, elastic.NewExistsQuery(field), elastic.NewExistsQuery("scan_id"))).
+		ProceedOnVersionConflict().
+		Do(context.Background())
+	if err != nil {
+		return pruned, errors.Wrap(err, "failed to delete scan history from elasticsearch")
+	}
+	pruned.Deleted = deleted.Deleted
+
+	return pruned, nil
+}
+
+// prune removes everything stored before now minus retention
+func prune(retention time.Duration, elasticsearch bool) (PruneReport, error) {
+	report := PruneReport{Cutoff: time.Now().UTC().Add(-retention)}
+
+	var err error
+	if store != nil {
+		if report.Results, err = store.pruneResults(report.Cutoff); err != nil {
+			return report, errors.Wrap(err, "failed to prune stored results")
+		}
+		if report.Samples, err = store.pruneSamples(report.Cutoff); err != nil {
+			return report, errors.Wrap(err, "failed to prune retained samples")
+		}
+	}
+	if elasticsearch {
+		pruned, err := pruneElasticsearch(report.Cutoff)
+		report.Elasticsearch = &pruned
+		if err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+func pruneCommand(c *cli.Context) error {
+	if len(c.String("older-than")) == 0 {
+		return fmt.Errorf("prune requires --older-than")
+	}
+	retention, err := parseRetention(c.String("older-than"))
+	if err != nil {
+		return err
+	}
+	elasticsearch := c.Bool("elasticsearch")
+	if elasticsearch && len(c.GlobalString("elasticsearch")) == 0 {
+		return fmt.Errorf("prune --elasticsearch requires the global --elasticsearch url")
+	}
+	if store == nil && !elasticsearch {
+		return fmt.Errorf("nothing to prune, set --store or prune --elasticsearch")
+	}
+
+	run := func() error {
+		report, err := prune(retention, elasticsearch)
+		reportJSON, jerr := json.Marshal(report)
+		if jerr != nil {
+			return jerr
+		}
+		fmt.Println(string(reportJSON))
+		return err
+	}
+
+	every := c.Duration("every")
+	if every <= 0 {
+		return run()
+	}
+	for {
+		if err := run(); err != nil {
+			log.WithFields(log.Fields{
+				"plugin":   name,
+				"category": category,
+			}).Error(err)
+		}
+		time.Sleep(every)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// QueuedJob json object, an async scan waiting for or running on the engine
+type QueuedJob struct {
+	ID          string     `json:"id"`
+	Status      string     `json:"status"`
+	Priority    string     `json:"priority"`
+	SHA256      string     `json:"sha256"`
+	Size        int        `json:"size"`
+	Tenant      string     `json:"tenant,omitempty"`
+	SubmittedAt time.Time  `json:"submitted_at"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	Age         int64      `json:"age"`                // seconds since it was submitted
+	Instance    string     `json:"instance,omitempty"` // running it, with a job directory
+}
+
+// QueueStatus json object, the running jobs and then the queued ones in the
+// order they will run
+type QueueStatus struct {
+	Queued  int         `json:"queued"`
+	Running int         `json:"running"`
+	Limit   int         `json:"limit"`
+	Jobs    []QueuedJob `json:"jobs"`
+}
+
+// inTenant matches the jobs of tenant, or every job if tenant is empty
+func inTenant(tenant string) func(owner, jobTenant string) bool {
+	return func(owner, jobTenant string) bool {
+		return len(tenant) == 0 || jobTenant == tenant
+	}
+}
+
+func queuedJob(job ScanJob, tenant string, now time.Time) QueuedJob {
+	return QueuedJob{
+		ID:          job.ID,
+		Status:      job.Status,
+		Priority:    jobPriority(job.Priority),
+		SHA256:      job.SHA256,
+		Size:        job.Size,
+		Tenant:      tenant,
+		SubmittedAt: job.SubmittedAt,
+		StartedAt:   job.StartedAt,
+		Age:         int64(now.Sub(job.SubmittedAt).Seconds()),
+	}
+}
+
+// sortQueue puts the running jobs first and the queued ones in the order
+// they will run
+func sortQueue(queued []QueuedJob) {
+	sort.SliceStable(queued, func(i, j int) bool {
+		a, b := queued[i], queued[j]
+		if a.Status != b.Status {
+			return a.Status == jobRunning
+		}
+		if priorityRank(a.Priority) != priorityRank(b.Priority) {
+			return priorityRank(a.Priority) < priorityRank(b.Priority)
+		}
+		return a.SubmittedAt.Before(b.SubmittedAt)
+	})
+}
+
+// status returns the queued and running jobs of tenant, or all of them
+func (q *jobQueue) status(tenant string) QueueStatus {
+	match := inTenant(tenant)
+	now := time.Now()
+	status := QueueStatus{Limit: maxQueuedJobs, Jobs: []QueuedJob{}}
+
+	q.Lock()
+	if len(q.dir) > 0 {
+		for _, job := range q.list() {
+			if (job.Status == jobQueued || job.Status == jobRunning) && match(job.Owner, job.tenant()) {
+				queued := queuedJob(job.ScanJob, job.tenant(), now)
+				if job.Status == jobRunning {
+					queued.Instance = q.claimedBy(job.ID)
+				}
+				status.Jobs = append(status.Jobs, queued)
+			}
+		}
+	} else {
+		for _, job := range q.jobs {
+			if (job.Status == jobQueued || job.Status == jobRunning) && match(job.owner, job.tenant) {
+				status.Jobs = append(status.Jobs, queuedJob(*job, job.tenant, now))
+			}
+		}
+	}
+	q.Unlock()
+
+	sortQueue(status.Jobs)
+	for _, job := range status.Jobs {
+		if job.Status == jobRunning {
+			status.Running++
+		} else {
+			status.Queued++
+		}
+	}
+	return status
+}
+
+// reprioritize changes the priority of a queued job of tenant, jobs that
+// already run can not be reprioritized
+func (q *jobQueue) reprioritize(id, tenant, priority string) (ScanJob, bool, error) {
+	match := inTenant(tenant)
+	q.Lock()
+	defer q.Unlock()
+
+	if len(q.dir) > 0 {
+		job, err := q.load(id)
+		if err != nil || !match(job.Owner, job.tenant()) {
+			return ScanJob{}, false, nil
+		}
+		if job.Status != jobQueued {
+			return job.ScanJob, true, fmt.Errorf("scan job is already %s", job.Status)
+		}
+		job.Priority = priority
+		return job.ScanJob, true, q.save(job)
+	}
+
+	job, ok := q.jobs[id]
+	if !ok || !match(job.owner, job.tenant) {
+		return ScanJob{}, false, nil
+	}
+	if job.Status != jobQueued {
+		return *job, true, fmt.Errorf("scan job is already %s", job.Status)
+	}
+	job.Priority = priority
+	return *job, true, nil
+}
+
+// drain cancels the queued jobs of tenant, or all of them, with priority or
+// any priority if it is empty, and returns their ids. Running jobs finish.
+func (q *jobQueue) drain(tenant, priority string) []string {
+	match := inTenant(tenant)
+	drained := func(job ScanJob) bool {
+		return job.Status == jobQueued && (len(priority) == 0 || jobPriority(job.Priority) == priority)
+	}
+	finished := time.Now().UTC()
+	cancelled := []string{}
+
+	q.Lock()
+	defer q.Unlock()
+
+	if len(q.dir) > 0 {
+		for _, job := range q.list() {
+			if !drained(job.ScanJob) || !match(job.Owner, job.tenant()) {
+				continue
+			}
+			job.Status = jobCancelled
+			job.FinishedAt = &finished
+			if err := q.save(job); err != nil {
+				log.WithFields(log.Fields{
+					"plugin":   name,
+					"category": category,
+					"job":      job.ID,
+				}).Error(err)
+				continue
+			}
+			os.Remove(q.jobFile(job.ID, ".sample"))
+			cancelled = append(cancelled, job.ID)
+		}
+		return cancelled
+	}
+
+	var pending []*ScanJob
+	for _, job := range q.pending {
+		if !drained(*job) || !match(job.owner, job.tenant) {
+			pending = append(pending, job)
+			continue
+		}
+		job.Status = jobCancelled
+		job.FinishedAt = &finished
+		job.upload = nil
+		cancelled = append(cancelled, job.ID)
+	}
+	q.pending = pending
+	return cancelled
+}
+
+// webQueue lists the async scans waiting for or running on the engine.
+// Admin keys of a tenant only see their tenant's.
+func webQueue(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, jobs.status(requestTenant(r)))
+}
+
+// webReprioritizeJob moves a queued job ahead or back with {"priority": "high"}
+func webReprioritizeJob(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Priority string `json:"priority"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(request.Priority) == 0 {
+		http.Error(w, "invalid request: missing priority", http.StatusBadRequest)
+		return
+	}
+	priority, err := parsePriority(request.Priority)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	job, ok, err := jobs.reprioritize(mux.Vars(r)["jobID"], requestTenant(r), priority)
+	if !ok {
+		http.Error(w, "scan job not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	log.WithFields(log.Fields{
+		"plugin":   name,
+		"category": category,
+		"job":      job.ID,
+		"priority": priority,
+	}).Info("scan job reprioritized")
+	writeJSON(w, http.StatusOK, job)
+}
+
+// webQueueCancelJob cancels any async scan, not only those of the admin key
+func webQueueCancelJob(w http.ResponseWriter, r *http.Request) {
+	job, ok, err := jobs.cancelWhere(mux.Vars(r)["jobID"], inTenant(requestTenant(r)))
+	if !ok {
+		http.Error(w, "scan job not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	log.WithFields(log.Fields{
+		"plugin":   name,
+		"category": category,
+		"job":      job.ID,
+	}).Info("scan job cancelled by an admin")
+	writeJSON(w, http.StatusOK, job)
+}
+
+// webDrainQueue cancels every queued scan, or those with ?priority=
+func webDrainQueue(w http.ResponseWriter, r *http.Request) {
+	priority := r.URL.Query().Get("priority")
+	if len(priority) > 0 {
+		var err error
+		if priority, err = parsePriority(priority); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	cancelled := jobs.drain(requestTenant(r), priority)
+	log.WithFields(log.Fields{
+		"plugin":    name,
+		"category":  category,
+		"priority":  priority,
+		"cancelled": len(cancelled),
+	}).Info("drained scan queue")
+	writeJSON(w, http.StatusOK, map[string][]string{"cancelled": cancelled})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// defaultScanDir is where the samples of scanReader are written to, the
+// directory the engine is allowed to scan
+const defaultScanDir = "/malware"
+
+// readerScan is how scanReader scans a sample
+type readerScan struct {
+	dir     string
+	maxSize int64 // 0 is unlimited
+	timeout int   // in seconds
+	profile *ScanProfile
+	explode bool
+	limits  extractLimits
+}
+
+// scanOption changes how scanReader scans a sample
+type scanOption func(*readerScan)
+
+// withScanDir writes the sample to dir instead of /malware
+func withScanDir(dir string) scanOption {
+	return func(s *readerScan) { s.dir = dir }
+}
+
+// withMaxSize fails the scan of samples larger than size bytes
+func withMaxSize(size int64) scanOption {
+	return func(s *readerScan) { s.maxSize = size }
+}
+
+// withTimeout is the scan timeout in seconds of a profile without one
+func withTimeout(seconds int) scanOption {
+	return func(s *readerScan) { s.timeout = seconds }
+}
+
+// withProfile scans the sample with profile instead of the default one
+func withProfile(profile *ScanProfile) scanOption {
+	return func(s *readerScan) { s.profile = profile }
+}
+
+// withExplode unpacks archives and scans their members as well
+func withExplode(explode bool) scanOption {
+	return func(s *readerScan) { s.explode = explode }
+}
+
+// withLimits unpacks archives with limits instead of the --max-* settings
+func withLimits(limits extractLimits) scanOption {
+	return func(s *readerScan) { s.limits = limits }
+}
+
+// sampleTooLargeError is returned for samples over withMaxSize
+type sampleTooLargeError struct {
+	limit int64
+}
+
+func (e *sampleTooLargeError) Error() string {
+	return fmt.Sprintf("sample exceeds the limit of %d bytes", e.limit)
+}
+
+// scanReader scans what r reads. The engine only scans files, so the sample
+// is written to a temp file only this process can read, which is removed
+// again however the scan ends.
+func scanReader(ctx context.Context, r io.Reader, opts ...scanOption) (DrWEB, error) {
+	s := &readerScan{dir: defaultScanDir, timeout: defaultTimeout, profile: currentDefaultProfile(), limits: explodeLimits}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	var drweb DrWEB
+	tmpfile, err := ioutil.TempFile(s.dir, "web_")
+	if err != nil {
+		return drweb, errors.Wrap(err, "failed to create temp file to scan")
+	}
+	defer os.Remove(tmpfile.Name())
+
+	if s.maxSize > 0 {
+		r = io.LimitReader(r, s.maxSize+1)
+	}
+	written, err := io.Copy(tmpfile, r)
+	if closeErr := tmpfile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return drweb, errors.Wrap(err, "failed to write temp file to scan")
+	}
+	if s.maxSize > 0 && written > s.maxSize {
+		return drweb, &sampleTooLargeError{limit: s.maxSize}
+	}
+
+	scanStarted := time.Now()
+	drweb = avScanFile(ctx, tmpfile.Name(), s.timeout, s.profile)
+	if ctx.Err() != nil {
+		return drweb, ctx.Err()
+	}
+	if drweb.Results.Status == statusEngineUnavailable {
+		return drweb, errors.New(drweb.Results.Error)
+	}
+	shedder.observe(time.Since(scanStarted))
+
+	if s.explode && len(archiveType(tmpfile.Name())) > 0 {
+		if drweb.Results.Members, err = explodeAndScan(tmpfile.Name(), s.limits, explodeCommand, s.timeout, s.profile); err != nil {
+			return drweb, errors.Wrap(err, "failed to explode archive")
+		}
+		drweb.Results.addMembers()
+	}
+	return drweb, nil
+}
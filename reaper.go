@@ -0,0 +1,45 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// startReaper waits for the zombie children nobody else waits for. As PID 1
+// of a container every orphaned process becomes our child, e.g. engine
+// processes whose drweb-ctl was killed, and would otherwise stay in the
+// process table forever.
+func startReaper(interval time.Duration) {
+	go func() {
+		// children we started ourselves are waited for by exec.Cmd right after
+		// they exit, so only zombies that are still around a sweep later are ours
+		suspects := map[int]bool{}
+		for range time.Tick(interval) {
+			zombies := map[int]bool{}
+			for _, child := range childProcesses() {
+				if child.State != "Z" {
+					continue
+				}
+				if !suspects[child.PID] {
+					zombies[child.PID] = true
+					continue
+				}
+				var status syscall.WaitStatus
+				if pid, err := syscall.Wait4(child.PID, &status, syscall.WNOHANG, nil); err == nil && pid > 0 {
+					log.WithFields(log.Fields{
+						"plugin":   name,
+						"category": category,
+						"pid":      pid,
+						"command":  child.Command,
+					}).Debug("reaped zombie process")
+				}
+			}
+			suspects = zombies
+		}
+	}()
+}
@@ -0,0 +1,6 @@
+package main
+
+import "time"
+
+// startReaper does nothing, Windows has no zombie processes to wait for
+func startReaper(interval time.Duration) {}
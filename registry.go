@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// container image manifest media types
+const (
+	mediaDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	mediaOCIIndex           = "application/vnd.oci.image.index.v1+json"
+)
+
+var challengeParamRe = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// imageRef is a parsed container image reference
+type imageRef struct {
+	registry   string
+	repository string
+	reference  string // tag or digest
+}
+
+// parseImageRef parses references like nginx, quay.io/org/app:1.2 or app@sha256:...
+func parseImageRef(ref string) (imageRef, error) {
+	image := imageRef{registry: "registry-1.docker.io", reference: "latest"}
+	rest := ref
+	if i := strings.Index(rest, "/"); i > 0 {
+		if host := rest[:i]; strings.ContainsAny(host, ".:") || host == "localhost" {
+			image.registry = host
+			rest = rest[i+1:]
+		}
+	}
+	if image.registry == "docker.io" || image.registry == "index.docker.io" {
+		image.registry = "registry-1.docker.io"
+	}
+	if i := strings.Index(rest, "@"); i >= 0 {
+		image.reference = rest[i+1:]
+		rest = rest[:i]
+	} else if i := strings.LastIndex(rest, ":"); i > strings.LastIndex(rest, "/") {
+		image.reference = rest[i+1:]
+		rest = rest[:i]
+	}
+	if image.registry == "registry-1.docker.io" && !strings.Contains(rest, "/") {
+		rest = "library/" + rest
+	}
+	if len(rest) == 0 || len(image.reference) == 0 {
+		return image, fmt.Errorf("invalid image reference %q", ref)
+	}
+	image.repository = rest
+	return image, nil
+}
+
+// imageLayer is a layer blob of an image manifest
+type imageLayer struct {
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+}
+
+type imageManifest struct {
+	MediaType string       `json:"mediaType"`
+	Layers    []imageLayer `json:"layers"`
+	Manifests []struct {
+		Digest   string `json:"digest"`
+		Platform struct {
+			OS           string `json:"os"`
+			Architecture string `json:"architecture"`
+		} `json:"platform"`
+	} `json:"manifests"`
+}
+
+// registryClient pulls image manifests and layers with the registry HTTP API v2
+type registryClient struct {
+	sync.Mutex
+	client   *http.Client
+	auths    map[string]string // registry host to base64 user:password
+	platform string            // os/architecture picked from multi-platform images
+	maxSize  int64             // largest layer downloaded
+	tokens   map[string]string // token per registry and repository
+}
+
+func newRegistryClient(timeout time.Duration, platform string, maxSize int64) *registryClient {
+	return &registryClient{
+		client:   &http.Client{Timeout: timeout},
+		auths:    make(map[string]string),
+		platform: platform,
+		maxSize:  maxSize,
+		tokens:   make(map[string]string),
+	}
+}
+
+// loadDockerConfig reads the registry credentials of a docker config.json
+func (c *registryClient) loadDockerConfig(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return errors.Wrap(err, "failed to read registry credentials")
+	}
+	var config struct {
+		Auths map[string]struct {
+			Auth string `json:"auth"`
+		} `json:"auths"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return errors.Wrap(err, "failed to parse registry credentials")
+	}
+	for registry, auth := range config.Auths {
+		host := registry
+		if u, err := url.Parse(registry); err == nil && len(u.Host) > 0 {
+			host = u.Host
+		}
+		if host == "index.docker.io" || host == "docker.io" {
+			host = "registry-1.docker.io"
+		}
+		c.auths[host] = auth.Auth
+	}
+	return nil
+}
+
+// token gets a bearer token for the challenge of a registry
+func (c *registryClient) token(image imageRef, challenge string) (string, error) {
+	params := make(map[string]string)
+	for _, match := range challengeParamRe.FindAllStringSubmatch(challenge, -1) {
+		params[match[1]] = match[2]
+	}
+	if len(params["realm"]) == 0 {
+		return "", fmt.Errorf("registry %s sent an invalid auth challenge", image.registry)
+	}
+	query := url.Values{}
+	if len(params["service"]) > 0 {
+		query.Set("service", params["service"])
+	}
+	query.Set("scope", "repository:"+image.repository+":pull")
+	req, err := http.NewRequest("GET", params["realm"]+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	if auth, ok := c.auths[image.registry]; ok {
+		req.Header.Set("Authorization", "Basic "+auth)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to get registry token")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to get registry token: %s", resp.Status)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", errors.Wrap(err, "failed to parse registry token")
+	}
+	if len(token.Token) > 0 {
+		return token.Token, nil
+	}
+	return token.AccessToken, nil
+}
+
+// get requests a registry API path, authenticating when challenged
+func (c *registryClient) get(image imageRef, path string, accept ...string) (*http.Response, error) {
+	key := image.registry + "/" + image.repository
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest("GET", "https://"+image.registry+"/v2/"+image.repository+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, mediaType := range accept {
+			req.Header.Add("Accept", mediaType)
+		}
+		c.Lock()
+		token, ok := c.tokens[key]
+		c.Unlock()
+		if ok {
+			req.Header.Set("Authorization", token)
+		} else if auth, ok := c.auths[image.registry]; ok {
+			req.Header.Set("Authorization", "Basic "+auth)
+		}
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusUnauthorized || attempt > 0 {
+			return resp, nil
+		}
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		if !strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+			return nil, fmt.Errorf("registry %s requires credentials", image.registry)
+		}
+		token, err = c.token(image, challenge)
+		if err != nil {
+			return nil, err
+		}
+		c.Lock()
+		c.tokens[key] = "Bearer " + token
+		c.Unlock()
+	}
+}
+
+// layers returns the layers of an image, for c.platform if it has several
+func (c *registryClient) layers(image imageRef) ([]imageLayer, error) {
+	reference := image.reference
+	for depth := 0; depth < 2; depth++ {
+		resp, err := c.get(image, "/manifests/"+reference, mediaDockerManifest, mediaOCIManifest, mediaDockerManifestList, mediaOCIIndex)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get image manifest")
+		}
+		var manifest imageManifest
+		err = json.NewDecoder(io.LimitReader(resp.Body, 4<<20)).Decode(&manifest)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("failed to get image manifest: %s", resp.Status)
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse image manifest")
+		}
+		if len(manifest.Manifests) == 0 {
+			return manifest.Layers, nil
+		}
+		reference = ""
+		for _, platform := range manifest.Manifests {
+			if platform.Platform.OS+"/"+platform.Platform.Architecture == c.platform {
+				reference = platform.Digest
+				break
+			}
+		}
+		if len(reference) == 0 {
+			return nil, fmt.Errorf("image has no %s variant", c.platform)
+		}
+	}
+	return nil, fmt.Errorf("image manifest lists are nested too deep")
+}
+
+// downloadLayer saves a layer blob to a temp file, the caller removes it
+func (c *registryClient) downloadLayer(image imageRef, layer imageLayer) (string, error) {
+	if layer.Size > c.maxSize {
+		return "", fmt.Errorf("layer %s is larger than %d MB", layer.Digest, c.maxSize>>20)
+	}
+	resp, err := c.get(image, "/blobs/"+layer.Digest)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to download layer")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to download layer: %s", resp.Status)
+	}
+
+	tmpfile, err := ioutil.TempFile("", "layer_")
+	if err != nil {
+		return "", err
+	}
+	n, err := io.Copy(tmpfile, io.LimitReader(resp.Body, c.maxSize+1))
+	if err == nil && n > c.maxSize {
+		err = fmt.Errorf("layer is larger than %d MB", c.maxSize>>20)
+	}
+	if cerr := tmpfile.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpfile.Name())
+		return "", errors.Wrap(err, "failed to download layer")
+	}
+	return tmpfile.Name(), nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// --report formats
+const (
+	reportHTML = "html"
+	reportPDF  = "pdf"
+)
+
+// reportRow is a labelled value of an incident report
+type reportRow struct {
+	Label string
+	Value string
+}
+
+// reportSection is a titled part of an incident report
+type reportSection struct {
+	Title string
+	Rows  []reportRow
+}
+
+// incidentReport is what the html and pdf reports show, built from the same
+// results, hash and duration as the markdown table
+type incidentReport struct {
+	Title     string
+	Verdict   string
+	Infected  bool
+	Sections  []reportSection
+	Generated time.Time
+	Version   string
+}
+
+// timelineEvent is something that happened to the sample while it was scanned
+type timelineEvent struct {
+	at    time.Time
+	event string
+}
+
+// scanTimeline records the events of a scan for the incident report
+type scanTimeline []timelineEvent
+
+func (t *scanTimeline) add(event string) {
+	*t = append(*t, timelineEvent{at: time.Now().UTC(), event: event})
+}
+
+// fileHashes returns the md5 and sha1 of file, the sha256 is known already
+func fileHashes(file string) (string, string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	md5sum, sha1sum := md5.New(), sha1.New()
+	if _, err := io.Copy(io.MultiWriter(md5sum, sha1sum), f); err != nil {
+		return "", "", err
+	}
+	return fmt.Sprintf("%x", md5sum.Sum(nil)), fmt.Sprintf("%x", sha1sum.Sum(nil)), nil
+}
+
+// verdictSummary describes results in a few words
+func verdictSummary(results ResultsData) string {
+	switch {
+	case results.Infected:
+		return "infected with " + strings.Join(detections(results), ", ")
+	case results.Suppressed:
+		return "suppressed " + results.Result
+	case results.Status != statusClean:
+		return strings.TrimSpace(results.Status + ": " + results.Result + " " + results.Error)
+	}
+	return "clean"
+}
+
+// newIncidentReport collects the report of a scanned file
+func newIncidentReport(a DrWEB, file, contentType, sha string, timeline scanTimeline) (incidentReport, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return incidentReport{}, err
+	}
+	md5sum, sha1sum, err := fileHashes(file)
+	if err != nil {
+		return incidentReport{}, err
+	}
+
+	results := a.Results
+	report := incidentReport{
+		Title:     "Dr.Web incident report: " + filepath.Base(file),
+		Verdict:   verdictSummary(results),
+		Infected:  results.Infected,
+		Generated: time.Now().UTC(),
+		Version:   Version,
+	}
+
+	// rows leaves out empty values, a report only shows what is known
+	rows := func(pairs ...string) []reportRow {
+		var rows []reportRow
+		for i := 0; i+1 < len(pairs); i += 2 {
+			if len(pairs[i+1]) > 0 {
+				rows = append(rows, reportRow{Label: pairs[i], Value: pairs[i+1]})
+			}
+		}
+		return rows
+	}
+
+	sample := reportSection{Title: "Sample", Rows: rows(
+		"File", filepath.Base(file),
+		"Size", fmt.Sprintf("%d bytes", info.Size()),
+		"Content type", contentType,
+		"MD5", md5sum,
+		"SHA1", sha1sum,
+		"SHA256", sha,
+		"Tags", strings.Join(results.Tags, ", "),
+	)}
+	var keys []string
+	for key := range results.Metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		sample.Rows = append(sample.Rows, reportRow{Label: key, Value: results.Metadata[key]})
+	}
+	if results.Submitter != nil {
+		sample.Rows = append(sample.Rows, rows("Submitted by", results.Submitter.source())...)
+	}
+	report.Sections = append(report.Sections, sample)
+
+	detection := reportSection{Title: "Detections", Rows: rows(
+		"Status", results.Status,
+		"Result", results.Result,
+		"Family", results.Family,
+		"Confidence", results.Confidence,
+		"ATT&CK", strings.Join(results.Attack, ", "),
+		"Action", actionTaken(results),
+	)}
+	for _, member := range notClean(results.Members) {
+		detection.Rows = append(detection.Rows, reportRow{
+			Label: member.Path,
+			Value: strings.TrimSpace(member.Results.Status + ": " + member.Results.Result + " " + member.Results.Error),
+		})
+	}
+	if results.Peers != nil {
+		for _, verdict := range results.Peers.Verdicts {
+			value := verdict.Result
+			switch {
+			case len(verdict.Error) > 0:
+				value = "error: " + verdict.Error
+			case !verdict.Infected:
+				value = "clean"
+			}
+			peer := verdict.Plugin
+			if len(peer) == 0 {
+				peer = verdict.URL
+			}
+			detection.Rows = append(detection.Rows, reportRow{Label: "Peer " + peer, Value: value})
+		}
+	}
+	report.Sections = append(report.Sections, detection)
+
+	report.Sections = append(report.Sections, reportSection{Title: "Engine", Rows: rows(
+		"Engine", results.Engine,
+		"Virus base", results.Database,
+		"Updated", updatedString(results),
+		"Virus base timestamp", formatTimestamp(results.DBTimestamp),
+		"Scanned at", formatTimestamp(results.ScannedAt),
+		"Profile", results.Profile,
+		"Source", results.Source,
+	)})
+
+	var events []reportRow
+	for _, event := range timeline {
+		events = append(events, reportRow{Label: event.at.Format(time.RFC3339Nano), Value: event.event})
+	}
+	report.Sections = append(report.Sections, reportSection{Title: "Timeline", Rows: events})
+
+	return report, nil
+}
+
+// writeHTML renders the report as a single html file with inline styles
+func (r incidentReport) writeHTML(w io.Writer) error {
+	t, err := template.New("report").Parse(string(asset("report.html.tmpl")))
+	if err != nil {
+		return err
+	}
+	return t.Execute(w, r)
+}
+
+// writePDF renders the report as a pdf file
+func (r incidentReport) writePDF(w io.Writer) error {
+	doc := &pdfDocument{title: r.Title}
+	doc.add(r.Title, 16, true, 0)
+	doc.add("Verdict: "+r.Verdict, 12, true, 8)
+	for _, section := range r.Sections {
+		doc.add(section.Title, 13, true, 14)
+		for _, row := range section.Rows {
+			doc.add(row.Label+": "+row.Value, 9, false, 2)
+		}
+	}
+	doc.add(fmt.Sprintf("Generated %s by drweb %s", r.Generated.Format(time.RFC3339), r.Version), 8, false, 14)
+	return doc.write(w, r.Generated)
+}
+
+// write writes the report in format, html or pdf
+func (r incidentReport) write(w io.Writer, format string) error {
+	switch format {
+	case reportHTML:
+		return r.writeHTML(w)
+	case reportPDF:
+		return r.writePDF(w)
+	}
+	return fmt.Errorf("invalid report format %q (must be %s or %s)", format, reportHTML, reportPDF)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// headers of signed scan submissions
+const (
+	signingKeyIDHeader     = "X-Malice-Key-Id"
+	signingTimestampHeader = "X-Malice-Timestamp"
+	signingNonceHeader     = "X-Malice-Nonce"
+	signingSignatureHeader = "X-Malice-Signature"
+)
+
+// signedBodyContextKey holds the signedBody of a request
+const signedBodyContextKey = contextKey("signed-body")
+
+// maxSignedTrailer is how much of a signed body is read after the handler
+// read what it needs, e.g. the epilogue of a multipart upload
+const maxSignedTrailer = 1 << 20
+
+// nonceRe matches nonces, 16 to 128 characters that are safe to log
+var nonceRe = regexp.MustCompile(`^[A-Za-z0-9_-]{16,128}$`)
+
+// SigningKey is an entry of the request signing keys file, a producer
+// allowed to submit scans and the secret it signs them with
+type SigningKey struct {
+	ID     string `json:"id"`
+	Secret string `json:"secret"`
+}
+
+// requestSigning checks that scan submissions are signed by a known
+// producer: an HMAC-SHA256 over the timestamp, nonce, method, request URI
+// and sha256 of the body. Timestamps must be within the skew of our clock
+// and every nonce is only accepted once while its timestamp is, so a
+// captured request can not be replayed.
+type requestSigning struct {
+	sync.Mutex
+	file   string
+	keys   map[string][]byte
+	skew   time.Duration
+	nonces map[string]time.Time // of the accepted requests, by key id and nonce
+	pruned time.Time
+}
+
+// signing is disabled unless a request signing keys file is configured
+var signing = &requestSigning{skew: 5 * time.Minute, nonces: make(map[string]time.Time)}
+
+// load reads the request signing keys file, a JSON list of keys
+func (s *requestSigning) load(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return errors.Wrap(err, "failed to read request signing keys")
+	}
+	var list []SigningKey
+	if err := json.Unmarshal(data, &list); err != nil {
+		return errors.Wrapf(err, "failed to parse request signing keys file %s", file)
+	}
+
+	keys := make(map[string][]byte)
+	for i, key := range list {
+		switch {
+		case len(key.ID) == 0:
+			return fmt.Errorf("request signing key %d has no id", i)
+		case len(key.Secret) < 32:
+			return fmt.Errorf("request signing key %s has a secret shorter than 32 characters", key.ID)
+		}
+		keys[key.ID] = []byte(key.Secret)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.file = file
+	s.keys = keys
+	return nil
+}
+
+// reload re-reads the request signing keys file, if there is one
+func (s *requestSigning) reload() error {
+	s.Lock()
+	file := s.file
+	s.Unlock()
+	if len(file) == 0 {
+		return nil
+	}
+	return s.load(file)
+}
+
+func (s *requestSigning) enabled() bool {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.keys) > 0
+}
+
+// signedBody hashes a request body as the handler reads it
+type signedBody struct {
+	io.ReadCloser
+	sum       io.Writer
+	digest    func() []byte
+	keyID     string
+	timestamp string
+	nonce     string
+	signature []byte
+	secret    []byte
+	at        time.Time
+}
+
+func (b *signedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.sum.Write(p[:n])
+	return n, err
+}
+
+// signingPayload is what a submission's signature is computed over
+func signingPayload(timestamp, nonce, method, uri, bodySHA256 string) string {
+	return timestamp + "\n" + nonce + "\n" + method + "\n" + uri + "\n" + bodySHA256
+}
+
+func unsigned(w http.ResponseWriter, reason string) {
+	w.Header().Set("WWW-Authenticate", `HMAC realm="drweb", headers="`+signingKeyIDHeader+" "+signingTimestampHeader+" "+signingNonceHeader+`"`)
+	http.Error(w, "valid request signature required: "+reason, http.StatusUnauthorized)
+}
+
+// requireSigned refuses submissions without a valid signature while
+// request signing keys are configured. The headers are checked before the
+// body is read, the signature by the handler with signatureVerified once it
+// read the body.
+func requireSigned(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !signing.enabled() {
+			next(w, r)
+			return
+		}
+
+		keyID, timestamp, nonce := r.Header.Get(signingKeyIDHeader), r.Header.Get(signingTimestampHeader), r.Header.Get(signingNonceHeader)
+		signing.Lock()
+		secret, known := signing.keys[keyID]
+		skew := signing.skew
+		_, replayed := signing.nonces[keyID+"/"+nonce]
+		signing.Unlock()
+
+		seconds, err := strconv.ParseInt(timestamp, 10, 64)
+		at := time.Unix(seconds, 0)
+		signature, sigErr := hex.DecodeString(r.Header.Get(signingSignatureHeader))
+		switch {
+		case !known:
+			unsigned(w, "unknown "+signingKeyIDHeader)
+		case err != nil:
+			unsigned(w, "invalid "+signingTimestampHeader+", unix seconds expected")
+		case at.Before(time.Now().Add(-skew)) || at.After(time.Now().Add(skew)):
+			unsigned(w, signingTimestampHeader+" is more than "+skew.String()+" off")
+		case !nonceRe.MatchString(nonce):
+			unsigned(w, "invalid "+signingNonceHeader+", 16 to 128 letters, digits, - or _ expected")
+		case replayed:
+			signing.refused(keyID, "nonce was used before")
+			unsigned(w, signingNonceHeader+" was used before")
+		case sigErr != nil || len(signature) != sha256.Size:
+			unsigned(w, "invalid "+signingSignatureHeader+", a hex encoded HMAC-SHA256 expected")
+		default:
+			sum := sha256.New()
+			body := &signedBody{ReadCloser: r.Body, sum: sum, digest: func() []byte { return sum.Sum(nil) }, keyID: keyID, timestamp: timestamp, nonce: nonce, signature: signature, secret: secret, at: at}
+			r.Body = body
+			next(w, r.WithContext(context.WithValue(r.Context(), signedBodyContextKey, body)))
+		}
+	}
+}
+
+// signatureVerified reads the rest of the body of a signed request and
+// checks its signature, answering 401 if it does not match. The nonce is
+// only taken once the signature matched.
+func signatureVerified(w http.ResponseWriter, r *http.Request) bool {
+	body, ok := r.Context().Value(signedBodyContextKey).(*signedBody)
+	if !ok {
+		return true
+	}
+	if n, _ := io.Copy(ioutil.Discard, io.LimitReader(r.Body, maxSignedTrailer+1)); n > maxSignedTrailer {
+		unsigned(w, "body is too large")
+		return false
+	}
+
+	mac := hmac.New(sha256.New, body.secret)
+	io.WriteString(mac, signingPayload(body.timestamp, body.nonce, r.Method, r.URL.RequestURI(), hex.EncodeToString(body.digest())))
+	if !hmac.Equal(mac.Sum(nil), body.signature) {
+		signing.refused(body.keyID, "signature does not match")
+		unsigned(w, "signature does not match")
+		return false
+	}
+	if !signing.take(body.keyID, body.nonce, body.at) {
+		signing.refused(body.keyID, "nonce was used before")
+		unsigned(w, signingNonceHeader+" was used before")
+		return false
+	}
+	return true
+}
+
+// take records a nonce, false if it was taken already. Nonces are forgotten
+// once their timestamp is too old to be accepted anyway.
+func (s *requestSigning) take(keyID, nonce string, at time.Time) bool {
+	s.Lock()
+	defer s.Unlock()
+	if time.Since(s.pruned) > time.Second {
+		for seen, seenAt := range s.nonces {
+			if time.Since(seenAt) > s.skew {
+				delete(s.nonces, seen)
+			}
+		}
+		s.pruned = time.Now()
+	}
+	if _, taken := s.nonces[keyID+"/"+nonce]; taken {
+		return false
+	}
+	s.nonces[keyID+"/"+nonce] = at
+	return true
+}
+
+func (s *requestSigning) refused(keyID, reason string) {
+	log.WithFields(log.Fields{
+		"plugin":   name,
+		"category": category,
+		"key_id":   keyID,
+	}).Warn("refused signed submission: ", reason)
+}
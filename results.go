@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/malice-plugins/pkgs/utils"
+)
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		assert(err)
+	}
+}
+
+// writeTaggedJSON is writeJSON with an ETag of the serialized response, or
+// 304 Not Modified if the If-None-Match of the request has it
+func writeTaggedJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	var body bytes.Buffer
+	assert(json.NewEncoder(&body).Encode(v))
+	sum := sha256.Sum256(body.Bytes())
+	if notModified(w, r, fmt.Sprintf(`W/"%x"`, sum[:16])) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body.Bytes())
+}
+
+// notModified sets the ETag of a response and answers 304 Not Modified if
+// the If-None-Match of the request has it, so polling clients and caches do
+// not fetch the same verdict again
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	for _, tag := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		// If-None-Match compares weakly
+		if tag = strings.TrimSpace(tag); tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+// ndjsonContentType is the content type of results exported one per line
+const ndjsonContentType = "application/x-ndjson"
+
+// searchAfterHeader is the cursor of the last result of a page of GET /results
+const searchAfterHeader = "X-Malice-Search-After"
+
+// resultsCursor is the search_after cursor of a stored result, its scan
+// time and sha256, which sort the results
+func resultsCursor(stored StoredResult) string {
+	return stored.ScannedAt.UTC().Format(storeTimeFormat) + "_" + stored.SHA256
+}
+
+// resultsBefore orders stored results by scan time and sha256
+func resultsBefore(a, b StoredResult) bool {
+	if !a.ScannedAt.Equal(b.ScannedAt) {
+		return a.ScannedAt.Before(b.ScannedAt)
+	}
+	return a.SHA256 < b.SHA256
+}
+
+// parseResultsCursor returns the stored result a search_after cursor points
+// at, only its scan time and sha256 are set
+func parseResultsCursor(cursor string) (StoredResult, bool) {
+	parts := strings.SplitN(cursor, "_", 2)
+	if len(parts) != 2 || !validSHA256(parts[1]) {
+		return StoredResult{}, false
+	}
+	scannedAt, err := time.Parse(storeTimeFormat, parts[0])
+	if err != nil {
+		return StoredResult{}, false
+	}
+	return StoredResult{SHA256: parts[1], ScannedAt: scannedAt}, true
+}
+
+// webResults lists stored results, optionally filtered by ?tag= and ?infected=
+// and trimmed to the ?fields=. Newest first, or oldest first with
+// ?order=asc, a page at a time with ?search_after= the cursor of the last
+// result of the page before. As NDJSON they are served with Range support,
+// so an interrupted export resumes where it stopped.
+func webResults(w http.ResponseWriter, r *http.Request) {
+	if store == nil {
+		http.Error(w, "results store is not enabled (see --store)", http.StatusNotFound)
+		return
+	}
+
+	limit := 100
+	if l := r.URL.Query().Get("limit"); len(l) > 0 {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+	ascending := false
+	switch r.URL.Query().Get("order") {
+	case "", "desc":
+	case "asc":
+		ascending = true
+	default:
+		http.Error(w, "order must be asc or desc", http.StatusBadRequest)
+		return
+	}
+	var after *StoredResult
+	if cursor := r.URL.Query().Get("search_after"); len(cursor) > 0 {
+		last, ok := parseResultsCursor(cursor)
+		if !ok {
+			http.Error(w, "search_after must be the "+searchAfterHeader+" of an earlier page", http.StatusBadRequest)
+			return
+		}
+		after = &last
+	}
+	fields, ok := requestFields(w, r)
+	if !ok {
+		return
+	}
+	tags := parseTags(r.URL.Query()["tag"]...)
+	infected := r.URL.Query().Get("infected")
+
+	results, err := store.tenant(requestTenant(r)).query(func(stored StoredResult) bool {
+		for _, tag := range tags {
+			if !utils.StringInSlice(tag, stored.Results.Tags) {
+				return false
+			}
+		}
+		if len(infected) > 0 && strconv.FormatBool(stored.Results.Infected) != infected {
+			return false
+		}
+		if after != nil && !(ascending && resultsBefore(*after, stored) || !ascending && resultsBefore(stored, *after)) {
+			return false
+		}
+		return true
+	}, 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if ascending {
+			return resultsBefore(results[i], results[j])
+		}
+		return resultsBefore(results[j], results[i])
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+
+	if len(results) > 0 {
+		cursor := resultsCursor(results[len(results)-1])
+		w.Header().Set(searchAfterHeader, cursor)
+		if limit > 0 && len(results) == limit {
+			next := *r.URL
+			query := next.Query()
+			query.Set("search_after", cursor)
+			next.RawQuery = query.Encode()
+			w.Header().Set("Link", "<"+next.RequestURI()+`>; rel="next"`)
+		}
+	}
+
+	page := make([]interface{}, 0, len(results))
+	for _, stored := range results {
+		switch {
+		case len(fields) > 0:
+			page = append(page, requestSelection(r, stored.SHA256, stored.Results, fields))
+		case verdictOnly(r):
+			page = append(page, newVerdict(stored.SHA256, stored.Results))
+		default:
+			page = append(page, stored)
+		}
+	}
+	if r.URL.Query().Get("format") == "ndjson" || strings.Contains(r.Header.Get("Accept"), ndjsonContentType) {
+		serveNDJSON(w, r, page)
+		return
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// serveNDJSON writes the results of page one per line. The export
+// is written to a temp file first, so it can be served in ranges with an
+// ETag of its contents that If-Range checks it did not change since.
+func serveNDJSON(w http.ResponseWriter, r *http.Request, page []interface{}) {
+	tmpfile, err := ioutil.TempFile("", "results_")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmpfile.Name())
+	defer tmpfile.Close()
+
+	h := sha256.New()
+	enc := json.NewEncoder(io.MultiWriter(tmpfile, h))
+	for _, result := range page {
+		if err := enc.Encode(result); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", ndjsonContentType)
+	w.Header().Set("ETag", fmt.Sprintf(`"%x"`, h.Sum(nil)))
+	http.ServeContent(w, r, "", time.Time{}, tmpfile)
+}
+
+// webResult returns the latest stored result of a sample
+func webResult(w http.ResponseWriter, r *http.Request) {
+	if store == nil {
+		http.Error(w, "results store is not enabled (see --store)", http.StatusNotFound)
+		return
+	}
+
+	sha := mux.Vars(r)["sha256"]
+	if !validSHA256(sha) {
+		http.Error(w, "invalid sha256", http.StatusBadRequest)
+		return
+	}
+
+	fields, ok := requestFields(w, r)
+	if !ok {
+		return
+	}
+
+	stored, found, err := store.tenant(requestTenant(r)).latest(sha)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "no results found for "+sha, http.StatusNotFound)
+		return
+	}
+
+	if len(fields) > 0 {
+		writeTaggedJSON(w, r, requestSelection(r, sha, stored.Results, fields))
+		return
+	}
+	if verdictOnly(r) {
+		writeTaggedJSON(w, r, newVerdict(sha, stored.Results))
+		return
+	}
+	writeTaggedJSON(w, r, stored)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// retryPolicy is when and how often a failed drweb-ctl scan is run again
+type retryPolicy struct {
+	attempts  int           // runs in total, 1 never retries
+	backoff   time.Duration // wait before the first retry, doubled for every further one
+	exitCodes []int         // exit codes retried besides engine failures
+}
+
+// scanRetry retries a scan once right after the engine failed, see --scan-attempts
+var scanRetry = retryPolicy{attempts: 2}
+
+// retry reports whether a scan that failed with err after retries retries
+// is run again
+func (p retryPolicy) retry(err error, retries int) bool {
+	if err == nil || retries+1 >= p.attempts {
+		return false
+	}
+	if engineFailed(err) {
+		return true
+	}
+	code, ok := exitCode(err)
+	for _, retried := range p.exitCodes {
+		if ok && code == retried {
+			return true
+		}
+	}
+	return false
+}
+
+// delay is how long to wait before the retry-th retry
+func (p retryPolicy) delay(retry int) time.Duration {
+	delay := p.backoff
+	for i := 1; i < retry && delay < time.Hour; i++ {
+		delay *= 2
+	}
+	return delay
+}
+
+// wait sleeps before the retry-th retry, it returns false if ctx is done first
+func (p retryPolicy) wait(ctx context.Context, retry int) bool {
+	delay := p.delay(retry)
+	if delay <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// exitCode returns the exit code of a drweb-ctl command, whether it ran here
+// or in the engine helper
+func exitCode(err error) (int, bool) {
+	switch err := err.(type) {
+	case *engineExitError:
+		return err.code, true
+	case *exec.ExitError:
+		if status, ok := err.Sys().(syscall.WaitStatus); ok {
+			return status.ExitStatus(), true
+		}
+	}
+	return 0, false
+}
+
+// parseExitCodes parses the --scan-retry-on exit codes
+func parseExitCodes(values []string) ([]int, error) {
+	var codes []int
+	for _, value := range values {
+		for _, field := range strings.Split(value, ",") {
+			if field = strings.TrimSpace(field); len(field) == 0 {
+				continue
+			}
+			code, err := strconv.Atoi(field)
+			if err != nil || code < 0 || code > 255 {
+				return nil, fmt.Errorf("invalid --scan-retry-on exit code %q", field)
+			}
+			codes = append(codes, code)
+		}
+	}
+	return codes, nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	prSetNoNewPrivs     = 38
+	prSetSeccomp        = 22
+	seccompModeFilter   = 2
+	seccompRetAllow     = 0x7fff0000
+	seccompRetErrno     = 0x00050000
+	seccompDataArch     = 4 // offsetof(struct seccomp_data, arch)
+	x32SyscallBit       = 0x40000000
+	sysLandlockCreate   = 444
+	sysLandlockAddRule  = 445
+	sysLandlockRestrict = 446
+	landlockVersion     = 1 << 0 // LANDLOCK_CREATE_RULESET_VERSION
+	landlockPathBeneath = 1
+	oPath               = 0x200000 // O_PATH, missing from package syscall on amd64
+)
+
+// landlock filesystem access rights, reading and executing stay unrestricted
+const (
+	landlockWriteFile  = 1 << 1
+	landlockRemoveDir  = 1 << 4
+	landlockRemoveFile = 1 << 5
+	landlockMakeChar   = 1 << 6
+	landlockMakeDir    = 1 << 7
+	landlockMakeReg    = 1 << 8
+	landlockMakeSock   = 1 << 9
+	landlockMakeFifo   = 1 << 10
+	landlockMakeBlock  = 1 << 11
+	landlockMakeSym    = 1 << 12
+	landlockRefer      = 1 << 13 // ABI 2
+	landlockTruncate   = 1 << 14 // ABI 3
+)
+
+// engineWritableDirs are where Dr.Web keeps its databases, settings, sockets
+// and temp files, engine commands may always write below them
+var engineWritableDirs = []string{"/var/opt/drweb.com", "/etc/opt/drweb.com", "/run", "/var/run", "/tmp", "/var/tmp", "/dev"}
+
+// deniedSyscalls are never needed to scan a file, but a compromised engine
+// could use them to get out of the container or at the kernel
+var deniedSyscalls = append([]uintptr{
+	syscall.SYS_MOUNT, syscall.SYS_UMOUNT2, syscall.SYS_PIVOT_ROOT,
+	syscall.SYS_SWAPON, syscall.SYS_SWAPOFF, syscall.SYS_REBOOT,
+	syscall.SYS_KEXEC_LOAD, syscall.SYS_INIT_MODULE, syscall.SYS_DELETE_MODULE,
+	syscall.SYS_PERF_EVENT_OPEN, syscall.SYS_PTRACE, syscall.SYS_UNSHARE,
+	syscall.SYS_KEYCTL, syscall.SYS_ADD_KEY, syscall.SYS_REQUEST_KEY,
+	syscall.SYS_ACCT, syscall.SYS_QUOTACTL, syscall.SYS_LOOKUP_DCOOKIE,
+	syscall.SYS_SETTIMEOFDAY, syscall.SYS_CLOCK_SETTIME, syscall.SYS_ADJTIMEX,
+	syscall.SYS_VHANGUP,
+}, archDeniedSyscalls...)
+
+// engineSandbox is applied to the thread starting engine commands, which
+// drweb-ctl, drweb-configd and everything they start inherit
+type engineSandbox struct {
+	seccomp *syscall.SockFprog
+	ruleset int // landlock ruleset fd, -1 without landlock
+}
+
+// sandbox is nil unless --engine-seccomp or --engine-landlock is set
+var sandbox *engineSandbox
+
+// sandboxEngine confines the engine commands started from now on: seccomp
+// makes deniedSyscalls fail with EPERM, landlock only lets them write below
+// engineWritableDirs and writable
+func sandboxEngine(seccomp, landlock bool, writable []string) error {
+	if !seccomp && !landlock {
+		return nil
+	}
+	s := &engineSandbox{ruleset: -1}
+	if seccomp {
+		filter, err := seccompFilter()
+		if err != nil {
+			return err
+		}
+		s.seccomp = filter
+	}
+	if landlock {
+		ruleset, err := landlockRuleset(append(append([]string{os.TempDir()}, engineWritableDirs...), writable...))
+		if err != nil {
+			return err
+		}
+		s.ruleset = ruleset
+	}
+	sandbox = s
+	startCommand = startRestricted
+	return nil
+}
+
+// seccompFilter returns a BPF program failing deniedSyscalls, and every
+// syscall of another architecture or the x32 ABI, with EPERM
+func seccompFilter() (*syscall.SockFprog, error) {
+	if auditArch == 0 {
+		return nil, fmt.Errorf("--engine-seccomp is not supported on this architecture")
+	}
+	deny := syscall.SockFilter{Code: syscall.BPF_RET | syscall.BPF_K, K: seccompRetErrno | uint32(syscall.EPERM)}
+	filter := []syscall.SockFilter{
+		{Code: syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS, K: seccompDataArch},
+		{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, Jt: 1, K: auditArch},
+		deny,
+		{Code: syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS, K: 0},
+		{Code: syscall.BPF_JMP | syscall.BPF_JGE | syscall.BPF_K, Jf: 1, K: x32SyscallBit},
+		deny,
+	}
+	for _, nr := range deniedSyscalls {
+		filter = append(filter,
+			syscall.SockFilter{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, Jf: 1, K: uint32(nr)},
+			deny)
+	}
+	filter = append(filter, syscall.SockFilter{Code: syscall.BPF_RET | syscall.BPF_K, K: seccompRetAllow})
+	return &syscall.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}, nil
+}
+
+// landlockRuleset creates a ruleset handling every write access right the
+// kernel knows, granting them below dirs, missing dirs are skipped
+func landlockRuleset(dirs []string) (int, error) {
+	abi, _, errno := syscall.Syscall(sysLandlockCreate, 0, 0, landlockVersion)
+	if errno != 0 {
+		return -1, errors.Wrap(errno, "--engine-landlock requires a kernel with landlock enabled")
+	}
+	var handled uint64 = landlockWriteFile | landlockRemoveDir | landlockRemoveFile | landlockMakeChar |
+		landlockMakeDir | landlockMakeReg | landlockMakeSock | landlockMakeFifo | landlockMakeBlock | landlockMakeSym
+	if abi >= 2 {
+		handled |= landlockRefer
+	}
+	if abi >= 3 {
+		handled |= landlockTruncate
+	}
+	attr := struct{ handledAccessFs uint64 }{handled}
+	fd, _, errno := syscall.Syscall(sysLandlockCreate, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return -1, errors.Wrap(errno, "failed to create landlock ruleset")
+	}
+	ruleset := int(fd)
+
+	for _, dir := range dirs {
+		info, err := os.Stat(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			syscall.Close(ruleset)
+			return -1, err
+		}
+		allowed := handled
+		if !info.IsDir() {
+			allowed &= landlockWriteFile | landlockTruncate
+		}
+		parent, err := syscall.Open(dir, oPath|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			syscall.Close(ruleset)
+			return -1, errors.Wrapf(err, "failed to open %s", dir)
+		}
+		rule := struct {
+			allowedAccess uint64
+			parentFd      int32
+		}{allowed, int32(parent)}
+		_, _, errno := syscall.Syscall6(sysLandlockAddRule, uintptr(ruleset), landlockPathBeneath, uintptr(unsafe.Pointer(&rule)), 0, 0, 0)
+		syscall.Close(parent)
+		if errno != 0 {
+			syscall.Close(ruleset)
+			return -1, errors.Wrapf(errno, "failed to allow writing below %s", dir)
+		}
+	}
+	return ruleset, nil
+}
+
+// apply confines the calling thread, which must be locked and thrown away
+func (s *engineSandbox) apply() error {
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return errors.Wrap(errno, "failed to set no_new_privs")
+	}
+	if s.ruleset >= 0 {
+		if _, _, errno := syscall.RawSyscall(sysLandlockRestrict, uintptr(s.ruleset), 0, 0); errno != 0 {
+			return errors.Wrap(errno, "failed to apply landlock ruleset")
+		}
+	}
+	if s.seccomp != nil {
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetSeccomp, seccompModeFilter, uintptr(unsafe.Pointer(s.seccomp))); errno != 0 {
+			return errors.Wrap(errno, "failed to apply seccomp filter")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+package main
+
+// auditArch is AUDIT_ARCH_X86_64
+const auditArch = 0xc000003e
+
+// archDeniedSyscalls are the deniedSyscalls missing from package syscall
+var archDeniedSyscalls = []uintptr{
+	172, // iopl
+	173, // ioperm
+	304, // open_by_handle_at
+	305, // clock_adjtime
+	308, // setns
+	310, // process_vm_readv
+	311, // process_vm_writev
+	313, // finit_module
+	320, // kexec_file_load
+	321, // bpf
+	323, // userfaultfd
+}
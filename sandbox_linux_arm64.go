@@ -0,0 +1,17 @@
+package main
+
+// auditArch is AUDIT_ARCH_AARCH64
+const auditArch = 0xc00000b7
+
+// archDeniedSyscalls are the deniedSyscalls missing from package syscall
+var archDeniedSyscalls = []uintptr{
+	265, // open_by_handle_at
+	266, // clock_adjtime
+	268, // setns
+	270, // process_vm_readv
+	271, // process_vm_writev
+	273, // finit_module
+	280, // bpf
+	282, // userfaultfd
+	294, // kexec_file_load
+}
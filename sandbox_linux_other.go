@@ -0,0 +1,9 @@
+//go:build linux && !amd64 && !arm64
+// +build linux,!amd64,!arm64
+
+package main
+
+// auditArch is unknown, --engine-seccomp is only supported on amd64 and arm64
+const auditArch = 0
+
+var archDeniedSyscalls []uintptr
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "fmt"
+
+// sandboxEngine fails if asked to, seccomp and landlock are Linux only
+func sandboxEngine(seccomp, landlock bool, writable []string) error {
+	if seccomp || landlock {
+		return fmt.Errorf("--engine-seccomp and --engine-landlock require Linux")
+	}
+	return nil
+}
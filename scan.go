@@ -1,27 +1,24 @@
 package main
 
 import (
-	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
-	"html/template"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
-	log "github.com/Sirupsen/logrus"
-	"github.com/fatih/structs"
 	"github.com/gorilla/mux"
-	"github.com/malice-plugins/pkgs/database"
-	"github.com/malice-plugins/pkgs/database/elasticsearch"
 	"github.com/malice-plugins/pkgs/utils"
 	"github.com/parnurzeal/gorequest"
 	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 )
 
@@ -30,6 +27,26 @@ const (
 	category = "av"
 )
 
+// scan statuses, anything but clean and infected means the file (or part of
+// it) could not be scanned and must not be treated as clean
+const (
+	statusClean             = "clean"
+	statusInfected          = "infected"
+	statusError             = "error"
+	statusArchiveTooDeep    = "archive_too_deep"
+	statusDecompressionBomb = "decompression_bomb"
+	statusFileTooLarge      = "file_too_large"
+	statusSkipped           = "skipped"
+	statusEngineUnavailable = "engine_unavailable"
+)
+
+// detection confidences
+const (
+	confidenceHigh   = "high"
+	confidenceMedium = "medium"
+	confidenceLow    = "low"
+)
+
 var (
 	// Version stores the plugin's version
 	Version string
@@ -40,7 +57,7 @@ var (
 	path       string
 	hash       string
 	// es is the elasticsearch database object
-	es elasticsearch.Database
+	es elasticDatabase
 )
 
 type pluginResults struct {
@@ -50,18 +67,39 @@ type pluginResults struct {
 
 // DrWEB json object
 type DrWEB struct {
-	Results ResultsData `json:"drweb"`
+	Results   ResultsData `json:"drweb"`
+	Signature string      `json:"signature,omitempty"`
 }
 
 // ResultsData json object
 type ResultsData struct {
-	Infected bool   `json:"infected" structs:"infected"`
-	Result   string `json:"result" structs:"result"`
-	Engine   string `json:"engine" structs:"engine"`
-	Database string `json:"database" structs:"database"`
-	Updated  string `json:"updated" structs:"updated"`
-	MarkDown string `json:"markdown,omitempty" structs:"markdown,omitempty"`
-	Error    string `json:"error,omitempty" structs:"error,omitempty"`
+	Infected      bool                `json:"infected" structs:"infected"`
+	Status        string              `json:"status,omitempty" structs:"status,omitempty"`
+	Result        string              `json:"result" structs:"result"`
+	Heuristic     bool                `json:"heuristic" structs:"heuristic"`
+	Confidence    string              `json:"confidence,omitempty" structs:"confidence,omitempty"`
+	Family        string              `json:"family,omitempty" structs:"family,omitempty"`
+	Attack        []string            `json:"attack,omitempty" structs:"attack,omitempty"`
+	Metadata      map[string]string   `json:"metadata,omitempty" structs:"metadata,omitempty"`
+	Tags          []string            `json:"tags,omitempty" structs:"tags,omitempty"`
+	Engine        string              `json:"engine" structs:"engine"`
+	Database      string              `json:"database" structs:"database"`
+	Updated       string              `json:"updated,omitempty" structs:"updated,omitempty"`
+	UpdatedAt     *time.Time          `json:"updated_at,omitempty" structs:"updated_at,omitempty"`
+	DBTimestamp   *time.Time          `json:"db_timestamp,omitempty" structs:"db_timestamp,omitempty"`
+	ScannedAt     *time.Time          `json:"scanned_at,omitempty" structs:"scanned_at,omitempty"`
+	MarkDown      string              `json:"markdown,omitempty" structs:"markdown,omitempty"`
+	Error         string              `json:"error,omitempty" structs:"error,omitempty"`
+	Members       []ArchiveMember     `json:"members,omitempty" structs:"members,omitempty"`
+	Submitter     *Submitter          `json:"submitter,omitempty" structs:"submitter,omitempty"`
+	Source        string              `json:"source,omitempty" structs:"source,omitempty"`
+	Peers         *PeerResults        `json:"peers,omitempty" structs:"peers,omitempty"`
+	Intel         []IntelReference    `json:"intel,omitempty" structs:"intel,omitempty"`
+	PolicyApplied *AppliedPolicy      `json:"policy_applied,omitempty" structs:"policy_applied,omitempty"`
+	Suppressed    bool                `json:"suppressed,omitempty" structs:"suppressed,omitempty"`
+	Suppression   *AppliedSuppression `json:"suppression,omitempty" structs:"suppression,omitempty"`
+	Profile       string              `json:"profile,omitempty" structs:"profile,omitempty"`
+	Retries       int                 `json:"retries,omitempty" structs:"retries,omitempty"`
 }
 
 func assert(err error) {
@@ -79,150 +117,268 @@ func assert(err error) {
 
 // AvScan performs antivirus scan
 func AvScan(timeout int) DrWEB {
+	return AvScanContext(context.Background(), timeout)
+}
+
+// AvScanContext performs antivirus scan, the scan is killed once parent is cancelled
+func AvScanContext(parent context.Context, timeout int) DrWEB {
+	return AvScanProfile(parent, timeout, currentDefaultProfile())
+}
+
+// AvScanProfile performs antivirus scan with the settings of profile, nil
+// keeps the engine configuration
+func AvScanProfile(parent context.Context, timeout int, profile *ScanProfile) DrWEB {
+	return avScanFile(parent, path, timeout, profile)
+}
+
+// avScanFile scans file instead of the global path, so scans can run at the
+// same time
+func avScanFile(parent context.Context, file string, timeout int, profile *ScanProfile) DrWEB {
 
 	var output string
 	var sErr error
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(profile.timeout(timeout))*time.Second)
 	defer cancel()
 
-	expired, err := didLicenseExpire(ctx)
-	assert(err)
-	if expired {
-		err = updateLicense(ctx)
-		assert(err)
-	}
-
-	// drweb needs to have the daemon started first
-	configd := exec.CommandContext(ctx, "/opt/drweb.com/bin/drweb-configd", "-d")
-	_, err = configd.Output()
-	assert(err)
-	defer configd.Process.Kill()
+	// only drweb-ctl scan is killed with parent, so a cancelled scan never
+	// trips over a half started daemon
+	scanCtx, cancelScan := context.WithCancel(ctx)
+	defer cancelScan()
+	go func() {
+		select {
+		case <-parent.Done():
+			cancelScan()
+		case <-scanCtx.Done():
+		}
+	}()
 
-	time.Sleep(1 * time.Second)
+	if err := session.prepare(ctx); err != nil {
+		// the engine is not installed or licensed, there is nothing to retry
+		engineState.set(err)
+		return DrWEB{Results: engineUnavailableResults(err.Error())}
+	}
+	engineState.set(nil)
 
+	args := append(append(append([]string{"scan"}, profile.ctlArgs()...), reportArgs()...), file)
 	log.Debug("running drweb-ctl scan")
-	output, sErr = utils.RunCommand(ctx, "/opt/drweb.com/bin/drweb-ctl", "scan", path)
-	if sErr != nil {
-		// If fails try a second time
-		time.Sleep(10 * time.Second)
-		log.Debug("re-running drweb-ctl scan")
-		output, sErr = utils.RunCommand(ctx, "/opt/drweb.com/bin/drweb-ctl", "scan", path)
+	// the limits of the profile only confine the scan, not starting the engine
+	limitedCtx := withEngineLimits(scanCtx, profile.limits())
+	output, sErr = runCtl(limitedCtx, args...)
+	retries := 0
+	for parent.Err() == nil && scanRetry.retry(sErr, retries) {
+		retries++
+		if engineFailed(sErr) {
+			// the daemon or scan engine died, bring it back first
+			log.WithFields(log.Fields{
+				"plugin":   name,
+				"category": category,
+			}).Warn(errors.Wrap(sErr, "scan engine failed, restarting it"))
+			session.invalidate("scan engine failed")
+			if err := restartEngine(ctx); err != nil {
+				log.WithFields(log.Fields{
+					"plugin":   name,
+					"category": category,
+				}).Error(err)
+			}
+		} else {
+			log.WithFields(log.Fields{
+				"plugin":   name,
+				"category": category,
+			}).Warn(errors.Wrap(sErr, "scan failed, retrying"))
+		}
+		if !scanRetry.wait(limitedCtx, retries) {
+			break
+		}
+		log.Debugf("re-running drweb-ctl scan (retry %d of %d)", retries, scanRetry.attempts-1)
+		output, sErr = runCtl(limitedCtx, args...)
+	}
+	if parent.Err() != nil {
+		// cancelled scans say nothing about the engine
+		return DrWEB{Results: ResultsData{Status: statusError, Error: "scan was cancelled"}}
+	}
+	if engineFailed(sErr) {
+		session.invalidate("scan engine failed")
+		breaker.failure(sErr)
+	} else {
+		breaker.success()
 	}
 
-	baseinfo, err := utils.RunCommand(ctx, "/opt/drweb.com/bin/drweb-ctl", "baseinfo")
-	assert(err)
+	info, err := baseInfo.get(ctx)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"plugin":   name,
+			"category": category,
+		}).Error(errors.Wrap(err, "failed to get engine info"))
+	}
 
-	results, err := ParseDrWEBOutput(output, baseinfo, sErr)
+	results, err := parseScanOutput(file, output, info, sErr)
+	results.Profile = profile.profileName()
+	results.Retries = retries
+	scannedAt := time.Now().UTC()
+	results.ScannedAt = &scannedAt
 
 	return DrWEB{Results: results}
 }
 
+// scanBuffer writes data to a temp file and scans it
+func scanBuffer(data []byte, prefix string, timeout int) (ResultsData, error) {
+	return scanBufferContext(context.Background(), data, prefix, timeout)
+}
+
+// scanBufferContext is scanBuffer, cancelled when parent is done
+func scanBufferContext(parent context.Context, data []byte, prefix string, timeout int) (ResultsData, error) {
+	tmpfile, err := ioutil.TempFile("", prefix)
+	if err != nil {
+		return ResultsData{}, err
+	}
+	defer os.Remove(tmpfile.Name()) // clean up
+
+	if _, err = tmpfile.Write(data); err != nil {
+		tmpfile.Close()
+		return ResultsData{}, err
+	}
+	if err = tmpfile.Close(); err != nil {
+		return ResultsData{}, err
+	}
+
+	path = tmpfile.Name()
+	return AvScanContext(parent, timeout).Results, nil
+}
+
 // ParseDrWEBOutput convert drweb output into ResultsData struct
-func ParseDrWEBOutput(drwebOut, baseInfo string, drwebErr error) (ResultsData, error) {
+func ParseDrWEBOutput(drwebOut string, info BaseInfo, drwebErr error) (ResultsData, error) {
+	return parseScanOutput(path, drwebOut, info, drwebErr)
+}
+
+// parseScanOutput converts the output of the scan of file
+func parseScanOutput(file string, drwebOut string, info BaseInfo, drwebErr error) (ResultsData, error) {
 
 	log.WithFields(log.Fields{
 		"plugin":   name,
 		"category": category,
-		"path":     path,
+		"path":     file,
 	}).Debug("Dr.WEB Output: ", drwebOut)
 
 	if drwebErr != nil {
 		if drwebErr.Error() == "exit status 119" {
-			return ResultsData{Error: "ScanEngine is not available"}, drwebErr
+			return ResultsData{Status: statusError, Error: "ScanEngine is not available"}, drwebErr
 		}
-		return ResultsData{Error: drwebErr.Error()}, drwebErr
+		return ResultsData{Status: statusError, Error: drwebErr.Error()}, drwebErr
 	}
 
 	drweb := ResultsData{
-		Infected: false,
-		Engine:   getDrWebVersion(),
-		Updated:  getUpdatedDate(),
+		Infected:    false,
+		Status:      statusClean,
+		Engine:      info.Engine,
+		Database:    info.Database,
+		UpdatedAt:   info.UpdatedAt,
+		DBTimestamp: info.DBTimestamp,
+	}
+	if legacyUpdated {
+		drweb.Updated = legacyDate(info.UpdatedAt)
 	}
 
-	for _, line := range strings.Split(drwebOut, "\n") {
-		if len(line) != 0 {
-			if strings.Contains(line, "- Ok") {
-				break
-
-			} else {
-
-				drweb.Infected = true
-				drweb.Result = strings.TrimSpace(strings.TrimPrefix(line, " - "))
-				break
-
-			}
-
+	drweb.Status, drweb.Result = parseFileVerdict(file, drwebOut)
+	drweb.Infected = drweb.Status == statusInfected
+	if drweb.Status == statusError {
+		// the engine could not read the file, or we could not read the engine
+		drweb.Error = drweb.Result
+	}
+	if drweb.Infected {
+		drweb.Heuristic, drweb.Confidence = classifyDetection(drweb.Result)
+		if families := currentFamilies(); families != nil {
+			drweb.Family = families.normalize(drweb.Result)
+		}
+		if currentAttackMap() != nil {
+			drweb.Attack = attackTechniques(drweb.Result, drweb.Family)
 		}
 	}
 
-	log.WithFields(log.Fields{
-		"plugin":   name,
-		"category": category,
-		"path":     path,
-	}).Debug("Dr.WEB Base Info: ", baseInfo)
+	return drweb, nil
+}
 
-	for _, line := range strings.Split(baseInfo, "\n") {
+// parseOutputVerdict returns the scan status and result of the output of
+// drweb-ctl scan for a single file, in the --engine-output format. Output
+// without a verdict is an error rather than clean.
+func parseOutputVerdict(drwebOut string) (string, string) {
+	return parseFileVerdict(path, drwebOut)
+}
+
+// parseFileVerdict is parseOutputVerdict of the scan of file
+func parseFileVerdict(file string, drwebOut string) (string, string) {
+	if engineOutput == engineOutputJSON {
+		return parseJSONVerdict(drwebOut)
+	}
+	for _, line := range strings.Split(drwebOut, "\n") {
 		if len(line) != 0 {
-			if strings.Contains(line, "Core engine:") {
-				drweb.Engine = strings.TrimSpace(strings.TrimPrefix(line, "Core engine:"))
-			}
-			if strings.Contains(line, "Virus base records:") {
-				drweb.Database = strings.TrimSpace(strings.TrimPrefix(line, "Virus base records:"))
-			}
+			return parseVerdict(file, line)
 		}
 	}
-
-	return drweb, nil
+	return statusError, "empty engine output"
 }
 
-func getDrWebVersion() string {
+// parseVerdict returns the scan status and result of a drweb-ctl scan output
+// line formatted as "<file> - <verdict>"
+func parseVerdict(file string, line string) (string, string) {
+	verdict := strings.TrimSpace(line)
+	if strings.HasPrefix(verdict, file+" - ") {
+		verdict = strings.TrimPrefix(verdict, file+" - ")
+	} else if i := strings.LastIndex(verdict, " - "); i >= 0 {
+		verdict = verdict[i+3:]
+	}
+	verdict = strings.TrimSpace(verdict)
 
-	versionOut, err := utils.RunCommand(nil, "/opt/drweb.com/bin/drweb-ctl", "--version")
-	assert(err)
+	// detection names may contain any of the words the engine describes the
+	// files it could not scan with, e.g. Trojan.PWS.PasswordStealer
+	if strings.HasPrefix(verdict, "infected with ") {
+		return statusInfected, strings.TrimPrefix(verdict, "infected with ")
+	}
 
-	log.Debug("DrWEB Version: ", versionOut)
-	return strings.TrimSpace(strings.TrimPrefix(versionOut, "drweb-ctl "))
-}
+	lower := strings.ToLower(verdict)
+	switch {
+	case verdict == "Ok":
+		return statusClean, ""
+	case strings.Contains(lower, "level limit"), strings.Contains(lower, "nesting"):
+		return statusArchiveTooDeep, verdict
+	case strings.Contains(lower, "compression"), strings.Contains(lower, "ratio limit"):
+		return statusDecompressionBomb, verdict
+	case strings.Contains(lower, "too large"), strings.Contains(lower, "size limit"):
+		return statusFileTooLarge, verdict
+	case strings.Contains(lower, "skipped"), strings.Contains(lower, "not scanned"), strings.Contains(lower, "password"):
+		return statusSkipped, verdict
+	case strings.Contains(lower, "access denied"), strings.Contains(lower, "permission denied"), strings.Contains(lower, "read error"):
+		return statusError, verdict
+	case localized(verdict):
+		// neither clean nor a detection name, see --engine-locale
+		return statusError, "unrecognized engine output: " + verdict
+	}
 
-func parseUpdatedDate(date string) string {
-	layout := "Mon, 02 Jan 2006 15:04:05 +0000"
-	t, _ := time.Parse(layout, date)
-	return fmt.Sprintf("%d%02d%02d", t.Year(), t.Month(), t.Day())
+	return statusInfected, verdict
 }
 
-func getUpdatedDate() string {
-	if _, err := os.Stat("/opt/malice/UPDATED"); os.IsNotExist(err) {
-		return BuildTime
+// classifyDetection tells signature detections apart from heuristic ones
+// (heuristic analyzer, Origins Tracing and "probably" verdicts) and returns a
+// coarse confidence of the detection
+func classifyDetection(result string) (bool, string) {
+	lower := strings.ToLower(result)
+	switch {
+	case strings.HasPrefix(lower, "probably"), strings.Contains(lower, "suspicious"),
+		strings.HasPrefix(lower, "dph:"), strings.Contains(lower, "heur"):
+		return true, confidenceLow
+	case strings.HasSuffix(lower, ".origin"):
+		return true, confidenceMedium
+	case strings.Contains(lower, "modification of"):
+		return false, confidenceMedium
 	}
-	updated, err := ioutil.ReadFile("/opt/malice/UPDATED")
-	assert(err)
-	return string(updated)
-}
-
-func updateAV(ctx context.Context) error {
-	// drweb needs to have the daemon started first
-	configd := exec.Command("/opt/drweb.com/bin/drweb-configd", "-d")
-	_, err := configd.Output()
-	assert(err)
-	defer configd.Process.Kill()
-
-	fmt.Println("Updating Dr.WEB...")
-	fmt.Println(utils.RunCommand(ctx, "/opt/drweb.com/bin/drweb-ctl", "update"))
-	// Update UPDATED file
-	t := time.Now().Format("20060102")
-	err = ioutil.WriteFile("/opt/malice/UPDATED", []byte(t), 0644)
-	return err
+	return false, confidenceHigh
 }
 
 func updateLicense(ctx context.Context) error {
 	// drweb needs to have the daemon started first
-	configd := exec.CommandContext(ctx, "/opt/drweb.com/bin/drweb-configd", "-d")
-	_, err := configd.Output()
-	if err != nil {
+	if err := startConfigd(ctx); err != nil {
 		return err
 	}
-	defer configd.Process.Kill()
 	time.Sleep(1 * time.Second)
 
 	// check for exec context timeout
@@ -232,74 +388,332 @@ func updateLicense(ctx context.Context) error {
 
 	log.Debug("updating Dr.WEB license")
 	if len(LicenseKey) > 0 {
-		log.Debugln(utils.RunCommand(ctx, "/opt/drweb.com/bin/drweb-ctl", "license", "--GetRegistered", LicenseKey))
+		log.Debugln(runCtl(ctx, "license", "--GetRegistered", LicenseKey))
 	} else {
-		log.Debugln(utils.RunCommand(ctx, "/opt/drweb.com/bin/drweb-ctl", "license", "--GetDemo"))
+		log.Debugln(runCtl(ctx, "license", "--GetDemo"))
 	}
 
 	return nil
 }
 
 func didLicenseExpire(ctx context.Context) (bool, error) {
+	if !ctlEngine {
+		// the Dr.Web service renews its license itself
+		return false, nil
+	}
+
 	// drweb needs to have the daemon started first
-	configd := exec.CommandContext(ctx, "/opt/drweb.com/bin/drweb-configd", "-d")
-	_, err := configd.Output()
-	if err != nil {
+	if err := startConfigd(ctx); err != nil {
 		return false, err
 	}
-	defer configd.Process.Kill()
 	time.Sleep(1 * time.Second)
 
 	log.Debug("checking Dr.WEB license")
-	license := exec.CommandContext(ctx, "/opt/drweb.com/bin/drweb-ctl", "license")
-	lOut, err := license.Output()
+	lOut, err := runCtl(ctx, "license")
 	if err != nil {
 		return false, err
 	}
 
-	if strings.Contains(string(lOut), "No license") {
+	if strings.Contains(lOut, "No license") {
 		log.Debug("no licence found or licence has been invalidated")
 		return true, nil
 	}
 
-	if strings.Contains(string(lOut), "expires") {
+	if strings.Contains(lOut, "expires") {
 		return false, nil
 	}
 
-	log.WithFields(log.Fields{"output": string(lOut)}).Debug("licence expired")
+	log.WithFields(log.Fields{"output": lOut}).Debug("licence expired")
 	return true, nil
 }
 
-func generateMarkDownTable(a DrWEB) string {
-	var tplOut bytes.Buffer
-
-	t := template.Must(template.New("drweb").Parse(tpl))
+func printStatus(resp gorequest.Response, body string, errs []error) {
+	fmt.Println(body)
+}
 
-	err := t.Execute(&tplOut, a)
+func webService(c *cli.Context) {
+	useEngineHelper()
+	if len(c.String("privsep-user")) > 0 && helper == nil {
+		if err := superviseWeb(c, c.String("privsep-user")); err != nil {
+			log.WithFields(log.Fields{
+				"plugin":   name,
+				"category": category,
+			}).Fatal(err)
+		}
+		return
+	}
+	idempotency.window = c.Duration("idempotency-window")
+	jobs.retention = c.Duration("job-retention")
+	if len(c.String("job-dir")) > 0 {
+		assert(os.MkdirAll(c.String("job-dir"), 0700))
+		hostname, _ := os.Hostname()
+		jobs.dir = c.String("job-dir")
+		jobs.instance = fmt.Sprintf("%s:%d", hostname, os.Getpid())
+	}
+	if len(c.String("standby-of")) > 0 {
+		if len(jobs.dir) == 0 {
+			log.WithFields(log.Fields{
+				"plugin":   name,
+				"category": category,
+			}).Fatal("--standby-of requires a --job-dir shared with the active instance")
+		}
+		pair.watch(c.String("standby-of"), c.Duration("standby-interval"), c.Int("standby-threshold"))
+	}
+	audit.configured(c)
+	engineState.watch(c.Duration("engine-probe-interval"))
+	workers := 1
+	if size := c.Int("warm-pool"); size > 0 {
+		if c.Duration("warm-interval") <= 0 {
+			log.WithFields(log.Fields{
+				"plugin":   name,
+				"category": category,
+			}).Fatal("--warm-interval must be positive")
+		}
+		// as many jobs run at once as the pool has slots
+		pool, workers = newWarmPool(size, c.Duration("warm-interval")), size
+		go pool.keepWarm()
+	}
+	for i := 0; i < workers; i++ {
+		go jobs.work()
+	}
+	fetcher.client.Timeout = c.Duration("fetch-timeout")
+	fetcher.maxSize = c.Int64("fetch-max-size") << 20
+	maxUploadSize = c.Int64("max-upload-size") << 20
+	largeSampleSize = c.Int64("large-sample-size") << 20
+	admission.registry = newRegistryClient(c.Duration("registry-timeout"), c.String("admission-platform"), c.Int64("admission-max-layer-size")<<20)
+	if len(c.String("registry-config")) > 0 {
+		assert(admission.registry.loadDockerConfig(c.String("registry-config")))
+	}
+	admission.timeout = c.Duration("admission-timeout")
+	admission.failClosed = c.Bool("admission-fail-closed")
+	admission.scanTimeout = c.GlobalInt("timeout")
+	go admission.work()
+	breaker.threshold = c.Int("breaker-threshold")
+	breaker.cooldown = c.Duration("breaker-cooldown")
+	shedder.threshold = c.Duration("shed-latency")
+	shedder.window = c.Duration("shed-window")
+	sampleRetention = c.Duration("retain-samples")
+	behindProxy = c.Bool("behind-proxy")
+	windows, err := parseWindows(c.String("stats-windows"))
 	if err != nil {
-		log.Println("executing template:", err)
+		log.WithFields(log.Fields{
+			"plugin":   name,
+			"category": category,
+		}).Fatal(errors.Wrap(err, "invalid --stats-windows"))
+	}
+	stats.windows = windows
+	if c.Duration("timeout-advice") > 0 {
+		go latencies.advise(c.Duration("timeout-advice"))
+	}
+	if len(c.String("shadow-url")) > 0 || len(c.String("shadow-engine-dir")) > 0 {
+		shadow, err = newShadowScanner(c.String("shadow-url"), c.String("shadow-engine-dir"), c.String("shadow-token"), c.Duration("shadow-timeout"))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"plugin":   name,
+				"category": category,
+			}).Fatal(errors.Wrap(err, "invalid shadow engine"))
+		}
+	}
+	baseInfo.maxAge = c.Duration("baseinfo-max-age")
+	baseInfo.invalidateOnHangup()
+	if len(c.String("sample-archive")) > 0 {
+		if archive, err = openArchive(c.String("sample-archive"), c.String("sample-archive-endpoint"), c.String("sample-archive-lock")); err != nil {
+			log.WithFields(log.Fields{
+				"plugin":   name,
+				"category": category,
+			}).Fatal(err)
+		}
+	}
+	if sampleRetention > 0 && store == nil && archive == nil {
+		log.WithFields(log.Fields{
+			"plugin":   name,
+			"category": category,
+		}).Fatal("--retain-samples requires --store or --sample-archive")
+	}
+	if retainInfectedMembers = c.Bool("retain-infected-members"); retainInfectedMembers && sampleRetention <= 0 {
+		log.WithFields(log.Fields{
+			"plugin":   name,
+			"category": category,
+		}).Fatal("--retain-infected-members requires --retain-samples")
+	}
+	if archive != nil && sampleRetention <= 0 {
+		log.WithFields(log.Fields{
+			"plugin":   name,
+			"category": category,
+		}).Fatal("--sample-archive requires --retain-samples")
 	}
 
-	return tplOut.String()
-}
+	j := &janitor{tempMaxAge: c.Duration("temp-max-age"), retention: sampleRetention}
+	j.start(c.Duration("janitor-interval"))
 
-func printStatus(resp gorequest.Response, body string, errs []error) {
-	fmt.Println(body)
-}
+	adminToken = c.String("admin-token")
+	if len(c.String("api-keys")) > 0 {
+		assert(apiKeys.load(c.String("api-keys")))
+	}
+	if len(c.String("tenants")) > 0 {
+		assert(tenants.load(c.String("tenants")))
+	}
+	if len(c.String("tickets")) > 0 {
+		assert(tickets.load(c.String("tickets")))
+	}
+	if len(c.String("request-signing-keys")) > 0 {
+		assert(signing.load(c.String("request-signing-keys")))
+		signing.skew = c.Duration("request-signing-skew")
+	}
+	if len(c.String("statsd")) > 0 {
+		metrics, err = newStatsdEmitter(c.String("statsd"), c.String("statsd-prefix"), c.String("statsd-format"), c.String("statsd-tags"), c.StringSlice("statsd-tag"))
+		assert(err)
+	}
+	if len(c.String("oidc-issuer")) > 0 {
+		oidc, err = newOIDCVerifier(
+			c.String("oidc-issuer"),
+			c.String("oidc-audience"),
+			c.String("oidc-jwks-url"),
+			c.String("oidc-scan-scope"),
+			c.String("oidc-admin-scope"),
+		)
+		assert(err)
+	}
 
-func webService() {
 	router := mux.NewRouter().StrictSlash(true)
-	router.HandleFunc("/scan", webAvScan).Methods("POST")
+	router.HandleFunc("/healthz", webHealth).Methods("GET")
+	router.HandleFunc("/readyz", webReady(webCapabilities(c.GlobalBool("explode"), len(c.String("tls-cert")) > 0))).Methods("GET")
+	router.HandleFunc("/openapi.json", webOpenAPI).Methods("GET")
+	router.HandleFunc("/schema/results.json", webSchema).Methods("GET")
+	router.Handle("/scan", drainable(requireVerdict(requireSigned(webAvScan)))).Methods("POST")
+	router.Handle("/scan/{jobID}", requireVerdict(webJob)).Methods("GET")
+	router.Handle("/scan/{jobID}", requireVerdict(webCancelJob)).Methods("DELETE")
+	router.Handle("/malice/scan", drainable(requireVerdict(requireSigned(webMaliceScan)))).Methods("POST")
+	router.Handle("/admission", drainable(requireScan(webAdmission))).Methods("POST")
+	router.Handle("/results", requireVerdict(webResults)).Methods("GET")
+	router.Handle("/results/{sha256}", requireVerdict(webResult)).Methods("GET")
+	router.Handle("/results/{sha256}/history", requireScan(webResultHistory)).Methods("GET")
+	router.Handle("/version", requireScan(webVersion)).Methods("GET")
+	router.Handle("/baseinfo", requireScan(webBaseInfo)).Methods("GET")
+	adminRoutes(router, func() error {
+		if c.GlobalBool("family") {
+			initFamilies(c.GlobalString("family-aliases"))
+		}
+		if len(c.GlobalString("scan-policies")) > 0 {
+			if err := loadScanPolicies(c.GlobalString("scan-policies")); err != nil {
+				return err
+			}
+		}
+		if len(c.GlobalString("scan-profiles")) > 0 {
+			if err := loadScanProfiles(c.GlobalString("scan-profiles")); err != nil {
+				return err
+			}
+		}
+		profile, err := lookupProfile(c.GlobalString("profile"))
+		if err != nil {
+			return err
+		}
+		setDefaultProfile(profile)
+		if len(c.GlobalString("suppressions")) > 0 {
+			if err := loadSuppressions(c.GlobalString("suppressions")); err != nil {
+				return err
+			}
+		}
+		if len(c.GlobalString("attack-map")) > 0 {
+			return loadAttackMap(c.GlobalString("attack-map"))
+		}
+		return nil
+	})
+
+	listener, err := sdListener()
+	assert(err)
+	if listener == nil {
+		listener, err = net.Listen("tcp", ":3993")
+		assert(err)
+	}
 	log.WithFields(log.Fields{
 		"plugin":   name,
 		"category": category,
-	}).Info("web service listening on port :3993")
-	log.Fatal(http.ListenAndServe(":3993", router))
+	}).Info("web service listening on ", listener.Addr())
+
+	if len(c.String("socket")) > 0 {
+		mode, err := strconv.ParseUint(c.String("socket-mode"), 8, 32)
+		if err == nil {
+			err = serveSocket(c.String("socket"), os.FileMode(mode))
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"plugin":   name,
+				"category": category,
+			}).Fatal(errors.Wrap(err, "invalid --socket"))
+		}
+	}
+	if len(c.String("coordinator")) > 0 {
+		tls := len(c.String("tls-cert")) > 0
+		coordinator, err := newCoordinatorClient(c.String("coordinator"), c.String("coordinator-token"), c.String("advertise-url"),
+			listener.Addr(), tls, c.Duration("heartbeat-interval"), webCapabilities(c.GlobalBool("explode"), tls))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"plugin":   name,
+				"category": category,
+			}).Fatal(err)
+		}
+		go coordinator.run()
+	}
+
+	if err := sdNotify("READY=1"); err != nil {
+		log.WithFields(log.Fields{
+			"plugin":   name,
+			"category": category,
+		}).Error(err)
+	}
+	sdWatchdog(breaker.healthy)
+
+	if len(c.String("tls-cert")) > 0 {
+		log.Fatal(http.ServeTLS(listener, router, c.String("tls-cert"), c.String("tls-key")))
+	}
+	log.Fatal(http.Serve(listener, router))
 }
 
 func webAvScan(w http.ResponseWriter, r *http.Request) {
+	started := time.Now()
+
+	if pair.role() == roleStandby {
+		w.Header().Set("Retry-After", strconv.Itoa(int(pair.interval.Seconds())+1))
+		http.Error(w, "this is the standby instance, send scans to the active one", http.StatusServiceUnavailable)
+		return
+	}
+	if refuseUnavailable(w) {
+		return
+	}
+	if ok, wait := breaker.allow(); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		http.Error(w, "scan engine is unavailable, try again later", http.StatusServiceUnavailable)
+		return
+	}
+
+	// everything that can be decided from the headers is, before the body
+	// is read and the client that sent Expect: 100-continue uploads it
+	body, ok := limitUpload(w, r)
+	if !ok {
+		return
+	}
+	if len(r.Header.Get(priorityHeader)) > 0 {
+		priority, err := requestPriority(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if ok, wait := shedder.allow(priority); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			http.Error(w, "scan engine is overloaded, try again later or with a higher priority", http.StatusServiceUnavailable)
+			return
+		}
+	}
 
 	r.ParseMultipartForm(32 << 20)
+	if body.tooLarge {
+		uploadTooLarge(w)
+		return
+	}
+	if !signatureVerified(w, r) {
+		return
+	}
 	file, header, err := r.FormFile("malware")
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -308,31 +722,120 @@ func webAvScan(w http.ResponseWriter, r *http.Request) {
 			"plugin":   name,
 			"category": category,
 		}).Error(err)
+		return
 	}
 	defer file.Close()
 
+	options, err := requestScanOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if options.Callback != nil && verdictOnly(r) {
+		// the callback gets the full results
+		http.Error(w, "API key is not allowed to choose the callback", http.StatusForbidden)
+		return
+	}
+	fields, ok := requestFields(w, r)
+	if !ok {
+		return
+	}
+	if ok, wait := shedder.allow(options.Priority); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		http.Error(w, "scan engine is overloaded, try again later or with a higher priority", http.StatusServiceUnavailable)
+		return
+	}
+
 	log.WithFields(log.Fields{
 		"plugin":   name,
 		"category": category,
 	}).Debug("Uploaded fileName: ", header.Filename)
 
-	tmpfile, err := ioutil.TempFile("/malware", "web_")
-	assert(err)
-	defer os.Remove(tmpfile.Name()) // clean up
-
 	data, err := ioutil.ReadAll(file)
 	assert(err)
+	sha := fmt.Sprintf("%x", sha256.Sum256(data))
 
-	if _, err = tmpfile.Write(data); err != nil {
-		assert(err)
+	if rejectUpload(w, uploadSample(data, header.Filename, requestSubmitter(r))) {
+		return
 	}
-	if err = tmpfile.Close(); err != nil {
-		assert(err)
+	if overQuota(w, r) {
+		return
 	}
 
-	// Do AV scan
-	path = tmpfile.Name()
-	drweb := AvScan(60)
+	// a retried request gets the original response instead of a new scan,
+	// an API key never gets the response of another key's scan
+	if key := r.Header.Get(idempotencyHeader); len(key) > 0 {
+		if verdictOnly(r) {
+			key = roleVerdict + ":" + key
+		}
+		if id := requestKeyID(r); len(id) > 0 {
+			key = id + ":" + key
+		}
+		if tenant := requestTenant(r); len(tenant) > 0 {
+			key = tenant + "/" + key
+		}
+		entry, first := idempotency.begin(key, sha)
+		if !first {
+			entry.replay(w, sha)
+			return
+		}
+		w = &recordingResponseWriter{ResponseWriter: w}
+		defer func() {
+			idempotency.finish(entry, w.(*recordingResponseWriter))
+		}()
+	}
+
+	if options.Callback != nil && len(options.Callback.ScanID) == 0 {
+		options.Callback.ScanID = sha
+	}
+	upload, err := newUploadScan(data, header.Filename, requestSubmitter(r), started, options)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	audit.submitted(upload, "web")
+
+	if scanAsync(r, len(data)) {
+		job, err := jobs.submit(upload, requestKeyID(r))
+		if err != nil {
+			w.Header().Set("Retry-After", "60")
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Location", "/scan/"+job.ID)
+		w.Header().Set("Preference-Applied", "respond-async")
+		if verdictOnly(r) {
+			writeJSON(w, http.StatusAccepted, verdictOfJob(job))
+			return
+		}
+		writeJSON(w, http.StatusAccepted, job)
+		return
+	}
+
+	drweb, err := upload.scan(context.Background())
+	options.Callback.deliver(sha, drweb, err)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"plugin":   name,
+			"category": category,
+		}).Error(err)
+		if verdictOnly(r) {
+			http.Error(w, "scan failed", http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if len(fields) > 0 {
+		writeJSON(w, http.StatusOK, requestSelection(r, sha, drweb.Results, fields))
+		return
+	}
+	if verdictOnly(r) {
+		// the store and callbacks still get the full results
+		writeJSON(w, http.StatusOK, newVerdict(sha, drweb.Results))
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(http.StatusOK)
@@ -351,12 +854,46 @@ func main() {
 	app.Author = "blacktop"
 	app.Email = "https://github.com/blacktop"
 	app.Version = Version + ", BuildTime: " + BuildTime
-	app.Compiled, _ = time.Parse("20060102", BuildTime)
+	app.Compiled, _ = parseTimestamp(BuildTime)
 	app.Usage = "Malice Dr.WEB AntiVirus Plugin"
 	app.Flags = []cli.Flag{
 		cli.BoolFlag{
 			Name:  "verbose, V",
-			Usage: "verbose output",
+			Usage: "verbose output (same as --log-level debug)",
+		},
+		cli.StringFlag{
+			Name:   "log-level",
+			Value:  "info",
+			Usage:  "log level (trace, debug, info, warn, error, fatal or panic)",
+			EnvVar: "MALICE_LOG_LEVEL",
+		},
+		cli.StringFlag{
+			Name:   "log-format",
+			Value:  "text",
+			Usage:  "log format (text or json)",
+			EnvVar: "MALICE_LOG_FORMAT",
+		},
+		cli.StringFlag{
+			Name:   "log-file",
+			Usage:  "write logs to this file instead of stderr",
+			EnvVar: "MALICE_LOG_FILE",
+		},
+		cli.Int64Flag{
+			Name:   "log-max-size",
+			Value:  100,
+			Usage:  "rotate the log file once it is larger than this (in MB, 0 to disable)",
+			EnvVar: "MALICE_LOG_MAX_SIZE",
+		},
+		cli.DurationFlag{
+			Name:   "log-max-age",
+			Usage:  "rotate the log file once it has been written to for this long (0 to disable)",
+			EnvVar: "MALICE_LOG_MAX_AGE",
+		},
+		cli.IntFlag{
+			Name:   "log-max-backups",
+			Value:  5,
+			Usage:  "number of rotated log files to keep (0 to keep all)",
+			EnvVar: "MALICE_LOG_MAX_BACKUPS",
 		},
 		cli.StringFlag{
 			Name:        "elasticsearch",
@@ -365,26 +902,546 @@ func main() {
 			EnvVar:      "MALICE_ELASTICSEARCH_URL",
 			Destination: &es.URL,
 		},
+		cli.StringFlag{
+			Name:   "elasticsearch-dedup",
+			Value:  dedupOverwrite,
+			Usage:  "what to do when a sample is indexed again: overwrite, version or skip",
+			EnvVar: "MALICE_ELASTICSEARCH_DEDUP",
+		},
 		cli.BoolFlag{
 			Name:  "table, t",
 			Usage: "output as Markdown table",
 		},
 		cli.BoolFlag{
-			Name:   "callback, c",
-			Usage:  "POST results back to Malice webhook",
-			EnvVar: "MALICE_ENDPOINT",
+			Name:   "legacy-updated",
+			EnvVar: "MALICE_LEGACY_UPDATED",
+			Usage:  "also put when the virus definitions were updated into the old yyyymmdd updated field of results",
 		},
-		cli.BoolFlag{
+		cli.StringFlag{
+			Name:   "report",
+			EnvVar: "MALICE_REPORT",
+			Usage:  "output a styled incident report instead, html or pdf",
+		},
+		cli.StringFlag{
+			Name:   "table-columns",
+			Value:  defaultTableColumns,
+			EnvVar: "MALICE_TABLE_COLUMNS",
+			Usage:  "comma separated columns of the Markdown table: infected, status, result, detections, family, engine, database, updated, sha256, duration, action, profile",
+		},
+		cli.StringFlag{
+			Name:   "fields",
+			EnvVar: "MALICE_FIELDS",
+			Usage:  "comma separated fields of the results to output, e.g. infected,result,sha256 (all if empty)",
+		},
+		cli.BoolFlag{
+			Name:   "callback, c",
+			Usage:  "POST results back to Malice webhook",
+			EnvVar: "MALICE_ENDPOINT",
+		},
+		cli.BoolFlag{
 			Name:   "proxy, x",
 			Usage:  "proxy settings for Malice webhook endpoint",
 			EnvVar: "MALICE_PROXY",
 		},
+		cli.StringSliceFlag{
+			Name:   "fetch-allow-host",
+			Usage:  "only fetch Malice scan request samples from and post their results to these hosts (globs like *.example.com), any host if none",
+			EnvVar: "MALICE_FETCH_ALLOW_HOSTS",
+		},
+		cli.BoolFlag{
+			Name:   "fetch-allow-private",
+			Usage:  "let Malice scan requests reach loopback, link-local and private addresses of hosts not allowed by --fetch-allow-host",
+			EnvVar: "MALICE_FETCH_ALLOW_PRIVATE",
+		},
 		cli.IntFlag{
 			Name:   "timeout",
 			Value:  120,
 			Usage:  "malice plugin timeout (in seconds)",
 			EnvVar: "MALICE_TIMEOUT",
 		},
+		cli.BoolFlag{
+			Name:   "explode",
+			Usage:  "unpack archives and scan each member",
+			EnvVar: "MALICE_EXPLODE",
+		},
+		cli.StringFlag{
+			Name:   "scan-action",
+			Usage:  "what the engine does with infected samples: report or cure (the profile's setting if empty)",
+			EnvVar: "MALICE_SCAN_ACTION",
+		},
+		cli.IntFlag{
+			Name:  "max-depth",
+			Value: 5,
+			Usage: "maximum archive nesting depth to unpack",
+		},
+		cli.Int64Flag{
+			Name:  "max-member-size",
+			Value: 100,
+			Usage: "maximum size of an unpacked archive member (in MB)",
+		},
+		cli.Float64Flag{
+			Name:  "max-ratio",
+			Value: 100,
+			Usage: "maximum compression ratio of an archive member",
+		},
+		cli.Int64Flag{
+			Name:  "max-total-size",
+			Value: 1024,
+			Usage: "maximum total size of the members unpacked from an archive (in MB)",
+		},
+		cli.StringFlag{
+			Name:   "extractor",
+			Value:  defaultExtractor,
+			Usage:  "command used to unpack 7z and rar archives",
+			EnvVar: "MALICE_EXTRACTOR",
+		},
+		cli.BoolFlag{
+			Name:   "family",
+			Usage:  "normalize detection names into malware family names",
+			EnvVar: "MALICE_FAMILY",
+		},
+		cli.StringFlag{
+			Name:   "family-aliases",
+			Usage:  "url of a family alias table to merge over the built-in one",
+			EnvVar: "MALICE_FAMILY_ALIASES",
+		},
+		cli.StringFlag{
+			Name:   "attack-map",
+			Usage:  "file mapping detections to MITRE ATT&CK techniques",
+			EnvVar: "MALICE_ATTACK_MAP",
+		},
+		cli.StringFlag{
+			Name:   "scan-policies",
+			Usage:  "file of per content type scan policies (skip, explode or flag samples)",
+			EnvVar: "MALICE_SCAN_POLICIES",
+		},
+		cli.StringFlag{
+			Name:   "suppressions",
+			Usage:  "file of false positives to report as suppressed rather than infected: detections with a hash or path, expiry and justification",
+			EnvVar: "MALICE_SUPPRESSIONS",
+		},
+		cli.StringFlag{
+			Name:   "profile",
+			Usage:  "scan profile to scan with, e.g. fast or deep",
+			EnvVar: "MALICE_PROFILE",
+		},
+		cli.StringFlag{
+			Name:   "scan-profiles",
+			Usage:  "file of named scan profiles to merge over the built-in fast and deep ones",
+			EnvVar: "MALICE_SCAN_PROFILES",
+		},
+		cli.StringSliceFlag{
+			Name:  "meta",
+			Usage: "metadata (key=value) to attach to the scan results",
+		},
+		cli.StringFlag{
+			Name:  "tags",
+			Usage: "comma separated tags to attach to the scan results",
+		},
+		cli.StringFlag{
+			Name:        "engine-alert",
+			Usage:       "url to POST scan engine restart and circuit breaker events to",
+			EnvVar:      "MALICE_ENGINE_ALERT",
+			Destination: &engineAlertURL,
+		},
+		cli.StringFlag{
+			Name:   "callback-recipient",
+			Usage:  "PEM encoded X25519 public key (or file) to encrypt callback results to",
+			EnvVar: "MALICE_CALLBACK_RECIPIENT",
+		},
+		cli.StringSliceFlag{
+			Name:   "callback-template",
+			Usage:  "Go template file to render the results POSTed to callback urls starting with URL as URL=FILE (repeatable)",
+			EnvVar: "MALICE_CALLBACK_TEMPLATES",
+		},
+		cli.StringFlag{
+			Name:   "sign-key",
+			Usage:  "PEM encoded Ed25519 private key to sign results with",
+			EnvVar: "MALICE_SIGN_KEY",
+		},
+		cli.StringFlag{
+			Name:   "sign-key-id",
+			Usage:  "key id to put in result signatures",
+			EnvVar: "MALICE_SIGN_KEY_ID",
+		},
+		cli.StringFlag{
+			Name:   "audit-log",
+			Usage:  "file to append a hash chained audit trail of submissions, verdicts, admin actions and configuration changes to",
+			EnvVar: "MALICE_AUDIT_LOG",
+		},
+		cli.StringFlag{
+			Name:   "audit-syslog",
+			Usage:  "syslog collector to ship the audit trail to, tls://, tcp:// or udp://host:port",
+			EnvVar: "MALICE_AUDIT_SYSLOG",
+		},
+		cli.StringFlag{
+			Name:   "audit-syslog-ca",
+			Usage:  "PEM file of the certificate authorities of a tls:// --audit-syslog collector (default: the system ones)",
+			EnvVar: "MALICE_AUDIT_SYSLOG_CA",
+		},
+		cli.StringFlag{
+			Name:   "store",
+			Usage:  "directory to keep a local history of scan results in",
+			EnvVar: "MALICE_STORE",
+		},
+		cli.StringFlag{
+			Name:   "engine-dir",
+			Value:  defaultEngineDir,
+			Usage:  "directory the Dr.Web binaries are installed in",
+			EnvVar: "MALICE_ENGINE_DIR",
+		},
+		cli.StringFlag{
+			Name:   "engine-locale",
+			Value:  engineLocale,
+			Usage:  "locale to run engine commands in so they report in English, empty to keep the environment's",
+			EnvVar: "MALICE_ENGINE_LOCALE",
+		},
+		cli.StringFlag{
+			Name:   "engine-output",
+			Value:  engineOutputText,
+			Usage:  "format drweb-ctl scan reports verdicts in: text, or json for its locale independent JSON report",
+			EnvVar: "MALICE_ENGINE_OUTPUT",
+		},
+		cli.StringFlag{
+			Name:   "engine-workdir",
+			Usage:  "working directory of engine commands, only we may get into it (default: a private one in the temp dir)",
+			EnvVar: "MALICE_ENGINE_WORKDIR",
+		},
+		cli.DurationFlag{
+			Name:   "engine-session-ttl",
+			Value:  session.ttl,
+			Usage:  "how long scans trust the license and daemon checked by an earlier scan (0 to check before every scan)",
+			EnvVar: "MALICE_ENGINE_SESSION_TTL",
+		},
+		cli.StringSliceFlag{
+			Name:   "engine-option",
+			Usage:  "engine setting to apply on startup as Section.Parameter=Value (repeatable)",
+			EnvVar: "MALICE_ENGINE_OPTIONS",
+		},
+		cli.BoolFlag{
+			Name:   "engine-seccomp",
+			Usage:  "make syscalls the engine never needs (mount, ptrace, bpf, loading modules, ...) fail in engine commands (Linux only)",
+			EnvVar: "MALICE_ENGINE_SECCOMP",
+		},
+		cli.BoolFlag{
+			Name:   "engine-landlock",
+			Usage:  "only let engine commands write below Dr.Web's own, the run and the temp directories (Linux only)",
+			EnvVar: "MALICE_ENGINE_LANDLOCK",
+		},
+		cli.StringSliceFlag{
+			Name:   "engine-writable",
+			Usage:  "another directory engine commands may write below with --engine-landlock (repeatable)",
+			EnvVar: "MALICE_ENGINE_WRITABLE",
+		},
+		cli.StringFlag{
+			Name:   "engine-cgroup",
+			Usage:  "cgroup v2 directory delegated to us, each engine command with scan profile limits runs in a cgroup below it (Linux only)",
+			EnvVar: "MALICE_ENGINE_CGROUP",
+		},
+		cli.StringFlag{
+			Name:   "vault-addr",
+			Usage:  "HashiCorp Vault server to read the --vault-secret secrets from at startup",
+			EnvVar: "MALICE_VAULT_ADDR,VAULT_ADDR",
+		},
+		cli.StringFlag{
+			Name:   "vault-auth",
+			Value:  vaultAuthToken,
+			Usage:  "how to log in to Vault: token, approle or kubernetes",
+			EnvVar: "MALICE_VAULT_AUTH",
+		},
+		cli.StringFlag{
+			Name:   "vault-auth-mount",
+			Usage:  "path the Vault auth method is mounted at (default: approle or kubernetes)",
+			EnvVar: "MALICE_VAULT_AUTH_MOUNT",
+		},
+		cli.StringFlag{
+			Name:   "vault-token",
+			Usage:  "Vault token for --vault-auth token",
+			EnvVar: "MALICE_VAULT_TOKEN,VAULT_TOKEN",
+		},
+		cli.StringFlag{
+			Name:   "vault-role-id",
+			Usage:  "AppRole role id for --vault-auth approle",
+			EnvVar: "MALICE_VAULT_ROLE_ID",
+		},
+		cli.StringFlag{
+			Name:   "vault-secret-id",
+			Usage:  "AppRole secret id for --vault-auth approle",
+			EnvVar: "MALICE_VAULT_SECRET_ID",
+		},
+		cli.StringFlag{
+			Name:   "vault-role",
+			Usage:  "Vault role to log in as with --vault-auth kubernetes",
+			EnvVar: "MALICE_VAULT_ROLE",
+		},
+		cli.StringSliceFlag{
+			Name:   "vault-secret",
+			Usage:  "environment variable to set to a Vault secret as ENV=PATH#FIELD, e.g. MALICE_ADMIN_TOKEN=secret/data/drweb#admin_token (repeatable)",
+			EnvVar: "MALICE_VAULT_SECRETS",
+		},
+		cli.BoolFlag{
+			Name:   "vault-renew",
+			Usage:  "keep renewing the Vault token and leased secrets",
+			EnvVar: "MALICE_VAULT_RENEW",
+		},
+		cli.IntFlag{
+			Name:   "scan-attempts",
+			Value:  scanRetry.attempts,
+			Usage:  "how often to run a scan that failed with an engine failure or a --scan-retry-on exit code (1 never retries)",
+			EnvVar: "MALICE_SCAN_ATTEMPTS",
+		},
+		cli.DurationFlag{
+			Name:   "scan-retry-backoff",
+			Usage:  "how long to wait before retrying a failed scan, doubled for every further retry",
+			EnvVar: "MALICE_SCAN_RETRY_BACKOFF",
+		},
+		cli.StringSliceFlag{
+			Name:   "scan-retry-on",
+			Usage:  "drweb-ctl scan exit code to retry besides engine failures (repeatable)",
+			EnvVar: "MALICE_SCAN_RETRY_ON",
+		},
+		cli.StringFlag{
+			Name:   "cloud-url",
+			Usage:  "hash reputation service to ask before scanning, {sha256} is replaced by the sample hash",
+			EnvVar: "MALICE_CLOUD_URL",
+		},
+		cli.StringFlag{
+			Name:   "cloud-key",
+			Usage:  "bearer token for the hash reputation service",
+			EnvVar: "MALICE_CLOUD_KEY",
+		},
+		cli.StringFlag{
+			Name:   "cloud-confidence",
+			Value:  confidenceHigh,
+			Usage:  "minimum confidence of a hash reputation detection to skip the local scan (low, medium or high)",
+			EnvVar: "MALICE_CLOUD_CONFIDENCE",
+		},
+		cli.DurationFlag{
+			Name:   "cloud-timeout",
+			Value:  5 * time.Second,
+			Usage:  "how long to wait for the hash reputation service before scanning locally",
+			EnvVar: "MALICE_CLOUD_TIMEOUT",
+		},
+		cli.BoolFlag{
+			Name:   "privacy",
+			Usage:  "never send sample hashes to the hash reputation service or Dr.Web Cloud",
+			EnvVar: "MALICE_PRIVACY",
+		},
+		cli.StringSliceFlag{
+			Name:   "peer",
+			Usage:  "url of a sibling Malice AV plugin web service to also scan samples with (repeatable)",
+			EnvVar: "MALICE_PEERS",
+		},
+		cli.StringFlag{
+			Name:   "peer-token",
+			Usage:  "bearer token for the peer web services",
+			EnvVar: "MALICE_PEER_TOKEN",
+		},
+		cli.DurationFlag{
+			Name:   "peer-timeout",
+			Value:  2 * time.Minute,
+			Usage:  "how long to wait for a peer verdict",
+			EnvVar: "MALICE_PEER_TIMEOUT",
+		},
+		cli.StringSliceFlag{
+			Name:   "intel-url",
+			Usage:  "threat intel platform to look detections up in, {sha256}, {result} and {family} are filled in (repeatable)",
+			EnvVar: "MALICE_INTEL_URLS",
+		},
+		cli.StringFlag{
+			Name:   "misp-url",
+			Usage:  "MISP instance to search for the hashes of detected samples",
+			EnvVar: "MALICE_MISP_URL",
+		},
+		cli.StringFlag{
+			Name:   "misp-key",
+			Usage:  "MISP automation key",
+			EnvVar: "MALICE_MISP_KEY",
+		},
+		cli.DurationFlag{
+			Name:   "intel-timeout",
+			Value:  10 * time.Second,
+			Usage:  "how long to wait for a threat intel lookup",
+			EnvVar: "MALICE_INTEL_TIMEOUT",
+		},
+		cli.IntFlag{
+			Name:   "watchdog-factor",
+			Value:  3,
+			Usage:  "kill engine commands still running this many times their timeout, with a goroutine and process dump (0 to disable)",
+			EnvVar: "MALICE_WATCHDOG_FACTOR",
+		},
+		cli.DurationFlag{
+			Name:   "watchdog-interval",
+			Value:  10 * time.Second,
+			Usage:  "how often the watchdog checks the running engine commands",
+			EnvVar: "MALICE_WATCHDOG_INTERVAL",
+		},
+		cli.StringFlag{
+			Name:   "watchdog-dir",
+			Usage:  "directory to write the dumps of stuck engine commands to (default: the temp directory)",
+			EnvVar: "MALICE_WATCHDOG_DIR",
+		},
+		cli.BoolFlag{
+			Name:   "dry-run",
+			Usage:  "print the engine commands and actions a scan would run and validate the configuration, without scanning",
+			EnvVar: "MALICE_DRY_RUN",
+		},
+		cli.BoolFlag{
+			Name:   "json-only",
+			Usage:  "print the results as a single JSON line and nothing else, for programs running us: no markdown and no elasticsearch, a non-zero exit code only if the scan failed",
+			EnvVar: "MALICE_JSON_ONLY",
+		},
+		cli.BoolFlag{
+			Name:   "no-daemon-teardown",
+			Usage:  "leave drweb-configd and the engine session to the next call, which only runs drweb-ctl scan within --engine-session-ttl",
+			EnvVar: "MALICE_NO_DAEMON_TEARDOWN",
+		},
+	}
+	app.Before = func(c *cli.Context) error {
+		if err := configureLogging(c); err != nil {
+			return err
+		}
+		if len(c.String("vault-addr")) > 0 {
+			if err := loadVaultSecrets(c); err != nil {
+				return errors.Wrap(err, "failed to read secrets from Vault")
+			}
+		}
+		if os.Getpid() == 1 {
+			// nobody else is going to clean up after orphaned engine processes
+			startReaper(time.Second)
+		}
+		if err := validDedupPolicy(c.String("elasticsearch-dedup")); err != nil {
+			return err
+		}
+		if c.Bool("dry-run") {
+			if command := c.Args().First(); c.App.Command(command) != nil && !utils.StringInSlice(command, dryRunCommands) {
+				return fmt.Errorf("--dry-run is not supported by the %s command", command)
+			}
+		}
+		if c.Bool("family") && !c.Bool("dry-run") {
+			initFamilies(c.String("family-aliases"))
+		}
+		fetcher.allowedHosts = c.StringSlice("fetch-allow-host")
+		fetcher.allowPrivate = c.Bool("fetch-allow-private")
+		setEngineDir(c.String("engine-dir"))
+		engineLocale = c.String("engine-locale")
+		engineWorkDir = c.String("engine-workdir")
+		session.ttl = c.Duration("engine-session-ttl")
+		switch engineOutput = strings.ToLower(c.String("engine-output")); {
+		case engineOutput != engineOutputText && engineOutput != engineOutputJSON:
+			return fmt.Errorf("invalid --engine-output %q (must be %s or %s)", engineOutput, engineOutputText, engineOutputJSON)
+		case engineOutput == engineOutputJSON && !ctlEngine:
+			return fmt.Errorf("--engine-output json needs drweb-ctl, which Dr.Web for Windows does not have")
+		}
+		if err := sandboxEngine(c.Bool("engine-seccomp"), c.Bool("engine-landlock"), c.StringSlice("engine-writable")); err != nil {
+			return errors.Wrap(err, "failed to sandbox engine commands")
+		}
+		// with --privsep-user the engine helper runs the engine commands
+		if len(os.Getenv(engineSocketEnv)) == 0 {
+			if err := setEngineCgroup(c.String("engine-cgroup")); err != nil {
+				return errors.Wrap(err, "invalid --engine-cgroup")
+			}
+		}
+		var err error
+		if engineOptions, err = parseEngineOptions(c.StringSlice("engine-option")); err != nil {
+			return err
+		}
+		if scanRetry.attempts = c.Int("scan-attempts"); scanRetry.attempts < 1 {
+			return fmt.Errorf("--scan-attempts must be at least 1")
+		}
+		scanRetry.backoff = c.Duration("scan-retry-backoff")
+		if scanRetry.exitCodes, err = parseExitCodes(c.StringSlice("scan-retry-on")); err != nil {
+			return err
+		}
+		if c.Bool("privacy") {
+			for _, option := range engineOptions {
+				if strings.EqualFold(option.key, "Root.UseCloud") && !strings.EqualFold(option.value, "No") {
+					return fmt.Errorf("--engine-option %s=%s sends hashes to Dr.Web Cloud, which --privacy forbids", option.key, option.value)
+				}
+			}
+		} else if len(c.String("cloud-url")) > 0 {
+			if cloud, err = newCloudReputation(c.String("cloud-url"), c.String("cloud-key"), c.String("cloud-confidence"), c.Duration("cloud-timeout")); err != nil {
+				return err
+			}
+		}
+		if len(c.StringSlice("peer")) > 0 {
+			peers = newPeerPlugins(c.StringSlice("peer"), c.String("peer-token"), c.Duration("peer-timeout"))
+		}
+		if len(c.StringSlice("intel-url")) > 0 || len(c.String("misp-url")) > 0 {
+			intel = newIntelSources(c.StringSlice("intel-url"), c.String("misp-url"), c.String("misp-key"), c.Duration("intel-timeout"))
+		}
+		legacyUpdated = c.Bool("legacy-updated")
+		watchdog.start(c.Int("watchdog-factor"), time.Duration(c.Int("timeout"))*time.Second, c.Duration("watchdog-interval"), c.String("watchdog-dir"))
+		if tableColumns, err = parseTableColumns(c.String("table-columns")); err != nil {
+			return err
+		}
+		if outputFields, err = parseFields(c.String("fields")); err != nil {
+			return errors.Wrap(err, "invalid --fields")
+		}
+		if report := c.String("report"); len(report) > 0 && report != reportHTML && report != reportPDF {
+			return fmt.Errorf("invalid --report format %q (must be %s or %s)", report, reportHTML, reportPDF)
+		}
+		if len(c.String("store")) > 0 {
+			if store, err = openStore(c.String("store")); err != nil {
+				return err
+			}
+		}
+		if len(c.String("callback-recipient")) > 0 {
+			if err := loadRecipient(c.String("callback-recipient")); err != nil {
+				return err
+			}
+		}
+		if err := loadPayloadTemplates(c.StringSlice("callback-template")); err != nil {
+			return err
+		}
+		if len(c.String("sign-key")) > 0 {
+			if err := loadSigner(c.String("sign-key"), c.String("sign-key-id")); err != nil {
+				return err
+			}
+		}
+		if len(c.String("audit-log")) > 0 || len(c.String("audit-syslog")) > 0 {
+			if audit, err = openAuditTrail(c.String("audit-log"), c.String("audit-syslog"), c.String("audit-syslog-ca")); err != nil {
+				return err
+			}
+		}
+		explodeLimits = extractLimits{
+			MaxDepth: c.Int("max-depth"),
+			MaxSize:  c.Int64("max-member-size") << 20,
+			MaxRatio: c.Float64("max-ratio"),
+			MaxTotal: c.Int64("max-total-size") << 20,
+		}
+		explodeCommand = c.String("extractor")
+		defaultTimeout, defaultExplode, defaultAction = c.Int("timeout"), c.Bool("explode"), c.String("scan-action")
+		if err := (&ScanOptions{Action: defaultAction}).normalize(); err != nil {
+			return errors.Wrap(err, "invalid --scan-action")
+		}
+		if len(c.String("scan-policies")) > 0 {
+			if err := loadScanPolicies(c.String("scan-policies")); err != nil {
+				return err
+			}
+		}
+		if len(c.String("scan-profiles")) > 0 {
+			if err := loadScanProfiles(c.String("scan-profiles")); err != nil {
+				return err
+			}
+		}
+		for _, profile := range profileNames() {
+			if limits := scanProfiles[profile].Limits; limits != nil && limits.cgroupOnly() && len(c.String("engine-cgroup")) == 0 {
+				return fmt.Errorf("scan profile %s: cpu_percent, io_weight and max_processes limits require --engine-cgroup", profile)
+			}
+		}
+		if defaultProfile, err = lookupProfile(c.String("profile")); err != nil {
+			return err
+		}
+		if len(c.String("suppressions")) > 0 {
+			if err := loadSuppressions(c.String("suppressions")); err != nil {
+				return err
+			}
+		}
+		if len(c.String("attack-map")) > 0 {
+			return loadAttackMap(c.String("attack-map"))
+		}
+		return nil
 	}
 	app.Commands = []cli.Command{
 		{
@@ -392,50 +1449,1040 @@ func main() {
 			Aliases: []string{"u"},
 			Usage:   "Update virus definitions",
 			Action: func(c *cli.Context) error {
-				return updateAV(nil)
+				update, err := updateAV(nil)
+				updateJSON, jsonErr := json.Marshal(update)
+				if jsonErr != nil {
+					return jsonErr
+				}
+				fmt.Println(string(updateJSON))
+				return err
+			},
+		},
+		{
+			Name:  "self-update",
+			Usage: "Replace this binary with the latest signed release",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "url",
+					Usage:  "url of the release manifest",
+					EnvVar: "MALICE_SELF_UPDATE_URL",
+				},
+				cli.StringFlag{
+					Name:   "key",
+					Usage:  "PEM encoded Ed25519 public key releases are signed with",
+					EnvVar: "MALICE_SELF_UPDATE_KEY",
+				},
+				cli.StringFlag{
+					Name:   "ca",
+					Usage:  "PEM file of the certificate authorities of the release server (default: the system ones)",
+					EnvVar: "MALICE_SELF_UPDATE_CA",
+				},
+				cli.DurationFlag{
+					Name:  "timeout",
+					Value: 10 * time.Minute,
+					Usage: "how long fetching the manifest and downloading the release may take",
+				},
+				cli.BoolFlag{
+					Name:  "check",
+					Usage: "only report whether a newer release is available, exit 1 if it is",
+				},
+				cli.BoolFlag{
+					Name:  "force",
+					Usage: "install the latest release even if it is not newer, e.g. to roll back",
+				},
+			},
+			Action: selfUpdate,
+		},
+		{
+			Name:      "verify",
+			Usage:     "Verify the signature of a result",
+			ArgsUsage: "RESULT",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "key",
+					Usage: "PEM encoded Ed25519 public key",
+				},
 			},
+			Action: verify,
+		},
+		{
+			Name:      "decrypt",
+			Usage:     "Decrypt an encrypted callback result",
+			ArgsUsage: "[RESULT]",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "key",
+					Usage:  "PEM encoded X25519 private key (or file)",
+					EnvVar: "MALICE_DECRYPT_KEY",
+				},
+			},
+			Action: decrypt,
+		},
+		{
+			Name:  "config",
+			Usage: "Show or change the engine configuration",
+			Subcommands: []cli.Command{
+				{
+					Name:      "show",
+					Usage:     "Print the effective engine configuration as JSON",
+					ArgsUsage: "[SECTION]",
+					Action:    showConfig,
+				},
+				{
+					Name:      "set",
+					Usage:     "Change engine settings",
+					ArgsUsage: "Section.Parameter=Value...",
+					Action:    setConfig,
+				},
+			},
+		},
+		{
+			Name:   "info",
+			Usage:  "Print plugin, engine, virus base and license versions",
+			Action: printInfo,
+		},
+		{
+			Name:      "completion",
+			Usage:     "Print a bash, zsh or fish completion script",
+			ArgsUsage: "bash|zsh|fish",
+			Action:    completion,
+		},
+		{
+			Name:   "eicar",
+			Usage:  "Scan the EICAR test file and check it is detected",
+			Action: eicar,
+		},
+		{
+			Name:  "bench",
+			Usage: "Scan generated files and report throughput and latency",
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "n",
+					Value: 100,
+					Usage: "number of files to scan",
+				},
+				cli.StringFlag{
+					Name:  "size",
+					Value: "1M",
+					Usage: "size of each file (e.g. 512K, 1M)",
+				},
+				cli.Int64Flag{
+					Name:  "seed",
+					Value: 1,
+					Usage: "seed of the generated file contents",
+				},
+			},
+			Action: bench,
+		},
+		{
+			Name:  "healthcheck",
+			Usage: "Check the engine, license and virus base are ready",
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "timeout",
+					Value: 30,
+					Usage: "healthcheck timeout (in seconds)",
+				},
+			},
+			Action: healthcheck,
+		},
+		{
+			Name:  "prune",
+			Usage: "Delete stored results and samples older than a retention period",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "older-than",
+					Usage:  "retention period, e.g. 90d or 720h (required)",
+					EnvVar: "MALICE_RETENTION",
+				},
+				cli.BoolFlag{
+					Name:  "elasticsearch",
+					Usage: "also remove results from elasticsearch",
+				},
+				cli.DurationFlag{
+					Name:   "every",
+					Usage:  "keep running and prune this often (only once if 0)",
+					EnvVar: "MALICE_PRUNE_EVERY",
+				},
+			},
+			Action: pruneCommand,
+		},
+		{
+			Name:  "export",
+			Usage: "Export stored results to CSV or Parquet",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "format, f",
+					Value: exportCSV,
+					Usage: "export format (csv or parquet)",
+				},
+				cli.StringFlag{
+					Name:  "since",
+					Usage: "only results of scans at or after this date or RFC3339 time",
+				},
+				cli.StringFlag{
+					Name:  "until",
+					Usage: "only results of scans before this RFC3339 time, or up to and including this date",
+				},
+				cli.StringFlag{
+					Name:  "output, o",
+					Usage: "file to write the export to (default: stdout)",
+				},
+			},
+			Action: exportCommand,
+		},
+		{
+			Name:      "import",
+			Usage:     "Import result exports of earlier versions into the store",
+			ArgsUsage: "FILE|DIR...",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "format, f",
+					Usage: "format of the exports, json or csv (default: by file extension)",
+				},
+				cli.StringFlag{
+					Name:  "tenant",
+					Usage: "import into the results of this tenant",
+				},
+				cli.StringFlag{
+					Name:  "scanned-at",
+					Usage: "date or RFC3339 time of results without a scan time, they are skipped otherwise",
+				},
+			},
+			Action: importCommand,
+		},
+		{
+			Name:      "diff",
+			Usage:     "Compare two scans of a sample, the oldest and latest stored results of SHA256 or two result files",
+			ArgsUsage: "SHA256 | OLD.json NEW.json",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "from",
+					Usage: "compare the first stored scan at or after this date or RFC3339 time",
+				},
+				cli.StringFlag{
+					Name:  "to",
+					Usage: "compare the last stored scan up to this RFC3339 time, or up to and including this date",
+				},
+				cli.BoolFlag{
+					Name:  "history",
+					Usage: "print every stored scan and what changed from one to the next instead",
+				},
+				cli.BoolFlag{
+					Name:  "changes",
+					Usage: "with --history, only the scans that changed something",
+				},
+			},
+			Action: diffCommand,
+		},
+		{
+			Name:   "stats",
+			Usage:  "Print the cumulative statistics of the store",
+			Action: statsCommand,
+		},
+		{
+			Name:  "outbox",
+			Usage: "List or replay the callbacks recorded in the store",
+			Subcommands: []cli.Command{
+				{
+					Name:  "list",
+					Usage: "Print the recorded callbacks and their delivery as JSON lines",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "status",
+							Usage: "only callbacks with this delivery status (pending, delivered or failed)",
+						},
+					},
+					Action: outboxListCommand,
+				},
+				{
+					Name:      "replay",
+					Usage:     "POST recorded callbacks again, every one that was not delivered unless ids are given",
+					ArgsUsage: "[ID...]",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "force",
+							Usage: "also replay the given callbacks if they were delivered",
+						},
+					},
+					Action: outboxReplayCommand,
+				},
+			},
+		},
+		{
+			Name:  "audit",
+			Usage: "Check the audit trail of --audit-log",
+			Subcommands: []cli.Command{
+				{
+					Name:      "verify",
+					Usage:     "Check that no entry of an audit log was changed, removed or inserted",
+					ArgsUsage: "FILE",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "after",
+							Usage: "hash of the entry before the first one, if the log continues an archived one",
+						},
+					},
+					Action: auditVerifyCommand,
+				},
+			},
+		},
+		{
+			Name:   "engine-helper",
+			Usage:  "Run engine commands for an unprivileged web service (started by web --privsep-user)",
+			Hidden: true,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "socket",
+					Usage: "unix socket to accept requests on",
+				},
+				cli.IntFlag{
+					Name:  "group",
+					Usage: "group allowed to connect to the socket",
+				},
+			},
+			Action: engineHelperCommand,
+		},
+		{
+			Name:  "support-bundle",
+			Usage: "Collect troubleshooting details into a tarball",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "output, o",
+					Usage: "file to write the bundle to, - for stdout (default: drweb-support-TIMESTAMP.tar.gz)",
+				},
+			},
+			Action: supportBundleCommand,
 		},
 		{
 			Name:  "web",
 			Usage: "Create a Dr.WEB scan web service",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "admin-token",
+					Usage:  "admin API key, in addition to the ones in --api-keys",
+					EnvVar: "MALICE_ADMIN_TOKEN",
+				},
+				cli.StringFlag{
+					Name:   "api-keys",
+					Usage:  "JSON file listing the API keys, their roles (verdict, scan or admin) and tenants",
+					EnvVar: "MALICE_API_KEYS",
+				},
+				cli.StringFlag{
+					Name:   "tenants",
+					Usage:  "JSON file listing the tenants of the API keys with their daily quotas and callbacks",
+					EnvVar: "MALICE_TENANTS",
+				},
+				cli.StringFlag{
+					Name:   "tickets",
+					Usage:  "JSON file listing the Jira and ServiceNow tickets to open for infected uploads",
+					EnvVar: "MALICE_TICKETS",
+				},
+				cli.StringFlag{
+					Name:   "request-signing-keys",
+					Usage:  "JSON file of the producers whose HMAC signatures POST /scan and POST /malice/scan require",
+					EnvVar: "MALICE_REQUEST_SIGNING_KEYS",
+				},
+				cli.DurationFlag{
+					Name:   "request-signing-skew",
+					Value:  5 * time.Minute,
+					Usage:  "how far the timestamp of a signed submission may be off",
+					EnvVar: "MALICE_REQUEST_SIGNING_SKEW",
+				},
+				cli.StringFlag{
+					Name:   "oidc-issuer",
+					Usage:  "also accept JWTs issued by this OpenID Connect issuer",
+					EnvVar: "MALICE_OIDC_ISSUER",
+				},
+				cli.StringFlag{
+					Name:   "oidc-audience",
+					Usage:  "audience JWTs must be issued for",
+					EnvVar: "MALICE_OIDC_AUDIENCE",
+				},
+				cli.StringFlag{
+					Name:   "oidc-jwks-url",
+					Usage:  "JWKS to verify JWTs with (default: discovered from the issuer)",
+					EnvVar: "MALICE_OIDC_JWKS_URL",
+				},
+				cli.StringFlag{
+					Name:   "oidc-scan-scope",
+					Value:  "drweb:scan",
+					Usage:  "JWT scope granting the scan role",
+					EnvVar: "MALICE_OIDC_SCAN_SCOPE",
+				},
+				cli.StringFlag{
+					Name:   "oidc-admin-scope",
+					Value:  "drweb:admin",
+					Usage:  "JWT scope granting the admin role",
+					EnvVar: "MALICE_OIDC_ADMIN_SCOPE",
+				},
+				cli.IntFlag{
+					Name:   "breaker-threshold",
+					Value:  5,
+					Usage:  "consecutive engine failures before rejecting scans with 503 (0 to disable)",
+					EnvVar: "MALICE_BREAKER_THRESHOLD",
+				},
+				cli.DurationFlag{
+					Name:   "breaker-cooldown",
+					Value:  time.Minute,
+					Usage:  "time to wait before trying the engine again once the breaker opened",
+					EnvVar: "MALICE_BREAKER_COOLDOWN",
+				},
+				cli.DurationFlag{
+					Name:   "engine-probe-interval",
+					Value:  time.Minute,
+					Usage:  "how often to check again for an engine that is not installed or licensed (0 = only at startup)",
+					EnvVar: "MALICE_ENGINE_PROBE_INTERVAL",
+				},
+				cli.IntFlag{
+					Name:   "warm-pool",
+					Usage:  "high-throughput mode: run this many scans at once and keep the engine they share warm (0 = off)",
+					EnvVar: "MALICE_WARM_POOL",
+				},
+				cli.DurationFlag{
+					Name:   "warm-interval",
+					Value:  30 * time.Second,
+					Usage:  "how long the --warm-pool engine stays warm without scanning, it is warmed up every half of it while idle",
+					EnvVar: "MALICE_WARM_INTERVAL",
+				},
+				cli.DurationFlag{
+					Name:   "job-retention",
+					Value:  time.Hour,
+					Usage:  "how long finished async scan jobs can be looked up",
+					EnvVar: "MALICE_JOB_RETENTION",
+				},
+				cli.StringFlag{
+					Name:   "job-dir",
+					Usage:  "keep async scan jobs in this directory, e.g. a volume shared with a standby instance",
+					EnvVar: "MALICE_JOB_DIR",
+				},
+				cli.StringFlag{
+					Name:   "standby-of",
+					Usage:  "run as the standby of the active instance at this url and take over once it is unhealthy",
+					EnvVar: "MALICE_STANDBY_OF",
+				},
+				cli.DurationFlag{
+					Name:   "standby-interval",
+					Value:  5 * time.Second,
+					Usage:  "how often the standby checks the active instance's /healthz",
+					EnvVar: "MALICE_STANDBY_INTERVAL",
+				},
+				cli.IntFlag{
+					Name:   "standby-threshold",
+					Value:  3,
+					Usage:  "failed health checks in a row before the standby takes over",
+					EnvVar: "MALICE_STANDBY_THRESHOLD",
+				},
+				cli.DurationFlag{
+					Name:   "shed-latency",
+					Usage:  "reject low priority scans while the average scan takes longer than this (0 to disable)",
+					EnvVar: "MALICE_SHED_LATENCY",
+				},
+				cli.DurationFlag{
+					Name:   "shed-window",
+					Value:  time.Minute,
+					Usage:  "period the average scan latency is taken over",
+					EnvVar: "MALICE_SHED_WINDOW",
+				},
+				cli.StringFlag{
+					Name:   "shadow-url",
+					Usage:  "url of another plugin web service (e.g. with a new engine version) to mirror uploads to and compare verdicts with",
+					EnvVar: "MALICE_SHADOW_URL",
+				},
+				cli.StringFlag{
+					Name:   "shadow-engine-dir",
+					Usage:  "directory of another Dr.Web installation to mirror uploads to and compare verdicts with",
+					EnvVar: "MALICE_SHADOW_ENGINE_DIR",
+				},
+				cli.StringFlag{
+					Name:   "shadow-token",
+					Usage:  "bearer token for the --shadow-url web service",
+					EnvVar: "MALICE_SHADOW_TOKEN",
+				},
+				cli.DurationFlag{
+					Name:   "shadow-timeout",
+					Value:  2 * time.Minute,
+					Usage:  "how long to wait for a shadow scan",
+					EnvVar: "MALICE_SHADOW_TIMEOUT",
+				},
+				cli.DurationFlag{
+					Name:   "fetch-timeout",
+					Value:  time.Minute,
+					Usage:  "how long to wait for the sample of a Malice scan request, and to post its results",
+					EnvVar: "MALICE_FETCH_TIMEOUT",
+				},
+				cli.Int64Flag{
+					Name:   "max-upload-size",
+					Usage:  "largest upload POST /scan accepts (in MB, no limit if 0)",
+					EnvVar: "MALICE_MAX_UPLOAD_SIZE",
+				},
+				cli.Int64Flag{
+					Name:   "large-sample-size",
+					Usage:  "scan uploads larger than this in the background even without async=true (in MB, never if 0)",
+					EnvVar: "MALICE_LARGE_SAMPLE_SIZE",
+				},
+				cli.Int64Flag{
+					Name:   "fetch-max-size",
+					Value:  100,
+					Usage:  "largest sample a Malice scan request may reference (in MB)",
+					EnvVar: "MALICE_FETCH_MAX_SIZE",
+				},
+				cli.DurationFlag{
+					Name:   "admission-timeout",
+					Value:  25 * time.Second,
+					Usage:  "how long an admission review waits for its scans, keep it below the webhook timeout",
+					EnvVar: "MALICE_ADMISSION_TIMEOUT",
+				},
+				cli.BoolFlag{
+					Name:   "admission-fail-closed",
+					Usage:  "deny admission when an image or payload could not be scanned in time",
+					EnvVar: "MALICE_ADMISSION_FAIL_CLOSED",
+				},
+				cli.StringFlag{
+					Name:   "admission-platform",
+					Value:  "linux/amd64",
+					Usage:  "variant of multi-platform images to scan",
+					EnvVar: "MALICE_ADMISSION_PLATFORM",
+				},
+				cli.Int64Flag{
+					Name:   "admission-max-layer-size",
+					Value:  1024,
+					Usage:  "largest image layer downloaded for admission reviews (in MB)",
+					EnvVar: "MALICE_ADMISSION_MAX_LAYER_SIZE",
+				},
+				cli.DurationFlag{
+					Name:   "registry-timeout",
+					Value:  5 * time.Minute,
+					Usage:  "how long to wait for an image manifest or layer",
+					EnvVar: "MALICE_REGISTRY_TIMEOUT",
+				},
+				cli.StringFlag{
+					Name:   "registry-config",
+					Usage:  "docker config.json with the credentials of private registries",
+					EnvVar: "MALICE_REGISTRY_CONFIG",
+				},
+				cli.StringFlag{
+					Name:   "privsep-user",
+					Usage:  "run the web service as this user, engine commands are run by a privileged helper",
+					EnvVar: "MALICE_PRIVSEP_USER",
+				},
+				cli.StringFlag{
+					Name:   "tls-cert",
+					Usage:  "serve HTTPS with this certificate (PEM), required by Kubernetes admission webhooks",
+					EnvVar: "MALICE_TLS_CERT",
+				},
+				cli.StringFlag{
+					Name:   "tls-key",
+					Usage:  "private key (PEM) of --tls-cert",
+					EnvVar: "MALICE_TLS_KEY",
+				},
+				cli.DurationFlag{
+					Name:   "retain-samples",
+					Usage:  "keep uploaded samples in the --store directory for this long (not kept if 0)",
+					EnvVar: "MALICE_RETAIN_SAMPLES",
+				},
+				cli.BoolFlag{
+					Name:   "retain-infected-members",
+					Usage:  "also keep the infected members of unpacked archives under their own sha256, with --retain-samples",
+					EnvVar: "MALICE_RETAIN_INFECTED_MEMBERS",
+				},
+				cli.StringFlag{
+					Name:   "sample-archive",
+					Usage:  "also write uploaded samples and their verdicts to this append-only archive, an s3://bucket/prefix url or a directory",
+					EnvVar: "MALICE_SAMPLE_ARCHIVE",
+				},
+				cli.StringFlag{
+					Name:   "sample-archive-endpoint",
+					Usage:  "S3 compatible endpoint of an s3:// archive (default: AWS S3 in AWS_REGION)",
+					EnvVar: "MALICE_SAMPLE_ARCHIVE_ENDPOINT",
+				},
+				cli.StringFlag{
+					Name:   "sample-archive-lock",
+					Usage:  "S3 object lock mode of archived samples (governance or compliance), locked for --retain-samples",
+					EnvVar: "MALICE_SAMPLE_ARCHIVE_LOCK",
+				},
+				cli.DurationFlag{
+					Name:   "temp-max-age",
+					Value:  time.Hour,
+					Usage:  "remove scan temp files older than this, they were left behind by a crash",
+					EnvVar: "MALICE_TEMP_MAX_AGE",
+				},
+				cli.DurationFlag{
+					Name:   "janitor-interval",
+					Value:  10 * time.Minute,
+					Usage:  "how often to clean up temp files and expired samples (only on startup if 0)",
+					EnvVar: "MALICE_JANITOR_INTERVAL",
+				},
+				cli.DurationFlag{
+					Name:   "baseinfo-max-age",
+					Value:  30 * time.Minute,
+					Usage:  "how long to cache the engine version and virus base info (until an update or SIGHUP if 0)",
+					EnvVar: "MALICE_BASEINFO_MAX_AGE",
+				},
+				cli.StringFlag{
+					Name:   "stats-windows",
+					Value:  "1m,1h,24h",
+					Usage:  "comma separated periods GET /stats reports on",
+					EnvVar: "MALICE_STATS_WINDOWS",
+				},
+				cli.DurationFlag{
+					Name:   "timeout-advice",
+					Usage:  "log the profiles whose timeout the latest scan latencies suggest changing this often (0 = never)",
+					EnvVar: "MALICE_TIMEOUT_ADVICE",
+				},
+				cli.StringFlag{
+					Name:   "socket",
+					Usage:  "also accept samples on this unix socket, length-prefixed, for co-located applications",
+					EnvVar: "MALICE_SOCKET",
+				},
+				cli.StringFlag{
+					Name:   "socket-mode",
+					Value:  "0660",
+					Usage:  "permissions of the --socket, which is all that restricts who may scan with it",
+					EnvVar: "MALICE_SOCKET_MODE",
+				},
+				cli.StringFlag{
+					Name:   "coordinator",
+					Usage:  "url of a Malice coordinator to register this instance with and send heartbeats to",
+					EnvVar: "MALICE_COORDINATOR",
+				},
+				cli.StringFlag{
+					Name:   "coordinator-token",
+					Usage:  "bearer token for the Malice coordinator",
+					EnvVar: "MALICE_COORDINATOR_TOKEN",
+				},
+				cli.StringFlag{
+					Name:   "advertise-url",
+					Usage:  "url the coordinator and Malice reach this instance at (default: http(s)://<hostname>:<port>)",
+					EnvVar: "MALICE_ADVERTISE_URL",
+				},
+				cli.DurationFlag{
+					Name:   "heartbeat-interval",
+					Value:  30 * time.Second,
+					Usage:  "how often to send the coordinator a heartbeat",
+					EnvVar: "MALICE_HEARTBEAT_INTERVAL",
+				},
+				cli.StringFlag{
+					Name:   "statsd",
+					Usage:  "push scan metrics to the statsd or DogStatsD agent at this address (host:port)",
+					EnvVar: "MALICE_STATSD",
+				},
+				cli.StringFlag{
+					Name:   "statsd-format",
+					Value:  "dogstatsd",
+					Usage:  "statsd or dogstatsd, plain statsd metrics have no tags",
+					EnvVar: "MALICE_STATSD_FORMAT",
+				},
+				cli.StringFlag{
+					Name:   "statsd-prefix",
+					Value:  "drweb.",
+					Usage:  "prefix of the metric names",
+					EnvVar: "MALICE_STATSD_PREFIX",
+				},
+				cli.StringFlag{
+					Name:   "statsd-tags",
+					Value:  "host,tenant,verdict",
+					Usage:  "comma separated tags of every scan metric (host, tenant, verdict, source or profile)",
+					EnvVar: "MALICE_STATSD_TAGS",
+				},
+				cli.StringSliceFlag{
+					Name:   "statsd-tag",
+					Usage:  "KEY:VALUE tag added to every metric, e.g. env:prod (repeatable)",
+					EnvVar: "MALICE_STATSD_TAG",
+				},
+				cli.BoolFlag{
+					Name:   "behind-proxy",
+					Usage:  "take the client IP from the X-Forwarded-For header",
+					EnvVar: "MALICE_BEHIND_PROXY",
+				},
+				cli.DurationFlag{
+					Name:   "idempotency-window",
+					Value:  time.Hour,
+					Usage:  "how long responses are replayed for repeated Idempotency-Keys",
+					EnvVar: "MALICE_IDEMPOTENCY_WINDOW",
+				},
+			},
 			Action: func(c *cli.Context) error {
-				webService()
+				webService(c)
 				return nil
 			},
 		},
+		{
+			Name:  "mailbox",
+			Usage: "Sweep an IMAP mailbox for infected attachments",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "server",
+					Usage:  "IMAP server address (host:port)",
+					EnvVar: "MALICE_IMAP_SERVER",
+				},
+				cli.StringFlag{
+					Name:   "username, u",
+					Usage:  "IMAP account username",
+					EnvVar: "MALICE_IMAP_USERNAME",
+				},
+				cli.StringFlag{
+					Name:   "password, p",
+					Usage:  "IMAP account password",
+					EnvVar: "MALICE_IMAP_PASSWORD",
+				},
+				cli.StringFlag{
+					Name:  "mailbox, m",
+					Value: "INBOX",
+					Usage: "mailbox to sweep",
+				},
+				cli.StringFlag{
+					Name:  "since",
+					Usage: "only scan messages since date (YYYY-MM-DD)",
+				},
+				cli.StringFlag{
+					Name:  "action",
+					Value: "none",
+					Usage: "action to take on infected messages (none, flag, move or delete)",
+				},
+				cli.StringFlag{
+					Name:  "quarantine",
+					Value: "Quarantine",
+					Usage: "mailbox to move infected messages to",
+				},
+				cli.BoolFlag{
+					Name:  "no-tls",
+					Usage: "connect without TLS",
+				},
+				cli.BoolFlag{
+					Name:  "insecure",
+					Usage: "skip TLS certificate verification",
+				},
+			},
+			Action: sweepMailbox,
+		},
+		{
+			Name:      "pcap",
+			Usage:     "Scan files transferred over HTTP/SMB/FTP in a network capture",
+			ArgsUsage: "CAPTURE",
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "max-size",
+					Value: 100,
+					Usage: "skip extracted objects larger than this (in MB)",
+				},
+				cli.BoolFlag{
+					Name:  "infected-only",
+					Usage: "only report infected objects",
+				},
+				cli.StringFlag{
+					Name:  "fail-on",
+					Usage: "exit 1 if files are infected, 2 if files had errors or were skipped (comma separated: infected, errors, skipped)",
+				},
+				cli.IntFlag{
+					Name:  "max-findings",
+					Usage: "stop after N infected files and report the partial results as truncated (0 = never)",
+				},
+				cli.DurationFlag{
+					Name:  "max-time",
+					Usage: "stop after this long and report the partial results as truncated, with what was left unscanned (0 = never)",
+				},
+			},
+			Action: scanPcap,
+		},
+		{
+			Name:      "dir",
+			Usage:     "Scan every file in a directory tree",
+			ArgsUsage: "DIR",
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "exclude",
+					Usage: "skip files and directories matching this glob, or regular expression prefixed with re: (repeatable)",
+				},
+				cli.StringFlag{
+					Name:  "exclude-from",
+					Usage: "file with one exclusion pattern per line",
+				},
+				cli.BoolFlag{
+					Name:  "follow-symlinks",
+					Usage: "scan the targets of symbolic links (each directory is scanned once)",
+				},
+				cli.BoolFlag{
+					Name:  "one-filesystem",
+					Usage: "skip files and directories on other filesystems than DIR",
+				},
+				cli.BoolFlag{
+					Name:  "infected-only",
+					Usage: "only report infected files and errors",
+				},
+				cli.StringFlag{
+					Name:  "fail-on",
+					Usage: "exit 1 if files are infected, 2 if files had errors or were skipped (comma separated: infected, errors, skipped)",
+				},
+				cli.IntFlag{
+					Name:  "max-findings",
+					Usage: "stop after N infected files and report the partial results as truncated (0 = never)",
+				},
+				cli.DurationFlag{
+					Name:  "max-time",
+					Usage: "stop after this long and report the partial results as truncated, with what was left unscanned (0 = never)",
+				},
+				cli.StringFlag{
+					Name:   "host-facts",
+					Usage:  "JSON file of facts about the host to add to the report, e.g. its asset and agent ids",
+					EnvVar: "MALICE_HOST_FACTS",
+				},
+				cli.StringFlag{
+					Name:   "osquery-socket",
+					Usage:  "extensions socket of the osqueryd to ask for the hostname, OS and hardware ids of the host",
+					EnvVar: "MALICE_OSQUERY_SOCKET",
+				},
+			},
+			Action: scanDirectory,
+		},
+		{
+			Name:  "serve-dir",
+			Usage: "Protect a directory tree: scan new files, quarantine infected ones and serve a status page",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "dir, d",
+					Usage:  "directory to protect, e.g. a shared drop folder",
+					EnvVar: "MALICE_SERVE_DIR",
+				},
+				cli.StringFlag{
+					Name:   "quarantine",
+					Usage:  "directory infected files are moved to (default: .drweb-quarantine inside --dir)",
+					EnvVar: "MALICE_QUARANTINE",
+				},
+				cli.DurationFlag{
+					Name:   "full-scan",
+					Value:  24 * time.Hour,
+					Usage:  "scan the whole tree again this often, with the latest virus base (0 = only at start)",
+					EnvVar: "MALICE_FULL_SCAN",
+				},
+				cli.DurationFlag{
+					Name:   "poll",
+					Value:  10 * time.Second,
+					Usage:  "look for new and changed files this often, they are scanned once unchanged for as long",
+					EnvVar: "MALICE_POLL",
+				},
+				cli.StringFlag{
+					Name:   "listen",
+					Value:  ":3993",
+					Usage:  "address of the status page",
+					EnvVar: "MALICE_LISTEN",
+				},
+				cli.StringSliceFlag{
+					Name:  "exclude",
+					Usage: "skip files and directories matching this glob, or regular expression prefixed with re: (repeatable)",
+				},
+				cli.StringFlag{
+					Name:   "host-facts",
+					Usage:  "JSON file of facts about the host to add to the report, e.g. its asset and agent ids",
+					EnvVar: "MALICE_HOST_FACTS",
+				},
+				cli.StringFlag{
+					Name:   "osquery-socket",
+					Usage:  "extensions socket of the osqueryd to ask for the hostname, OS and hardware ids of the host",
+					EnvVar: "MALICE_OSQUERY_SOCKET",
+				},
+			},
+			Action: serveDir,
+		},
+		{
+			Name:  "gate",
+			Usage: "Pass on uploads: move clean files to the approved ones and infected ones to quarantine, with a manifest per batch",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "incoming",
+					Usage:  "directory uploads arrive in",
+					EnvVar: "MALICE_GATE_INCOMING",
+				},
+				cli.StringFlag{
+					Name:   "approved",
+					Usage:  "directory or s3://bucket/prefix clean files are moved to, keeping their path",
+					EnvVar: "MALICE_GATE_APPROVED",
+				},
+				cli.StringFlag{
+					Name:   "quarantine",
+					Usage:  "directory or s3://bucket/prefix infected files are moved to",
+					EnvVar: "MALICE_QUARANTINE",
+				},
+				cli.StringFlag{
+					Name:   "manifests",
+					Usage:  "directory or s3://bucket/prefix the manifest of every batch is written to (default: printed)",
+					EnvVar: "MALICE_GATE_MANIFESTS",
+				},
+				cli.StringFlag{
+					Name:   "s3-endpoint",
+					Usage:  "S3 compatible endpoint of s3:// targets (default: AWS S3 in AWS_REGION)",
+					EnvVar: "MALICE_S3_ENDPOINT",
+				},
+				cli.DurationFlag{
+					Name:   "poll",
+					Value:  10 * time.Second,
+					Usage:  "look for new uploads this often, they are passed on once unchanged for as long",
+					EnvVar: "MALICE_POLL",
+				},
+				cli.DurationFlag{
+					Name:   "retry-held",
+					Value:  5 * time.Minute,
+					Usage:  "scan files that could not be scanned again after this long",
+					EnvVar: "MALICE_GATE_RETRY_HELD",
+				},
+				cli.BoolFlag{
+					Name:  "once",
+					Usage: "pass on the files in --incoming as one batch and exit, 1 if any were held",
+				},
+				cli.StringSliceFlag{
+					Name:  "exclude",
+					Usage: "leave files and directories matching this glob, or regular expression prefixed with re:, in --incoming (repeatable)",
+				},
+			},
+			Action: gate,
+		},
+		{
+			Name:      "image",
+			Usage:     "Scan a raw disk or memory image in chunks or by mounting it",
+			ArgsUsage: "IMAGE",
+			Flags: []cli.Flag{
+				cli.Int64Flag{
+					Name:  "chunk-size",
+					Value: 64,
+					Usage: "size of each scanned chunk (in MB)",
+				},
+				cli.Int64Flag{
+					Name:  "overlap",
+					Value: 1,
+					Usage: "overlap between consecutive chunks (in MB)",
+				},
+				cli.BoolFlag{
+					Name:  "mount",
+					Usage: "loop mount the image read-only and scan each file in it",
+				},
+				cli.Int64Flag{
+					Name:  "offset",
+					Usage: "byte offset of the filesystem inside the image (with --mount)",
+				},
+				cli.BoolFlag{
+					Name:  "infected-only",
+					Usage: "only report infected entries and errors",
+				},
+				cli.StringFlag{
+					Name:  "fail-on",
+					Usage: "exit 1 if files are infected, 2 if files had errors or were skipped (comma separated: infected, errors, skipped)",
+				},
+				cli.IntFlag{
+					Name:  "max-findings",
+					Usage: "stop after N infected files and report the partial results as truncated (0 = never)",
+				},
+				cli.DurationFlag{
+					Name:  "max-time",
+					Usage: "stop after this long and report the partial results as truncated, with what was left unscanned (0 = never)",
+				},
+			},
+			Action: scanImage,
+		},
 	}
 	app.Action = func(c *cli.Context) error {
 
 		var err error
 
-		if c.Bool("verbose") {
-			log.SetLevel(log.DebugLevel)
+		if c.Args().Present() && c.Bool("dry-run") {
+			return dryRunScan(c)
 		}
 
 		if c.Args().Present() {
+			jsonOnly := c.Bool("json-only")
+			if jsonOnly && (c.Bool("table") || len(c.String("report")) > 0 || c.Bool("callback")) {
+				return fmt.Errorf("--json-only can not be combined with --table, --report or --callback")
+			}
+			if c.Bool("no-daemon-teardown") {
+				session.resume()
+				defer session.save()
+			}
+
 			path, err = filepath.Abs(c.Args().First())
 			assert(err)
 
-			if _, err = os.Stat(path); os.IsNotExist(err) {
-				assert(err)
-			}
+			info, err := os.Stat(path)
+			assert(err)
 
 			hash = utils.GetSHA256(path)
 
-			drweb := AvScan(c.Int("timeout"))
-			drweb.Results.MarkDown = generateMarkDownTable(drweb)
-			// upsert into Database
-			if len(c.String("elasticsearch")) > 0 {
-				err := es.Init()
+			options, err := cliScanOptions(c, hash)
+			if err != nil {
+				return err
+			}
+			profile, err := options.scanProfile()
+			if err != nil {
+				return err
+			}
+			audit.record(auditSubmitted, "cli", "", hash, map[string]string{
+				"channel": "cli",
+				"size":    strconv.FormatInt(info.Size(), 10),
+				"name":    path,
+			})
+
+			contentType, err := sniffFile(path)
+			if err != nil {
+				return errors.Wrap(err, "failed to sniff sample")
+			}
+			policy := matchScanPolicy(fileSample(path, contentType, info.Size()))
+
+			started := time.Now()
+			var timeline scanTimeline
+			timeline.add("scan started")
+			var fanOut *peerScan
+			var drweb DrWEB
+			if policy.keepsFromEngine() {
+				drweb.Results = policy.skipped(contentType)
+				timeline.add(drweb.Results.Result)
+			} else {
+				if peers != nil {
+					data, err := ioutil.ReadFile(path)
+					if err != nil {
+						return errors.Wrap(err, "failed to read sample for peers")
+					}
+					fanOut = peers.scan(context.Background(), hash, data)
+				}
+				drweb = scanOrLookup(context.Background(), hash, c.Int("timeout"), profile)
+				if len(drweb.Results.Source) > 0 {
+					timeline.add(drweb.Results.Source + " verdict: " + verdictSummary(drweb.Results))
+				} else {
+					timeline.add("engine verdict: " + verdictSummary(drweb.Results))
+				}
+			}
+			drweb.Results.Metadata = options.Metadata
+			drweb.Results.Tags = options.Tags
+			if policy != nil {
+				if policy.Action == policyFlag {
+					policy.flag(&drweb.Results)
+				}
+				drweb.Results.PolicyApplied = policy.applied(contentType)
+			}
+			explode := profile.explode(defaultExplode) || policy != nil && policy.Action == policyExplode
+			if explode && len(archiveType(path)) > 0 {
+				drweb.Results.Members, err = explodeAndScan(path, options.limits(), explodeCommand, c.Int("timeout"), profile)
 				if err != nil {
-					return errors.Wrap(err, "failed to initalize elasticsearch")
+					return errors.Wrap(err, "failed to explode archive")
+				}
+				drweb.Results.addMembers()
+				timeline.add(fmt.Sprintf("unpacked and scanned %d archive members", len(drweb.Results.Members)))
+			}
+			suppress(hash, path, &Submitter{KeyID: "cli"}, &drweb.Results)
+			drweb.Results.Peers = fanOut.results(drweb.Results)
+			intel.enrich(context.Background(), hash, &drweb.Results)
+			timeline.add("scan finished")
+			if !jsonOnly {
+				drweb.Results.MarkDown = generateMarkDownTable(drweb, hash, time.Since(started))
+			}
+			audit.verdict(hash, &Submitter{KeyID: "cli"}, drweb.Results)
+			// keep local history
+			if store != nil {
+				if _, err := store.save(hash, drweb.Results); err != nil {
+					return err
 				}
-				err = es.StorePluginResults(database.PluginResults{
-					ID:       utils.Getopt("MALICE_SCANID", hash),
-					Name:     name,
-					Category: category,
-					Data:     structs.Map(drweb.Results),
-				})
+				store.countScan(drweb.Results, info.Size())
+			}
+			// upsert into Database
+			if len(c.String("elasticsearch")) > 0 && !jsonOnly {
+				err := storeElasticsearch(utils.Getopt("MALICE_SCANID", hash), drweb.Results, c.String("elasticsearch-dedup"))
 				if err != nil {
 					return errors.Wrapf(err, "failed to index malice/%s results", name)
 				}
@@ -443,23 +2490,64 @@ func main() {
 
 			if c.Bool("table") {
 				fmt.Printf(drweb.Results.MarkDown)
+			} else if len(c.String("report")) > 0 {
+				report, err := newIncidentReport(drweb, path, contentType, hash, timeline)
+				if err != nil {
+					return errors.Wrap(err, "failed to collect the report")
+				}
+				return report.write(os.Stdout, c.String("report"))
 			} else {
 				drweb.Results.MarkDown = ""
+				if signer != nil {
+					if drweb.Signature, err = signer.sign(drweb); err != nil {
+						return errors.Wrap(err, "failed to sign results")
+					}
+				}
 				drwebJSON, err := json.Marshal(drweb)
 				assert(err)
-				if c.Bool("callback") {
+				if options.Callback != nil {
 					request := gorequest.New()
 					if c.Bool("proxy") {
 						request = gorequest.New().Proxy(os.Getenv("MALICE_PROXY"))
 					}
-					request.Post(os.Getenv("MALICE_ENDPOINT")).
-						Set("X-Malice-ID", utils.Getopt("MALICE_SCANID", hash)).
-						Send(string(drwebJSON)).
-						End(printStatus)
+					endpoint, scanID := options.Callback.URL, options.Callback.ScanID
+					if drwebJSON, err = callbackBody(endpoint, scanID, drweb); err != nil {
+						return err
+					}
+					outbox := store.outbox()
+					entry, err := outbox.add(endpoint, scanID, hash, drweb, drwebJSON)
+					if err != nil {
+						return err
+					}
+					request = request.Post(endpoint).
+						Set("X-Malice-ID", scanID)
+					if entry != nil {
+						request = request.Set(deliveryHeader, entry.ID)
+					}
+					resp, _, errs := request.Send(string(drwebJSON)).End(printStatus)
+					var statusCode int
+					var postErr error
+					switch {
+					case len(errs) > 0:
+						postErr = errors.Wrap(errs[0], "failed to post results")
+					case resp.StatusCode >= 300:
+						statusCode, postErr = resp.StatusCode, fmt.Errorf("failed to post results: %s", resp.Status)
+					default:
+						statusCode = resp.StatusCode
+					}
+					outbox.record(entry, statusCode, postErr, false)
 
 					return nil
 				}
+				if len(outputFields) > 0 {
+					// a selection can not carry the signature of the whole results
+					drwebJSON, err = json.Marshal(selectFields(hash, drweb.Results, outputFields))
+					assert(err)
+				}
 				fmt.Println(string(drwebJSON))
+				if jsonOnly && (drweb.Results.Status == statusError || drweb.Results.Status == statusEngineUnavailable) {
+					return fmt.Errorf("scan failed: %s", drweb.Results.Error)
+				}
 			}
 		} else {
 			log.WithFields(log.Fields{
@@ -471,5 +2559,6 @@ func main() {
 	}
 
 	err := app.Run(os.Args)
+	audit.flush(5 * time.Second)
 	assert(err)
 }
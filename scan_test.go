@@ -1,5 +1,54 @@
 package main
 
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// TestParseOutputVerdict parses drweb-ctl scan outputs in tests/ctl, localized
+// ones must never come out clean or as detections named after the verdict
+func TestParseOutputVerdict(t *testing.T) {
+	defer func(output string) { engineOutput = output }(engineOutput)
+
+	tests := []struct {
+		fixture string
+		output  string
+		status  string
+		result  string
+	}{
+		{"en_infected.txt", engineOutputText, statusInfected, "EICAR Test File (NOT a Virus!)"},
+		{"en_clean.txt", engineOutputText, statusClean, ""},
+		{"en_infected_password.txt", engineOutputText, statusInfected, "Trojan.PWS.PasswordStealer.1"},
+		{"en_infected_compression.txt", engineOutputText, statusInfected, "Trojan.Packed.Compression.7"},
+		{"en_infected_ratio.txt", engineOutputText, statusInfected, "Exploit.Archive.RatioLimit.1 (ratio limit evasion)"},
+		{"en_infected_too_large.txt", engineOutputText, statusInfected, "Trojan.Dropper.TooLarge (too large to upload)"},
+		{"en_infected_size_limit.txt", engineOutputText, statusInfected, "Trojan.Overlay.SizeLimit (size limit evasion)"},
+		{"en_infected_skipped.txt", engineOutputText, statusInfected, "Trojan.Loader.Skipped (not scanned by AV check)"},
+		{"en_infected_nesting.txt", engineOutputText, statusInfected, "Exploit.Nesting.Level (level limit evasion)"},
+		{"en_password.txt", engineOutputText, statusSkipped, "password protected archive, not scanned"},
+		{"ru_infected.txt", engineOutputText, statusError, "unrecognized engine output: инфицирован EICAR Test File (NOT a Virus!)"},
+		{"ru_clean.txt", engineOutputText, statusError, "unrecognized engine output: Ок"},
+		{"ja_infected.txt", engineOutputText, statusError, "unrecognized engine output: 感染 EICAR Test File (NOT a Virus!)"},
+		{"empty.txt", engineOutputText, statusError, "empty engine output"},
+		{"json_infected.json", engineOutputJSON, statusInfected, "EICAR Test File (NOT a Virus!)"},
+		{"json_clean.json", engineOutputJSON, statusClean, ""},
+		{"json_error.json", engineOutputJSON, statusError, "Permission denied"},
+		{"en_clean.txt", engineOutputJSON, statusError, "unrecognized engine output: /malware/readme.txt - Ok"},
+	}
+	for _, test := range tests {
+		output, err := ioutil.ReadFile(filepath.Join("tests", "ctl", test.fixture))
+		if err != nil {
+			t.Fatal(err)
+		}
+		engineOutput = test.output
+		status, result := parseOutputVerdict(string(output))
+		if status != test.status || result != test.result {
+			t.Errorf("%s as %s: got %q %q, want %q %q", test.fixture, test.output, status, result, test.status, test.result)
+		}
+	}
+}
+
 // TestParseResult tests the __ function.
 // func TestParseMalwareResultXML(t *testing.T) {
 // 	xmlFile, err := os.Open("tests/av_malware.xml")
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// ReleaseManifest json object, what the release endpoint serves: the latest
+// version and its binary per platform, as <os>/<arch>
+type ReleaseManifest struct {
+	Version  string                  `json:"version"`
+	Binaries map[string]ReleaseAsset `json:"binaries"`
+}
+
+// ReleaseAsset json object, a binary of a release. The signature is the
+// base64 Ed25519 signature of releaseMessage, so a signed binary can not be
+// passed off as another version or platform.
+type ReleaseAsset struct {
+	URL       string `json:"url"`
+	Size      int64  `json:"size"`
+	SHA256    string `json:"sha256"`
+	Signature string `json:"signature"`
+}
+
+// releaseMessage is what the release key signs for a binary
+func releaseMessage(version, platform, sha string) string {
+	return fmt.Sprintf("drweb %s %s %s", version, platform, sha)
+}
+
+// releaseVersion splits a version like v1.2.3 into its numbers, false if it
+// is not one
+func releaseVersion(version string) ([]int, bool) {
+	version = strings.TrimPrefix(strings.Fields(version + " ")[0], "v")
+	var numbers []int
+	for _, part := range strings.Split(version, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, false
+		}
+		numbers = append(numbers, n)
+	}
+	return numbers, true
+}
+
+// newerRelease reports whether latest is newer than current. Versions that
+// are not numbers, like those of development builds, are only the same if
+// they are equal.
+func newerRelease(current, latest string) bool {
+	c, cok := releaseVersion(current)
+	l, lok := releaseVersion(latest)
+	if !cok || !lok {
+		return current != latest
+	}
+	for i := 0; i < len(c) || i < len(l); i++ {
+		var a, b int
+		if i < len(c) {
+			a = c[i]
+		}
+		if i < len(l) {
+			b = l[i]
+		}
+		if a != b {
+			return b > a
+		}
+	}
+	return false
+}
+
+// selfUpdater downloads releases from the release endpoint
+type selfUpdater struct {
+	manifest *url.URL
+	key      ed25519.PublicKey
+	client   *http.Client
+}
+
+func newSelfUpdater(manifest, keyFile, ca string, timeout time.Duration) (*selfUpdater, error) {
+	u, err := url.Parse(manifest)
+	if err != nil || !httpURL(manifest) {
+		return nil, fmt.Errorf("please supply the http(s) url of the release manifest (--url)")
+	}
+	if len(keyFile) == 0 {
+		return nil, fmt.Errorf("please supply the public key releases are signed with (--key)")
+	}
+	keyData, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read release key")
+	}
+	key, err := parseEd25519Key(keyData)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse release key %s", keyFile)
+	}
+	public, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("release key %s is a private key, only the public key belongs on hosts", keyFile)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if len(ca) > 0 {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read --ca")
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: x509.NewCertPool()}
+		if !transport.TLSClientConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", ca)
+		}
+	}
+	return &selfUpdater{manifest: u, key: public, client: &http.Client{Timeout: timeout, Transport: transport}}, nil
+}
+
+func (s *selfUpdater) get(ctx context.Context, u string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", name+"/"+Version)
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s returned %s", u, resp.Status)
+	}
+	return resp, nil
+}
+
+// latest fetches the manifest and returns the latest version and its
+// binary for this platform, with its url resolved against the manifest's
+func (s *selfUpdater) latest(ctx context.Context) (string, ReleaseAsset, error) {
+	resp, err := s.get(ctx, s.manifest.String())
+	if err != nil {
+		return "", ReleaseAsset{}, errors.Wrap(err, "failed to fetch release manifest")
+	}
+	defer resp.Body.Close()
+
+	var manifest ReleaseManifest
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&manifest); err != nil {
+		return "", ReleaseAsset{}, errors.Wrap(err, "failed to parse release manifest")
+	}
+	if len(manifest.Version) == 0 {
+		return "", ReleaseAsset{}, fmt.Errorf("release manifest has no version")
+	}
+	platform := runtime.GOOS + "/" + runtime.GOARCH
+	asset, ok := manifest.Binaries[platform]
+	if !ok {
+		return manifest.Version, ReleaseAsset{}, fmt.Errorf("release %s has no binary for %s", manifest.Version, platform)
+	}
+	binary, err := s.manifest.Parse(asset.URL)
+	if err != nil {
+		return manifest.Version, ReleaseAsset{}, errors.Wrapf(err, "invalid url of the %s binary", platform)
+	}
+	asset.URL = binary.String()
+	return manifest.Version, asset, nil
+}
+
+// download writes the binary of a release to file and checks its size,
+// sha256 and signature
+func (s *selfUpdater) download(ctx context.Context, version string, asset ReleaseAsset, file *os.File) error {
+	signature, err := base64.StdEncoding.DecodeString(asset.Signature)
+	if err != nil || len(signature) != ed25519.SignatureSize {
+		return fmt.Errorf("release %s has an invalid signature", version)
+	}
+
+	resp, err := s.get(ctx, asset.URL)
+	if err != nil {
+		return errors.Wrap(err, "failed to download release")
+	}
+	defer resp.Body.Close()
+
+	h := sha256.New()
+	body := io.Reader(resp.Body)
+	if asset.Size > 0 {
+		body = io.LimitReader(resp.Body, asset.Size+1)
+	}
+	written, err := io.Copy(io.MultiWriter(file, h), body)
+	if err != nil {
+		return errors.Wrap(err, "failed to download release")
+	}
+	if asset.Size > 0 && written != asset.Size {
+		return fmt.Errorf("downloaded %d bytes, release %s has %d", written, version, asset.Size)
+	}
+
+	sha := hex.EncodeToString(h.Sum(nil))
+	if !strings.EqualFold(sha, asset.SHA256) {
+		return fmt.Errorf("sha256 of the download is %s, release %s has %s", sha, version, asset.SHA256)
+	}
+	platform := runtime.GOOS + "/" + runtime.GOARCH
+	if !ed25519.Verify(s.key, []byte(releaseMessage(version, platform, sha)), signature) {
+		return fmt.Errorf("signature of release %s does not match, it was not signed with the release key", version)
+	}
+	return nil
+}
+
+// replaceExecutable swaps exe for the verified binary at file with a rename,
+// so exe is either the old or the new binary whatever happens. Windows does
+// not let a running program be replaced, it is moved aside to exe.old first.
+func replaceExecutable(exe, file string) error {
+	if runtime.GOOS == "windows" {
+		old := exe + ".old"
+		os.Remove(old)
+		if err := os.Rename(exe, old); err != nil {
+			return err
+		}
+		if err := os.Rename(file, exe); err != nil {
+			os.Rename(old, exe)
+			return err
+		}
+		return nil
+	}
+	return os.Rename(file, exe)
+}
+
+func selfUpdate(c *cli.Context) error {
+	updater, err := newSelfUpdater(c.String("url"), c.String("key"), c.String("ca"), c.Duration("timeout"))
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+
+	version, asset, err := updater.latest(ctx)
+	if err != nil {
+		return err
+	}
+	current := strings.Fields(Version + " ")[0]
+	if !newerRelease(current, version) && !c.Bool("force") {
+		fmt.Printf("%s is up to date (latest release: %s)\n", current, version)
+		return nil
+	}
+	if c.Bool("check") {
+		fmt.Printf("%s is available (running %s)\n", version, current)
+		return cli.NewExitError("", 1)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return errors.Wrap(err, "failed to find the running binary")
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return errors.Wrap(err, "failed to find the running binary")
+	}
+	info, err := os.Stat(exe)
+	if err != nil {
+		return err
+	}
+
+	// next to the binary, so the rename does not cross filesystems
+	tmpfile, err := ioutil.TempFile(filepath.Dir(exe), ".drweb-update-")
+	if err != nil {
+		return errors.Wrap(err, "failed to create the new binary next to the running one")
+	}
+	defer os.Remove(tmpfile.Name())
+	err = updater.download(ctx, version, asset, tmpfile)
+	if closeErr := tmpfile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpfile.Name(), info.Mode().Perm()); err != nil {
+		return err
+	}
+
+	// a binary that does not even start is not swapped in
+	checkCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	if out, err := exec.CommandContext(checkCtx, tmpfile.Name(), "--version").CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "release %s does not run on this host: %s", version, strings.TrimSpace(string(out)))
+	}
+
+	if err := replaceExecutable(exe, tmpfile.Name()); err != nil {
+		return errors.Wrapf(err, "failed to replace %s", exe)
+	}
+	log.WithFields(log.Fields{
+		"plugin":   name,
+		"category": category,
+		"from":     current,
+		"to":       version,
+	}).Info("updated ", exe)
+	fmt.Printf("updated %s from %s to %s\n", exe, current, version)
+	return nil
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// quarantineDirName is the default quarantine directory, inside the protected one
+const quarantineDirName = ".drweb-quarantine"
+
+// maxShareFindings is how many infected files the status page lists
+const maxShareFindings = 100
+
+// fileStamp tells a changed file from one that was scanned already
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+// ShareFinding json object, an infected file and where it was moved to
+type ShareFinding struct {
+	Path        string    `json:"path"`
+	SHA256      string    `json:"sha256"`
+	Detections  []string  `json:"detections"`
+	Quarantined string    `json:"quarantined,omitempty"`
+	Error       string    `json:"error,omitempty"` // why it was not quarantined
+	FoundAt     time.Time `json:"found_at"`
+}
+
+// ShareStatus json object, what the status page shows
+type ShareStatus struct {
+	Dir          string         `json:"dir"`
+	Host         *HostFacts     `json:"host,omitempty"`
+	Quarantine   string         `json:"quarantine"`
+	Started      time.Time      `json:"started"`
+	Engine       string         `json:"engine,omitempty"`
+	Database     string         `json:"database,omitempty"`
+	EngineError  string         `json:"engine_error,omitempty"`
+	Files        int            `json:"files"`
+	Scanned      int            `json:"scanned"`
+	Infected     int            `json:"infected"`
+	Quarantined  int            `json:"quarantined"`
+	Errors       int            `json:"errors"`
+	LastScanAt   *time.Time     `json:"last_scan_at,omitempty"`
+	FullScan     *ScanSummary   `json:"last_full_scan,omitempty"`
+	FullScanAt   *time.Time     `json:"last_full_scan_at,omitempty"`
+	NextFullScan *time.Time     `json:"next_full_scan_at,omitempty"`
+	Findings     []ShareFinding `json:"findings"`
+}
+
+// QuarantineRecord json object, written next to a quarantined file as <sha256>.json
+type QuarantineRecord struct {
+	Path          string      `json:"path"`
+	Host          *HostFacts  `json:"host,omitempty"`
+	SHA256        string      `json:"sha256"`
+	QuarantinedAt time.Time   `json:"quarantined_at"`
+	Results       ResultsData `json:"drweb"`
+}
+
+// shareGuard protects a single directory tree, e.g. an SMB drop folder: new
+// and changed files are scanned once they stopped changing, the whole tree
+// again on a schedule with the latest virus base, and infected files are
+// moved to the quarantine directory. Scans run one at a time.
+type shareGuard struct {
+	sync.Mutex
+	root       string
+	quarantine string
+	exclude    *exclusions
+	timeout    int
+	facts      func() (*HostFacts, error) // of the host, read again for every full scan
+
+	known   map[string]fileStamp // files scanned as they were
+	pending map[string]fileStamp // changed files, scanned once they settled
+	status  ShareStatus
+}
+
+func newShareGuard(root, quarantine string, exclude *exclusions, timeout int, host *HostFacts) *shareGuard {
+	return &shareGuard{
+		root:       root,
+		quarantine: quarantine,
+		exclude:    exclude,
+		timeout:    timeout,
+		known:      make(map[string]fileStamp),
+		pending:    make(map[string]fileStamp),
+		status:     ShareStatus{Dir: root, Host: host, Quarantine: quarantine, Started: time.Now().UTC(), Findings: []ShareFinding{}},
+	}
+}
+
+// files returns the stamps of the regular files in the tree
+func (g *shareGuard) files() map[string]fileStamp {
+	return treeFiles(g.root, g.exclude)
+}
+
+// treeFiles returns the stamps of the regular files below root by their
+// path relative to it, symbolic links are not followed
+func treeFiles(root string, exclude *exclusions) map[string]fileStamp {
+	files := make(map[string]fileStamp)
+	filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			// unreadable files are reported by the full scans
+			return nil
+		}
+		rel, _ := filepath.Rel(root, file)
+		if file != root && exclude.excluded(file, rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			files[rel] = fileStamp{size: info.Size(), modTime: info.ModTime()}
+		}
+		return nil
+	})
+	return files
+}
+
+// poll scans the files that changed since the last poll and then stayed the
+// same for a whole interval, so files still being copied are left alone
+func (g *shareGuard) poll() {
+	files := g.files()
+	for rel, stamp := range files {
+		if g.known[rel] == stamp {
+			delete(g.pending, rel)
+			continue
+		}
+		if g.pending[rel] != stamp {
+			g.pending[rel] = stamp
+			continue
+		}
+		delete(g.pending, rel)
+		g.known[rel] = stamp
+		g.scanFile(rel)
+	}
+	for rel := range g.known {
+		if _, ok := files[rel]; !ok {
+			delete(g.known, rel)
+		}
+	}
+	for rel := range g.pending {
+		if _, ok := files[rel]; !ok {
+			delete(g.pending, rel)
+		}
+	}
+
+	g.Lock()
+	g.status.Files = len(files)
+	g.Unlock()
+}
+
+// scanFile scans a file of the tree and quarantines it if it is infected
+func (g *shareGuard) scanFile(rel string) {
+	file := filepath.Join(g.root, rel)
+	sha, err := fileSHA256(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			g.failed(rel, err)
+		}
+		return
+	}
+	log.WithFields(log.Fields{
+		"plugin":   name,
+		"category": category,
+	}).Debug("scanning: ", rel)
+
+	results := avScanFile(context.Background(), file, g.timeout, currentDefaultProfile()).Results
+	suppress(sha, "", &Submitter{KeyID: "serve-dir"}, &results)
+	audit.verdict(sha, &Submitter{KeyID: "serve-dir"}, results)
+	g.scanned(results)
+	if len(results.Error) > 0 {
+		g.failed(rel, errors.New(results.Error))
+		return
+	}
+	if results.Infected {
+		g.found(rel, sha, results)
+	}
+}
+
+// fullScan scans the whole tree like the dir command and quarantines what
+// it finds
+func (g *shareGuard) fullScan() {
+	log.WithFields(log.Fields{
+		"plugin":   name,
+		"category": category,
+	}).Info("full scan of ", g.root)
+
+	if g.facts != nil {
+		host, err := g.facts()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"plugin":   name,
+				"category": category,
+			}).Warn(errors.Wrap(err, "failed to read the host facts again, keeping the previous ones"))
+		} else {
+			g.Lock()
+			g.status.Host = host
+			g.Unlock()
+		}
+	}
+
+	report := DirReport{Dir: g.root, Summary: newScanSummary(0, 0), Entries: []dirEntry{}, Errors: []DirError{}}
+	scan := dirScan{root: g.root, exclude: g.exclude, infectedOnly: true, timeout: g.timeout, report: &report}
+	if err := scan.scan(); err != nil {
+		g.failed(".", err)
+		return
+	}
+	report.Summary.finish()
+
+	for _, entry := range report.Entries {
+		audit.verdict(entry.SHA256, &Submitter{KeyID: "serve-dir"}, entry.Results)
+		g.found(entry.Path, entry.SHA256, entry.Results)
+	}
+	for _, failure := range report.Errors {
+		log.WithFields(log.Fields{
+			"plugin":   name,
+			"category": category,
+			"reason":   failure.Reason,
+		}).Warn("full scan failed to scan ", failure.Path, ": ", failure.Error)
+	}
+
+	now := time.Now().UTC()
+	g.Lock()
+	g.status.FullScan, g.status.FullScanAt = &report.Summary, &now
+	g.status.Scanned += report.Summary.Scanned
+	g.status.Errors += report.Summary.Errors
+	g.Unlock()
+}
+
+// scanned records the engine and virus base of a scan
+func (g *shareGuard) scanned(results ResultsData) {
+	now := time.Now().UTC()
+	g.Lock()
+	defer g.Unlock()
+	g.status.Scanned++
+	g.status.LastScanAt = &now
+	if len(results.Database) > 0 {
+		g.status.Engine, g.status.Database = results.Engine, results.Database
+	}
+}
+
+func (g *shareGuard) failed(rel string, err error) {
+	g.Lock()
+	g.status.Errors++
+	g.Unlock()
+	log.WithFields(log.Fields{
+		"plugin":   name,
+		"category": category,
+	}).Warn(errors.Wrapf(err, "failed to scan %s", rel))
+}
+
+// found quarantines an infected file and lists it on the status page
+func (g *shareGuard) found(rel, sha string, results ResultsData) {
+	finding := ShareFinding{Path: rel, SHA256: sha, Detections: detections(results), FoundAt: time.Now().UTC()}
+	quarantined, err := g.quarantineFile(rel, sha, results)
+	if err != nil {
+		finding.Error = err.Error()
+	} else {
+		finding.Quarantined = quarantined
+	}
+
+	entry := log.WithFields(log.Fields{
+		"plugin":     name,
+		"category":   category,
+		"path":       rel,
+		"sha256":     sha,
+		"detections": strings.Join(finding.Detections, ", "),
+	})
+	if err != nil {
+		entry.Error(errors.Wrap(err, "infected file could not be quarantined"))
+	} else {
+		entry.Warn("infected file quarantined")
+	}
+
+	g.Lock()
+	defer g.Unlock()
+	g.status.Infected++
+	if err == nil {
+		g.status.Quarantined++
+	}
+	g.status.Findings = append([]ShareFinding{finding}, g.status.Findings...)
+	if len(g.status.Findings) > maxShareFindings {
+		g.status.Findings = g.status.Findings[:maxShareFindings]
+	}
+}
+
+// quarantineFile moves an infected file to the quarantine directory
+func (g *shareGuard) quarantineFile(rel, sha string, results ResultsData) (string, error) {
+	g.Lock()
+	host := g.status.Host
+	g.Unlock()
+	record := QuarantineRecord{Path: rel, Host: host, SHA256: sha, QuarantinedAt: time.Now().UTC(), Results: results}
+	return quarantineFile(&dirTarget{dir: g.quarantine, private: true}, filepath.Join(g.root, rel), record)
+}
+
+// quarantineFile moves an infected file to quarantine as <sha256>, with a
+// <sha256>.json of where it came from and what was found in it
+func quarantineFile(quarantine dispositionTarget, file string, record QuarantineRecord) (string, error) {
+	recordJSON, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if _, err := quarantine.write(record.SHA256+".json", recordJSON); err != nil {
+		return "", errors.Wrap(err, "failed to write quarantine record")
+	}
+	target, err := quarantine.move(file, record.SHA256)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to move file to quarantine")
+	}
+	return target, nil
+}
+
+// moveFile copies file to target and removes it. The copy is renamed to
+// target once complete, so target is never seen half written.
+func moveFile(file, target string) error {
+	src, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	dst, err := ioutil.TempFile(filepath.Dir(target), "."+filepath.Base(target)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dst.Name())
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(dst.Name(), info.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := os.Rename(dst.Name(), target); err != nil {
+		return err
+	}
+	src.Close()
+	return os.Remove(file)
+}
+
+// snapshot returns the status for the status page
+func (g *shareGuard) snapshot() ShareStatus {
+	g.Lock()
+	defer g.Unlock()
+	status := g.status
+	status.EngineError = engineState.unavailable()
+	status.Findings = append([]ShareFinding{}, g.status.Findings...)
+	return status
+}
+
+// run scans the whole tree, then polls for changes every poll interval and
+// scans the whole tree again every fullScan, 0 for never
+func (g *shareGuard) run(poll, fullScan time.Duration) {
+	// files already there are scanned by the first full scan, not the polls
+	g.known = g.files()
+	for {
+		g.fullScan()
+		next := time.Now().Add(fullScan)
+		if fullScan > 0 {
+			at := next.UTC()
+			g.Lock()
+			g.status.NextFullScan = &at
+			g.Unlock()
+		}
+		for fullScan <= 0 || time.Now().Before(next) {
+			time.Sleep(poll)
+			g.poll()
+		}
+	}
+}
+
+// webShareStatus serves the status page, as json with ?format=json or an
+// Accept of application/json
+func (g *shareGuard) webShareStatus(page *template.Template) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := g.snapshot()
+		if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+			writeJSON(w, http.StatusOK, status)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := page.Execute(w, struct {
+			ShareStatus
+			Version string
+		}{status, Version}); err != nil {
+			log.WithFields(log.Fields{
+				"plugin":   name,
+				"category": category,
+			}).Error(errors.Wrap(err, "failed to render status page"))
+		}
+	}
+}
+
+func serveDir(c *cli.Context) error {
+
+	if len(c.String("dir")) == 0 {
+		return fmt.Errorf("please supply a directory to protect with --dir")
+	}
+	root, err := filepath.Abs(c.String("dir"))
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(root); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", root)
+	}
+
+	quarantine := c.String("quarantine")
+	if len(quarantine) == 0 {
+		quarantine = filepath.Join(root, quarantineDirName)
+	}
+	if quarantine, err = filepath.Abs(quarantine); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(quarantine, 0700); err != nil {
+		return errors.Wrap(err, "failed to create quarantine directory")
+	}
+
+	exclude, err := parseExclusions(c.StringSlice("exclude"))
+	if err != nil {
+		return err
+	}
+	// the quarantine is never scanned, also when it is inside the tree
+	exclude.paths = append(exclude.paths, quarantine)
+	if c.Duration("poll") <= 0 {
+		return fmt.Errorf("--poll must be positive")
+	}
+
+	page, err := template.New("serve-dir").Funcs(template.FuncMap{
+		"join": strings.Join,
+	}).Parse(string(asset("servedir.html.tmpl")))
+	if err != nil {
+		return err
+	}
+
+	host, err := hostFacts(c)
+	if err != nil {
+		return err
+	}
+	guard := newShareGuard(root, quarantine, exclude, c.GlobalInt("timeout"), host)
+	if host != nil {
+		guard.facts = func() (*HostFacts, error) { return hostFacts(c) }
+	}
+	go guard.run(c.Duration("poll"), c.Duration("full-scan"))
+
+	router := mux.NewRouter().StrictSlash(true)
+	router.HandleFunc("/", guard.webShareStatus(page)).Methods("GET")
+	log.WithFields(log.Fields{
+		"plugin":     name,
+		"category":   category,
+		"quarantine": quarantine,
+	}).Info("protecting ", root, ", status page on ", c.String("listen"))
+	return http.ListenAndServe(c.String("listen"), router)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// engineSession remembers that drweb-configd is running with a valid
+// license, so scans only spawn drweb-ctl scan instead of also checking the
+// license, starting the daemon and waiting for it every time. The protocol
+// drweb-ctl speaks with drweb-configd is not documented, so scans still go
+// through drweb-ctl; --engine-output json makes its verdicts structured.
+type engineSession struct {
+	sync.Mutex
+	ttl      time.Duration // 0 prepares the engine before every scan
+	ready    bool
+	readyAt  time.Time
+	prepared int
+	reused   int
+}
+
+var session = &engineSession{ttl: 5 * time.Minute}
+
+// prepare makes sure the license is valid and the daemon runs, unless that
+// was done within the session ttl. Concurrent callers wait for the one
+// preparing the engine.
+func (s *engineSession) prepare(ctx context.Context) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.ready && s.ttl > 0 && time.Since(s.readyAt) < s.ttl {
+		s.reused++
+		return nil
+	}
+
+	expired, err := didLicenseExpire(ctx)
+	if err != nil {
+		return err
+	}
+	if expired {
+		if err := updateLicense(ctx); err != nil {
+			return err
+		}
+	}
+
+	// drweb needs to have the daemon started first
+	if err := startConfigd(ctx); err != nil {
+		return err
+	}
+	time.Sleep(1 * time.Second)
+
+	s.ready, s.readyAt = true, time.Now()
+	s.prepared++
+	return nil
+}
+
+// warm reports whether the next scan does not need to prepare the engine,
+// never with a ttl of 0
+func (s *engineSession) warm() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.ttl > 0 && s.ready && time.Since(s.readyAt) < s.ttl
+}
+
+// renew prepares the engine again if the session expires within margin, so
+// the scans after it do not have to
+func (s *engineSession) renew(ctx context.Context, margin time.Duration) error {
+	s.Lock()
+	expiring := s.ttl > 0 && time.Since(s.readyAt) > s.ttl-margin
+	if expiring {
+		s.ready = false
+	}
+	s.Unlock()
+	if !expiring {
+		return nil
+	}
+	return s.prepare(ctx)
+}
+
+// invalidate makes the next scan prepare the engine again
+func (s *engineSession) invalidate(reason string) {
+	s.Lock()
+	s.ready = false
+	s.Unlock()
+
+	log.WithFields(log.Fields{
+		"plugin":   name,
+		"category": category,
+	}).Debug("engine session invalidated: ", reason)
+}
+
+func init() {
+	expvar.Publish("engine_session", expvar.Func(func() interface{} {
+		session.Lock()
+		defer session.Unlock()
+		return map[string]interface{}{
+			"enabled":  session.ttl > 0,
+			"ready":    session.ready,
+			"ready_at": session.readyAt,
+			"prepared": session.prepared,
+			"reused":   session.reused,
+		}
+	}))
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxShadowScans is how many shadow scans may run at once, uploads arriving
+// while they all are busy are not mirrored
+const maxShadowScans = 4
+
+// maxShadowMismatches is how many of the latest mismatches are kept
+const maxShadowMismatches = 50
+
+// kinds of verdict differences
+const (
+	shadowMissed  = "missed"  // only this engine detected the sample
+	shadowNew     = "new"     // only the shadow engine detected the sample
+	shadowRenamed = "renamed" // both detected it under different names
+)
+
+// ShadowMismatch json object, a sample the engines disagree about
+type ShadowMismatch struct {
+	SHA256  string      `json:"sha256"`
+	Kind    string      `json:"kind"`
+	Primary PeerVerdict `json:"primary"`
+	Shadow  PeerVerdict `json:"shadow"`
+	At      time.Time   `json:"at"`
+}
+
+// ShadowStats json object
+type ShadowStats struct {
+	Target     string           `json:"target"`
+	Scans      int              `json:"scans"`
+	Agreed     int              `json:"agreed"`
+	Mismatches map[string]int   `json:"mismatches"`
+	Errors     int              `json:"errors"`
+	Dropped    int              `json:"dropped"`
+	Recent     []ShadowMismatch `json:"recent"`
+}
+
+// shadowScanner mirrors uploads to a second engine, e.g. a new Dr.Web
+// version, and counts where its verdicts differ from ours. Shadow scans run
+// in the background and never change the results returned to clients.
+type shadowScanner struct {
+	sync.Mutex
+	url     string // another plugin web service
+	peer    *peerPlugins
+	ctl     string // or the drweb-ctl of another installation
+	timeout time.Duration
+	slots   chan struct{}
+	stats   ShadowStats
+}
+
+// shadow is nil unless --shadow-url or --shadow-engine-dir is set
+var shadow *shadowScanner
+
+func newShadowScanner(url, engineDir, token string, timeout time.Duration) (*shadowScanner, error) {
+	s := &shadowScanner{
+		timeout: timeout,
+		slots:   make(chan struct{}, maxShadowScans),
+		stats:   ShadowStats{Mismatches: map[string]int{}, Recent: []ShadowMismatch{}},
+	}
+	switch {
+	case len(url) > 0 && len(engineDir) > 0:
+		return nil, fmt.Errorf("--shadow-url and --shadow-engine-dir can not be used together")
+	case len(url) > 0:
+		s.peer = newPeerPlugins([]string{url}, token, timeout)
+		if len(s.peer.urls) == 0 {
+			return nil, fmt.Errorf("invalid --shadow-url %q", url)
+		}
+		s.url = s.peer.urls[0]
+		s.stats.Target = s.url
+	case !ctlEngine:
+		return nil, fmt.Errorf("--shadow-engine-dir needs drweb-ctl, which Dr.Web for Windows does not have")
+	default:
+		_, s.ctl = engineBinaries(engineDir)
+		if _, err := os.Stat(s.ctl); err != nil {
+			return nil, err
+		}
+		s.stats.Target = s.ctl
+	}
+	return s, nil
+}
+
+// ask scans the sample with the shadow engine
+func (s *shadowScanner) ask(ctx context.Context, sha string, data []byte) PeerVerdict {
+	if s.peer != nil {
+		return s.peer.ask(ctx, s.url, sha, data)
+	}
+
+	verdict := PeerVerdict{URL: s.ctl}
+	tmpfile, err := ioutil.TempFile("", "shadow_")
+	if err != nil {
+		verdict.Error = err.Error()
+		return verdict
+	}
+	defer os.Remove(tmpfile.Name())
+	_, err = tmpfile.Write(data)
+	if closeErr := tmpfile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		verdict.Error = err.Error()
+		return verdict
+	}
+
+	// the other installation runs its own daemon, we only ask it to scan
+	output, err := runGroup(ctx, s.ctl, append(append([]string{"scan"}, reportArgs()...), tmpfile.Name())...)
+	results, _ := ParseDrWEBOutput(output, BaseInfo{}, err)
+	verdict.Infected, verdict.Result, verdict.Error = results.Infected, results.Result, results.Error
+	if len(verdict.Error) == 0 && results.Status != statusClean && results.Status != statusInfected {
+		verdict.Error = results.Status
+	}
+	return verdict
+}
+
+// mirror scans the sample with the shadow engine in the background and
+// compares its verdict with primary, the results of the local scan. Samples
+// without a local verdict are not mirrored.
+func (s *shadowScanner) mirror(sha string, data []byte, primary ResultsData) {
+	if s == nil || (primary.Status != statusClean && primary.Status != statusInfected) {
+		return
+	}
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		s.Lock()
+		s.stats.Dropped++
+		s.Unlock()
+		return
+	}
+
+	go func() {
+		defer func() { <-s.slots }()
+		ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+		defer cancel()
+		s.record(sha, primary, s.ask(ctx, sha, data))
+	}()
+}
+
+// compareShadow returns the kind of difference between the verdicts, empty if they agree
+func compareShadow(primary ResultsData, shadow PeerVerdict) string {
+	switch {
+	case primary.Infected && !shadow.Infected:
+		return shadowMissed
+	case !primary.Infected && shadow.Infected:
+		return shadowNew
+	case primary.Infected && primary.Result != shadow.Result:
+		return shadowRenamed
+	}
+	return ""
+}
+
+func (s *shadowScanner) record(sha string, primary ResultsData, verdict PeerVerdict) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.stats.Scans++
+	if len(verdict.Error) > 0 {
+		s.stats.Errors++
+		log.WithFields(log.Fields{
+			"plugin":   name,
+			"category": category,
+			"sha256":   sha,
+		}).Warn("shadow scan failed: ", verdict.Error)
+		return
+	}
+	kind := compareShadow(primary, verdict)
+	if len(kind) == 0 {
+		s.stats.Agreed++
+		return
+	}
+
+	s.stats.Mismatches[kind]++
+	mismatch := ShadowMismatch{
+		SHA256:  sha,
+		Kind:    kind,
+		Primary: PeerVerdict{Infected: primary.Infected, Result: primary.Result, Engine: primary.Engine, Updated: updatedString(primary)},
+		Shadow:  verdict,
+		At:      time.Now().UTC(),
+	}
+	s.stats.Recent = append(s.stats.Recent, mismatch)
+	if len(s.stats.Recent) > maxShadowMismatches {
+		s.stats.Recent = s.stats.Recent[len(s.stats.Recent)-maxShadowMismatches:]
+	}
+	log.WithFields(log.Fields{
+		"plugin":   name,
+		"category": category,
+		"sha256":   sha,
+		"kind":     kind,
+		"primary":  primary.Result,
+		"shadow":   verdict.Result,
+	}).Warn("shadow engine verdict differs")
+}
+
+// snapshot returns a copy of the stats
+func (s *shadowScanner) snapshot() ShadowStats {
+	s.Lock()
+	defer s.Unlock()
+
+	stats := s.stats
+	stats.Mismatches = make(map[string]int, len(s.stats.Mismatches))
+	for kind, n := range s.stats.Mismatches {
+		stats.Mismatches[kind] = n
+	}
+	stats.Recent = append([]ShadowMismatch{}, s.stats.Recent...)
+	return stats
+}
+
+func init() {
+	expvar.Publish("shadow", expvar.Func(func() interface{} {
+		if shadow == nil {
+			return nil
+		}
+		return shadow.snapshot()
+	}))
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// priorityHeader is the HTTP header (or form field "priority") a scan's priority is read from
+const priorityHeader = "X-Malice-Priority"
+
+// scan priorities, high priority scans are never shed
+const (
+	priorityHigh   = "high"
+	priorityNormal = "normal"
+	priorityLow    = "low"
+)
+
+var scanPriorities = []string{priorityHigh, priorityNormal, priorityLow}
+
+// priorityRank orders priorities, the highest first, normal if empty
+func priorityRank(priority string) int {
+	for rank, p := range scanPriorities {
+		if p == priority {
+			return rank
+		}
+	}
+	return priorityRank(priorityNormal)
+}
+
+// jobPriority is the priority of a queued job, normal if it has none
+func jobPriority(priority string) string {
+	if len(priority) == 0 {
+		return priorityNormal
+	}
+	return priority
+}
+
+// requestPriority returns the priority of a parsed scan request, normal if it has none
+func requestPriority(r *http.Request) (string, error) {
+	priority := r.Header.Get(priorityHeader)
+	if r.MultipartForm != nil && len(r.MultipartForm.Value["priority"]) > 0 {
+		priority = r.MultipartForm.Value["priority"][0]
+	}
+	return parsePriority(priority)
+}
+
+// parsePriority returns priority in lower case, normal if it is empty
+func parsePriority(priority string) (string, error) {
+	priority = strings.ToLower(strings.TrimSpace(priority))
+	switch priority {
+	case "":
+		return priorityNormal, nil
+	case priorityHigh, priorityNormal, priorityLow:
+		return priority, nil
+	}
+	return "", fmt.Errorf("invalid priority %q (must be one of %s)", priority, strings.Join(scanPriorities, ", "))
+}
+
+type latencySample struct {
+	at      time.Time
+	latency time.Duration
+}
+
+// loadShedder rejects low priority scans while the average scan latency over
+// the last window is above threshold, and normal priority scans as well while
+// it is above twice the threshold
+type loadShedder struct {
+	sync.Mutex
+	threshold time.Duration
+	window    time.Duration
+	samples   []latencySample
+}
+
+var shedder = &loadShedder{window: time.Minute}
+
+// observe records the latency of a finished scan
+func (s *loadShedder) observe(latency time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	s.samples = append(s.expired(now), latencySample{at: now, latency: latency})
+}
+
+// expired drops the samples older than the window, s must be locked
+func (s *loadShedder) expired(now time.Time) []latencySample {
+	i := 0
+	for i < len(s.samples) && now.Sub(s.samples[i].at) > s.window {
+		i++
+	}
+	return s.samples[i:]
+}
+
+// latency is the average scan latency over the window, zero without any scans
+func (s *loadShedder) latency() time.Duration {
+	s.Lock()
+	defer s.Unlock()
+
+	s.samples = s.expired(time.Now())
+	if len(s.samples) == 0 {
+		return 0
+	}
+	var total time.Duration
+	for _, sample := range s.samples {
+		total += sample.latency
+	}
+	return total / time.Duration(len(s.samples))
+}
+
+// allow reports whether a scan with priority may go ahead and otherwise when to retry.
+// Once the slow scans fall out of the window scans are accepted again, even if
+// nothing but shed requests came in since.
+func (s *loadShedder) allow(priority string) (bool, time.Duration) {
+	if s.threshold <= 0 || priority == priorityHigh {
+		return true, 0
+	}
+	latency := s.latency()
+	if latency > 2*s.threshold || (latency > s.threshold && priority == priorityLow) {
+		return false, latency
+	}
+	return true, 0
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxSocketSample is the largest sample the socket accepts without --max-upload-size
+const maxSocketSample = 1 << 30
+
+// socketSource is the source of samples sent to the socket in /stats
+const socketSource = "socket"
+
+// SocketVerdict json object, the answer to a sample sent to the socket
+type SocketVerdict struct {
+	Verdict
+	Result string `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// serveSocket accepts samples on a unix socket for co-located applications:
+// every request is a 4 byte big-endian length and that many bytes of the
+// sample, every response a 4 byte big-endian length and the JSON verdict.
+// A connection may send any number of samples, one after another.
+func serveSocket(socket string, mode os.FileMode) error {
+	os.Remove(socket)
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return errors.Wrap(err, "failed to listen on --socket")
+	}
+	if err := os.Chmod(socket, mode); err != nil {
+		listener.Close()
+		return err
+	}
+	log.WithFields(log.Fields{
+		"plugin":   name,
+		"category": category,
+	}).Info("scan socket listening on ", socket)
+
+	go func() {
+		defer listener.Close()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				log.WithFields(log.Fields{
+					"plugin":   name,
+					"category": category,
+				}).Error(errors.Wrap(err, "scan socket stopped accepting connections"))
+				return
+			}
+			go serveSocketConn(conn)
+		}
+	}()
+	return nil
+}
+
+func serveSocketConn(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	limit := int64(maxSocketSample)
+	if maxUploadSize > 0 {
+		limit = maxUploadSize
+	}
+
+	for {
+		var size uint32
+		if err := binary.Read(reader, binary.BigEndian, &size); err != nil {
+			return
+		}
+		if int64(size) > limit {
+			// the sample is not read, so the connection can not be used any more
+			writeSocketVerdict(conn, SocketVerdict{Error: fmt.Sprintf("sample of %d bytes exceeds the limit of %d bytes", size, limit)})
+			return
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return
+		}
+		if err := writeSocketVerdict(conn, scanSocketSample(data)); err != nil {
+			return
+		}
+	}
+}
+
+// scanSocketSample scans a sample sent to the socket like an upload
+func scanSocketSample(data []byte) SocketVerdict {
+	sha := fmt.Sprintf("%x", sha256.Sum256(data))
+	if pair.role() == roleStandby {
+		return SocketVerdict{Verdict: Verdict{SHA256: sha}, Error: "this is the standby instance, send scans to the active one"}
+	}
+	if reason := engineState.unavailable(); len(reason) > 0 {
+		return SocketVerdict{Verdict: Verdict{SHA256: sha, Status: statusEngineUnavailable}, Error: reason}
+	}
+	if ok, wait := breaker.allow(); !ok {
+		return SocketVerdict{Verdict: Verdict{SHA256: sha}, Error: "scan engine is unavailable, try again in " + strconv.Itoa(int(wait.Seconds())+1) + "s"}
+	}
+	if !drain.enter() {
+		return SocketVerdict{Verdict: Verdict{SHA256: sha}, Error: drainingError}
+	}
+	defer drain.leave()
+
+	upload, err := newUploadScan(data, "", &Submitter{KeyID: socketSource, IP: socketSource}, time.Now(), ScanOptions{})
+	var drweb DrWEB
+	if err == nil {
+		audit.submitted(upload, socketSource)
+		drweb, err = upload.scan(context.Background())
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"plugin":   name,
+			"category": category,
+			"sha256":   sha,
+		}).Error(err)
+		return SocketVerdict{Verdict: Verdict{SHA256: sha, Status: statusError}, Error: err.Error()}
+	}
+	return SocketVerdict{Verdict: newVerdict(sha, drweb.Results), Result: drweb.Results.Result}
+}
+
+func writeSocketVerdict(w io.Writer, verdict SocketVerdict) error {
+	data, err := json.Marshal(verdict)
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	_, err = w.Write(append(frame, data...))
+	return err
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// resultSigner signs result documents with a detached JWS (RFC 7515 appendix F)
+type resultSigner struct {
+	key ed25519.PrivateKey
+	kid string
+}
+
+// signer is nil unless result signing is enabled
+var signer *resultSigner
+
+type jwsHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid,omitempty"`
+}
+
+// parseEd25519Key reads a PEM encoded PKCS#8 private or PKIX public Ed25519 key
+func parseEd25519Key(data []byte) (interface{}, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM encoded key found")
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch key.(type) {
+	case ed25519.PrivateKey, ed25519.PublicKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("key is not an Ed25519 key")
+}
+
+func loadSigner(file, kid string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return errors.Wrap(err, "failed to read signing key")
+	}
+	key, err := parseEd25519Key(data)
+	if err != nil {
+		return errors.Wrapf(err, "failed to parse signing key %s", file)
+	}
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return fmt.Errorf("signing key %s is a public key", file)
+	}
+
+	signer = &resultSigner{key: private, kid: kid}
+	return nil
+}
+
+// canonicalJSON encodes v with sorted keys, no insignificant whitespace and no
+// HTML escaping so signatures survive being re-encoded by consumers
+func canonicalJSON(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var generic interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&generic); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(generic); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// sign returns the detached JWS of doc without its signature
+func (s *resultSigner) sign(doc DrWEB) (string, error) {
+	doc.Signature = ""
+	payload, err := canonicalJSON(doc)
+	if err != nil {
+		return "", err
+	}
+	header, err := json.Marshal(jwsHeader{Alg: "EdDSA", Kid: s.kid})
+	if err != nil {
+		return "", err
+	}
+
+	encodedHeader := base64.RawURLEncoding.EncodeToString(header)
+	signingInput := encodedHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	signature := ed25519.Sign(s.key, []byte(signingInput))
+
+	return encodedHeader + ".." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// verifyResult checks the signature embedded in a result document
+func verifyResult(data []byte, key ed25519.PublicKey) error {
+	var doc map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil {
+		return errors.Wrap(err, "failed to parse result")
+	}
+	jws, _ := doc["signature"].(string)
+	if len(jws) == 0 {
+		return fmt.Errorf("result is not signed")
+	}
+	delete(doc, "signature")
+
+	parts := strings.Split(jws, ".")
+	if len(parts) != 3 || len(parts[1]) != 0 {
+		return fmt.Errorf("signature is not a detached JWS")
+	}
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return errors.Wrap(err, "failed to decode signature header")
+	}
+	var h jwsHeader
+	if err := json.Unmarshal(header, &h); err != nil || h.Alg != "EdDSA" {
+		return fmt.Errorf("unsupported signature algorithm")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return errors.Wrap(err, "failed to decode signature")
+	}
+
+	payload, err := canonicalJSON(doc)
+	if err != nil {
+		return err
+	}
+	signingInput := parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload)
+	if !ed25519.Verify(key, []byte(signingInput), signature) {
+		return fmt.Errorf("signature does not match the result")
+	}
+	return nil
+}
+
+func verify(c *cli.Context) error {
+	if !c.Args().Present() {
+		return fmt.Errorf("please supply a result to verify")
+	}
+	if len(c.String("key")) == 0 {
+		return fmt.Errorf("please supply the public key to verify with (--key)")
+	}
+
+	keyData, err := ioutil.ReadFile(c.String("key"))
+	if err != nil {
+		return err
+	}
+	key, err := parseEd25519Key(keyData)
+	if err != nil {
+		return err
+	}
+	var public ed25519.PublicKey
+	switch k := key.(type) {
+	case ed25519.PublicKey:
+		public = k
+	case ed25519.PrivateKey:
+		public = k.Public().(ed25519.PublicKey)
+	}
+
+	data, err := ioutil.ReadFile(c.Args().First())
+	if err != nil {
+		return err
+	}
+	if err := verifyResult(data, public); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	fmt.Println("OK")
+	return nil
+}
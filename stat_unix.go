@@ -0,0 +1,51 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+func statID(info os.FileInfo) (fileID, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileID{}, false
+	}
+	return fileID{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}, true
+}
+
+func isMountPoint(dir string, info os.FileInfo) bool {
+	parent, err := os.Stat(filepath.Dir(dir))
+	if err != nil {
+		return true
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	parentStat, pok := parent.Sys().(*syscall.Stat_t)
+	return !ok || !pok || stat.Dev != parentStat.Dev
+}
+
+// diskSpace returns the free and total bytes of the filesystem dir is on
+func diskSpace(dir string) (uint64, uint64, bool) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(dir, &fs); err != nil {
+		return 0, 0, false
+	}
+	return uint64(fs.Bavail) * uint64(fs.Bsize), uint64(fs.Blocks) * uint64(fs.Bsize), true
+}
+
+// privateDir reports whether the directory is ours and closed to everyone else
+func privateDir(info os.FileInfo) bool {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && int(stat.Uid) == os.Geteuid() && info.Mode().Perm()&0077 == 0
+}
+
+// defaultEngineWorkDir is the name of the engine working directory in the
+// shared temp dir, one per user so the privsep helper and web service each
+// have their own
+func defaultEngineWorkDir() string {
+	return "drweb-engine-" + strconv.Itoa(os.Geteuid())
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+var getDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// statID returns nothing, os.FileInfo has no file index on Windows so
+// directory scans rely on not following links to avoid loops
+func statID(info os.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
+
+// isMountPoint reports whether dir is the root of a volume
+func isMountPoint(dir string, info os.FileInfo) bool {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return true
+	}
+	return filepath.Dir(abs) == abs
+}
+
+// diskSpace returns the free and total bytes of the volume dir is on
+func diskSpace(dir string) (uint64, uint64, bool) {
+	p, err := syscall.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, 0, false
+	}
+	var free, total uint64
+	if r, _, _ := getDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&free)), uintptr(unsafe.Pointer(&total)), 0); r == 0 {
+		return 0, 0, false
+	}
+	return free, total, true
+}
+
+// privateDir reports true, the temp dir is private to the user on Windows
+// and its ACLs are inherited
+func privateDir(info os.FileInfo) bool {
+	return true
+}
+
+// defaultEngineWorkDir is the name of the engine working directory in the temp dir
+func defaultEngineWorkDir() string {
+	return "drweb-engine"
+}
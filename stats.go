@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Submitter json object
+type Submitter struct {
+	KeyID     string `json:"key_id,omitempty" structs:"key_id,omitempty"`
+	Tenant    string `json:"tenant,omitempty" structs:"tenant,omitempty"`
+	IP        string `json:"ip" structs:"ip"`
+	UserAgent string `json:"user_agent,omitempty" structs:"user_agent,omitempty"`
+}
+
+// behindProxy makes us trust the X-Forwarded-For header for the client IP
+var behindProxy bool
+
+// requestSubmitter returns who submitted r
+func requestSubmitter(r *http.Request) *Submitter {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if forwarded := r.Header.Get("X-Forwarded-For"); behindProxy && len(forwarded) > 0 {
+		ip = strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+	return &Submitter{
+		KeyID:     requestKeyID(r),
+		Tenant:    requestTenant(r),
+		IP:        ip,
+		UserAgent: r.UserAgent(),
+	}
+}
+
+// source is what submissions are grouped by in the statistics, the API key
+// or the client IP if the request was not authenticated, prefixed with the
+// tenant of the key as <tenant>/<key>
+func (s *Submitter) source() string {
+	if len(s.Tenant) > 0 {
+		return s.Tenant + "/" + s.KeyID
+	}
+	if len(s.KeyID) > 0 {
+		return s.KeyID
+	}
+	return s.IP
+}
+
+// SourceStats json object
+type SourceStats struct {
+	Scans        int     `json:"scans"`
+	Infected     int     `json:"infected"`
+	AvgLatencyMS float64 `json:"avg_latency_ms"`
+
+	latency time.Duration
+}
+
+// statsWindow is a period statistics are reported for, named as configured
+type statsWindow struct {
+	name   string
+	length time.Duration
+}
+
+// scanStats counts submissions per source in one minute buckets
+type scanStats struct {
+	sync.Mutex
+	windows []statsWindow
+	buckets map[int64]map[string]*SourceStats
+}
+
+// stats only keeps buckets as long as the largest window
+var stats = &scanStats{
+	windows: []statsWindow{{"1m", time.Minute}, {"1h", time.Hour}, {"24h", 24 * time.Hour}},
+	buckets: make(map[int64]map[string]*SourceStats),
+}
+
+// parseWindows parses a comma separated list of durations of at least a minute
+func parseWindows(list string) ([]statsWindow, error) {
+	var windows []statsWindow
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		length, err := time.ParseDuration(item)
+		if err != nil {
+			return nil, err
+		}
+		if length < time.Minute {
+			return nil, fmt.Errorf("statistics window %s is shorter than a minute", item)
+		}
+		windows = append(windows, statsWindow{name: item, length: length})
+	}
+	sort.Slice(windows, func(i, j int) bool { return windows[i].length < windows[j].length })
+	return windows, nil
+}
+
+func (s *scanStats) record(source string, infected bool, latency time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+
+	minute := time.Now().Unix() / 60
+	bucket, ok := s.buckets[minute]
+	if !ok {
+		bucket = make(map[string]*SourceStats)
+		s.buckets[minute] = bucket
+		s.prune(minute)
+	}
+	counters, ok := bucket[source]
+	if !ok {
+		counters = &SourceStats{}
+		bucket[source] = counters
+	}
+	counters.Scans++
+	if infected {
+		counters.Infected++
+	}
+	counters.latency += latency
+}
+
+// prune drops the buckets that are outside of every window, s must be locked
+func (s *scanStats) prune(minute int64) {
+	oldest := minute - int64(s.windows[len(s.windows)-1].length/time.Minute)
+	for m := range s.buckets {
+		if m <= oldest {
+			delete(s.buckets, m)
+		}
+	}
+}
+
+// snapshot sums up the buckets of every window, the current minute counts
+// towards all of them
+func (s *scanStats) snapshot() map[string]map[string]*SourceStats {
+	s.Lock()
+	defer s.Unlock()
+
+	minute := time.Now().Unix() / 60
+	snapshot := make(map[string]map[string]*SourceStats)
+	for _, window := range s.windows {
+		oldest := minute - int64(window.length/time.Minute)
+		sources := make(map[string]*SourceStats)
+		for m, bucket := range s.buckets {
+			if m <= oldest {
+				continue
+			}
+			for source, counters := range bucket {
+				sum, ok := sources[source]
+				if !ok {
+					sum = &SourceStats{}
+					sources[source] = sum
+				}
+				sum.Scans += counters.Scans
+				sum.Infected += counters.Infected
+				sum.latency += counters.latency
+			}
+		}
+		for _, sum := range sources {
+			sum.AvgLatencyMS = milliseconds(sum.latency) / float64(sum.Scans)
+		}
+		snapshot[window.name] = sources
+	}
+	return snapshot
+}
+
+// webStats returns the per source statistics of every window, and the totals
+// since the store was created if there is one. Admin keys of a tenant only
+// see the sources and totals of their tenant, not the latencies of the
+// whole service.
+func webStats(w http.ResponseWriter, r *http.Request) {
+	tenant := requestTenant(r)
+	response := make(map[string]interface{})
+	for window, sources := range stats.snapshot() {
+		if len(tenant) > 0 {
+			for source := range sources {
+				if !strings.HasPrefix(source, tenant+"/") {
+					delete(sources, source)
+				}
+			}
+		}
+		response[window] = sources
+	}
+	if store != nil {
+		totals, err := store.tenant(tenant).totals()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		response["totals"] = totals
+	}
+	if len(tenant) == 0 {
+		response["latency"] = latencies.snapshot()
+	}
+	if pool != nil && len(tenant) == 0 {
+		response["warm_pool"] = pool.snapshot()
+	}
+	writeJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// tags statsd metrics can carry per scan, see --statsd-tags
+const (
+	statsdTagHost    = "host"
+	statsdTagTenant  = "tenant"
+	statsdTagVerdict = "verdict"
+	statsdTagSource  = "source"
+	statsdTagProfile = "profile"
+)
+
+// statsdEmitter pushes scan metrics over UDP to statsd or the DogStatsD
+// agent. Plain statsd has no tags, they are only sent to DogStatsD.
+type statsdEmitter struct {
+	conn      net.Conn
+	prefix    string
+	dogstatsd bool
+	tags      map[string]bool
+	static    []string
+	host      string
+}
+
+// metrics is nil unless --statsd is set
+var metrics *statsdEmitter
+
+func newStatsdEmitter(addr, prefix, format, tags string, static []string) (*statsdEmitter, error) {
+	if format != "statsd" && format != "dogstatsd" {
+		return nil, fmt.Errorf("invalid --statsd-format %q (must be statsd or dogstatsd)", format)
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to connect to statsd at %s", addr)
+	}
+	m := &statsdEmitter{
+		conn:      conn,
+		prefix:    prefix,
+		dogstatsd: format == "dogstatsd",
+		tags:      make(map[string]bool),
+		static:    static,
+	}
+	for _, tag := range strings.Split(tags, ",") {
+		switch tag = strings.TrimSpace(tag); tag {
+		case "":
+		case statsdTagHost, statsdTagTenant, statsdTagVerdict, statsdTagSource, statsdTagProfile:
+			m.tags[tag] = true
+		default:
+			return nil, fmt.Errorf("invalid --statsd-tags %q (must be host, tenant, verdict, source or profile)", tag)
+		}
+	}
+	for _, tag := range static {
+		if !strings.Contains(tag, ":") {
+			return nil, fmt.Errorf("invalid --statsd-tag %q (must be KEY:VALUE)", tag)
+		}
+	}
+	m.host, _ = os.Hostname()
+	return m, nil
+}
+
+// send writes a metric, errors are logged at debug level only as UDP
+// metrics are best effort
+func (m *statsdEmitter) send(metric, value, kind string, tags []string) {
+	line := m.prefix + metric + ":" + value + "|" + kind
+	if m.dogstatsd && len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+	if _, err := m.conn.Write([]byte(line)); err != nil {
+		log.WithFields(log.Fields{
+			"plugin":   name,
+			"category": category,
+		}).Debug(errors.Wrap(err, "failed to send statsd metric"))
+	}
+}
+
+// sanitizeTag drops the characters DogStatsD uses as separators
+func sanitizeTag(value string) string {
+	return strings.NewReplacer(",", "_", "|", "_", "#", "_").Replace(value)
+}
+
+// scan counts a scan of an upload and times it, failed scans count as errors
+func (m *statsdEmitter) scan(submitter *Submitter, profile string, results ResultsData, latency time.Duration) {
+	if m == nil {
+		return
+	}
+	verdict := results.Status
+	if len(verdict) == 0 {
+		verdict = statusClean
+		if results.Infected {
+			verdict = statusInfected
+		}
+	}
+
+	tags := append([]string{}, m.static...)
+	add := func(tag, value string) {
+		if m.tags[tag] && len(value) > 0 {
+			tags = append(tags, tag+":"+sanitizeTag(value))
+		}
+	}
+	add(statsdTagHost, m.host)
+	add(statsdTagVerdict, verdict)
+	add(statsdTagProfile, profile)
+	if submitter != nil {
+		add(statsdTagTenant, submitter.Tenant)
+		add(statsdTagSource, submitter.source())
+	}
+
+	m.send("scans", "1", "c", tags)
+	m.send("scan.latency", fmt.Sprintf("%d", latency.Nanoseconds()/int64(time.Millisecond)), "ms", tags)
+	switch verdict {
+	case statusInfected:
+		m.send("infected", "1", "c", tags)
+	case statusClean, statusSkipped:
+	default:
+		m.send("errors", "1", "c", tags)
+	}
+}
+
+// warmScan times a scan of the warm pool as warm or cold
+func (m *statsdEmitter) warmScan(warm bool, latency time.Duration) {
+	if m == nil {
+		return
+	}
+	metric := "scan.latency.cold"
+	if warm {
+		metric = "scan.latency.warm"
+	}
+	m.send(metric, fmt.Sprintf("%d", latency.Nanoseconds()/int64(time.Millisecond)), "ms", m.static)
+}
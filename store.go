@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/malice-plugins/pkgs/utils"
+	"github.com/pkg/errors"
+)
+
+// storeTimeFormat sorts lexically in chronological order
+const storeTimeFormat = "20060102T150405.000000000Z"
+
+// StoredResult json object
+type StoredResult struct {
+	SHA256    string      `json:"sha256"`
+	ScannedAt time.Time   `json:"scanned_at"`
+	Results   ResultsData `json:"drweb"`
+}
+
+// resultStore keeps every scan result on disk as
+// <dir>/results/<sha256>/<scan time>.json and optionally the scanned samples
+// as <dir>/samples/<sha256>. The results and totals of tenants are kept apart
+// in <dir>/tenants/<tenant>.
+type resultStore struct {
+	dir string
+}
+
+// store is nil unless a local store directory is configured
+var store *resultStore
+
+func openStore(dir string) (*resultStore, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "results"), 0755); err != nil {
+		return nil, errors.Wrapf(err, "failed to create store in %s", dir)
+	}
+	return &resultStore{dir: dir}, nil
+}
+
+// tenant returns the part of the store with the results of tenant, the store
+// itself for no tenant
+func (s *resultStore) tenant(tenant string) *resultStore {
+	if s == nil || len(tenant) == 0 {
+		return s
+	}
+	return &resultStore{dir: filepath.Join(s.dir, "tenants", tenant)}
+}
+
+// tenants returns the parts of the store of every tenant that stored results
+func (s *resultStore) tenants() ([]*resultStore, error) {
+	dirs, err := ioutil.ReadDir(filepath.Join(s.dir, "tenants"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var stores []*resultStore
+	for _, dir := range dirs {
+		if dir.IsDir() && validTenantID(dir.Name()) {
+			stores = append(stores, s.tenant(dir.Name()))
+		}
+	}
+	return stores, nil
+}
+
+func validSHA256(sha string) bool {
+	hashType, err := utils.GetHashType(sha)
+	return err == nil && hashType == "sha256"
+}
+
+func (s *resultStore) sampleDir(sha string) string {
+	return filepath.Join(s.dir, "results", strings.ToLower(sha))
+}
+
+// save stores the results of a scan of the sample with the given sha256
+func (s *resultStore) save(sha string, results ResultsData) (StoredResult, error) {
+	results.MarkDown = ""
+	stored := StoredResult{
+		SHA256:    strings.ToLower(sha),
+		ScannedAt: time.Now().UTC(),
+		Results:   results,
+	}
+	return stored, s.write(stored)
+}
+
+// restore stores the results of an earlier scan, unless the store already
+// has results of the sample scanned at that time
+func (s *resultStore) restore(stored StoredResult) (bool, error) {
+	stored.SHA256 = strings.ToLower(stored.SHA256)
+	stored.ScannedAt = stored.ScannedAt.UTC()
+	stored.Results.MarkDown = ""
+	if _, err := os.Stat(s.resultFile(stored)); err == nil {
+		return false, nil
+	}
+	return true, s.write(stored)
+}
+
+func (s *resultStore) resultFile(stored StoredResult) string {
+	return filepath.Join(s.sampleDir(stored.SHA256), stored.ScannedAt.Format(storeTimeFormat)+".json")
+}
+
+func (s *resultStore) write(stored StoredResult) error {
+	if err := os.MkdirAll(s.sampleDir(stored.SHA256), 0755); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(s.resultFile(stored), data)
+
+	return errors.Wrapf(err, "failed to store results for %s", stored.SHA256)
+}
+
+// writeFileAtomic writes data to file so readers never see a partial file
+func writeFileAtomic(file string, data []byte) error {
+	tmpfile, err := ioutil.TempFile(filepath.Dir(file), ".tmp_")
+	if err != nil {
+		return err
+	}
+	if _, err = tmpfile.Write(data); err != nil {
+		tmpfile.Close()
+		os.Remove(tmpfile.Name())
+		return err
+	}
+	if err = tmpfile.Close(); err != nil {
+		os.Remove(tmpfile.Name())
+		return err
+	}
+	return os.Rename(tmpfile.Name(), file)
+}
+
+// saveSample keeps a copy of a scanned sample as <dir>/samples/<sha256>
+func (s *resultStore) saveSample(sha string, data []byte) error {
+	dir := filepath.Join(s.dir, "samples")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	err := writeFileAtomic(filepath.Join(dir, strings.ToLower(sha)), data)
+	return errors.Wrapf(err, "failed to retain sample %s", sha)
+}
+
+// pruneSamples removes retained samples that were last scanned before cutoff
+func (s *resultStore) pruneSamples(cutoff time.Time) (int, error) {
+	samples, err := ioutil.ReadDir(filepath.Join(s.dir, "samples"))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, sample := range samples {
+		if sample.ModTime().Before(cutoff) {
+			if err := os.Remove(filepath.Join(s.dir, "samples", sample.Name())); err != nil {
+				return removed, err
+			}
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// pruneResults removes the results of scans before cutoff, and the
+// directories of samples that have no results left, those of tenants too
+func (s *resultStore) pruneResults(cutoff time.Time) (int, error) {
+	samples, err := ioutil.ReadDir(filepath.Join(s.dir, "results"))
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	removed := 0
+	tenants, err := s.tenants()
+	if err != nil {
+		return removed, err
+	}
+	for _, tenant := range tenants {
+		pruned, err := tenant.pruneResults(cutoff)
+		removed += pruned
+		if err != nil {
+			return removed, err
+		}
+	}
+
+	for _, sample := range samples {
+		if !sample.IsDir() {
+			continue
+		}
+		files, err := filepath.Glob(filepath.Join(s.sampleDir(sample.Name()), "*.json"))
+		if err != nil {
+			return removed, err
+		}
+		kept := len(files)
+		for _, file := range files {
+			scannedAt, err := time.Parse(storeTimeFormat, strings.TrimSuffix(filepath.Base(file), ".json"))
+			if err != nil || !scannedAt.Before(cutoff) {
+				continue
+			}
+			if err := os.Remove(file); err != nil {
+				return removed, err
+			}
+			removed++
+			kept--
+		}
+		if kept == 0 {
+			// fails if a scan just stored new results, which is fine
+			os.Remove(s.sampleDir(sample.Name()))
+		}
+	}
+	return removed, nil
+}
+
+// history returns all stored results of a sample, oldest first
+func (s *resultStore) history(sha string) ([]StoredResult, error) {
+	files, err := filepath.Glob(filepath.Join(s.sampleDir(sha), "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	results := []StoredResult{}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var stored StoredResult
+		if err := json.Unmarshal(data, &stored); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse stored result %s", file)
+		}
+		results = append(results, stored)
+	}
+
+	return results, nil
+}
+
+// latest returns the most recent stored result of a sample
+func (s *resultStore) latest(sha string) (StoredResult, bool, error) {
+	history, err := s.history(sha)
+	if err != nil || len(history) == 0 {
+		return StoredResult{}, false, err
+	}
+	return history[len(history)-1], true, nil
+}
+
+// query returns the stored results matching filter, newest first
+func (s *resultStore) query(filter func(StoredResult) bool, limit int) ([]StoredResult, error) {
+	samples, err := ioutil.ReadDir(filepath.Join(s.dir, "results"))
+	if os.IsNotExist(err) {
+		// a tenant that has not stored anything yet
+		return []StoredResult{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	results := []StoredResult{}
+	for _, sample := range samples {
+		if !sample.IsDir() {
+			continue
+		}
+		history, err := s.history(sample.Name())
+		if err != nil {
+			return nil, err
+		}
+		for _, stored := range history {
+			if filter == nil || filter(stored) {
+				results = append(results, stored)
+			}
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].ScannedAt.After(results[j].ScannedAt)
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+
+	return results, nil
+}
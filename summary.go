@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/malice-plugins/pkgs/utils"
+	"github.com/urfave/cli"
+)
+
+// exit codes of multi-file scans with --fail-on
+const (
+	exitInfected   = 1
+	exitIncomplete = 2
+)
+
+// --fail-on conditions
+const (
+	failOnInfected = "infected"
+	failOnErrors   = "errors"
+	failOnSkipped  = "skipped"
+)
+
+var failOnConditions = []string{failOnInfected, failOnErrors, failOnSkipped}
+
+// ScanSummary json object, files is the number of files found: the scanned,
+// skipped, excluded and unreadable ones. Errors count the unreadable files and
+// the scanned files without a result, infected files count as scanned.
+// Truncated scans stopped early because of --max-findings or --max-time,
+// unscanned lists what they left out.
+type ScanSummary struct {
+	Files      int      `json:"files"`
+	Scanned    int      `json:"scanned"`
+	Skipped    int      `json:"skipped"`
+	Excluded   int      `json:"excluded"`
+	Errors     int      `json:"errors"`
+	Infected   int      `json:"infected"`
+	Detections []string `json:"detections"`
+	WallTimeMS float64  `json:"wall_time_ms"`
+	Truncated  bool     `json:"truncated"`
+	Unscanned  []string `json:"unscanned,omitempty"`
+
+	maxFindings int
+	started     time.Time
+	ctx         context.Context
+	cancel      context.CancelFunc
+}
+
+// newScanSummary starts the wall clock, maxTime is the --max-time of the
+// whole scan, 0 for none
+func newScanSummary(maxFindings int, maxTime time.Duration) ScanSummary {
+	s := ScanSummary{Detections: []string{}, maxFindings: maxFindings, started: time.Now()}
+	if maxTime > 0 {
+		s.ctx, s.cancel = context.WithDeadline(context.Background(), s.started.Add(maxTime))
+	} else {
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+	}
+	return s
+}
+
+// context is done once maxTime is up, scans running then are cancelled
+func (s *ScanSummary) context() context.Context {
+	return s.ctx
+}
+
+// timedOut reports whether maxTime is up
+func (s *ScanSummary) timedOut() bool {
+	return s.ctx.Err() != nil
+}
+
+// stop reports whether maxFindings infected files were found or maxTime is
+// up, the rest of the scan is then left out and the summary marked truncated
+func (s *ScanSummary) stop() bool {
+	if s.maxFindings > 0 && s.Infected >= s.maxFindings || s.timedOut() {
+		s.Truncated = true
+	}
+	return s.Truncated
+}
+
+// leaveOut lists what a truncated scan did not scan
+func (s *ScanSummary) leaveOut(unscanned ...string) {
+	s.Unscanned = append(s.Unscanned, unscanned...)
+}
+
+// add counts a scanned file
+func (s *ScanSummary) add(results ResultsData) {
+	s.Files++
+	s.Scanned++
+	switch {
+	case results.Infected:
+		s.Infected++
+		if !utils.StringInSlice(results.Result, s.Detections) {
+			s.Detections = append(s.Detections, results.Result)
+		}
+	case len(results.Error) > 0, results.Status == statusSkipped:
+		s.Errors++
+	}
+}
+
+// unreadable counts a file or directory that could not be read
+func (s *ScanSummary) unreadable() {
+	s.Files++
+	s.Errors++
+}
+
+// skip counts a file that was not scanned
+func (s *ScanSummary) skip() {
+	s.Files++
+	s.Skipped++
+}
+
+// exclude counts a file or directory left out by an exclusion
+func (s *ScanSummary) exclude() {
+	s.Files++
+	s.Excluded++
+}
+
+// finish stops the wall clock
+func (s *ScanSummary) finish() {
+	s.cancel()
+	sort.Strings(s.Detections)
+	s.WallTimeMS = milliseconds(time.Since(s.started))
+}
+
+// parseFailOn parses a comma separated list of --fail-on conditions
+func parseFailOn(value string) ([]string, error) {
+	var conditions []string
+	for _, condition := range strings.Split(value, ",") {
+		condition = strings.ToLower(strings.TrimSpace(condition))
+		if len(condition) == 0 {
+			continue
+		}
+		if !utils.StringInSlice(condition, failOnConditions) {
+			return nil, fmt.Errorf("invalid --fail-on condition %q (must be one of %s)", condition, strings.Join(failOnConditions, ", "))
+		}
+		conditions = append(conditions, condition)
+	}
+	return conditions, nil
+}
+
+// exitError applies the --fail-on policy: infected files exit with 1, errors
+// or skipped files with 2 as the scan is incomplete. Infected files win.
+func (s ScanSummary) exitError(failOn []string) error {
+	fails := func(condition string, count int) bool {
+		return count > 0 && utils.StringInSlice(condition, failOn)
+	}
+	switch {
+	case fails(failOnInfected, s.Infected):
+		return cli.NewExitError("", exitInfected)
+	case fails(failOnErrors, s.Errors), fails(failOnSkipped, s.Skipped):
+		return cli.NewExitError("", exitIncomplete)
+	}
+	return nil
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// maxBundleLogSize is how much of the end of the log file goes into a support bundle
+const maxBundleLogSize = 1 << 20
+
+// maxBundleDumps is how many of the latest watchdog dumps go into a support bundle
+const maxBundleDumps = 5
+
+// secretRe matches the names of flags, environment variables and engine
+// settings whose values must not leave the host
+var secretRe = regexp.MustCompile(`(?i)(key|token|secret|passw|credential|recipient)`)
+
+// redact hides value if name looks like it holds a secret, and the password of urls
+func redact(name, value string) string {
+	if len(value) > 0 && secretRe.MatchString(name) {
+		return "REDACTED"
+	}
+	if u, err := url.Parse(value); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), "REDACTED")
+			return u.String()
+		}
+	}
+	return value
+}
+
+// redactText hides the built in license key and the values of secret
+// looking Name = Value lines, e.g. in drweb-ctl cfshow output
+func redactText(text string) string {
+	if len(LicenseKey) > 0 {
+		text = strings.Replace(text, LicenseKey, "REDACTED", -1)
+	}
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		if parts := strings.SplitN(line, "=", 2); len(parts) == 2 && secretRe.MatchString(parts[0]) && len(strings.TrimSpace(parts[1])) > 0 {
+			lines[i] = parts[0] + "= REDACTED"
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// supportBundle is a gzipped tarball of troubleshooting information
+type supportBundle struct {
+	tw      *tar.Writer
+	created time.Time
+	files   int
+}
+
+func (b *supportBundle) add(file string, data []byte) error {
+	header := &tar.Header{
+		Name:    "drweb-support/" + file,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: b.created,
+	}
+	if err := b.tw.WriteHeader(header); err != nil {
+		return err
+	}
+	b.files++
+	_, err := b.tw.Write(data)
+	return err
+}
+
+func (b *supportBundle) addJSON(file string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return b.add(file, append(data, '\n'))
+}
+
+// addCommand adds the redacted output of a drweb-ctl command, or why it failed
+func (b *supportBundle) addCommand(ctx context.Context, file string, args ...string) error {
+	out, err := runCtl(ctx, args...)
+	if err != nil {
+		out += "\nerror: " + err.Error() + "\n"
+	}
+	return b.add(file, []byte(redactText(out)))
+}
+
+// pluginConfig returns the global flags and their values, secrets redacted
+func pluginConfig(c *cli.Context) map[string]string {
+	config := make(map[string]string)
+	for _, flag := range c.App.Flags {
+		flagName := strings.TrimSpace(strings.Split(flag.GetName(), ",")[0])
+		if flagName == "help" || flagName == "version" {
+			continue
+		}
+		value := c.GlobalGeneric(flagName)
+		if value == nil {
+			continue
+		}
+		config[flagName] = redact(flagName, fmt.Sprint(value))
+	}
+	// engine options can carry proxy or update server passwords
+	var options []string
+	for _, option := range engineOptions {
+		options = append(options, option.key+"="+redact(option.key, option.value))
+	}
+	config["engine-option"] = strings.Join(options, ", ")
+	return config
+}
+
+// environment describes the host, container and process
+func environment() map[string]interface{} {
+	env := map[string]interface{}{
+		"go_version":        runtime.Version(),
+		"os":                runtime.GOOS,
+		"arch":              runtime.GOARCH,
+		"cpus":              runtime.NumCPU(),
+		"pid":               os.Getpid(),
+		"uid":               os.Getuid(),
+		"gid":               os.Getgid(),
+		"configd_processes": len(configdProcesses()),
+		"time":              time.Now().UTC().Format(time.RFC3339),
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		env["hostname"] = hostname
+	}
+	if uptime, err := ioutil.ReadFile("/proc/uptime"); err == nil {
+		env["uptime"] = strings.Fields(string(uptime))[0] + "s"
+	}
+	if meminfo, err := ioutil.ReadFile("/proc/meminfo"); err == nil {
+		for _, line := range strings.Split(string(meminfo), "\n") {
+			if strings.HasPrefix(line, "MemTotal:") || strings.HasPrefix(line, "MemAvailable:") {
+				parts := strings.SplitN(line, ":", 2)
+				env[strings.ToLower(parts[0])] = strings.TrimSpace(parts[1])
+			}
+		}
+	}
+	disks := make(map[string]string)
+	for _, dir := range []string{"/malware", os.TempDir(), "/var/opt/drweb.com"} {
+		if free, total, ok := diskSpace(dir); ok {
+			disks[dir] = fmt.Sprintf("%d MB free of %d MB", free>>20, total>>20)
+		}
+	}
+	env["disks"] = disks
+
+	vars := make(map[string]string)
+	for _, kv := range os.Environ() {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 2 && (strings.HasPrefix(parts[0], "MALICE_") || strings.HasPrefix(parts[0], "DRWEB")) {
+			vars[parts[0]] = redact(parts[0], parts[1])
+		}
+	}
+	env["variables"] = vars
+	return env
+}
+
+// tailFile returns at most the last max bytes of file, starting at a line
+func tailFile(file string, max int64) ([]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	offset := info.Size() - max
+	if offset < 0 {
+		offset = 0
+	}
+	data, err := ioutil.ReadAll(io.NewSectionReader(f, offset, info.Size()-offset))
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			data = data[i+1:]
+		}
+	}
+	return data, nil
+}
+
+func writeSupportBundle(c *cli.Context, w io.Writer) (int, error) {
+	gz := gzip.NewWriter(w)
+	bundle := &supportBundle{tw: tar.NewWriter(gz), created: time.Now()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.GlobalInt("timeout"))*time.Second)
+	defer cancel()
+
+	if err := bundle.addJSON("config.json", pluginConfig(c)); err != nil {
+		return bundle.files, err
+	}
+	if err := bundle.addJSON("environment.json", environment()); err != nil {
+		return bundle.files, err
+	}
+
+	if err := startConfigd(ctx); err != nil {
+		if err := bundle.add("engine/error.txt", []byte(errors.Wrap(err, "failed to start drweb-configd").Error()+"\n")); err != nil {
+			return bundle.files, err
+		}
+	} else {
+		if err := bundle.addJSON("info.json", getInfo(ctx)); err != nil {
+			return bundle.files, err
+		}
+		for _, command := range []string{"--version", "baseinfo", "license", "appinfo", "cfshow"} {
+			file := "engine/" + strings.TrimLeft(command, "-") + ".txt"
+			if err := bundle.addCommand(ctx, file, command); err != nil {
+				return bundle.files, err
+			}
+		}
+	}
+
+	if file := c.GlobalString("log-file"); len(file) > 0 {
+		data, err := tailFile(file, maxBundleLogSize)
+		if err != nil {
+			data = []byte(errors.Wrap(err, "failed to read log file").Error() + "\n")
+		}
+		if err := bundle.add("logs/drweb.log", []byte(redactText(string(data)))); err != nil {
+			return bundle.files, err
+		}
+	}
+
+	// the latest dumps of stuck engine commands
+	for i, file := range watchdogDumps(watchdog.dir) {
+		if i == maxBundleDumps {
+			break
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		if err := bundle.add("watchdog/"+filepath.Base(file), []byte(redactText(string(data)))); err != nil {
+			return bundle.files, err
+		}
+	}
+
+	if err := bundle.tw.Close(); err != nil {
+		return bundle.files, err
+	}
+	return bundle.files, gz.Close()
+}
+
+func supportBundleCommand(c *cli.Context) error {
+	output := c.String("output")
+	if output == "-" {
+		_, err := writeSupportBundle(c, os.Stdout)
+		return err
+	}
+	if len(output) == 0 {
+		output = fmt.Sprintf("drweb-support-%s.tar.gz", time.Now().UTC().Format("20060102T150405"))
+	}
+
+	f, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to create support bundle")
+	}
+	files, err := writeSupportBundle(c, f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(output)
+		return errors.Wrap(err, "failed to write support bundle")
+	}
+
+	resultJSON, err := json.Marshal(map[string]interface{}{"bundle": output, "files": files})
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(resultJSON))
+	return nil
+}
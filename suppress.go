@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	pathpkg "path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// auditSuppressed is recorded for every detection a suppression downgraded
+const auditSuppressed = "detection_suppressed"
+
+// Suppression is a rule of the suppression file, a sanctioned false positive.
+// Detection is a glob on the detection name, path a glob on the path a sample
+// was scanned at, or its file name if the glob has no slash. A suppression
+// needs a hash or a path to match on, and stops matching once it expired.
+type Suppression struct {
+	Name          string    `json:"name"`
+	Detection     string    `json:"detection"`
+	SHA256        string    `json:"sha256,omitempty"`
+	Path          string    `json:"path,omitempty"`
+	Expires       time.Time `json:"expires"`
+	Justification string    `json:"justification"`
+}
+
+// AppliedSuppression json object, the suppression a detection matched
+type AppliedSuppression struct {
+	Name          string    `json:"name" structs:"name"`
+	Justification string    `json:"justification" structs:"justification"`
+	Expires       time.Time `json:"expires" structs:"expires"`
+}
+
+// suppressions are nil unless a suppression file is configured
+var suppressions []Suppression
+
+func loadSuppressions(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return errors.Wrap(err, "failed to read suppression file")
+	}
+
+	var loaded []Suppression
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return errors.Wrapf(err, "failed to parse suppression file %s", file)
+	}
+	for i := range loaded {
+		s := &loaded[i]
+		if len(s.Name) == 0 {
+			s.Name = fmt.Sprintf("suppression %d", i+1)
+		}
+		switch {
+		case len(s.Detection) == 0:
+			return fmt.Errorf("suppression %s: no detection", s.Name)
+		case len(s.SHA256) == 0 && len(s.Path) == 0:
+			return fmt.Errorf("suppression %s: no sha256 or path, it would suppress the detection everywhere", s.Name)
+		case s.Expires.IsZero():
+			return fmt.Errorf("suppression %s: no expiry", s.Name)
+		case len(strings.TrimSpace(s.Justification)) == 0:
+			return fmt.Errorf("suppression %s: no justification", s.Name)
+		}
+		s.SHA256 = strings.ToLower(s.SHA256)
+		if _, err := pathpkg.Match(s.Detection, ""); err != nil {
+			return errors.Wrapf(err, "suppression %s: invalid detection %q", s.Name, s.Detection)
+		}
+		if _, err := pathpkg.Match(s.Path, ""); err != nil {
+			return errors.Wrapf(err, "suppression %s: invalid path %q", s.Name, s.Path)
+		}
+		if s.expired() {
+			log.WithFields(log.Fields{
+				"plugin":   name,
+				"category": category,
+				"expires":  s.Expires,
+			}).Warn("suppression ", s.Name, " expired, it no longer suppresses anything")
+		}
+	}
+	reloadLock.Lock()
+	suppressions = loaded
+	reloadLock.Unlock()
+
+	return nil
+}
+
+// currentSuppressions returns the suppressions, nil unless a suppression file
+// is configured
+func currentSuppressions() []Suppression {
+	reloadLock.RLock()
+	defer reloadLock.RUnlock()
+	return suppressions
+}
+
+// expired reports whether the suppression stopped matching
+func (s *Suppression) expired() bool {
+	return !time.Now().Before(s.Expires)
+}
+
+// matches reports whether the suppression applies to the detection of the
+// sample sha, scanned as file
+func (s *Suppression) matches(sha, file, detection string) bool {
+	if s.expired() {
+		return false
+	}
+	if matched, _ := pathpkg.Match(strings.ToLower(s.Detection), strings.ToLower(detection)); !matched {
+		return false
+	}
+	if len(s.SHA256) > 0 && s.SHA256 != strings.ToLower(sha) {
+		return false
+	}
+	if len(s.Path) == 0 {
+		return true
+	}
+	if len(file) == 0 {
+		return false
+	}
+	file = filepath.ToSlash(file)
+	if !strings.Contains(s.Path, "/") {
+		file = pathpkg.Base(file)
+	}
+	matched, _ := pathpkg.Match(s.Path, file)
+	return matched
+}
+
+// matchSuppression returns the first of list applying to a detection, nil if
+// none does
+func matchSuppression(list []Suppression, sha, file, detection string) *Suppression {
+	for i := range list {
+		if list[i].matches(sha, file, detection) {
+			return &list[i]
+		}
+	}
+	return nil
+}
+
+// suppress downgrades the detections of the sample sha, scanned at file, and
+// of its archive members that a suppression applies to: they are reported as
+// clean and suppressed rather than infected, with the detection kept in the
+// result. Every suppressed detection is logged and audited. file must be a
+// path this service chose, empty for uploads whose name the client picked;
+// members are named by the archive, they only match on their hash.
+func suppress(sha, file string, submitter *Submitter, results *ResultsData) {
+	list := currentSuppressions()
+	if len(list) == 0 {
+		return
+	}
+	var last *Suppression
+	infectedMembers := false
+	for i := range results.Members {
+		member := &results.Members[i]
+		if !member.Results.Infected {
+			continue
+		}
+		s := matchSuppression(list, member.SHA256, "", member.Results.Result)
+		if s == nil {
+			infectedMembers = true
+			continue
+		}
+		s.apply(member.SHA256, member.Path, submitter, &member.Results)
+		if member.Results.Result == results.Result {
+			last = s
+		}
+	}
+	if !results.Infected {
+		return
+	}
+	if s := matchSuppression(list, sha, file, results.Result); s != nil {
+		s.apply(sha, file, submitter, results)
+	} else if last != nil && !infectedMembers {
+		// the archive was only infected by the members that were suppressed,
+		// the others still decide whether it is known to be clean
+		last.apply(sha, file, submitter, results)
+		results.addMembers()
+	}
+}
+
+// apply downgrades a detection to suppressed
+func (s *Suppression) apply(sha, file string, submitter *Submitter, results *ResultsData) {
+	results.Infected = false
+	results.Status = statusClean
+	results.Suppressed = true
+	results.Suppression = &AppliedSuppression{Name: s.Name, Justification: s.Justification, Expires: s.Expires}
+
+	log.WithFields(log.Fields{
+		"plugin":        name,
+		"category":      category,
+		"sha256":        sha,
+		"path":          file,
+		"detection":     results.Result,
+		"suppression":   s.Name,
+		"justification": s.Justification,
+		"expires":       s.Expires,
+	}).Warn("detection suppressed")
+	var actor, tenant string
+	if submitter != nil {
+		actor, tenant = submitter.KeyID, submitter.Tenant
+	}
+	details := map[string]string{
+		"detection":     results.Result,
+		"suppression":   s.Name,
+		"justification": s.Justification,
+		"expires":       s.Expires.Format(time.RFC3339),
+	}
+	if len(file) > 0 {
+		details["path"] = file
+	}
+	audit.record(auditSuppressed, actor, tenant, sha, details)
+}
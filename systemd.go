@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// first file descriptor passed by systemd socket activation
+const sdListenFdsStart = 3
+
+// sdNotify sends state to the service manager, it is a no-op unless we are
+// running under systemd with Type=notify
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if len(socket) == 0 {
+		return nil
+	}
+	// abstract namespace sockets are passed with a leading @
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return errors.Wrap(err, "failed to connect to systemd notify socket")
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return errors.Wrap(err, "failed to notify systemd")
+}
+
+// sdWatchdog pings the systemd watchdog at half the configured interval for as
+// long as healthy returns true, so systemd restarts us once it stops
+func sdWatchdog(healthy func() bool) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); len(pid) > 0 && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+
+	interval := time.Duration(usec) * time.Microsecond / 2
+	log.WithFields(log.Fields{
+		"plugin":   name,
+		"category": category,
+		"interval": interval,
+	}).Debug("pinging systemd watchdog")
+
+	go func() {
+		for range time.Tick(interval) {
+			if !healthy() {
+				continue
+			}
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				log.WithFields(log.Fields{
+					"plugin":   name,
+					"category": category,
+				}).Error(err)
+			}
+		}
+	}()
+}
+
+// sdListener returns the first socket passed to us by systemd socket activation
+// or nil if we were not socket activated
+func sdListener() (net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || fds < 1 {
+		return nil, nil
+	}
+	if fds > 1 {
+		log.WithFields(log.Fields{
+			"plugin":   name,
+			"category": category,
+		}).Warnf("systemd passed %d sockets, only using the first one", fds)
+	}
+
+	f := os.NewFile(sdListenFdsStart, "LISTEN_FD_3")
+	defer f.Close()
+	listener, err := net.FileListener(f)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to use socket passed by systemd")
+	}
+
+	return listener, nil
+}
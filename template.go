@@ -1,9 +0,0 @@
-package main
-
-const tpl = `#### Dr.WEB
-{{- with .Results }}
-| Infected      | Result      | Engine      | Updated      |
-|:-------------:|:-----------:|:-----------:|:------------:|
-| {{.Infected}} | {{.Result}} | {{.Engine}} | {{.Updated}} |
-{{ end -}}
-`
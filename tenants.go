@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// apiKeyTenantContextKey holds the tenant of the API key a request was made with
+const apiKeyTenantContextKey = contextKey("api-key-tenant")
+
+// tenantIDRe matches tenant ids, which name directories in the store
+var tenantIDRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// Tenant is an entry of the tenants file, a team sharing the web service
+// whose results, statistics and callbacks are kept apart from the others'
+type Tenant struct {
+	ID         string `json:"id"`
+	DailyQuota int    `json:"daily_quota,omitempty"`
+	Callback   string `json:"callback,omitempty"`
+}
+
+// tenantRegistry holds the tenants file and counts the scans of every tenant
+// per UTC day against its quota
+type tenantRegistry struct {
+	sync.Mutex
+	file    string
+	tenants map[string]Tenant
+	day     string
+	used    map[string]int
+}
+
+// tenants is empty unless a tenants file is configured, API keys may name
+// tenants that are not in it, they have no quota and the default callback
+var tenants = &tenantRegistry{used: make(map[string]int)}
+
+func validTenantID(id string) bool {
+	return tenantIDRe.MatchString(id)
+}
+
+// load reads the tenants file, a JSON list of tenants
+func (t *tenantRegistry) load(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return errors.Wrap(err, "failed to read tenants")
+	}
+	var list []Tenant
+	if err := json.Unmarshal(data, &list); err != nil {
+		return errors.Wrapf(err, "failed to parse tenants file %s", file)
+	}
+
+	byID := make(map[string]Tenant)
+	for i, tenant := range list {
+		switch {
+		case !validTenantID(tenant.ID):
+			return fmt.Errorf("tenant %d has invalid id %q (lower case letters, digits, - and _)", i, tenant.ID)
+		case tenant.DailyQuota < 0:
+			return fmt.Errorf("tenant %s has a negative daily_quota", tenant.ID)
+		case len(tenant.Callback) > 0 && !httpURL(tenant.Callback):
+			return fmt.Errorf("tenant %s needs an http(s) callback url", tenant.ID)
+		}
+		byID[tenant.ID] = tenant
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	t.file = file
+	t.tenants = byID
+	return nil
+}
+
+// reload re-reads the tenants file, if there is one
+func (t *tenantRegistry) reload() error {
+	t.Lock()
+	file := t.file
+	t.Unlock()
+	if len(file) == 0 {
+		return nil
+	}
+	return t.load(file)
+}
+
+func (t *tenantRegistry) get(id string) Tenant {
+	t.Lock()
+	defer t.Unlock()
+	if tenant, ok := t.tenants[id]; ok {
+		return tenant
+	}
+	return Tenant{ID: id}
+}
+
+// allow counts a scan of tenant against its daily quota, or returns how long
+// until the quota is reset if it is used up
+func (t *tenantRegistry) allow(id string) (bool, time.Duration) {
+	if len(id) == 0 {
+		return true, 0
+	}
+	t.Lock()
+	defer t.Unlock()
+
+	now := time.Now().UTC()
+	if day := now.Format("2006-01-02"); day != t.day {
+		t.day = day
+		t.used = make(map[string]int)
+	}
+	if quota := t.tenants[id].DailyQuota; quota > 0 && t.used[id] >= quota {
+		midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+		return false, midnight.Sub(now)
+	}
+	t.used[id]++
+	return true, 0
+}
+
+// overQuota answers 429 if the tenant of r used up its daily quota, otherwise
+// the request counts against it
+func overQuota(w http.ResponseWriter, r *http.Request) bool {
+	ok, wait := tenants.allow(requestTenant(r))
+	if ok {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+	http.Error(w, "daily scan quota of the tenant is used up, try again tomorrow", http.StatusTooManyRequests)
+	return true
+}
+
+// callback is where the results of Malice scan requests of tenant go unless
+// the request names a callback, fallback if the tenant has none
+func (t *tenantRegistry) callback(id, fallback string) string {
+	if callback := t.get(id).Callback; len(id) > 0 && len(callback) > 0 {
+		return callback
+	}
+	return fallback
+}
+
+// requestTenant returns the tenant of the API key r was authenticated with
+func requestTenant(r *http.Request) string {
+	tenant, _ := r.Context().Value(apiKeyTenantContextKey).(string)
+	return tenant
+}
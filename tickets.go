@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// ticketing systems of ticket rules
+const (
+	ticketJira       = "jira"
+	ticketServiceNow = "servicenow"
+)
+
+// ticketDedupWindow is how long a rule opens no second ticket for a sample
+const ticketDedupWindow = 24 * time.Hour
+
+const (
+	defaultTicketSummary     = `Dr.WEB detected {{.drweb.result}} in a sample from {{.source}}`
+	defaultTicketDescription = `Dr.WEB found {{.drweb.result}} in the sample {{.sha256}} submitted by {{.source}}.
+
+{{with .drweb.family}}Family: {{.}}
+{{end}}Engine: {{.drweb.engine}}
+Database: {{.drweb.database}}`
+)
+
+// TicketRule is an entry of the tickets file: infected uploads from its
+// sources open a ticket in Jira or ServiceNow. Summary and description are
+// templates of the results, like callback templates.
+type TicketRule struct {
+	Name        string   `json:"name"`
+	System      string   `json:"system"`
+	URL         string   `json:"url"`
+	User        string   `json:"user"`
+	TokenEnv    string   `json:"token_env"`
+	Project     string   `json:"project,omitempty"`
+	IssueType   string   `json:"issue_type,omitempty"`
+	Table       string   `json:"table,omitempty"`
+	Queue       string   `json:"queue,omitempty"`
+	Sources     []string `json:"sources,omitempty"`
+	Summary     string   `json:"summary,omitempty"`
+	Description string   `json:"description,omitempty"`
+
+	nets        []*net.IPNet
+	summary     *template.Template
+	description *template.Template
+}
+
+// ticketRules holds the tickets file and the tickets opened recently
+type ticketRules struct {
+	sync.Mutex
+	file   string
+	rules  []*TicketRule
+	opened map[string]time.Time
+	client *http.Client
+}
+
+// tickets has no rules unless a tickets file is configured
+var tickets = &ticketRules{
+	opened: make(map[string]time.Time),
+	client: &http.Client{Timeout: 30 * time.Second},
+}
+
+// load reads the tickets file, a JSON list of ticket rules
+func (t *ticketRules) load(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return errors.Wrap(err, "failed to read tickets")
+	}
+	var rules []*TicketRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return errors.Wrapf(err, "failed to parse tickets file %s", file)
+	}
+
+	for i, rule := range rules {
+		if len(rule.Name) == 0 {
+			rule.Name = fmt.Sprintf("ticket %d", i+1)
+		}
+		switch {
+		case rule.System != ticketJira && rule.System != ticketServiceNow:
+			return fmt.Errorf("ticket rule %s: invalid system %q (must be %s or %s)", rule.Name, rule.System, ticketJira, ticketServiceNow)
+		case !httpURL(rule.URL):
+			return fmt.Errorf("ticket rule %s needs an http(s) url", rule.Name)
+		case len(rule.TokenEnv) == 0 || len(os.Getenv(rule.TokenEnv)) == 0:
+			return fmt.Errorf("ticket rule %s: token_env must name a set environment variable", rule.Name)
+		case rule.System == ticketJira && len(rule.Project) == 0:
+			return fmt.Errorf("ticket rule %s: jira needs a project", rule.Name)
+		}
+		if len(rule.IssueType) == 0 {
+			rule.IssueType = "Task"
+		}
+		if len(rule.Table) == 0 {
+			rule.Table = "incident"
+		}
+		if rule.nets, err = parseSourceNets(rule.Sources); err != nil {
+			return errors.Wrapf(err, "ticket rule %s: invalid source", rule.Name)
+		}
+		if len(rule.Summary) == 0 {
+			rule.Summary = defaultTicketSummary
+		}
+		if len(rule.Description) == 0 {
+			rule.Description = defaultTicketDescription
+		}
+		if rule.summary, err = template.New(rule.Name).Funcs(payloadFuncs).Parse(rule.Summary); err != nil {
+			return errors.Wrapf(err, "ticket rule %s: failed to parse summary", rule.Name)
+		}
+		if rule.description, err = template.New(rule.Name).Funcs(payloadFuncs).Parse(rule.Description); err != nil {
+			return errors.Wrapf(err, "ticket rule %s: failed to parse description", rule.Name)
+		}
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	t.file = file
+	t.rules = rules
+	return nil
+}
+
+// reload re-reads the tickets file, if there is one
+func (t *ticketRules) reload() error {
+	t.Lock()
+	file := t.file
+	t.Unlock()
+	if len(file) == 0 {
+		return nil
+	}
+	return t.load(file)
+}
+
+// due returns the rules that open a ticket for an infected sample of
+// submitter, at most once per rule and sample within ticketDedupWindow
+func (t *ticketRules) due(sha string, submitter *Submitter) []*TicketRule {
+	t.Lock()
+	defer t.Unlock()
+
+	now := time.Now()
+	for key, opened := range t.opened {
+		if now.Sub(opened) > ticketDedupWindow {
+			delete(t.opened, key)
+		}
+	}
+	var due []*TicketRule
+	for _, rule := range t.rules {
+		if len(rule.Sources) > 0 && !matchesSource(rule.Sources, rule.nets, submitter) {
+			continue
+		}
+		key := rule.Name + "/" + sha
+		if _, ok := t.opened[key]; ok {
+			continue
+		}
+		t.opened[key] = now
+		due = append(due, rule)
+	}
+	return due
+}
+
+// open opens the tickets of the infected upload sha in the background
+func (t *ticketRules) open(sha string, submitter *Submitter, results ResultsData) {
+	if !results.Infected {
+		return
+	}
+	due := t.due(sha, submitter)
+	if len(due) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(DrWEB{Results: results})
+	if err != nil {
+		return
+	}
+	data := make(map[string]interface{})
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&data); err != nil {
+		return
+	}
+	data["sha256"] = sha
+	data["source"] = submitter.source()
+
+	go func() {
+		for _, rule := range due {
+			ticket, err := t.create(rule, data)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"plugin":   name,
+					"category": category,
+					"rule":     rule.Name,
+					"sha256":   sha,
+				}).Error(err)
+				continue
+			}
+			log.WithFields(log.Fields{
+				"plugin":   name,
+				"category": category,
+				"rule":     rule.Name,
+				"sha256":   sha,
+				"ticket":   ticket,
+			}).Info("opened ticket")
+		}
+	}()
+}
+
+// create opens a ticket with rule and returns its key or number
+func (t *ticketRules) create(rule *TicketRule, data map[string]interface{}) (string, error) {
+	var summary, description bytes.Buffer
+	if err := rule.summary.Execute(&summary, data); err != nil {
+		return "", errors.Wrap(err, "failed to render ticket summary")
+	}
+	if err := rule.description.Execute(&description, data); err != nil {
+		return "", errors.Wrap(err, "failed to render ticket description")
+	}
+
+	var endpoint string
+	var ticket interface{}
+	switch rule.System {
+	case ticketJira:
+		endpoint = strings.TrimRight(rule.URL, "/") + "/rest/api/2/issue"
+		ticket = map[string]interface{}{
+			"fields": map[string]interface{}{
+				"project":     map[string]string{"key": rule.Project},
+				"issuetype":   map[string]string{"name": rule.IssueType},
+				"summary":     strings.TrimSpace(summary.String()),
+				"description": description.String(),
+				"labels":      []string{name},
+			},
+		}
+	case ticketServiceNow:
+		endpoint = strings.TrimRight(rule.URL, "/") + "/api/now/table/" + rule.Table
+		fields := map[string]string{
+			"short_description": strings.TrimSpace(summary.String()),
+			"description":       description.String(),
+		}
+		if len(rule.Queue) > 0 {
+			fields["assignment_group"] = rule.Queue
+		}
+		ticket = fields
+	}
+	body, err := json.Marshal(ticket)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if len(rule.User) > 0 {
+		req.SetBasicAuth(rule.User, os.Getenv(rule.TokenEnv))
+	} else {
+		req.Header.Set("Authorization", "Bearer "+os.Getenv(rule.TokenEnv))
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to open %s ticket", rule.System)
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode >= 300 {
+		return "", fmt.Errorf("failed to open %s ticket: %s %s", rule.System, resp.Status, strings.TrimSpace(string(respBody)))
+	}
+
+	var created struct {
+		Key    string `json:"key"`
+		Result struct {
+			Number string `json:"number"`
+		} `json:"result"`
+	}
+	json.Unmarshal(respBody, &created)
+	if len(created.Key) > 0 {
+		return created.Key, nil
+	}
+	return created.Result.Number, nil
+}
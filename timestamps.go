@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// updatedFile is written after every update of the virus definitions
+const updatedFile = "/opt/malice/UPDATED"
+
+// legacyDateFormat is the format of the old "updated" field
+const legacyDateFormat = "20060102"
+
+// legacyUpdated keeps the "updated" yyyymmdd field in results, for consumers
+// of the old format
+var legacyUpdated bool
+
+// parseTimestamp parses an RFC3339 time, a yyyymmdd date (midnight UTC) as
+// the build time and old UPDATED files have it, or an RFC1123 time
+func parseTimestamp(value string) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	for _, layout := range []string{time.RFC3339Nano, legacyDateFormat, time.RFC1123Z, time.RFC1123} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.UTC(), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// engineTimestampLayouts are the formats drweb-ctl baseinfo prints times in
+var engineTimestampLayouts = []string{"2006-Jan-02 15:04:05", "2006-01-02 15:04:05", "2006-Jan-02", "2006-01-02"}
+
+// parseEngineTimestamp parses a time printed by drweb-ctl, which prints them
+// in the local time of the engine host without a zone
+func parseEngineTimestamp(value string) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	for _, layout := range engineTimestampLayouts {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t.UTC(), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// definitionsUpdated returns when the virus definitions were last updated by
+// us, the build time if they never were
+func definitionsUpdated() *time.Time {
+	value := BuildTime
+	if data, err := ioutil.ReadFile(updatedFile); err == nil {
+		value = string(data)
+	} else if !os.IsNotExist(err) {
+		log.WithFields(log.Fields{
+			"plugin":   name,
+			"category": category,
+		}).Error(err)
+	}
+	if t, ok := parseTimestamp(value); ok {
+		return &t
+	}
+	return nil
+}
+
+// markUpdated records that the virus definitions were just updated
+func markUpdated() error {
+	return ioutil.WriteFile(updatedFile, []byte(time.Now().UTC().Format(time.RFC3339)), 0644)
+}
+
+// legacyDate formats t as the old yyyymmdd "updated" field
+func legacyDate(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(legacyDateFormat)
+}
+
+// formatTimestamp formats t as RFC3339 in UTC, empty if it is unknown
+func formatTimestamp(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// updatedString returns when the virus definitions of results were updated,
+// for columns and tables, results of peers and hash lookups may only have
+// the old "updated" date
+func updatedString(results ResultsData) string {
+	if results.UpdatedAt != nil {
+		return formatTimestamp(results.UpdatedAt)
+	}
+	return results.Updated
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// Totals json object, cumulative counters kept in the store as
+// <dir>/totals.json so they survive restarts
+type Totals struct {
+	Scans          int64     `json:"scans"`
+	Infected       int64     `json:"infected"`
+	BytesScanned   int64     `json:"bytes_scanned"`
+	UpdatesApplied int64     `json:"updates_applied"`
+	Since          time.Time `json:"since"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// totalsLock serializes the updates of the totals file within this process
+var totalsLock sync.Mutex
+
+func (s *resultStore) totalsFile() string {
+	return filepath.Join(s.dir, "totals.json")
+}
+
+// totals returns the counters so far, all zero for a new store
+func (s *resultStore) totals() (Totals, error) {
+	var totals Totals
+	data, err := ioutil.ReadFile(s.totalsFile())
+	if os.IsNotExist(err) {
+		return totals, nil
+	}
+	if err != nil {
+		return totals, err
+	}
+	if err := json.Unmarshal(data, &totals); err != nil {
+		return totals, errors.Wrapf(err, "failed to parse %s", s.totalsFile())
+	}
+	return totals, nil
+}
+
+// addTotals applies add to the counters on disk. The file is read again every
+// time, so other processes sharing the store, like CLI scans next to the web
+// service, count towards the same totals.
+func (s *resultStore) addTotals(add func(*Totals)) {
+	if s == nil {
+		return
+	}
+	totalsLock.Lock()
+	defer totalsLock.Unlock()
+
+	totals, err := s.totals()
+	if err == nil {
+		now := time.Now().UTC()
+		if totals.Since.IsZero() {
+			totals.Since = now
+		}
+		totals.UpdatedAt = now
+		add(&totals)
+
+		var data []byte
+		if data, err = json.Marshal(totals); err == nil {
+			err = writeFileAtomic(s.totalsFile(), data)
+		}
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"plugin":   name,
+			"category": category,
+		}).Error(errors.Wrap(err, "failed to update the totals"))
+	}
+}
+
+// countScan counts a scanned sample of size bytes, skipped samples were not scanned
+func (s *resultStore) countScan(results ResultsData, size int64) {
+	if results.Status == statusSkipped {
+		return
+	}
+	s.addTotals(func(totals *Totals) {
+		totals.Scans++
+		if results.Infected {
+			totals.Infected++
+		}
+		totals.BytesScanned += size
+	})
+}
+
+// countUpdate counts a successful update of the virus definitions
+func (s *resultStore) countUpdate() {
+	s.addTotals(func(totals *Totals) {
+		totals.UpdatesApplied++
+	})
+}
+
+// statsCommand prints the totals of the store
+func statsCommand(c *cli.Context) error {
+	if store == nil {
+		return fmt.Errorf("stats requires --store")
+	}
+	totals, err := store.totals()
+	if err != nil {
+		return err
+	}
+	totalsJSON, err := json.Marshal(totals)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(totalsJSON))
+	return nil
+}
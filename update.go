@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// UpdateResults json object, what an update of the virus definitions did
+type UpdateResults struct {
+	StartedAt      time.Time  `json:"started_at"`
+	DurationMS     int64      `json:"duration_ms"`
+	Success        bool       `json:"success"`
+	Error          string     `json:"error,omitempty"`
+	EngineBefore   string     `json:"engine_before,omitempty"`
+	Engine         string     `json:"engine,omitempty"`
+	DatabaseBefore string     `json:"database_before,omitempty"`
+	Database       string     `json:"database,omitempty"`
+	RecordDelta    int64      `json:"record_delta"`
+	DBTimestamp    *time.Time `json:"db_timestamp,omitempty"`
+	RestartNeeded  bool       `json:"restart_needed"`
+	Output         string     `json:"output,omitempty"`
+}
+
+// updateAV updates the virus definitions with drweb-ctl update and records
+// what it did in the store and elasticsearch
+func updateAV(ctx context.Context) (UpdateResults, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	update := UpdateResults{StartedAt: time.Now().UTC()}
+	if !ctlEngine {
+		return update, fmt.Errorf("the Dr.Web service updates its virus bases itself")
+	}
+	// drweb needs to have the daemon started first
+	if err := startConfigd(ctx); err != nil {
+		return update, errors.Wrap(err, "failed to start drweb-configd")
+	}
+
+	// Dr.Web also updates itself, so do not trust the cached info
+	baseInfo.invalidate("virus definitions update")
+	if before, err := baseInfo.get(ctx); err == nil {
+		update.EngineBefore, update.DatabaseBefore = before.Engine, before.Database
+	}
+	output, updateErr := runCtl(ctx, "update")
+	update.DurationMS = int64(time.Since(update.StartedAt) / time.Millisecond)
+	update.Output = strings.TrimSpace(output)
+	update.Success = updateErr == nil
+	if updateErr != nil {
+		update.Error = updateErr.Error()
+	} else {
+		store.countUpdate()
+	}
+
+	baseInfo.invalidate("virus definitions updated")
+	if after, err := baseInfo.get(ctx); err == nil {
+		update.Engine, update.Database, update.DBTimestamp = after.Engine, after.Database, after.DBTimestamp
+	}
+	update.RecordDelta = recordDelta(update.DatabaseBefore, update.Database)
+	// a new core engine is only loaded by restarted daemons
+	update.RestartNeeded = (len(update.EngineBefore) > 0 && update.Engine != update.EngineBefore) ||
+		strings.Contains(strings.ToLower(update.Output), "restart")
+	if updateErr != nil {
+		updateErr = errors.Wrap(updateErr, "failed to update virus definitions")
+	} else if err := markUpdated(); err != nil {
+		updateErr = errors.Wrap(err, "failed to note when the virus definitions were updated")
+	}
+
+	fields := log.Fields{
+		"plugin":         name,
+		"category":       category,
+		"duration_ms":    update.DurationMS,
+		"record_delta":   update.RecordDelta,
+		"restart_needed": update.RestartNeeded,
+	}
+	if updateErr != nil {
+		log.WithFields(fields).Error(updateErr)
+	} else {
+		log.WithFields(fields).Info("virus definitions updated")
+	}
+	if err := store.saveUpdate(update); err != nil {
+		log.WithFields(log.Fields{
+			"plugin":   name,
+			"category": category,
+		}).Error(err)
+	}
+	if len(es.URL) > 0 {
+		if err := storeUpdateElasticsearch(update); err != nil {
+			log.WithFields(log.Fields{
+				"plugin":   name,
+				"category": category,
+			}).Error(err)
+		}
+	}
+	return update, updateErr
+}
+
+// recordDelta returns how many virus base records an update added, 0 if
+// either count is unknown
+func recordDelta(before, after string) int64 {
+	from, err := strconv.ParseInt(strings.TrimSpace(before), 10, 64)
+	if err != nil {
+		return 0
+	}
+	to, err := strconv.ParseInt(strings.TrimSpace(after), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return to - from
+}
+
+// saveUpdate keeps an update as <dir>/updates/<start time>.json
+func (s *resultStore) saveUpdate(update UpdateResults) error {
+	if s == nil {
+		return nil
+	}
+	dir := filepath.Join(s.dir, "updates")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrap(err, "failed to store update")
+	}
+	data, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(filepath.Join(dir, update.StartedAt.Format(storeTimeFormat)+".json"), data)
+	return errors.Wrap(err, "failed to store update")
+}
+
+// storeUpdateElasticsearch indexes an update as its own document with id
+// update_<start time>, next to the sample documents
+func storeUpdateElasticsearch(update UpdateResults) error {
+	client, err := elasticClient()
+	if err != nil {
+		return err
+	}
+	id := "update_" + update.StartedAt.Format(storeTimeFormat)
+	doc := map[string]interface{}{
+		"update_id":   id,
+		"update_date": update.StartedAt.Format(time.RFC3339Nano),
+		"database":    update.Database,
+		"plugins": map[string]interface{}{
+			category: map[string]interface{}{name: update},
+		},
+	}
+	_, err = client.Index().
+		Index(es.Index).
+		Type(es.Type).
+		Id(id).
+		OpType("create").
+		BodyJson(doc).
+		Do(context.Background())
+	return errors.Wrapf(err, "failed to index update with id: %s", id)
+}
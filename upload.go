@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// maxUploadSize is the largest request body POST /scan accepts, 0 for no limit
+var maxUploadSize int64
+
+// largeSampleSize is the size above which uploads are scanned in the
+// background, 0 leaves that to the client
+var largeSampleSize int64
+
+// uploadBody is a request body cut off after maxUploadSize, which remembers
+// whether the client sent more
+type uploadBody struct {
+	io.ReadCloser
+	tooLarge bool
+}
+
+func (b *uploadBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if _, ok := err.(*http.MaxBytesError); ok {
+		b.tooLarge = true
+	}
+	return n, err
+}
+
+// limitUpload rejects an upload whose Content-Length is over maxUploadSize
+// and limits the body of the others. Uploads rejected before their body is
+// read are never sent by clients waiting for 100 Continue, the server only
+// answers it once a handler reads the body.
+func limitUpload(w http.ResponseWriter, r *http.Request) (*uploadBody, bool) {
+	body := &uploadBody{ReadCloser: r.Body}
+	if maxUploadSize <= 0 {
+		return body, true
+	}
+	if r.ContentLength > maxUploadSize {
+		uploadTooLarge(w)
+		return nil, false
+	}
+	body.ReadCloser = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	r.Body = body
+	return body, true
+}
+
+func uploadTooLarge(w http.ResponseWriter) {
+	http.Error(w, fmt.Sprintf("upload is larger than %d MB", maxUploadSize>>20), http.StatusRequestEntityTooLarge)
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// Vault auth methods, see --vault-auth
+const (
+	vaultAuthToken      = "token"
+	vaultAuthAppRole    = "approle"
+	vaultAuthKubernetes = "kubernetes"
+)
+
+// licenseKeyEnv is the --vault-secret target replacing the built-in license key
+const licenseKeyEnv = "MALICE_LICENSE_KEY"
+
+// kubernetesTokenFile is the service account token Vault's kubernetes auth checks
+const kubernetesTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// vaultClient reads secrets from HashiCorp Vault's HTTP API
+type vaultClient struct {
+	addr   string
+	token  string
+	client *http.Client
+
+	ttl       time.Duration // of the token, 0 if it does not expire
+	renewable bool
+	leases    []vaultLease
+}
+
+// vaultLease is a leased secret, dynamic credentials expire unless renewed
+type vaultLease struct {
+	id  string
+	ttl time.Duration
+}
+
+// vaultResponse is the part of Vault's responses we use
+type vaultResponse struct {
+	LeaseID       string                 `json:"lease_id"`
+	LeaseDuration int                    `json:"lease_duration"`
+	Renewable     bool                   `json:"renewable"`
+	Data          map[string]interface{} `json:"data"`
+	Auth          *struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+		Renewable     bool   `json:"renewable"`
+	} `json:"auth"`
+	Errors []string `json:"errors"`
+}
+
+// vaultSecret is a --vault-secret mapping, the field of the secret at path
+// becomes the value of the environment variable target
+type vaultSecret struct {
+	target string
+	path   string
+	field  string
+}
+
+// parseVaultSecrets parses the TARGET=PATH#FIELD mappings of --vault-secret
+func parseVaultSecrets(values []string) ([]vaultSecret, error) {
+	var secrets []vaultSecret
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid --vault-secret %q (must be TARGET=PATH#FIELD)", value)
+		}
+		ref := strings.SplitN(parts[1], "#", 2)
+		if len(parts[0]) == 0 || len(ref) != 2 || len(ref[0]) == 0 || len(ref[1]) == 0 {
+			return nil, fmt.Errorf("invalid --vault-secret %q (must be TARGET=PATH#FIELD)", value)
+		}
+		secrets = append(secrets, vaultSecret{target: parts[0], path: strings.Trim(ref[0], "/"), field: ref[1]})
+	}
+	return secrets, nil
+}
+
+func (v *vaultClient) do(method, path string, body interface{}) (vaultResponse, error) {
+	var response vaultResponse
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return response, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, strings.TrimRight(v.addr, "/")+"/v1/"+path, reader)
+	if err != nil {
+		return response, err
+	}
+	if len(v.token) > 0 {
+		req.Header.Set("X-Vault-Token", v.token)
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return response, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return response, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &response); err != nil {
+			return response, errors.Wrapf(err, "failed to parse the response of %s", path)
+		}
+	}
+	if resp.StatusCode >= 300 {
+		if len(response.Errors) > 0 {
+			return response, fmt.Errorf("%s: %s", resp.Status, strings.Join(response.Errors, "; "))
+		}
+		return response, fmt.Errorf("%s", resp.Status)
+	}
+	return response, nil
+}
+
+// login gets a token with the --vault-auth method
+func (v *vaultClient) login(c *cli.Context) error {
+	method := c.String("vault-auth")
+	path := "auth/" + method + "/login"
+	if len(c.String("vault-auth-mount")) > 0 {
+		path = "auth/" + strings.Trim(c.String("vault-auth-mount"), "/") + "/login"
+	}
+	var body map[string]string
+	switch method {
+	case vaultAuthToken:
+		if v.token = c.String("vault-token"); len(v.token) == 0 {
+			return fmt.Errorf("--vault-auth token needs --vault-token")
+		}
+		response, err := v.do("GET", "auth/token/lookup-self", nil)
+		if err != nil {
+			return errors.Wrap(err, "failed to look up the Vault token")
+		}
+		ttl, _ := response.Data["ttl"].(float64)
+		renewable, _ := response.Data["renewable"].(bool)
+		v.ttl, v.renewable = time.Duration(ttl)*time.Second, renewable
+		return nil
+	case vaultAuthAppRole:
+		body = map[string]string{"role_id": c.String("vault-role-id"), "secret_id": c.String("vault-secret-id")}
+		if len(body["role_id"]) == 0 {
+			return fmt.Errorf("--vault-auth approle needs --vault-role-id")
+		}
+	case vaultAuthKubernetes:
+		jwt, err := ioutil.ReadFile(kubernetesTokenFile)
+		if err != nil {
+			return errors.Wrap(err, "failed to read the service account token")
+		}
+		body = map[string]string{"role": c.String("vault-role"), "jwt": strings.TrimSpace(string(jwt))}
+		if len(body["role"]) == 0 {
+			return fmt.Errorf("--vault-auth kubernetes needs --vault-role")
+		}
+	default:
+		return fmt.Errorf("invalid --vault-auth %q (must be %s, %s or %s)", method, vaultAuthToken, vaultAuthAppRole, vaultAuthKubernetes)
+	}
+
+	response, err := v.do("POST", path, body)
+	if err != nil {
+		return errors.Wrap(err, "failed to log in to Vault")
+	}
+	if response.Auth == nil || len(response.Auth.ClientToken) == 0 {
+		return fmt.Errorf("failed to log in to Vault: no token returned")
+	}
+	v.token = response.Auth.ClientToken
+	v.ttl, v.renewable = time.Duration(response.Auth.LeaseDuration)*time.Second, response.Auth.Renewable
+	return nil
+}
+
+// read returns a field of the secret at path, of KV version 1 and 2 alike
+func (v *vaultClient) read(path, field string) (string, error) {
+	response, err := v.do("GET", path, nil)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read Vault secret %s", path)
+	}
+	data := response.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, kv2 := data["metadata"]; kv2 {
+			data = nested
+		}
+	}
+	value, ok := data[field]
+	if !ok || value == nil {
+		return "", fmt.Errorf("Vault secret %s has no field %s", path, field)
+	}
+	if len(response.LeaseID) > 0 && response.Renewable {
+		v.leases = append(v.leases, vaultLease{id: response.LeaseID, ttl: time.Duration(response.LeaseDuration) * time.Second})
+	}
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	return fmt.Sprint(value), nil
+}
+
+// renew keeps the token and the leased secrets alive, renewing them at half
+// their ttl, until renewing the token fails
+func (v *vaultClient) renew() {
+	interval := v.ttl / 2
+	for _, lease := range v.leases {
+		if lease.ttl > 0 && (interval == 0 || lease.ttl/2 < interval) {
+			interval = lease.ttl / 2
+		}
+	}
+	if interval <= 0 {
+		return
+	}
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	for range time.Tick(interval) {
+		if v.renewable && v.ttl > 0 {
+			if _, err := v.do("POST", "auth/token/renew-self", nil); err != nil {
+				log.WithFields(log.Fields{
+					"plugin":   name,
+					"category": category,
+				}).Error(errors.Wrap(err, "failed to renew the Vault token"))
+				return
+			}
+		}
+		for _, lease := range v.leases {
+			if _, err := v.do("PUT", "sys/leases/renew", map[string]string{"lease_id": lease.id}); err != nil {
+				log.WithFields(log.Fields{
+					"plugin":   name,
+					"category": category,
+					"lease":    lease.id,
+				}).Error(errors.Wrap(err, "failed to renew a Vault lease"))
+			}
+		}
+	}
+}
+
+// loadVaultSecrets sets the environment variables of the --vault-secret
+// mappings, so the flags reading them, including those of commands which
+// are parsed later, get the secrets. Global flags were already parsed and are
+// set directly.
+func loadVaultSecrets(c *cli.Context) error {
+	secrets, err := parseVaultSecrets(c.StringSlice("vault-secret"))
+	if err != nil || len(secrets) == 0 {
+		return err
+	}
+
+	v := &vaultClient{addr: c.String("vault-addr"), client: &http.Client{Timeout: 30 * time.Second}}
+	if err := v.login(c); err != nil {
+		return err
+	}
+	for _, secret := range secrets {
+		value, err := v.read(secret.path, secret.field)
+		if err != nil {
+			return err
+		}
+		if secret.target == licenseKeyEnv {
+			LicenseKey = value
+			continue
+		}
+		if err := os.Setenv(secret.target, value); err != nil {
+			return err
+		}
+		for _, flag := range c.App.Flags {
+			f, ok := flag.(cli.StringFlag)
+			if !ok {
+				continue
+			}
+			for _, env := range strings.Split(f.EnvVar, ",") {
+				if strings.TrimSpace(env) != secret.target {
+					continue
+				}
+				if err := c.Set(strings.TrimSpace(strings.Split(f.Name, ",")[0]), value); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"plugin":   name,
+		"category": category,
+		"secrets":  len(secrets),
+	}).Debug("read secrets from Vault")
+
+	if c.Bool("vault-renew") {
+		go v.renew()
+	}
+	return nil
+}
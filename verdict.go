@@ -0,0 +1,50 @@
+package main
+
+import (
+	"time"
+)
+
+// Verdict is all a verdict API key learns of a scan: whether the sample is
+// infected, and the status so a failed scan does not pass for a clean one
+type Verdict struct {
+	SHA256   string `json:"sha256"`
+	Infected bool   `json:"infected"`
+	Status   string `json:"status,omitempty"`
+}
+
+// verdictJob is an async scan as a verdict API key sees it
+type verdictJob struct {
+	ID          string     `json:"id"`
+	Status      string     `json:"status"`
+	SHA256      string     `json:"sha256"`
+	SubmittedAt time.Time  `json:"submitted_at"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+	Result      *Verdict   `json:"result,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+func newVerdict(sha string, results ResultsData) Verdict {
+	return Verdict{SHA256: sha, Infected: results.Infected, Status: results.Status}
+}
+
+// verdictOfJob leaves the detections and engine details out of job, and
+// errors which might name them
+func verdictOfJob(job ScanJob) verdictJob {
+	redacted := verdictJob{
+		ID:          job.ID,
+		Status:      job.Status,
+		SHA256:      job.SHA256,
+		SubmittedAt: job.SubmittedAt,
+		StartedAt:   job.StartedAt,
+		FinishedAt:  job.FinishedAt,
+	}
+	if job.Result != nil {
+		verdict := newVerdict(job.SHA256, job.Result.Results)
+		redacted.Result = &verdict
+	}
+	if len(job.Error) > 0 {
+		redacted.Error = "scan failed"
+	}
+	return redacted
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxWarmSamples is how many latencies of warm and of cold scans are kept
+const maxWarmSamples = 1000
+
+// warmSample is what warm-up scans scan, anything the engine finds clean
+const warmSample = "malice drweb warm-up scan\n"
+
+// WarmPoolStats json object
+type WarmPoolStats struct {
+	Size      int            `json:"size"`
+	Busy      int            `json:"busy"`
+	Warm      bool           `json:"warm"`
+	WarmUps   int            `json:"warm_ups"`
+	WarmScans int            `json:"warm_scans"`
+	ColdScans int            `json:"cold_scans"`
+	WarmMS    LatencySummary `json:"warm_latency_ms"`
+	ColdMS    LatencySummary `json:"cold_latency_ms"`
+}
+
+// LatencySummary json object, of the latest scans
+type LatencySummary struct {
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+// warmPool is the high-throughput mode of --warm-pool: it runs up to its size
+// of scans at once and keeps the engine they share warm. drweb-configd and
+// its scan engine serve all scans, what goes cold is the engine session
+// (license and daemon checks, see --engine-session-ttl), the cached engine
+// info and the engine itself, which unloads what it has not used for a
+// while. The engine is warm while it scanned within the interval and the
+// session is valid. While traffic is low a tiny sample is scanned every half
+// interval, and the session is renewed before it expires.
+type warmPool struct {
+	sync.Mutex
+	interval  time.Duration
+	slots     chan struct{}
+	scannedAt time.Time // of the last scan, a warm-up or a real one
+	stats     WarmPoolStats
+	warm      []time.Duration
+	cold      []time.Duration
+}
+
+// pool is the warm pool, nil if --warm-pool is 0
+var pool *warmPool
+
+func newWarmPool(size int, interval time.Duration) *warmPool {
+	p := &warmPool{interval: interval, slots: make(chan struct{}, size)}
+	p.stats.Size = size
+	return p
+}
+
+// isWarm reports whether the engine scanned within the interval with a
+// session that does not need to be prepared again
+func (p *warmPool) isWarm() bool {
+	return !p.scannedAt.IsZero() && time.Since(p.scannedAt) < p.interval && session.warm()
+}
+
+// acquire takes a slot and waits while all of them are busy
+func (p *warmPool) acquire(ctx context.Context) error {
+	select {
+	case p.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// tryAcquire takes a slot if one is free
+func (p *warmPool) tryAcquire() bool {
+	select {
+	case p.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// release returns a slot, scanned says whether the engine scanned just now
+func (p *warmPool) release(scanned bool) {
+	if scanned {
+		p.Lock()
+		p.scannedAt = time.Now()
+		p.Unlock()
+	}
+	<-p.slots
+}
+
+// scan runs scan in a slot and records its latency as warm or cold
+func (p *warmPool) scan(ctx context.Context, scan func() (DrWEB, error)) (DrWEB, error) {
+	if p == nil {
+		return scan()
+	}
+	if err := p.acquire(ctx); err != nil {
+		return DrWEB{}, err
+	}
+	p.Lock()
+	warm := p.isWarm()
+	p.Unlock()
+
+	started := time.Now()
+	drweb, err := scan()
+	latency := time.Since(started)
+	p.release(err == nil)
+	if err == nil {
+		p.observe(warm, latency)
+		metrics.warmScan(warm, latency)
+	}
+	return drweb, err
+}
+
+func (p *warmPool) observe(warm bool, latency time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+	if warm {
+		p.stats.WarmScans++
+		p.warm = append(p.warm, latency)
+		if len(p.warm) > maxWarmSamples {
+			p.warm = p.warm[1:]
+		}
+	} else {
+		p.stats.ColdScans++
+		p.cold = append(p.cold, latency)
+		if len(p.cold) > maxWarmSamples {
+			p.cold = p.cold[1:]
+		}
+	}
+}
+
+// warmUp scans the warm-up sample in a slot it has taken
+func (p *warmPool) warmUp() {
+	ctx, cancel := context.WithTimeout(context.Background(), p.interval)
+	defer cancel()
+
+	err := func() error {
+		tmpfile, err := ioutil.TempFile(defaultScanDir, "warm_")
+		if err != nil {
+			if tmpfile, err = ioutil.TempFile("", "warm_"); err != nil {
+				return err
+			}
+		}
+		defer os.Remove(tmpfile.Name())
+		if _, err := tmpfile.WriteString(warmSample); err != nil {
+			tmpfile.Close()
+			return err
+		}
+		if err := tmpfile.Close(); err != nil {
+			return err
+		}
+		results := avScanFile(ctx, tmpfile.Name(), defaultTimeout, currentDefaultProfile()).Results
+		if len(results.Error) > 0 {
+			return errors.New(results.Error)
+		}
+		return nil
+	}()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"plugin":   name,
+			"category": category,
+		}).Warn(errors.Wrap(err, "warm-up scan failed"))
+	} else {
+		p.Lock()
+		p.stats.WarmUps++
+		p.Unlock()
+	}
+	p.release(err == nil)
+}
+
+// keepWarm renews the engine session before it expires and warms the engine
+// up if it did not scan for half an interval, every half interval
+func (p *warmPool) keepWarm() {
+	for {
+		if len(engineState.unavailable()) == 0 && breaker.healthy() {
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+			if err := session.renew(ctx, p.interval); err != nil {
+				log.WithFields(log.Fields{
+					"plugin":   name,
+					"category": category,
+				}).Warn(errors.Wrap(err, "failed to renew the engine session"))
+			}
+			cancel()
+
+			p.Lock()
+			idle := p.scannedAt.IsZero() || time.Since(p.scannedAt) >= p.interval/2
+			p.Unlock()
+			if idle && p.tryAcquire() {
+				p.warmUp()
+			}
+		}
+		time.Sleep(p.interval / 2)
+	}
+}
+
+// snapshot returns the stats of the pool and its latest latencies
+func (p *warmPool) snapshot() WarmPoolStats {
+	p.Lock()
+	defer p.Unlock()
+	stats := p.stats
+	stats.Busy = len(p.slots)
+	stats.Warm = p.isWarm()
+	stats.WarmMS = summarizeLatencies(p.warm)
+	stats.ColdMS = summarizeLatencies(p.cold)
+	return stats
+}
+
+func summarizeLatencies(latencies []time.Duration) LatencySummary {
+	sorted := append([]time.Duration{}, latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var summary LatencySummary
+	if len(sorted) > 0 {
+		summary = LatencySummary{
+			P50: milliseconds(percentile(sorted, 50)),
+			P90: milliseconds(percentile(sorted, 90)),
+			P99: milliseconds(percentile(sorted, 99)),
+			Max: milliseconds(sorted[len(sorted)-1]),
+		}
+	}
+	return summary
+}
+
+func init() {
+	expvar.Publish("warm_pool", expvar.Func(func() interface{} {
+		if pool == nil {
+			return nil
+		}
+		return pool.snapshot()
+	}))
+}
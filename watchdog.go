@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// watchdogDumpPrefix names the dumps of stuck engine commands
+const watchdogDumpPrefix = "drweb-watchdog-"
+
+// trackedCommand is an engine command the watchdog keeps an eye on
+type trackedCommand struct {
+	pid     int
+	command string
+	args    []string
+	started time.Time
+	timeout time.Duration
+	killed  bool
+}
+
+// scanWatchdog kills engine commands that are still running factor times
+// their timeout after they were started, which the timeout of the scan itself
+// should have taken care of long before
+type scanWatchdog struct {
+	sync.Mutex
+	factor  int
+	timeout time.Duration // of commands run without a deadline
+	dir     string        // the dumps of stuck commands go to
+	running map[int]*trackedCommand
+	stuck   int
+}
+
+// watchdog does nothing until it is started with --watchdog-factor
+var watchdog = &scanWatchdog{running: make(map[int]*trackedCommand)}
+
+func init() {
+	expvar.Publish("stuck_scans", expvar.Func(func() interface{} {
+		watchdog.Lock()
+		defer watchdog.Unlock()
+		return watchdog.stuck
+	}))
+}
+
+// start checks the running engine commands every interval, the dumps of
+// stuck ones go to dir or the temp directory
+func (w *scanWatchdog) start(factor int, timeout, interval time.Duration, dir string) {
+	if len(dir) == 0 {
+		dir = os.TempDir()
+	}
+	w.Lock()
+	w.dir = dir
+	if factor <= 0 || interval <= 0 {
+		w.Unlock()
+		return
+	}
+	w.factor, w.timeout = factor, timeout
+	w.Unlock()
+	go func() {
+		for range time.Tick(interval) {
+			w.check()
+		}
+	}()
+}
+
+// track watches the engine command with pid until the returned func is called
+func (w *scanWatchdog) track(ctx context.Context, pid int, command string, args []string) func() {
+	w.Lock()
+	defer w.Unlock()
+	if w.factor <= 0 {
+		return func() {}
+	}
+
+	now := time.Now()
+	timeout := w.timeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = deadline.Sub(now)
+	}
+	w.running[pid] = &trackedCommand{pid: pid, command: command, args: args, started: now, timeout: timeout}
+	return func() {
+		w.Lock()
+		defer w.Unlock()
+		delete(w.running, pid)
+	}
+}
+
+// check kills the commands running for longer than factor times their timeout
+func (w *scanWatchdog) check() {
+	w.Lock()
+	var stuck []*trackedCommand
+	for _, cmd := range w.running {
+		if !cmd.killed && cmd.timeout > 0 && time.Since(cmd.started) > time.Duration(w.factor)*cmd.timeout {
+			cmd.killed = true
+			w.stuck++
+			stuck = append(stuck, cmd)
+		}
+	}
+	w.Unlock()
+
+	for _, cmd := range stuck {
+		w.incident(cmd)
+	}
+}
+
+// incident dumps the goroutines and child processes, kills the process group
+// of a stuck command and logs what happened
+func (w *scanWatchdog) incident(cmd *trackedCommand) {
+	children := childProcesses()
+	dump, err := w.dump(cmd, children)
+	if err != nil {
+		dump = err.Error()
+	}
+	killGroup(cmd.pid)
+
+	log.WithFields(log.Fields{
+		"plugin":      name,
+		"category":    category,
+		"incident":    "stuck_scan",
+		"pid":         cmd.pid,
+		"command":     filepath.Base(cmd.command),
+		"args":        strings.Join(cmd.args, " "),
+		"started":     cmd.started.UTC().Format(time.RFC3339),
+		"running_for": time.Since(cmd.started).Round(time.Second).String(),
+		"timeout":     cmd.timeout.Round(time.Second).String(),
+		"children":    len(children),
+		"dump":        dump,
+	}).Error("killed stuck engine command")
+}
+
+// dump writes the goroutines of this process and its child processes to a
+// file in the watchdog directory and returns its name
+func (w *scanWatchdog) dump(cmd *trackedCommand, children []childProcess) (string, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "stuck engine command (pid %d) started %s, timeout %s\n%s %s\n\n",
+		cmd.pid, cmd.started.UTC().Format(time.RFC3339), cmd.timeout, cmd.command, strings.Join(cmd.args, " "))
+	childrenJSON, _ := json.MarshalIndent(children, "", "  ")
+	fmt.Fprintf(&buf, "child processes:\n%s\n\ngoroutines:\n", childrenJSON)
+	if err := pprof.Lookup("goroutine").WriteTo(&buf, 2); err != nil {
+		return "", err
+	}
+
+	file := filepath.Join(w.dir, fmt.Sprintf("%s%s-%d.txt", watchdogDumpPrefix, time.Now().UTC().Format("20060102T150405"), cmd.pid))
+	return file, ioutil.WriteFile(file, buf.Bytes(), 0600)
+}
+
+// watchdogDumps returns the dumps of stuck commands, newest first
+func watchdogDumps(dir string) []string {
+	files, _ := filepath.Glob(filepath.Join(dir, watchdogDumpPrefix+"*.txt"))
+	sort.Sort(sort.Reverse(sort.StringSlice(files)))
+	return files
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	pathpkg "path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// MaliceCallback is where the results of a Malice scan request are POSTed to
+type MaliceCallback struct {
+	ScanID string `json:"scan_id"`
+	URL    string `json:"url"`
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// MaliceScanRequest json object, a scan request of a central Malice instance
+type MaliceScanRequest struct {
+	ScanID   string       `json:"scan_id"`
+	SHA256   string       `json:"sha256"`
+	URL      string       `json:"url"`
+	Callback string       `json:"callback"`
+	Options  *ScanOptions `json:"options,omitempty"`
+}
+
+// sampleFetcher downloads the samples referenced by Malice scan requests and
+// posts their results. It only connects to allowedHosts, any host if there
+// are none, and never to the loopback, link-local or private addresses of a
+// host that is not listed, unless allowPrivate.
+type sampleFetcher struct {
+	client       *http.Client
+	maxSize      int64
+	allowedHosts []string // globs on the host name, see --fetch-allow-host
+	allowPrivate bool
+}
+
+var fetcher = newSampleFetcher()
+
+func newSampleFetcher() *sampleFetcher {
+	f := &sampleFetcher{maxSize: 100 << 20}
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	f.client = &http.Client{
+		Timeout: time.Minute,
+		// no proxy, the addresses connected to have to be the ones checked
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return f.dial(ctx, dialer, network, addr)
+			},
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return f.check(req.URL)
+		},
+	}
+	return f
+}
+
+// errHostNotAllowed means a url is not on the allowlist of --fetch-allow-host
+var errHostNotAllowed = errors.New("host is not allowed by --fetch-allow-host")
+
+// check refuses urls that are not http(s) or whose host is not allowed
+func (f *sampleFetcher) check(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("refusing to connect to %s: not an http(s) url", u.Host)
+	}
+	if len(f.allowedHosts) > 0 && !f.listed(u.Hostname()) {
+		return errors.Wrap(errHostNotAllowed, u.Hostname())
+	}
+	return nil
+}
+
+// listed reports whether host matches one of allowedHosts
+func (f *sampleFetcher) listed(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range f.allowedHosts {
+		if matched, _ := pathpkg.Match(strings.ToLower(pattern), host); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// dial resolves the host of addr itself, so the addresses it connects to are
+// the ones it checked and a second lookup can not point elsewhere
+func (f *sampleFetcher) dial(ctx context.Context, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if f.allowPrivate || f.listed(host) {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	err = fmt.Errorf("no addresses for %s", host)
+	for _, ip := range ips {
+		if internalAddress(ip.IP) {
+			err = fmt.Errorf("refusing to connect to %s: %s is an internal address", host, ip.IP)
+			continue
+		}
+		conn, dialErr := dialer.DialContext(ctx, network, net.JoinHostPort(ip.IP.String(), port))
+		if dialErr == nil {
+			return conn, nil
+		}
+		err = dialErr
+	}
+	return nil, err
+}
+
+// privateNetworks are the private and shared address ranges
+var privateNetworks = func() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7"} {
+		_, network, _ := net.ParseCIDR(cidr)
+		networks = append(networks, network)
+	}
+	return networks
+}()
+
+// internalAddress reports whether ip is a loopback, link-local, private or
+// unspecified address
+func internalAddress(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// errSampleMismatch means the downloaded sample is not the one requested
+var errSampleMismatch = errors.New("sample does not match its sha256")
+
+// fetch downloads a sample and checks it against sha, if given
+func (f *sampleFetcher) fetch(ctx context.Context, sampleURL, sha string) ([]byte, error) {
+	req, err := http.NewRequest("GET", sampleURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.check(req.URL); err != nil {
+		return nil, errors.Wrap(err, "failed to fetch sample")
+	}
+	resp, err := f.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to fetch sample")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch sample: %s", resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, f.maxSize+1))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to fetch sample")
+	}
+	if int64(len(data)) > f.maxSize {
+		return nil, fmt.Errorf("sample is larger than %d MB", f.maxSize>>20)
+	}
+	if len(sha) > 0 && !strings.EqualFold(sha, fmt.Sprintf("%x", sha256.Sum256(data))) {
+		return nil, errSampleMismatch
+	}
+	return data, nil
+}
+
+// callbackBody renders and encrypts the results POSTed to url
+func callbackBody(url, scanID string, drweb DrWEB) ([]byte, error) {
+	body, err := callbackPayload(url, scanID, drweb)
+	if err != nil {
+		return nil, err
+	}
+	if callbackRecipient != nil {
+		if body, err = encryptResult(body, callbackRecipient); err != nil {
+			return nil, errors.Wrap(err, "failed to encrypt results")
+		}
+	}
+	return body, nil
+}
+
+// postCallback sends body to the callback url with the Malice scan id and
+// the outbox id, if it was recorded, and returns the response status code
+func postCallback(url, scanID, deliveryID string, body []byte) (int, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	if err := fetcher.check(req.URL); err != nil {
+		return 0, errors.Wrap(err, "failed to post results")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Malice-ID", scanID)
+	if len(deliveryID) > 0 {
+		req.Header.Set(deliveryHeader, deliveryID)
+	}
+	resp, err := fetcher.client.Do(req)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to post results")
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("failed to post results: %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// post records the results of the sample sha in the outbox of the tenant,
+// if there is a store, and sends them to the callback url
+func (cb *MaliceCallback) post(sha string, drweb DrWEB) error {
+	body, err := callbackBody(cb.URL, cb.ScanID, drweb)
+	if err != nil {
+		return err
+	}
+
+	outbox := store.tenant(cb.Tenant).outbox()
+	entry, err := outbox.add(cb.URL, cb.ScanID, sha, drweb, body)
+	if err != nil {
+		// the callback is still worth sending
+		log.WithFields(log.Fields{
+			"plugin":   name,
+			"category": category,
+			"scan_id":  cb.ScanID,
+		}).Error(err)
+	}
+	var deliveryID string
+	if entry != nil {
+		deliveryID = entry.ID
+	}
+	statusCode, err := postCallback(cb.URL, cb.ScanID, deliveryID, body)
+	outbox.record(entry, statusCode, err, false)
+	return err
+}
+
+// deliver posts the results, or the error of the scan, of the sample sha to
+// the callback
+func (cb *MaliceCallback) deliver(sha string, drweb DrWEB, scanErr error) {
+	if cb == nil {
+		return
+	}
+	if scanErr != nil {
+		drweb = DrWEB{Results: ResultsData{Status: statusError, Error: scanErr.Error()}}
+	}
+	if err := cb.post(sha, drweb); err != nil {
+		log.WithFields(log.Fields{
+			"plugin":   name,
+			"category": category,
+			"scan_id":  cb.ScanID,
+		}).Error(err)
+	}
+}
+
+// webMaliceScan accepts a scan request of a central Malice instance: the
+// sample is fetched right away, scanned in the background and the results
+// POSTed to the callback
+func webMaliceScan(w http.ResponseWriter, r *http.Request) {
+	started := time.Now()
+
+	if pair.role() == roleStandby {
+		w.Header().Set("Retry-After", strconv.Itoa(int(pair.interval.Seconds())+1))
+		http.Error(w, "this is the standby instance, send scans to the active one", http.StatusServiceUnavailable)
+		return
+	}
+	if refuseUnavailable(w) {
+		return
+	}
+	if ok, wait := breaker.allow(); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		http.Error(w, "scan engine is unavailable, try again later", http.StatusServiceUnavailable)
+		return
+	}
+
+	var request MaliceScanRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&request); err != nil {
+		http.Error(w, "invalid scan request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !signatureVerified(w, r) {
+		return
+	}
+	if len(request.Callback) > 0 && verdictOnly(r) {
+		// the callback gets the full results
+		http.Error(w, "API key is not allowed to choose the callback", http.StatusForbidden)
+		return
+	}
+	if len(request.Callback) == 0 {
+		request.Callback = tenants.callback(requestTenant(r), os.Getenv("MALICE_ENDPOINT"))
+	}
+	switch {
+	case len(request.ScanID) == 0:
+		http.Error(w, "scan request has no scan_id", http.StatusBadRequest)
+		return
+	case len(request.SHA256) > 0 && !validSHA256(request.SHA256):
+		http.Error(w, "scan request has an invalid sha256", http.StatusBadRequest)
+		return
+	case !httpURL(request.URL):
+		http.Error(w, "scan request needs an http(s) sample url", http.StatusBadRequest)
+		return
+	case !httpURL(request.Callback):
+		http.Error(w, "scan request needs an http(s) callback url (or MALICE_ENDPOINT)", http.StatusBadRequest)
+		return
+	}
+	for _, u := range []string{request.URL, request.Callback} {
+		if parsed, _ := url.Parse(u); fetcher.check(parsed) != nil {
+			http.Error(w, fmt.Sprintf("scan request url %s is not allowed by --fetch-allow-host", parsed.Host), http.StatusForbidden)
+			return
+		}
+	}
+	// the options of the request body go over those of the query and headers
+	options, err := requestScanOptions(r)
+	if err == nil && request.Options != nil {
+		options = options.with(*request.Options)
+		err = options.normalize()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	options = options.with(ScanOptions{
+		Metadata: map[string]string{"malice_scan_id": request.ScanID},
+		Callback: &MaliceCallback{ScanID: request.ScanID, URL: request.Callback, Tenant: requestTenant(r)},
+	})
+
+	data, err := fetcher.fetch(r.Context(), request.URL, request.SHA256)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"plugin":   name,
+			"category": category,
+			"scan_id":  request.ScanID,
+		}).Error(err)
+		status := http.StatusBadGateway
+		if err == errSampleMismatch {
+			status = http.StatusUnprocessableEntity
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	// the sample is named after the last element of its url path
+	var sampleName string
+	if u, err := url.Parse(request.URL); err == nil && len(u.Path) > 0 {
+		sampleName = pathpkg.Base(u.Path)
+	}
+	if rejectUpload(w, uploadSample(data, sampleName, requestSubmitter(r))) {
+		return
+	}
+	if overQuota(w, r) {
+		return
+	}
+	upload, err := newUploadScan(data, sampleName, requestSubmitter(r), started, options)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	audit.submitted(upload, "malice")
+	job, err := jobs.submit(upload, requestKeyID(r))
+	if err != nil {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Location", "/scan/"+job.ID)
+	if verdictOnly(r) {
+		writeJSON(w, http.StatusAccepted, verdictOfJob(job))
+		return
+	}
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+func httpURL(value string) bool {
+	u, err := url.Parse(value)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && len(u.Host) > 0
+}